@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var approvalReasonFlag = flag.String("reason", "", "why you need a role which requires approval, for the approvers")
+
+const (
+	// defaultApprovalTimeout is how long logins wait for a decision unless IDP_APPROVAL_TIMEOUT says otherwise.
+	defaultApprovalTimeout = 15 * time.Minute
+	// approvalPollInterval is how often the status URL is asked for the decision.
+	approvalPollInterval = 5 * time.Second
+)
+
+// Formats of approval requests.
+const (
+	approvalFormatJSON  = "json"
+	approvalFormatSlack = "slack"
+	approvalFormatTeams = "teams"
+)
+
+// Statuses of approval decisions.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalDenied   = "denied"
+	// approvalExpired is what the audit log records for requests nobody decided on in time.
+	approvalExpired = "expired"
+)
+
+// approvalRequest is what approval services get posted, and what slack and teams messages describe.
+type approvalRequest struct {
+	ID           string    `json:"id"`
+	Role         string    `json:"role"`
+	Reason       string    `json:"reason"`
+	Requester    string    `json:"requester,omitempty"`
+	WorkspaceID  string    `json:"workspaceId,omitempty"`
+	WorkspaceURL string    `json:"workspaceUrl,omitempty"`
+	Repository   string    `json:"repository,omitempty"`
+	Time         time.Time `json:"time"`
+	// Expires is when the login stops waiting for a decision.
+	Expires time.Time `json:"expires"`
+}
+
+// approvalDecision is what the status URL answers.
+type approvalDecision struct {
+	Status   string `json:"status"`
+	Approver string `json:"approver,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// requiresApproval reports whether the policy only lets roleARN be assumed once an approver agreed to it.
+func requiresApproval(roleARN string) bool {
+	return matchesRolePattern(roleARN, rolePatterns("IDP_AWS_APPROVAL_ROLES"))
+}
+
+// awaitApproval asks the approvers for approval to assume roleARN through IDP_APPROVAL_WEBHOOK, and polls for
+// their decision until IDP_APPROVAL_TIMEOUT. The request and the decision go to the audit log, and the login
+// fails if they can't, so that every break-glass login can be traced to whoever approved it.
+func awaitApproval(ctx context.Context, roleARN string) error {
+	webhook := setting("IDP_APPROVAL_WEBHOOK")
+	if webhook == "" {
+		return exitErrorf(exitMissingConfig, "%s requires approval, but IDP_APPROVAL_WEBHOOK is not set", roleARN)
+	}
+	format := setting("IDP_APPROVAL_FORMAT")
+	switch format {
+	case "":
+		format = approvalFormatJSON
+	case approvalFormatJSON, approvalFormatSlack, approvalFormatTeams:
+	default:
+		return exitErrorf(exitMissingConfig, "IDP_APPROVAL_FORMAT must be json, slack or teams, not %q", format)
+	}
+	if format != approvalFormatJSON && setting("IDP_APPROVAL_STATUS_URL") == "" {
+		return exitErrorf(exitMissingConfig, "%s webhooks can't tell the decision - set IDP_APPROVAL_STATUS_URL to where the approvers' decisions are kept", format)
+	}
+	timeout := defaultApprovalTimeout
+	if s := setting("IDP_APPROVAL_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return exitErrorf(exitMissingConfig, "IDP_APPROVAL_TIMEOUT must be a duration like 15m, not %q", s)
+		}
+		timeout = d
+	}
+	reason, err := approvalReason(roleARN)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	req := approvalRequest{
+		ID:           randomHex(8),
+		Role:         roleARN,
+		Reason:       reason,
+		Requester:    approvalRequester(),
+		WorkspaceID:  os.Getenv("GITPOD_WORKSPACE_ID"),
+		WorkspaceURL: os.Getenv("GITPOD_WORKSPACE_URL"),
+		Time:         now,
+		Expires:      now.Add(timeout),
+	}
+	if wc, err := currentWorkspaceContext(ctx); err == nil {
+		req.Repository = wc.Repository.fullName()
+	}
+	statusURL, err := postApprovalRequest(ctx, webhook, format, req)
+	if err != nil {
+		return exitErrorf(exitExchangeFailed, "cannot ask for approval to assume %s: %w", roleARN, err)
+	}
+	err = auditApproval(req, approvalPending, approvalDecision{})
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write the audit log, so not asking for approval: %w", err)
+	}
+	printSuccess("asked for approval to assume %s (request %s), waiting up to %s for a decision", roleARN, req.ID, timeout.Round(time.Second))
+
+	ctx, cancel := context.WithDeadline(ctx, req.Expires)
+	defer cancel()
+	var decision approvalDecision
+	err = traceStep(ctx, "await approval", func(ctx context.Context) error {
+		return withProgress("waiting for the approval of "+roleARN, func() (err error) {
+			decision, err = pollApproval(ctx, statusURL)
+			return err
+		})
+	}, "idp.role", roleARN, "idp.approval", req.ID)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			_ = auditApproval(req, approvalExpired, approvalDecision{})
+			return exitErrorf(exitMissingConfig, "nobody decided on approval request %s for %s within %s", req.ID, roleARN, timeout.Round(time.Second))
+		}
+		return exitErrorf(exitExchangeFailed, "cannot get the decision on approval request %s: %w", req.ID, err)
+	}
+	err = auditApproval(req, decision.Status, decision)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write the audit log, so not assuming %s: %w", roleARN, err)
+	}
+	if decision.Status != approvalApproved {
+		msg := fmt.Sprintf("%s denied assuming %s", approverName(decision), roleARN)
+		if decision.Comment != "" {
+			msg += ": " + decision.Comment
+		}
+		return exitErrorf(exitMissingConfig, "%s", msg)
+	}
+	printSuccess("%s approved assuming %s", approverName(decision), roleARN)
+	return nil
+}
+
+// approvalReason returns why the user needs roleARN, from --reason or asked for on the terminal.
+func approvalReason(roleARN string) (string, error) {
+	if r := strings.TrimSpace(*approvalReasonFlag); r != "" {
+		return r, nil
+	}
+	p, err := newPrompter()
+	if err != nil {
+		return "", exitErrorf(exitUsage, "%s requires approval, pass --reason to tell the approvers why you need it", roleARN)
+	}
+	reason, err := p.ask(fmt.Sprintf("%s requires approval. Why do you need it?", roleARN), "")
+	if err != nil {
+		return "", err
+	}
+	if reason == "" {
+		return "", exitErrorf(exitUsage, "the approvers need a reason to approve assuming %s", roleARN)
+	}
+	return reason, nil
+}
+
+// approvalRequester names the user asking for approval, as Gitpod knows them.
+func approvalRequester() string {
+	name, email := os.Getenv("GITPOD_GIT_USER_NAME"), os.Getenv("GITPOD_GIT_USER_EMAIL")
+	switch {
+	case name != "" && email != "":
+		return fmt.Sprintf("%s <%s>", name, email)
+	case email != "":
+		return email
+	}
+	return name
+}
+
+func approverName(d approvalDecision) string {
+	if d.Approver != "" {
+		return d.Approver
+	}
+	return "the approvers"
+}
+
+// postApprovalRequest sends req to webhook and returns the URL to poll for the decision. Approval services may
+// answer with a statusUrl, which takes precedence over IDP_APPROVAL_STATUS_URL.
+func postApprovalRequest(ctx context.Context, webhook, format string, req approvalRequest) (string, error) {
+	var body any = req
+	switch format {
+	case approvalFormatSlack:
+		body = map[string]any{"text": approvalMessage(req, "`")}
+	case approvalFormatTeams:
+		body = map[string]any{
+			"type": "message",
+			"attachments": []any{map[string]any{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]any{
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body":    []any{map[string]any{"type": "TextBlock", "text": approvalMessage(req, ""), "wrap": true}},
+				},
+			}},
+		}
+	}
+	var answer struct {
+		StatusURL string `json:"statusUrl"`
+	}
+	// chat webhooks are other parties, which don't get to see the workspace's identity tokens
+	resp, err := approvalCall(ctx, http.MethodPost, webhook, body, format == approvalFormatJSON)
+	if err != nil {
+		return "", err
+	}
+	if format == approvalFormatJSON {
+		// services which only acknowledge requests needn't answer with JSON
+		_ = json.Unmarshal(resp, &answer)
+	}
+	if answer.StatusURL != "" {
+		u, err := url.Parse(webhook)
+		if err != nil {
+			return "", err
+		}
+		ref, err := u.Parse(answer.StatusURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid statusUrl %q: %w", answer.StatusURL, err)
+		}
+		return ref.String(), nil
+	}
+	statusURL := strings.ReplaceAll(setting("IDP_APPROVAL_STATUS_URL"), "{id}", url.PathEscape(req.ID))
+	if statusURL == "" {
+		return "", fmt.Errorf("the approval service answered without a statusUrl, and IDP_APPROVAL_STATUS_URL is not set")
+	}
+	return statusURL, nil
+}
+
+// approvalMessage describes req for the approvers in a chat, with code around the role and request ID.
+func approvalMessage(req approvalRequest, code string) string {
+	requester := req.Requester
+	if requester == "" {
+		requester = "Someone"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s asks to assume %s%s%s", requester, code, req.Role, code)
+	switch {
+	case req.WorkspaceURL != "" && req.Repository != "":
+		fmt.Fprintf(&b, " from the workspace %s on %s", req.WorkspaceURL, req.Repository)
+	case req.WorkspaceURL != "":
+		fmt.Fprintf(&b, " from the workspace %s", req.WorkspaceURL)
+	}
+	fmt.Fprintf(&b, ": %s\n", req.Reason)
+	fmt.Fprintf(&b, "Approval request %s%s%s, open until %s.", code, req.ID, code, req.Expires.UTC().Format("15:04 MST"))
+	return b.String()
+}
+
+// pollApproval asks statusURL for the decision until there is one. Answers of 404, as before the request got to
+// the store of decisions, and failures of the service count as no decision yet.
+func pollApproval(ctx context.Context, statusURL string) (approvalDecision, error) {
+	for {
+		resp, err := approvalCall(ctx, http.MethodGet, statusURL, nil, true)
+		var d approvalDecision
+		switch {
+		case errors.Is(err, errApprovalPending):
+		case err != nil:
+			if ctx.Err() != nil {
+				return d, err
+			}
+			var se *approvalStatusError
+			if errors.As(err, &se) && se.code/100 == 4 {
+				return d, err
+			}
+			slog.Debug("cannot get the approval decision, trying again", "error", err)
+		default:
+			err = json.Unmarshal(resp, &d)
+			if err != nil {
+				return d, fmt.Errorf("cannot decode the decision: %w", err)
+			}
+			switch d.Status {
+			case approvalApproved, approvalDenied:
+				return d, nil
+			case approvalPending, "":
+			default:
+				return d, fmt.Errorf("unknown approval status %q", d.Status)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return d, ctx.Err()
+		case <-time.After(approvalPollInterval):
+		}
+	}
+}
+
+// errApprovalPending is returned by approvalCall for status URLs which don't know the request yet.
+var errApprovalPending = errors.New("no decision yet")
+
+// approvalStatusError is an answer of the approval service other than 2xx.
+type approvalStatusError struct {
+	code int
+	msg  string
+}
+
+func (e *approvalStatusError) Error() string {
+	return e.msg
+}
+
+// approvalCall sends body, if any, to u and returns the answer. With authenticate, the request carries an identity
+// token for IDP_APPROVAL_AUDIENCE, by default the origin of u, so that approval services know which workspace asks.
+func approvalCall(ctx context.Context, method, u string, body any, authenticate bool) ([]byte, error) {
+	var rd io.Reader
+	if body != nil {
+		fc, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(fc)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, rd)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if authenticate && runningInGitpod() {
+		audience := setting("IDP_APPROVAL_AUDIENCE")
+		if audience == "" {
+			audience = req.URL.Scheme + "://" + req.URL.Host
+		}
+		token, err := gitpodIDToken(ctx, audience)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer drainBody(resp.Body)
+	fc, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodGet && resp.StatusCode == http.StatusNotFound {
+		return nil, errApprovalPending
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &approvalStatusError{code: resp.StatusCode, msg: fmt.Sprintf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(fc)))}
+	}
+	return fc, nil
+}
+
+// auditApproval appends the state of the approval request req to the audit log: pending once it's sent, then
+// approved, denied or expired.
+func auditApproval(req approvalRequest, status string, d approvalDecision) error {
+	entry := newAuditEntry(credentialRecord{Provider: "aws", Identity: req.Role, Method: "approval", IssuedAt: time.Now()})
+	entry.Reason = req.Reason
+	entry.Approval = &approvalAudit{ID: req.ID, Status: status, Approver: d.Approver, Comment: d.Comment}
+	return appendAuditEntry(entry)
+}
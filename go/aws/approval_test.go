@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+const approvalRole = "arn:aws:iam::123456789012:role/break-glass"
+
+// approvalService answers approval requests posted to https://approvals.example/requests with the decision,
+// and records what was posted.
+type approvalService struct {
+	decision string
+	// status is the status code of the answers to polls, 200 if zero.
+	status int
+	posted map[string]interface{}
+	auth   string
+}
+
+func (s *approvalService) respond(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodPost:
+		s.auth = req.Header.Get("Authorization")
+		fc, _ := io.ReadAll(req.Body)
+		_ = json.Unmarshal(fc, &s.posted)
+		return fakeResponse(req, http.StatusAccepted, "application/json", `{"statusUrl": "/requests/42"}`), nil
+	default:
+		status := s.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		return fakeResponse(req, status, "application/json", s.decision), nil
+	}
+}
+
+// approvalWorkspace sets up a workspace whose approval requests s answers, and returns the client they're sent with.
+func approvalWorkspace(t *testing.T, s *approvalService) *fakeDoer {
+	t.Helper()
+	testWorkspace(t, &fakeRunner{run: fakeGitpodToken})
+	t.Setenv("GITPOD_WORKSPACE_CONTEXT", ownContext)
+	t.Setenv("IDP_APPROVAL_WEBHOOK", "https://approvals.example/requests")
+	for _, name := range []string{"IDP_APPROVAL_FORMAT", "IDP_APPROVAL_STATUS_URL", "IDP_APPROVAL_TIMEOUT", "IDP_APPROVAL_AUDIENCE", "IDP_AUDIT_LOG"} {
+		t.Setenv(name, "")
+	}
+	oldReason := *approvalReasonFlag
+	*approvalReasonFlag = "the database is down"
+	d := &fakeDoer{respond: s.respond}
+	oldClient := httpClient
+	httpClient = d
+	t.Cleanup(func() {
+		*approvalReasonFlag = oldReason
+		httpClient = oldClient
+	})
+	return d
+}
+
+// auditedApprovals returns the statuses of the approval requests in the audit log, in order.
+func auditedApprovals(t *testing.T) []approvalAudit {
+	t.Helper()
+	fn, err := auditLogPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var res []approvalAudit
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Approval != nil {
+			res = append(res, *entry.Approval)
+		}
+	}
+	return res
+}
+
+func TestAwaitApproval(t *testing.T) {
+	tests := []struct {
+		name         string
+		decision     string
+		status       int
+		wantCode     int
+		wantErr      string
+		wantStatuses []string
+	}{
+		{
+			name:         "approved",
+			decision:     `{"status": "approved", "approver": "ops@acme.example"}`,
+			wantStatuses: []string{approvalPending, approvalApproved},
+		},
+		{
+			name:         "denied",
+			decision:     `{"status": "denied", "approver": "ops@acme.example", "comment": "use the read-only role"}`,
+			wantCode:     exitMissingConfig,
+			wantErr:      "ops@acme.example denied assuming " + approvalRole + ": use the read-only role",
+			wantStatuses: []string{approvalPending, approvalDenied},
+		},
+		{
+			name:         "unknown status",
+			decision:     `{"status": "maybe"}`,
+			wantCode:     exitExchangeFailed,
+			wantErr:      `unknown approval status "maybe"`,
+			wantStatuses: []string{approvalPending},
+		},
+		{
+			name:         "forbidden",
+			status:       http.StatusForbidden,
+			wantCode:     exitExchangeFailed,
+			wantErr:      "403 Forbidden",
+			wantStatuses: []string{approvalPending},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &approvalService{decision: tt.decision, status: tt.status}
+			d := approvalWorkspace(t, s)
+
+			err := awaitApproval(context.Background(), approvalRole)
+			if exitCode(err) != tt.wantCode || (tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("awaitApproval() error = %v, want exit code %d and %q", err, tt.wantCode, tt.wantErr)
+			}
+			sent := d.sent()
+			if len(sent) != 2 || sent[0] != "POST https://approvals.example/requests" || sent[1] != "GET https://approvals.example/requests/42" {
+				t.Errorf("sent %q, want the request and a poll of its statusUrl", sent)
+			}
+			if s.posted["role"] != approvalRole || s.posted["reason"] != "the database is down" || s.posted["repository"] != "acme/app" {
+				t.Errorf("posted %v", s.posted)
+			}
+			if !strings.HasPrefix(s.auth, "Bearer eyJ") {
+				t.Errorf("the request is authenticated with %q, want an identity token", s.auth)
+			}
+			var statuses []string
+			for _, a := range auditedApprovals(t) {
+				statuses = append(statuses, a.Status)
+				if a.Status == approvalApproved && a.Approver != "ops@acme.example" {
+					t.Errorf("the audit log says %s approved", a.Approver)
+				}
+			}
+			if strings.Join(statuses, ",") != strings.Join(tt.wantStatuses, ",") {
+				t.Errorf("the audit log says %q, want %q", statuses, tt.wantStatuses)
+			}
+		})
+	}
+}
+
+func TestAwaitApprovalInChat(t *testing.T) {
+	s := &approvalService{decision: `{"status": "approved"}`}
+	d := approvalWorkspace(t, s)
+	t.Setenv("IDP_APPROVAL_FORMAT", approvalFormatSlack)
+	t.Setenv("IDP_APPROVAL_STATUS_URL", "https://decisions.example/{id}")
+
+	err := awaitApproval(context.Background(), approvalRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := s.posted["text"].(string)
+	if !strings.Contains(text, "asks to assume `"+approvalRole+"`") || !strings.Contains(text, "the database is down") {
+		t.Errorf("posted %q, want a message for the approvers", text)
+	}
+	if s.auth != "" {
+		t.Errorf("the chat got an identity token: %q", s.auth)
+	}
+	audits := auditedApprovals(t)
+	if len(audits) == 0 {
+		t.Fatal("nothing in the audit log")
+	}
+	if sent := d.sent(); len(sent) != 2 || sent[1] != "GET https://decisions.example/"+audits[0].ID {
+		t.Errorf("sent %q, want a poll of IDP_APPROVAL_STATUS_URL for request %s", sent, audits[0].ID)
+	}
+}
+
+func TestAwaitApprovalMisconfigured(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]string
+	}{
+		{name: "no webhook", settings: map[string]string{"IDP_APPROVAL_WEBHOOK": ""}},
+		{name: "unknown format", settings: map[string]string{"IDP_APPROVAL_FORMAT": "email"}},
+		{name: "chat without status URL", settings: map[string]string{"IDP_APPROVAL_FORMAT": approvalFormatTeams}},
+		{name: "invalid timeout", settings: map[string]string{"IDP_APPROVAL_TIMEOUT": "soon"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := approvalWorkspace(t, &approvalService{})
+			for k, v := range tt.settings {
+				t.Setenv(k, v)
+			}
+			err := awaitApproval(context.Background(), approvalRole)
+			if exitCode(err) != exitMissingConfig {
+				t.Fatalf("awaitApproval() error = %v, want exit code %d", err, exitMissingConfig)
+			}
+			if sent := d.sent(); len(sent) > 0 {
+				t.Errorf("sent %q", sent)
+			}
+		})
+	}
+}
+
+func TestApprovalCallPending(t *testing.T) {
+	approvalWorkspace(t, &approvalService{status: http.StatusNotFound})
+	_, err := approvalCall(context.Background(), http.MethodGet, "https://approvals.example/requests/42", nil, false)
+	if err != errApprovalPending {
+		t.Errorf("approvalCall() error = %v, want errApprovalPending", err)
+	}
+}
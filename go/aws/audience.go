@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// audiencePresets return the audience each provider's token exchange expects by default, so that only setups
+// which deviate from it need IDP_<PROVIDER>_AUDIENCE.
+var audiencePresets = map[string]func() string{
+	"aws": func() string { return gitpodidp.AWSAudience },
+	"gcp": func() string {
+		if provider := gcpWorkloadIdentityProvider(); provider != "" {
+			return gitpodidp.GCPAudience(provider)
+		}
+		return ""
+	},
+	// national clouds expect audiences of their own
+	"azure": func() string { return gitpodidp.AzureAudienceFor(setting("IDP_AZURE_AUTHORITY_HOST")) },
+	"vault": func() string { return "vault" },
+}
+
+// providerAudience returns the audience of the identity tokens for provider: IDP_<PROVIDER>_AUDIENCE, or the
+// provider's preset. It's "" for providers without either, like GCP before the workload identity provider is set.
+func providerAudience(provider string) string {
+	if audience := setting("IDP_" + strings.ToUpper(provider) + "_AUDIENCE"); audience != "" {
+		return audience
+	}
+	if preset, ok := audiencePresets[provider]; ok {
+		return preset()
+	}
+	return ""
+}
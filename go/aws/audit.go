@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// auditEntry is a line of the audit log, which records every issuance of credentials and every approval asked for.
+type auditEntry struct {
+	Time        time.Time  `json:"time"`
+	Provider    string     `json:"provider"`
+	Identity    string     `json:"identity"`
+	Method      string     `json:"method,omitempty"`
+	SessionName string     `json:"sessionName,omitempty"`
+	Expiry      *time.Time `json:"expiry,omitempty"`
+	WorkspaceID string     `json:"workspaceId,omitempty"`
+	InstanceID  string     `json:"instanceId,omitempty"`
+	// Command is the command line which asked for the credentials.
+	Command []string `json:"command"`
+	// Client and Reason are the MCP client which asked for the credentials and why it said it needs them.
+	Client string `json:"client,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Approval is the state of the approval request of a role which requires approval.
+	Approval *approvalAudit `json:"approval,omitempty"`
+}
+
+type approvalAudit struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Approver string `json:"approver,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// auditLogPath returns where the audit log is kept: IDP_AUDIT_LOG, or audit.log in the state directory.
+func auditLogPath() (string, error) {
+	if fn := setting("IDP_AUDIT_LOG"); fn != "" {
+		return fn, nil
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "audit.log"), nil
+}
+
+// appendAuditLog appends rec to the audit log as a JSON line.
+func appendAuditLog(rec credentialRecord) error {
+	return appendAuditEntry(newAuditEntry(rec))
+}
+
+func newAuditEntry(rec credentialRecord) auditEntry {
+	entry := auditEntry{
+		Time:        rec.IssuedAt,
+		Provider:    rec.Provider,
+		Identity:    rec.Identity,
+		Method:      rec.Method,
+		SessionName: rec.SessionName,
+		WorkspaceID: os.Getenv("GITPOD_WORKSPACE_ID"),
+		InstanceID:  os.Getenv("GITPOD_INSTANCE_ID"),
+		Command:     append([]string{filepath.Base(os.Args[0])}, os.Args[1:]...),
+	}
+	if !rec.Expiry.IsZero() {
+		entry.Expiry = &rec.Expiry
+	}
+	return entry
+}
+
+func appendAuditEntry(entry auditEntry) error {
+	fn, err := auditLogPath()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = mkdirPrivate(filepath.Dir(fn))
+	if err != nil {
+		return err
+	}
+	err = restrictPermissions(fn, 0600)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		// the entry must survive the workspace stopping right after, as when the daemon is shut down
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
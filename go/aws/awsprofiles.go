@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// awsProfilesMethod is the method of credential records for IDP_AWS_PROFILES, which don't use the sign-in chain.
+const awsProfilesMethod = "profiles"
+
+// awsProfile is a named AWS profile to sign into, for teams with roles in many accounts.
+type awsProfile struct {
+	RoleARN string `json:"role_arn"`
+	// Region is written to the profile in the AWS config file. It defaults to IDP_AWS_REGION.
+	Region string `json:"region,omitempty"`
+	// Duration of the session. STS defaults to one hour.
+	Duration jsonDuration `json:"duration,omitempty"`
+}
+
+var awsProfileName = regexp.MustCompile(`^[A-Za-z0-9_.+@-]+$`)
+
+// awsProfiles returns the profiles of IDP_AWS_PROFILES, a JSON object or YAML mapping of profile name to role_arn,
+// region and duration. It replaces IDP_AWS_ROLE_ARN where it is set.
+func awsProfiles() (map[string]awsProfile, error) {
+	raw := strings.TrimSpace(setting("IDP_AWS_PROFILES"))
+	if raw == "" {
+		return nil, nil
+	}
+	var res map[string]awsProfile
+	var err error
+	if strings.HasPrefix(raw, "{") {
+		err = json.Unmarshal([]byte(raw), &res)
+	} else {
+		res, err = parseAWSProfilesYAML(raw)
+	}
+	if err != nil {
+		return nil, exitErrorf(exitMissingConfig, "IDP_AWS_PROFILES: %w", err)
+	}
+	for _, name := range sortedKeys(res) {
+		if !awsProfileName.MatchString(name) {
+			return nil, exitErrorf(exitMissingConfig, "IDP_AWS_PROFILES: %q is not a valid profile name", name)
+		}
+		if res[name].RoleARN == "" {
+			return nil, exitErrorf(exitMissingConfig, "IDP_AWS_PROFILES: profile %s has no role_arn", name)
+		}
+	}
+	return res, nil
+}
+
+// parseAWSProfilesYAML reads the block style YAML a profile map is usually written in, e.g.
+//
+//	prod:
+//	  role_arn: arn:aws:iam::123456789012:role/gitpod
+//	  region: eu-west-1
+func parseAWSProfilesYAML(doc string) (map[string]awsProfile, error) {
+	res := make(map[string]awsProfile)
+	var current string
+	for i, line := range strings.Split(doc, "\n") {
+		if idx := strings.Index(line, " #"); idx >= 0 {
+			line = line[:idx]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		k, v = strings.TrimSpace(k), strings.Trim(strings.TrimSpace(v), `"'`)
+		if line == strings.TrimLeft(line, " \t") {
+			if v != "" {
+				return nil, fmt.Errorf("line %d: expected the settings of profile %s on the lines below", i+1, k)
+			}
+			current = k
+			res[current] = awsProfile{}
+			continue
+		}
+		if current == "" {
+			return nil, fmt.Errorf("line %d: %s doesn't belong to a profile", i+1, k)
+		}
+		prof := res[current]
+		switch k {
+		case "role_arn":
+			prof.RoleARN = v
+		case "region":
+			prof.Region = v
+		case "duration":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			prof.Duration = jsonDuration(d)
+		default:
+			return nil, fmt.Errorf("line %d: unknown setting %s, use role_arn, region or duration", i+1, k)
+		}
+		res[current] = prof
+	}
+	return res, nil
+}
+
+// awsProfilesIdentity is the identity of the AWS provider with profiles: every profile with its role, so that
+// changing any of them counts as a different identity.
+func awsProfilesIdentity(profiles map[string]awsProfile) string {
+	var res []string
+	for _, name := range sortedKeys(profiles) {
+		res = append(res, name+"="+profiles[name].RoleARN)
+	}
+	return strings.Join(res, ",")
+}
+
+// loginAWSProfiles exchanges one identity token for the credentials of every profile and writes them to the
+// profiles of the same names. check vets each role against the policy first. A profile which fails doesn't keep
+// the others from being signed into.
+func loginAWSProfiles(ctx context.Context, profiles map[string]awsProfile, check func(ctx context.Context, roleARN string) error) error {
+	names := sortedKeys(profiles)
+	for _, name := range names {
+		err := check(ctx, profiles[name].RoleARN)
+		if err != nil {
+			return err
+		}
+	}
+	token, err := gitpodIDToken(ctx, providerAudience("aws"))
+	if err != nil {
+		return err
+	}
+
+	sessionName := gitpodidp.DefaultSessionName()
+	var (
+		expiry time.Time
+		errs   []error
+	)
+	for _, name := range names {
+		exp, err := loginAWSProfile(ctx, name, profiles[name], token, sessionName)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			errs = append(errs, fmt.Errorf("profile %s: %w", name, err))
+			continue
+		}
+		if expiry.IsZero() || exp.Before(expiry) {
+			expiry = exp
+		}
+	}
+	if len(errs) > 0 {
+		return withExitCode(exitCode(errs[0]), fmt.Errorf("cannot sign into %d of %d AWS profiles:\n%w", len(errs), len(names), errors.Join(errs...)))
+	}
+	recordLogin(credentialRecord{Provider: "aws", Identity: awsProfilesIdentity(profiles), Method: awsProfilesMethod, SessionName: sessionName, Expiry: expiry})
+	return nil
+}
+
+// loginAWSProfile assumes the role of profile name and writes its credentials, returning when they expire.
+func loginAWSProfile(ctx context.Context, name string, prof awsProfile, token, sessionName string) (time.Time, error) {
+	if prof.Region == "" {
+		prof.Region = setting("IDP_AWS_REGION")
+	}
+	var creds *gitpodidp.AWSCredentials
+	err := traceStep(ctx, "exchange token", func(ctx context.Context) error {
+		return withProgress(fmt.Sprintf("assuming %s for profile %s", prof.RoleARN, name), func() (err error) {
+			creds, err = gitpodidp.AssumeRoleWithWebIdentity(ctx, token, gitpodidp.AssumeRoleInput{
+				RoleARN:     prof.RoleARN,
+				SessionName: sessionName,
+				Duration:    time.Duration(prof.Duration),
+				Region:      prof.Region,
+			})
+			return err
+		})
+	}, "idp.method", awsProfilesMethod, "idp.profile", name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	registerSecret(creds.SecretAccessKey)
+	registerSecret(creds.SessionToken)
+	emitEvent(eventExchangeSucceeded, "aws", "method", awsProfilesMethod, "profile", name, "roleArn", prof.RoleARN)
+
+	err = traceStep(ctx, "persist credentials", func(ctx context.Context) error {
+		err := gitpodidp.WriteAWSProfile(name, creds)
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot write the profile: %w", err)
+		}
+		return writeAWSRegion(name, prof.Region)
+	}, "idp.profile", name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	emitEvent(eventProfileWritten, "aws", "profile", name)
+	return localTime(creds.Expiration), nil
+}
+
+// whoamiAWSProfiles asks STS whom the credentials of each profile belong to.
+func whoamiAWSProfiles(ctx context.Context, profiles map[string]awsProfile) (string, error) {
+	var res []string
+	for _, name := range sortedKeys(profiles) {
+		creds, err := profileCredentials(name)
+		if err != nil {
+			return "", fmt.Errorf("profile %s: %w", name, err)
+		}
+		region := profiles[name].Region
+		if region == "" {
+			region = setting("IDP_AWS_REGION")
+		}
+		identity, err := gitpodidp.GetCallerIdentity(ctx, creds, region)
+		if err != nil {
+			return "", fmt.Errorf("profile %s: %w", name, err)
+		}
+		res = append(res, name+": "+identity.ARN)
+	}
+	return strings.Join(res, ", "), nil
+}
+
+// envAWSProfiles points the AWS tools at the files the profiles are in, as only one profile's credentials could
+// be exported. Select one with AWS_PROFILE.
+func envAWSProfiles() (map[string]string, error) {
+	creds, err := gitpodidp.AWSCredentialsFile()
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{"AWS_SHARED_CREDENTIALS_FILE": creds}
+	if fn, err := gitpodidp.AWSConfigFile(); err == nil {
+		if _, err := os.Stat(fn); err == nil {
+			res["AWS_CONFIG_FILE"] = fn
+		}
+	}
+	return res, nil
+}
+
+// profileCredentials reads the credentials of profile from the shared credentials file.
+func profileCredentials(profile string) (*gitpodidp.AWSCredentials, error) {
+	fn, err := awsCredentialsFile()
+	if err != nil {
+		return nil, err
+	}
+	section, err := readINISection(fn, profile)
+	if err != nil {
+		return nil, err
+	}
+	if section["aws_access_key_id"] == "" {
+		return nil, exitErrorf(exitMissingConfig, "the %s profile has no credentials - run idp login aws", profile)
+	}
+	return &gitpodidp.AWSCredentials{
+		AccessKeyID:     section["aws_access_key_id"],
+		SecretAccessKey: section["aws_secret_access_key"],
+		SessionToken:    section["aws_session_token"],
+	}, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func azureMissingConfig() []string {
+	return missingSettings("IDP_AZURE_CLIENT_ID", "IDP_AZURE_TENANT_ID")
+}
+
+func azureIdentity() string {
+	return setting("IDP_AZURE_CLIENT_ID")
+}
+
+// loginAzure signs the az CLI into the configured app registration using a federated credential. The token is
+// also written to a file so that the Azure SDKs can use it via AZURE_FEDERATED_TOKEN_FILE.
+func loginAzure(ctx context.Context) error {
+	var (
+		clientID = setting("IDP_AZURE_CLIENT_ID")
+		tenantID = setting("IDP_AZURE_TENANT_ID")
+	)
+	token, err := gitpodIDToken(ctx, providerAudience("azure"))
+	if err != nil {
+		return err
+	}
+
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	tokenFile := filepath.Join(dir, "azure-token")
+	err = writeWipedSecretFile(tokenFile, []byte(token))
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write Azure token file: %w", err)
+	}
+	emitEvent(eventProfileWritten, "azure", "path", tokenFile)
+
+	if pth, _ := runner.LookPath("az"); pth != "" {
+		var out []byte
+		err = traceStep(ctx, "exchange token", func(ctx context.Context) error {
+			return withProgress("signing into Azure using az login", func() (err error) {
+				// az reads arguments starting with @ from the file, which keeps the token out of the process list
+				out, err = runner.CombinedOutput(ctx, "az", "login", "--service-principal", "--username", clientID, "--tenant", tenantID, "--federated-token", "@"+tokenFile, "--allow-no-subscriptions", "--output", "none")
+				return err
+			})
+		}, "idp.method", "az")
+		if err != nil {
+			explainAzureRejection(string(out), token)
+			return exitErrorf(exitExchangeFailed, "az login failure: %s: %w", string(out), err)
+		}
+		emitEvent(eventExchangeSucceeded, "azure", "clientId", clientID)
+		if sub := setting("IDP_AZURE_SUBSCRIPTION_ID"); sub != "" {
+			out, err := runner.CombinedOutput(ctx, "az", "account", "set", "--subscription", sub)
+			if err != nil {
+				return exitErrorf(exitPersistFailed, "az account set failure: %s: %w", string(out), err)
+			}
+		}
+	} else {
+		slog.Info("az is not installed - set these variables to use the Azure SDKs", "AZURE_CLIENT_ID", clientID, "AZURE_TENANT_ID", tenantID, "AZURE_FEDERATED_TOKEN_FILE", tokenFile)
+	}
+	recordLogin(credentialRecord{Provider: "azure", Identity: clientID, Expiry: localTime(gitpodidp.Expiry(token))})
+
+	return nil
+}
+
+// azureAccessToken exchanges the token of idp login azure for an Entra ID access token for scope, e.g.
+// https://management.azure.com/.default. method names what it's for in traces.
+func azureAccessToken(ctx context.Context, scope, method string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	token, err := os.ReadFile(filepath.Join(dir, "azure-token"))
+	if err != nil {
+		return "", exitErrorf(exitMissingConfig, "not signed into azure - run idp login azure: %w", err)
+	}
+	var accessToken string
+	err = traceStep(ctx, "exchange token", func(ctx context.Context) (err error) {
+		accessToken, err = gitpodidp.AzureAccessToken(ctx, setting("IDP_AZURE_TENANT_ID"), setting("IDP_AZURE_CLIENT_ID"), string(token), scope)
+		return err
+	}, "idp.method", method)
+	if err != nil {
+		explainAzureRejection(err.Error(), string(token))
+		return "", withExitCode(exitExchangeFailed, err)
+	}
+	registerSecret(accessToken)
+	return accessToken, nil
+}
+
+// whoamiAzure verifies the stored workspace token is accepted by Entra ID and returns the identity it maps to.
+func whoamiAzure(ctx context.Context) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	token, err := os.ReadFile(filepath.Join(dir, "azure-token"))
+	if err != nil {
+		return "", fmt.Errorf("cannot read Azure token file: %w", err)
+	}
+	accessToken, err := gitpodidp.AzureAccessToken(ctx, setting("IDP_AZURE_TENANT_ID"), setting("IDP_AZURE_CLIENT_ID"), string(token), "https://management.azure.com/.default")
+	if err != nil {
+		explainAzureRejection(err.Error(), string(token))
+		return "", err
+	}
+	registerSecret(accessToken)
+	claims, err := gitpodidp.Claims(accessToken)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("app %v (object %v) in tenant %v", claims["appid"], claims["oid"], claims["tid"]), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoginAzureKeepsTokenOffCommandLine(t *testing.T) {
+	r := &fakeRunner{run: func(name string, args ...string) ([]byte, error) {
+		if name == "az" {
+			return nil, nil
+		}
+		return fakeGitpodToken(name, args...)
+	}}
+	testWorkspace(t, r)
+	t.Setenv("IDP_AZURE_CLIENT_ID", "client-1")
+	t.Setenv("IDP_AZURE_TENANT_ID", "tenant-1")
+
+	err := loginAzure(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := stateDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range r.calls {
+		if strings.Contains(c, "eyJ") {
+			t.Errorf("ran %q with the token on its command line", c)
+		}
+	}
+	if !r.ran("az login --service-principal --username client-1 --tenant tenant-1 --federated-token @" + filepath.Join(dir, "azure-token")) {
+		t.Errorf("ran %q, want az login to read the token from its file", r.calls)
+	}
+}
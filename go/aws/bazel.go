@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "bazel",
+		Usage:   "bazel configure [--bin-dir dir] [--bazelrc file] [endpoint...] | get",
+		Summary: "act as Bazel credential helper for remote caches and remote execution on GCS, Artifactory and OIDC-authenticated HTTPS",
+		Run:     runBazel,
+	})
+}
+
+// bazelHelperName is the name the Bazel credential helper is installed as.
+const bazelHelperName = "bazel-credential-gitpod-idp"
+
+// bazelrcBegin and bazelrcEnd enclose the lines bazel configure writes to the bazelrc, which it replaces on the
+// next run.
+const (
+	bazelrcBegin = "# >>> gitpod-idp >>>"
+	bazelrcEnd   = "# <<< gitpod-idp <<<"
+)
+
+// bazelKind is a type of endpoint the helper knows how to authenticate Bazel to.
+type bazelKind struct {
+	Name string
+	// Provider is the provider whose credentials the endpoint accepts, or empty if it takes the workspace's
+	// identity token.
+	Provider string
+	// Hosts matches the hostnames of the kind's hosted endpoints, which need no configuration.
+	Hosts   *regexp.Regexp
+	Headers func(ctx context.Context, host string) (map[string][]string, time.Time, error)
+}
+
+var bazelKinds = []bazelKind{
+	{Name: "google", Provider: "gcp", Hosts: regexp.MustCompile(`^(([a-z0-9._-]+\.)?storage|remotebuildexecution)\.googleapis\.com$`), Headers: googleBazelHeaders},
+	{Name: "artifactory", Hosts: regexp.MustCompile(`^[a-z0-9-]+\.jfrog\.io$`), Headers: artifactoryBazelHeaders},
+	{Name: "oidc", Headers: oidcBazelHeaders},
+}
+
+// s3Host matches S3 endpoints, which Bazel can't be given credentials for: S3 wants every request signed, while
+// credential helpers can only hand Bazel headers to send as they are.
+var s3Host = regexp.MustCompile(`^([a-z0-9.-]+\.)?s3([.-][a-z0-9-]+)*\.amazonaws\.com(\.cn)?$`)
+
+func findBazelKind(name string) *bazelKind {
+	for i := range bazelKinds {
+		if bazelKinds[i].Name == name {
+			return &bazelKinds[i]
+		}
+	}
+	return nil
+}
+
+func bazelKindNames() []string {
+	var res []string
+	for _, k := range bazelKinds {
+		res = append(res, k.Name)
+	}
+	return res
+}
+
+// bazelEndpoints returns the endpoints of IDP_BAZEL_ENDPOINTS, written like IDP_DOCKER_REGISTRIES but with the
+// kinds of bazelKinds, e.g. "storage.googleapis.com,cache.corp.example=oidc".
+func bazelEndpoints() (map[string]string, error) {
+	res := make(map[string]string)
+	for _, entry := range strings.Split(setting("IDP_BAZEL_ENDPOINTS"), ",") {
+		host, kind, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		kind = strings.TrimSpace(kind)
+		if kind != "" && findBazelKind(kind) == nil {
+			return nil, exitErrorf(exitMissingConfig, "IDP_BAZEL_ENDPOINTS: unknown endpoint kind %q for %s, use one of %s", kind, host, strings.Join(bazelKindNames(), ", "))
+		}
+		res[registryHost(host)] = kind
+	}
+	return res, nil
+}
+
+// bazelKindFor returns the kind of the endpoint at host: the one it is configured with, or the one hosting it. It
+// returns nil if there are no credentials for host.
+func bazelKindFor(host string, configured map[string]string) *bazelKind {
+	if kind := configured[host]; kind != "" {
+		return findBazelKind(kind)
+	}
+	for i, k := range bazelKinds {
+		if k.Hosts != nil && k.Hosts.MatchString(host) {
+			return &bazelKinds[i]
+		}
+	}
+	return nil
+}
+
+func runBazel(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return exitErrorf(exitUsage, "usage: bazel configure [endpoint...], or get as Bazel credential helper")
+	}
+	switch args[0] {
+	case "configure":
+		return runBazelConfigure(ctx, args[1:])
+	case "get":
+		return bazelGet(ctx)
+	case "version":
+		fmt.Println(version)
+		return nil
+	}
+	return exitErrorf(exitUsage, "unknown bazel subcommand %q", args[0])
+}
+
+// bazelGet answers the get request of the credential helper protocol: {"uri": ...} on stdin, and the headers to
+// send with requests to it as JSON on stdout. Hosts the helper has no credentials for get no headers, so that
+// Bazel can be pointed at the helper for all of them.
+func bazelGet(ctx context.Context) error {
+	var req struct {
+		URI string `json:"uri"`
+	}
+	err := json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil {
+		return exitErrorf(exitUsage, "cannot read the credential helper request: %w", err)
+	}
+	u, err := url.Parse(req.URI)
+	if err != nil || u.Host == "" {
+		return exitErrorf(exitUsage, "invalid uri %q in the credential helper request", req.URI)
+	}
+	host := strings.ToLower(u.Hostname())
+	configured, err := bazelEndpoints()
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Headers map[string][]string `json:"headers,omitempty"`
+		Expires string              `json:"expires,omitempty"`
+	}
+	kind := bazelKindFor(host, configured)
+	if kind == nil && s3Host.MatchString(host) {
+		return exitErrorf(exitMissingConfig, "%s is S3, which signs every request, so Bazel can't be given credentials for it - put an OIDC-authenticated cache such as bazel-remote in front of the bucket and add it to IDP_BAZEL_ENDPOINTS as <host>=oidc", host)
+	}
+	if kind != nil {
+		if p, ok := findProvider(kind.Provider); ok && !p.configured() {
+			return exitErrorf(exitMissingConfig, "%s is a %s endpoint, but %s is not configured - see idp providers list", host, kind.Name, kind.Provider)
+		}
+		headers, expiry, err := kind.Headers(ctx, host)
+		if err != nil {
+			return err
+		}
+		resp.Headers = headers
+		meterUsage(ctx, "bazel", kind.Provider, host)
+		if !expiry.IsZero() {
+			resp.Expires = expiry.UTC().Format(time.RFC3339)
+		}
+	}
+	return json.NewEncoder(os.Stdout).Encode(resp)
+}
+
+func bearerHeaders(token string) map[string][]string {
+	return map[string][]string{"Authorization": {"Bearer " + token}}
+}
+
+// googleBazelHeaders authenticates to GCS buckets and Remote Build Execution with an access token of idp login
+// gcp. Access tokens last an hour.
+func googleBazelHeaders(ctx context.Context, host string) (map[string][]string, time.Time, error) {
+	accessToken, err := gcpAccessToken(ctx, "bazel")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return bearerHeaders(accessToken), time.Now().Add(time.Hour - dockerCredentialMargin), nil
+}
+
+// artifactoryBazelHeaders authenticates to Artifactory with the access token the Docker credential helper uses for
+// it, from the same cache.
+func artifactoryBazelHeaders(ctx context.Context, host string) (map[string][]string, time.Time, error) {
+	creds, err := cachedRegistryCredentials(ctx, host, findRegistryKind("artifactory"))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var expiry time.Time
+	if !creds.Expiry.IsZero() {
+		expiry = creds.Expiry.Add(-dockerCredentialMargin)
+	}
+	return bearerHeaders(creds.Secret), expiry, nil
+}
+
+// oidcBazelHeaders passes the workspace's identity token to endpoints which verify it themselves, such as
+// bazel-remote or a build farm behind an OIDC-aware proxy. Its audience is IDP_BAZEL_AUDIENCE, by default the
+// endpoint's URL.
+func oidcBazelHeaders(ctx context.Context, host string) (map[string][]string, time.Time, error) {
+	audience := setting("IDP_BAZEL_AUDIENCE")
+	if audience == "" {
+		audience = "https://" + host
+	}
+	token, err := gitpodIDToken(ctx, audience)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var expiry time.Time
+	if exp := gitpodidp.Expiry(token); !exp.IsZero() {
+		expiry = exp.Add(-dockerCredentialMargin)
+	}
+	return bearerHeaders(token), expiry, nil
+}
+
+func runBazelConfigure(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("bazel configure", flag.ExitOnError)
+	binDir := flags.String("bin-dir", "", "install "+bazelHelperName+" into this directory (default ~/.local/bin)")
+	bazelrc := flags.String("bazelrc", "", "add the helper to this bazelrc, e.g. a workspace's user.bazelrc (default ~/.bazelrc)")
+	_ = flags.Parse(args)
+
+	configured, err := bazelEndpoints()
+	if err != nil {
+		return err
+	}
+	hosts := sortedKeys(configured)
+	for _, arg := range flags.Args() {
+		hosts = append(hosts, registryHost(arg))
+	}
+	if len(hosts) == 0 {
+		return exitErrorf(exitUsage, "no endpoints to configure: pass the hostnames of the remote cache or executor, or set IDP_BAZEL_ENDPOINTS")
+	}
+	for _, host := range hosts {
+		if bazelKindFor(host, configured) != nil {
+			continue
+		}
+		if s3Host.MatchString(host) {
+			return exitErrorf(exitUsage, "%s is S3, which signs every request, so Bazel can't be given credentials for it - put an OIDC-authenticated cache such as bazel-remote in front of the bucket", host)
+		}
+		return exitErrorf(exitUsage, "don't know what kind of endpoint %s is - add it to IDP_BAZEL_ENDPOINTS as %s=<kind>, with kind one of %s", host, host, strings.Join(bazelKindNames(), ", "))
+	}
+
+	dir, err := helperDir(*binDir)
+	if err != nil {
+		return err
+	}
+	helper, err := installHelper(dir, bazelHelperName)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot install %s: %w", bazelHelperName, err)
+	}
+	if *bazelrc == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		*bazelrc = filepath.Join(home, ".bazelrc")
+	}
+	var lines []string
+	for _, host := range hosts {
+		// Bazel runs the helper by its absolute path, so it needn't be on PATH
+		lines = append(lines, "common --credential_helper="+host+"="+helper)
+	}
+	err = writeBazelrcBlock(*bazelrc, lines)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot configure the credential helper in %s: %w", *bazelrc, err)
+	}
+	emitEvent(eventProfileWritten, "", "tool", "bazel", "path", *bazelrc)
+	printSuccess("bazel uses %s for %s (%s)", bazelHelperName, strings.Join(hosts, ", "), *bazelrc)
+	return nil
+}
+
+// writeBazelrcBlock replaces the lines between bazelrcBegin and bazelrcEnd in fn with lines, or appends them if
+// fn has none yet. The rest of fn is left as it is.
+func writeBazelrcBlock(fn string, lines []string) error {
+	fc, err := os.ReadFile(fn)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if start := bytes.Index(fc, []byte(bazelrcBegin)); start >= 0 {
+		rest := fc[start:]
+		end := bytes.Index(rest, []byte(bazelrcEnd))
+		if end < 0 {
+			return fmt.Errorf("it has %q without %q - remove the line and run bazel configure again", bazelrcBegin, bazelrcEnd)
+		}
+		rest = bytes.TrimPrefix(rest[end+len(bazelrcEnd):], []byte("\n"))
+		fc = append(fc[:start:start], rest...)
+	}
+	var buf bytes.Buffer
+	buf.Write(fc)
+	if buf.Len() > 0 && !bytes.HasSuffix(fc, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(bazelrcBegin + "\n")
+	for _, l := range lines {
+		buf.WriteString(l + "\n")
+	}
+	buf.WriteString(bazelrcEnd + "\n")
+	return os.WriteFile(fn, buf.Bytes(), 0644)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "bootstrap",
+		Usage:   "bootstrap aws|gcp|azure [flags]",
+		Summary: "create the identity federation and a role, service account or app trusting this repository's workspaces",
+		Run:     runBootstrap,
+	})
+}
+
+func runBootstrap(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return exitErrorf(exitUsage, "bootstrap needs a provider, e.g. bootstrap aws")
+	}
+	switch args[0] {
+	case "aws":
+		return bootstrapAWS(ctx, args[1:])
+	case "gcp":
+		return bootstrapGCP(ctx, args[1:])
+	case "azure":
+		return bootstrapAzure(ctx, args[1:])
+	default:
+		return exitErrorf(exitUsage, "cannot bootstrap %q: use aws, gcp or azure", args[0])
+	}
+}
+
+func bootstrapAWS(ctx context.Context, args []string) error {
+	defaultIssuer, err := gitpodIssuer()
+	if err != nil {
+		defaultIssuer = "https://api.gitpod.io/idp"
+	}
+	repoURL := gitRepositoryURL(ctx)
+
+	flags := flag.NewFlagSet("bootstrap aws", flag.ExitOnError)
+	var (
+		issuer    = flags.String("issuer", defaultIssuer, "OIDC issuer of the workspace identity tokens")
+		roleName  = flags.String("role-name", defaultBootstrapRoleName(repoURL), "name of the IAM role to create")
+		policyARN = flags.String("policy-arn", "", "managed policy to attach to the role, e.g. arn:aws:iam::aws:policy/ReadOnlyAccess")
+		subjects  stringList
+	)
+	flags.Var(&subjects, "subject", "pattern the token's sub claim must match (StringLike), repeatable (default the repository URL and those below it)")
+	_ = flags.Parse(args)
+	if len(subjects) == 0 {
+		subjects = repositorySubjects(repoURL)
+	}
+	if len(subjects) == 0 {
+		return exitErrorf(exitMissingConfig, "cannot determine the repository URL: pass --subject to scope the role to your repository")
+	}
+
+	checkBootstrapSubject(ctx, "sts.amazonaws.com", subjects)
+
+	out, err := runAWSCLI(ctx, "sts", "get-caller-identity")
+	if err != nil {
+		return exitErrorf(exitMissingConfig, "bootstrap needs AWS admin credentials: %w", err)
+	}
+	var caller struct{ Account string }
+	err = json.Unmarshal(out, &caller)
+	if err != nil {
+		return err
+	}
+
+	issuerHost := strings.TrimPrefix(*issuer, "https://")
+	providerARN := fmt.Sprintf("arn:aws:iam::%s:oidc-provider/%s", caller.Account, issuerHost)
+	_, err = runAWSCLI(ctx, "iam", "get-open-id-connect-provider", "--open-id-connect-provider-arn", providerARN)
+	if err != nil {
+		thumbprint, err := oidcThumbprint(ctx, *issuer)
+		if err != nil {
+			return err
+		}
+		_, err = runAWSCLI(ctx, "iam", "create-open-id-connect-provider", "--url", *issuer, "--client-id-list", "sts.amazonaws.com", "--thumbprint-list", thumbprint)
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "cannot create OIDC identity provider: %w", err)
+		}
+		slog.Info("created OIDC identity provider", "arn", providerARN)
+	} else {
+		slog.Info("OIDC identity provider exists already", "arn", providerARN)
+	}
+
+	trustPolicy, err := json.Marshal(awsTrustPolicy(providerARN, issuerHost, subjects))
+	if err != nil {
+		return err
+	}
+	out, err = runAWSCLI(ctx, "iam", "create-role", "--role-name", *roleName, "--assume-role-policy-document", string(trustPolicy), "--description", "Assumed by Gitpod workspaces of "+repoURL)
+	if err != nil && strings.Contains(err.Error(), "EntityAlreadyExists") {
+		_, err = runAWSCLI(ctx, "iam", "update-assume-role-policy", "--role-name", *roleName, "--policy-document", string(trustPolicy))
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "cannot update trust policy of role %s: %w", *roleName, err)
+		}
+		slog.Info("updated the trust policy of the existing role", "role", *roleName)
+		out, err = runAWSCLI(ctx, "iam", "get-role", "--role-name", *roleName)
+	}
+	if err != nil {
+		return exitErrorf(exitExchangeFailed, "cannot create role %s: %w", *roleName, err)
+	}
+	var role struct {
+		Role struct{ Arn string }
+	}
+	err = json.Unmarshal(out, &role)
+	if err != nil {
+		return err
+	}
+
+	if *policyARN != "" {
+		_, err = runAWSCLI(ctx, "iam", "attach-role-policy", "--role-name", *roleName, "--policy-arn", *policyARN)
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "cannot attach %s to role %s: %w", *policyARN, *roleName, err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "\nDone. Set the role on your project, e.g. with\n  gp env IDP_AWS_ROLE_ARN=%s\n", role.Role.Arn)
+	fmt.Println(role.Role.Arn)
+	return nil
+}
+
+type awsPolicyDocument struct {
+	Version   string               `json:"Version"`
+	Statement []awsPolicyStatement `json:"Statement"`
+}
+
+type awsPolicyStatement struct {
+	Effect    string                            `json:"Effect"`
+	Principal map[string]string                 `json:"Principal,omitempty"`
+	Action    string                            `json:"Action"`
+	Condition map[string]map[string]interface{} `json:"Condition,omitempty"`
+}
+
+// awsTrustPolicy returns a trust policy that lets tokens of issuerHost for sts.amazonaws.com assume a role,
+// as long as their subject matches one of subjects.
+func awsTrustPolicy(providerARN, issuerHost string, subjects []string) awsPolicyDocument {
+	return awsPolicyDocument{
+		Version: "2012-10-17",
+		Statement: []awsPolicyStatement{{
+			Effect:    "Allow",
+			Principal: map[string]string{"Federated": providerARN},
+			Action:    "sts:AssumeRoleWithWebIdentity",
+			Condition: map[string]map[string]interface{}{
+				"StringEquals": {issuerHost + ":aud": "sts.amazonaws.com"},
+				"StringLike":   {issuerHost + ":sub": subjects},
+			},
+		}},
+	}
+}
+
+// oidcThumbprint returns the SHA-1 thumbprint of the top intermediate certificate presented by the issuer,
+// which is what IAM expects for OIDC identity providers.
+func oidcThumbprint(ctx context.Context, issuer string) (string, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return "", err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 10 * time.Second},
+		Config:    &tls.Config{ServerName: u.Hostname()},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return "", fmt.Errorf("cannot connect to %s: %w", host, err)
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("%s presented no certificates", host)
+	}
+	sum := sha1.Sum(certs[len(certs)-1].Raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// gitRepositoryURL returns the https URL of the origin remote without the .git suffix, or an empty string.
+func gitRepositoryURL(ctx context.Context) string {
+	out, err := runner.Output(ctx, "git", "remote", "get-url", "origin")
+	if err != nil {
+		return ""
+	}
+	remote := strings.TrimSuffix(strings.TrimSpace(string(out)), ".git")
+	if strings.HasPrefix(remote, "git@") {
+		// git@github.com:org/repo
+		remote = "https://" + strings.Replace(strings.TrimPrefix(remote, "git@"), ":", "/", 1)
+	}
+	if u, err := url.Parse(remote); err == nil && u.User != nil {
+		u.User = nil
+		remote = u.String()
+	}
+	return remote
+}
+
+// repositorySubjects returns the subject patterns which admit the workspaces of the repository at repoURL: the URL
+// itself and those below it, e.g. of its branches and pull requests, but not those of repositories whose name
+// merely starts with it. It returns nil if repoURL is empty.
+func repositorySubjects(repoURL string) []string {
+	if repoURL == "" {
+		return nil
+	}
+	return []string{repoURL, repoURL + "/*"}
+}
+
+// subjectsMatch reports whether sub matches one of the StringLike patterns.
+func subjectsMatch(patterns []string, sub string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool { return awsStringLike(p, sub) })
+}
+
+func defaultBootstrapRoleName(repoURL string) string {
+	name := "gitpod"
+	if repoURL != "" {
+		name += "-" + path.Base(repoURL)
+	}
+	// IAM role names are limited to 64 characters
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// runAWSCLI runs the aws CLI with JSON output and returns its stdout.
+func runAWSCLI(ctx context.Context, args ...string) ([]byte, error) {
+	return runAdminCLI(ctx, "aws", append(args, "--output", "json")...)
+}
+
+// runAdminCLI runs a cloud CLI with the user's own credentials and returns its stdout. Errors name the command by
+// its first two arguments, e.g. aws iam, and carry what it wrote to stderr.
+func runAdminCLI(ctx context.Context, name string, args ...string) ([]byte, error) {
+	what := strings.Join(append([]string{name}, args[:min(2, len(args))]...), " ")
+	out, err := runner.Output(ctx, name, args...)
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("%s: %w: %s", what, err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, fmt.Errorf("%s: %w", what, err)
+	}
+	return out, nil
+}
+
+// bootstrapScript collects the commands of a bootstrap for bootstrap --print script, to be run by someone with
+// admin rights, e.g. in Cloud Shell.
+type bootstrapScript struct {
+	strings.Builder
+}
+
+func newBootstrapScript(comment string) *bootstrapScript {
+	s := &bootstrapScript{}
+	s.WriteString("#!/bin/sh\n# " + comment + "\nset -eu\n")
+	return s
+}
+
+// command adds a command line. Arguments referring to variables the script sets, like "$PROJECT_NUMBER", are
+// double-quoted so that the shell expands them; the others are quoted where they need to be.
+func (s *bootstrapScript) command(args ...string) {
+	for i, a := range args {
+		if i > 0 {
+			s.WriteByte(' ')
+		}
+		s.WriteString(scriptArg(a))
+	}
+	s.WriteByte('\n')
+}
+
+func scriptArg(a string) string {
+	switch {
+	case strings.Contains(a, "$"):
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`").Replace(a) + `"`
+	case a == "" || strings.ContainsAny(a, " \t\n'\"\\*?[]{}()<>|&;#~!"):
+		return shellQuote(a)
+	}
+	return a
+}
+
+// hclString quotes s for Terraform, where ${ and %{ start interpolations.
+func hclString(s string) string {
+	return strings.NewReplacer("${", "$${", "%{", "%%{").Replace(strconv.Quote(s))
+}
+
+// checkBootstrapSubject warns if the subject of this workspace's token for audience doesn't match the patterns
+// the bootstrap trusts, so that users spot a mismatch before the first sign-in fails.
+func checkBootstrapSubject(ctx context.Context, audience string, patterns []string) {
+	token, err := gitpodIDToken(ctx, audience)
+	if err != nil {
+		return
+	}
+	claims, err := gitpodidp.Claims(token)
+	if err != nil {
+		return
+	}
+	sub, _ := claims["sub"].(string)
+	slog.Info("checked this workspace's token", "subject", sub)
+	if !subjectsMatch(patterns, sub) {
+		slog.Warn("the token's subject does not match --subject, so this workspace could not sign in", "subject", strings.Join(patterns, ", "))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRepositorySubjects(t *testing.T) {
+	const repoURL = "https://github.com/acme/app"
+	subjects := repositorySubjects(repoURL)
+	policy, err := json.Marshal(awsTrustPolicy("arn:aws:iam::123456789012:oidc-provider/"+testIssuer, testIssuer, subjects))
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition, err := parseCEL(celSubjectCondition(subjects))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		sub  string
+		want bool
+	}{
+		{sub: repoURL, want: true},
+		{sub: repoURL + "/pull/42", want: true},
+		{sub: repoURL + "/tree/main", want: true},
+		{sub: repoURL + "-fork"},
+		{sub: repoURL + "s/pull/42"},
+		{sub: "https://github.com/acme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sub, func(t *testing.T) {
+			res, err := evaluateAWSTrustPolicy(policy, testIssuer, map[string]interface{}{"sub": tt.sub, "aud": "sts.amazonaws.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Allowed != tt.want {
+				t.Errorf("the trust policy admits it: %v, want %v", res.Allowed, tt.want)
+			}
+			got, err := condition.eval(map[string]interface{}{"assertion": map[string]interface{}{"sub": tt.sub}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("the attribute condition admits it: %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if repositorySubjects("") != nil {
+		t.Error("repositorySubjects() returned patterns without a repository URL")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// azureBootstrap is what bootstrap azure creates: an app registration, unless it exists already, with a federated
+// credential for the workspace's subject and, optionally, a role assignment for its service principal.
+type azureBootstrap struct {
+	ClientID, AppName     string
+	Issuer, Subject       string
+	Audience, Role, Scope string
+}
+
+func bootstrapAzure(ctx context.Context, args []string) error {
+	defaultIssuer, err := gitpodIssuer()
+	if err != nil {
+		defaultIssuer = "https://api.gitpod.io/idp"
+	}
+	// Entra ID compares the subject exactly, so the default is the one of this workspace's token
+	var defaultSubject string
+	if token, err := gitpodIDToken(ctx, providerAudience("azure")); err == nil {
+		if claims, err := gitpodidp.Claims(token); err == nil {
+			defaultSubject, _ = claims["sub"].(string)
+		}
+	}
+
+	b := azureBootstrap{Audience: providerAudience("azure")}
+	flags := flag.NewFlagSet("bootstrap azure", flag.ExitOnError)
+	flags.StringVar(&b.ClientID, "client-id", setting("IDP_AZURE_CLIENT_ID"), "app registration to add the federated credential to (default IDP_AZURE_CLIENT_ID, or a new one)")
+	flags.StringVar(&b.AppName, "app-name", defaultBootstrapRoleName(gitRepositoryURL(ctx)), "display name of the app registration to create")
+	flags.StringVar(&b.Issuer, "issuer", defaultIssuer, "OIDC issuer of the workspace identity tokens")
+	flags.StringVar(&b.Subject, "subject", defaultSubject, "the token's sub claim, which Entra ID matches exactly (default this workspace's)")
+	flags.StringVar(&b.Role, "role", "", "role to assign to the app's service principal, e.g. Reader")
+	flags.StringVar(&b.Scope, "scope", "", "scope of the role assignment (default the current subscription)")
+	printAs := flags.String("print", "", "print a shell script or Terraform configuration instead of making the changes: script or terraform")
+	_ = flags.Parse(args)
+	switch {
+	case b.Subject == "":
+		return exitErrorf(exitMissingConfig, "cannot determine this workspace's subject: pass --subject")
+	case strings.ContainsAny(b.Subject, "*?"):
+		return exitErrorf(exitUsage, "Entra ID matches the subject exactly: pass a subject without wildcards, and bootstrap again for every other one")
+	}
+
+	switch *printAs {
+	case "script":
+		fmt.Print(b.script())
+		return nil
+	case "terraform":
+		fmt.Print(b.terraform())
+		return nil
+	case "":
+	default:
+		return exitErrorf(exitUsage, "cannot print %q: use script or terraform", *printAs)
+	}
+
+	out, err := runAdminCLI(ctx, "az", "account", "show", "--query", "[tenantId, id]", "--output", "tsv")
+	if err != nil {
+		return exitErrorf(exitMissingConfig, "bootstrap needs az signed in with rights to create app registrations: %w", err)
+	}
+	tenantID, subscription, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if b.Scope == "" {
+		b.Scope = "/subscriptions/" + strings.TrimSpace(subscription)
+	}
+
+	if b.ClientID == "" {
+		out, err = runAdminCLI(ctx, "az", "ad", "app", "create", "--display-name", b.AppName, "--query", "appId", "--output", "tsv")
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "cannot create app registration %s: %w", b.AppName, err)
+		}
+		b.ClientID = strings.TrimSpace(string(out))
+		slog.Info("created app registration", "name", b.AppName, "clientId", b.ClientID)
+	}
+	// role assignments go to the service principal, which a new app doesn't have yet
+	_, err = runAdminCLI(ctx, "az", "ad", "sp", "create", "--id", b.ClientID)
+	if err != nil && !strings.Contains(err.Error(), "already") {
+		return exitErrorf(exitExchangeFailed, "cannot create the service principal of app %s: %w", b.ClientID, err)
+	}
+
+	_, err = runAdminCLI(ctx, "az", b.federatedCredential("create", b.ClientID)...)
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		_, err = runAdminCLI(ctx, "az", append(b.federatedCredential("update", b.ClientID), "--federated-credential-id", b.credentialName())...)
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "cannot update federated credential %s: %w", b.credentialName(), err)
+		}
+		slog.Info("updated the existing federated credential", "name", b.credentialName())
+	} else if err != nil {
+		return exitErrorf(exitExchangeFailed, "cannot create federated credential: %w", err)
+	} else {
+		slog.Info("created federated credential", "name", b.credentialName(), "subject", b.Subject)
+	}
+
+	if b.Role != "" {
+		_, err = runAdminCLI(ctx, "az", b.roleAssignment(b.ClientID)...)
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "cannot assign %s on %s to app %s: %w", b.Role, b.Scope, b.ClientID, err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "\nDone. Set the app on your project, e.g. with\n  gp env IDP_AZURE_CLIENT_ID=%s IDP_AZURE_TENANT_ID=%s\n", b.ClientID, tenantID)
+	fmt.Println(b.ClientID)
+	return nil
+}
+
+func (b azureBootstrap) credentialName() string {
+	return "gitpod-" + federatedCredentialName(b.Subject)
+}
+
+func (b azureBootstrap) federatedCredential(verb, clientID string) []string {
+	params := snippetJSON(map[string]interface{}{
+		"name":      b.credentialName(),
+		"issuer":    b.Issuer,
+		"subject":   b.Subject,
+		"audiences": []string{b.Audience},
+	}, "")
+	return []string{"ad", "app", "federated-credential", verb, "--id", clientID, "--parameters", params}
+}
+
+func (b azureBootstrap) roleAssignment(clientID string) []string {
+	return []string{"role", "assignment", "create", "--assignee", clientID, "--role", b.Role, "--scope", b.Scope}
+}
+
+func (b azureBootstrap) script() string {
+	s := newBootstrapScript("Lets the Gitpod workspace " + b.Subject + " sign in to Azure. Run it with az signed in as someone who may create app registrations.")
+	if b.ClientID != "" {
+		s.WriteString("CLIENT_ID=" + scriptArg(b.ClientID) + "\n")
+	} else {
+		s.WriteString("CLIENT_ID=$(az ad app create --display-name " + scriptArg(b.AppName) + " --query appId --output tsv)\n")
+		s.command("az", "ad", "sp", "create", "--id", "$CLIENT_ID")
+	}
+	s.command(append([]string{"az"}, b.federatedCredential("create", "$CLIENT_ID")...)...)
+	if b.Role != "" {
+		if b.Scope == "" {
+			b.Scope = "/subscriptions/$(az account show --query id --output tsv)"
+		}
+		s.command(append([]string{"az"}, b.roleAssignment("$CLIENT_ID")...)...)
+	}
+	s.WriteString("TENANT_ID=$(az account show --query tenantId --output tsv)\n")
+	s.command("echo", "gp", "env", "IDP_AZURE_CLIENT_ID=$CLIENT_ID", "IDP_AZURE_TENANT_ID=$TENANT_ID")
+	return s.String()
+}
+
+func (b azureBootstrap) terraform() string {
+	app := "azuread_application.gitpod"
+	lines := []string{"# Lets the Gitpod workspace " + b.Subject + " sign in to Azure.", ""}
+	if b.ClientID != "" {
+		lines = append(lines,
+			`data "azuread_application" "gitpod" {`,
+			"  client_id = "+hclString(b.ClientID),
+			"}",
+			"",
+			`data "azuread_service_principal" "gitpod" {`,
+			"  client_id = "+hclString(b.ClientID),
+			"}",
+		)
+		app = "data." + app
+	} else {
+		lines = append(lines,
+			`resource "azuread_application" "gitpod" {`,
+			"  display_name = "+hclString(b.AppName),
+			"}",
+			"",
+			`resource "azuread_service_principal" "gitpod" {`,
+			"  client_id = azuread_application.gitpod.client_id",
+			"}",
+		)
+	}
+	lines = append(lines,
+		"",
+		`resource "azuread_application_federated_identity_credential" "gitpod" {`,
+		"  application_id = "+app+".id",
+		"  display_name   = "+hclString(b.credentialName()),
+		"  issuer         = "+hclString(b.Issuer),
+		"  subject        = "+hclString(b.Subject),
+		"  audiences      = ["+hclString(b.Audience)+"]",
+		"}",
+	)
+	if b.Role != "" {
+		scope := "data.azurerm_subscription.current.id"
+		if b.Scope != "" {
+			scope = hclString(b.Scope)
+		} else {
+			lines = append(lines, "", `data "azurerm_subscription" "current" {}`)
+		}
+		principal := "azuread_service_principal.gitpod.object_id"
+		if b.ClientID != "" {
+			principal = "data." + principal
+		}
+		lines = append(lines,
+			"",
+			`resource "azurerm_role_assignment" "gitpod" {`,
+			"  scope                = "+scope,
+			"  role_definition_name = "+hclString(b.Role),
+			"  principal_id         = "+principal,
+			"}",
+		)
+	}
+	lines = append(lines,
+		"",
+		`output "IDP_AZURE_CLIENT_ID" {`,
+		"  value = "+app+".client_id",
+		"}",
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
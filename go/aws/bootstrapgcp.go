@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// gcpBootstrap is what bootstrap gcp creates: a workload identity pool with an OIDC provider for the Gitpod
+// issuer and, optionally, the right for its identities to impersonate a service account.
+type gcpBootstrap struct {
+	Project, Pool, Provider, ServiceAccount string
+	Issuer                                  string
+	// Subjects are the StringLike patterns the token's sub claim must match one of.
+	Subjects stringList
+}
+
+func bootstrapGCP(ctx context.Context, args []string) error {
+	defaultIssuer, err := gitpodIssuer()
+	if err != nil {
+		defaultIssuer = "https://api.gitpod.io/idp"
+	}
+	repoURL := gitRepositoryURL(ctx)
+
+	var b gcpBootstrap
+	flags := flag.NewFlagSet("bootstrap gcp", flag.ExitOnError)
+	flags.StringVar(&b.Project, "project", setting("IDP_GCP_PROJECT"), "project to create the workload identity pool in (default IDP_GCP_PROJECT)")
+	flags.StringVar(&b.Pool, "pool", "gitpod", "ID of the workload identity pool to create")
+	flags.StringVar(&b.Provider, "provider", "gitpod", "ID of the pool's OIDC provider to create")
+	flags.StringVar(&b.ServiceAccount, "service-account", setting("IDP_GCP_SERVICE_ACCOUNT"), "service account the workspaces may impersonate (default IDP_GCP_SERVICE_ACCOUNT, none for direct access)")
+	flags.StringVar(&b.Issuer, "issuer", defaultIssuer, "OIDC issuer of the workspace identity tokens")
+	flags.Var(&b.Subjects, "subject", "pattern the token's sub claim must match, repeatable; * at the end matches any suffix (default the repository URL and those below it)")
+	printAs := flags.String("print", "", "print a shell script or Terraform configuration instead of making the changes: script or terraform")
+	_ = flags.Parse(args)
+	if len(b.Subjects) == 0 {
+		b.Subjects = repositorySubjects(repoURL)
+	}
+	switch {
+	case len(b.Subjects) == 0:
+		return exitErrorf(exitMissingConfig, "cannot determine the repository URL: pass --subject to scope the pool to your repository")
+	case b.Project == "":
+		return exitErrorf(exitMissingConfig, "bootstrap gcp needs the project: pass --project or set IDP_GCP_PROJECT")
+	}
+
+	switch *printAs {
+	case "script":
+		fmt.Print(b.script())
+		return nil
+	case "terraform":
+		fmt.Print(b.terraform())
+		return nil
+	case "":
+	default:
+		return exitErrorf(exitUsage, "cannot print %q: use script or terraform", *printAs)
+	}
+
+	out, err := runAdminCLI(ctx, "gcloud", "projects", "describe", b.Project, "--format=value(projectNumber)")
+	if err != nil {
+		return exitErrorf(exitMissingConfig, "bootstrap needs gcloud signed in with rights on project %s: %w", b.Project, err)
+	}
+	number := strings.TrimSpace(string(out))
+	checkBootstrapSubject(ctx, gitpodidp.GCPAudience(b.providerName(number)), b.Subjects)
+
+	_, err = runAdminCLI(ctx, "gcloud", b.createPool()...)
+	switch {
+	case err != nil && strings.Contains(err.Error(), "ALREADY_EXISTS"):
+		slog.Info("workload identity pool exists already", "pool", b.Pool)
+	case err != nil:
+		return exitErrorf(exitExchangeFailed, "cannot create workload identity pool %s: %w", b.Pool, err)
+	default:
+		slog.Info("created workload identity pool", "pool", b.Pool)
+	}
+	_, err = runAdminCLI(ctx, "gcloud", b.provider("create-oidc")...)
+	if err != nil && strings.Contains(err.Error(), "ALREADY_EXISTS") {
+		_, err = runAdminCLI(ctx, "gcloud", b.provider("update-oidc")...)
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "cannot update provider %s: %w", b.Provider, err)
+		}
+		slog.Info("updated the existing provider", "provider", b.Provider)
+	} else if err != nil {
+		return exitErrorf(exitExchangeFailed, "cannot create provider %s: %w", b.Provider, err)
+	} else {
+		slog.Info("created provider", "provider", b.Provider)
+	}
+	if b.ServiceAccount != "" {
+		_, err = runAdminCLI(ctx, "gcloud", b.bindServiceAccount(number)...)
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "cannot let the pool impersonate %s: %w", b.ServiceAccount, err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "\nDone. Set the provider on your project, e.g. with\n  gp env %s\n", strings.Join(b.settings(number), " "))
+	fmt.Println(b.providerName(number))
+	return nil
+}
+
+// providerName is the resource name of the provider, which is IDP_GCP_WORKLOAD_IDENTITY_PROVIDER. Google only
+// accepts it with the project number.
+func (b gcpBootstrap) providerName(number string) string {
+	return fmt.Sprintf("projects/%s/locations/global/workloadIdentityPools/%s/providers/%s", number, b.Pool, b.Provider)
+}
+
+func (b gcpBootstrap) settings(number string) []string {
+	res := []string{"IDP_GCP_WORKLOAD_IDENTITY_PROVIDER=" + b.providerName(number)}
+	if b.ServiceAccount != "" {
+		res = append(res, "IDP_GCP_SERVICE_ACCOUNT="+b.ServiceAccount)
+	}
+	return res
+}
+
+func (b gcpBootstrap) createPool() []string {
+	return []string{"iam", "workload-identity-pools", "create", b.Pool, "--project=" + b.Project, "--location=global", "--display-name=Gitpod"}
+}
+
+// provider returns the gcloud arguments which create or update the provider. It accepts the default audience,
+// the provider's own URL, which is what login asks Gitpod for.
+func (b gcpBootstrap) provider(verb string) []string {
+	return []string{"iam", "workload-identity-pools", "providers", verb, b.Provider, "--project=" + b.Project, "--location=global",
+		"--workload-identity-pool=" + b.Pool, "--issuer-uri=" + b.Issuer, "--attribute-mapping=google.subject=assertion.sub",
+		"--attribute-condition=" + celSubjectCondition(b.Subjects)}
+}
+
+// bindServiceAccount lets every identity of the pool impersonate the service account; the attribute condition
+// already limits them to the subject.
+func (b gcpBootstrap) bindServiceAccount(number string) []string {
+	return []string{"iam", "service-accounts", "add-iam-policy-binding", b.ServiceAccount, "--project=" + b.Project,
+		"--role=roles/iam.workloadIdentityUser", "--member=" + b.poolMembers(number)}
+}
+
+func (b gcpBootstrap) poolMembers(number string) string {
+	return fmt.Sprintf("principalSet://iam.googleapis.com/projects/%s/locations/global/workloadIdentityPools/%s/*", number, b.Pool)
+}
+
+func (b gcpBootstrap) script() string {
+	s := newBootstrapScript("Lets Gitpod workspaces matching " + strings.Join(b.Subjects, " or ") + " sign in to GCP. Run it with gcloud signed in as an owner of " + b.Project + ".")
+	s.WriteString("PROJECT_NUMBER=$(gcloud projects describe " + scriptArg(b.Project) + " --format='value(projectNumber)')\n")
+	s.command(append([]string{"gcloud"}, b.createPool()...)...)
+	s.command(append([]string{"gcloud"}, b.provider("create-oidc")...)...)
+	if b.ServiceAccount != "" {
+		s.command(append([]string{"gcloud"}, b.bindServiceAccount("$PROJECT_NUMBER")...)...)
+	}
+	s.command(append([]string{"echo", "gp", "env"}, b.settings("$PROJECT_NUMBER")...)...)
+	return s.String()
+}
+
+func (b gcpBootstrap) terraform() string {
+	lines := []string{
+		"# Lets Gitpod workspaces matching " + strings.Join(b.Subjects, " or ") + " sign in to GCP.",
+		"",
+		`resource "google_iam_workload_identity_pool" "gitpod" {`,
+		"  project                   = " + hclString(b.Project),
+		"  workload_identity_pool_id = " + hclString(b.Pool),
+		`  display_name              = "Gitpod"`,
+		"}",
+		"",
+		`resource "google_iam_workload_identity_pool_provider" "gitpod" {`,
+		"  project                            = " + hclString(b.Project),
+		"  workload_identity_pool_id          = google_iam_workload_identity_pool.gitpod.workload_identity_pool_id",
+		"  workload_identity_pool_provider_id = " + hclString(b.Provider),
+		`  attribute_mapping                  = { "google.subject" = "assertion.sub" }`,
+		"  attribute_condition                = " + hclString(celSubjectCondition(b.Subjects)),
+		"  oidc {",
+		"    issuer_uri = " + hclString(b.Issuer),
+		"  }",
+		"}",
+	}
+	if b.ServiceAccount != "" {
+		lines = append(lines,
+			"",
+			`resource "google_service_account_iam_member" "gitpod" {`,
+			"  service_account_id = "+hclString("projects/"+b.Project+"/serviceAccounts/"+b.ServiceAccount),
+			`  role               = "roles/iam.workloadIdentityUser"`,
+			`  member             = "principalSet://iam.googleapis.com/${google_iam_workload_identity_pool.gitpod.name}/*"`,
+			"}",
+		)
+	}
+	lines = append(lines,
+		"",
+		`output "IDP_GCP_WORKLOAD_IDENTITY_PROVIDER" {`,
+		"  value = google_iam_workload_identity_pool_provider.gitpod.name",
+		"}",
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
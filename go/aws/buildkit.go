@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "buildkit",
+		Usage:   "buildkit [--dir dir] [--min-valid 30m] [provider...]",
+		Summary: "write fresh credentials as BuildKit secrets and print the --secret flags for docker buildx build",
+		Run:     runBuildkit,
+	})
+}
+
+// memoryDir returns the tool's directory in a filesystem in memory, $XDG_RUNTIME_DIR or /dev/shm, if there is
+// one. Nothing in it outlives the machine or workspace instance, or ends up in backups.
+func memoryDir() (string, bool) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gitpod-idp"), true
+	}
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		return fmt.Sprintf("/dev/shm/gitpod-idp-%d", os.Getuid()), true
+	}
+	return "", false
+}
+
+// buildkitSecretsDir returns where build secrets are written by default: a directory in memory where there is
+// one, so they never touch the disk.
+func buildkitSecretsDir() (string, error) {
+	if dir, ok := memoryDir(); ok {
+		return filepath.Join(dir, "buildkit"), nil
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "buildkit"), nil
+}
+
+func runBuildkit(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("buildkit", flag.ExitOnError)
+	dir := flags.String("dir", "", "write the secrets to this directory (default in $XDG_RUNTIME_DIR or /dev/shm)")
+	minValid := flags.Duration("min-valid", 30*time.Minute, "refresh credentials which expire sooner than this, so they outlast the build")
+	_ = flags.Parse(args)
+
+	selected, err := selectProviders(flags.Args())
+	if err != nil {
+		return err
+	}
+	if *dir == "" {
+		*dir, err = buildkitSecretsDir()
+		if err != nil {
+			return err
+		}
+	}
+	err = loginWhereNeeded(ctx, selected, *minValid)
+	if err != nil {
+		return err
+	}
+	secrets, err := buildSecrets(ctx, selected)
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return exitErrorf(exitMissingConfig, "no credentials to pass to the build - configure a provider and run idp login")
+	}
+
+	// secrets of an earlier run may belong to providers which are no longer signed in
+	err = os.RemoveAll(*dir)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot clear %s: %w", *dir, err)
+	}
+	var secretFlags []string
+	for _, id := range sortedKeys(secrets) {
+		fn := filepath.Join(*dir, id)
+		err = writeWipedSecretFile(fn, []byte(secrets[id]))
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot write the build secret %s: %w", id, err)
+		}
+		secretFlags = append(secretFlags, "--secret", "id="+id+",src="+fn)
+	}
+	recordArtifact(*dir)
+	emitEvent(eventProfileWritten, "", "path", *dir)
+	fmt.Println(strings.Join(secretFlags, " "))
+	return nil
+}
+
+// buildSecrets returns the credentials of selected as BuildKit secrets by id: every environment variable the
+// credentials consist of, with the content of the file for those naming one, and the AWS credentials as aws, a
+// shared credentials file to mount at ~/.aws/credentials. Builds can't reach the GCP credential configuration, which
+// refers to files in the workspace, so GCP is passed as an access token instead.
+func buildSecrets(ctx context.Context, selected []provider) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, p := range selected {
+		rec, err := loadCredentialRecord(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if rec == nil {
+			continue
+		}
+		env, err := p.Env()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name, err)
+		}
+
+		switch p.Name {
+		case "aws":
+			res["aws"] = fmt.Sprintf("[default]\naws_access_key_id = %s\naws_secret_access_key = %s\n", env["AWS_ACCESS_KEY_ID"], env["AWS_SECRET_ACCESS_KEY"])
+			if token := env["AWS_SESSION_TOKEN"]; token != "" {
+				res["aws"] += "aws_session_token = " + token + "\n"
+			}
+		case "gcp":
+			delete(env, "GOOGLE_APPLICATION_CREDENTIALS")
+			delete(env, "CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE")
+			accessToken, err := gcpAccessToken(ctx, "buildkit")
+			if err != nil {
+				return nil, err
+			}
+			env["GOOGLE_OAUTH_ACCESS_TOKEN"] = accessToken
+			env["CLOUDSDK_AUTH_ACCESS_TOKEN"] = accessToken
+		}
+
+		for k, v := range env {
+			if filepath.IsAbs(v) {
+				if fc, err := os.ReadFile(v); err == nil {
+					v = string(fc)
+				}
+			}
+			res[k] = v
+		}
+	}
+	return res, nil
+}
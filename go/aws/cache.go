@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// credentialRecord describes credentials this tool obtained for a provider.
+type credentialRecord struct {
+	Provider string `json:"provider"`
+	Identity string `json:"identity"`
+	// Method is the sign-in method that obtained the credentials, if the provider has several.
+	Method string `json:"method,omitempty"`
+	// SessionName is the name of the AWS role session, where known.
+	SessionName string    `json:"sessionName,omitempty"`
+	IssuedAt    time.Time `json:"issuedAt"`
+	Expiry      time.Time `json:"expiry,omitempty"`
+}
+
+func credentialRecordPath(provider string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "credentials", provider+".json"), nil
+}
+
+func saveCredentialRecord(rec credentialRecord) error {
+	fn, err := credentialRecordPath(rec.Provider)
+	if err != nil {
+		return err
+	}
+	fc, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return writeSealedFile(fn, fc)
+}
+
+// loadCredentialRecord returns the record for provider, or nil if there is none.
+func loadCredentialRecord(provider string) (*credentialRecord, error) {
+	fn, err := credentialRecordPath(provider)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := readSealedFile(fn)
+	if os.IsNotExist(err) || errors.Is(err, errForeignCache) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res credentialRecord
+	err = json.Unmarshal(fc, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// recordLogin stores a credential record and appends it to the audit log, warning rather than failing if that's
+// not possible because the login itself succeeded.
+func recordLogin(rec credentialRecord) {
+	if rec.IssuedAt.IsZero() {
+		rec.IssuedAt = time.Now()
+	}
+	err := saveCredentialRecord(rec)
+	if err != nil {
+		slog.Warn("cannot record credentials", "provider", rec.Provider, "error", err)
+	}
+	err = appendAuditLog(rec)
+	if err != nil {
+		slog.Warn("cannot write the audit log", "provider", rec.Provider, "error", err)
+	}
+}
+
+// sealedMagic starts files written by writeSealedFile.
+var sealedMagic = []byte("idp-sealed-v1\n")
+
+// errForeignCache is returned by readSealedFile for files sealed in another workspace instance, e.g. restored
+// from a backup, and for files which aren't sealed at all, like those of earlier versions or planted by others.
+var errForeignCache = errors.New("the file was written in another workspace instance")
+
+var cachedKey struct {
+	once sync.Once
+	key  *secret
+}
+
+// cacheKey returns the key the cache is encrypted with. Outside of workspaces, it's a random key kept in the
+// platform's keychain where there is one; the instance doesn't identify anything there.
+func cacheKey() []byte {
+	cachedKey.once.Do(func() {
+		if keychainEnabled() {
+			key, err := keychainCacheKey()
+			if err == nil {
+				cachedKey.key = newSecret(key)
+				return
+			}
+			if !errors.Is(err, errNoKeychain) {
+				slog.Debug("cannot use the keychain for the cache key", "error", err)
+			}
+		}
+		cachedKey.key = newSecret(instanceCacheKey())
+	})
+	return cachedKey.key.Bytes()
+}
+
+// forgetCacheKey overwrites the cache key in memory. The cache cannot be used afterwards.
+func forgetCacheKey() {
+	cachedKey.once.Do(func() {})
+	cachedKey.key.Wipe()
+}
+
+// instanceCacheKey returns the key the cache is encrypted with in workspaces: a random one kept in memory, in
+// $XDG_RUNTIME_DIR or /dev/shm, which backups don't include and every instance starts without. Copies of the cache
+// are therefore useless outside the instance that wrote them, even to someone who knows everything about it.
+// Outside of workspaces, without a filesystem in memory, the key is derived from the host name and the user.
+func instanceCacheKey() []byte {
+	if dir, ok := memoryDir(); ok {
+		key, err := memoryCacheKey(filepath.Join(dir, "cache-key"))
+		if err == nil {
+			return key
+		}
+		slog.Debug("cannot keep the cache key in memory", "error", err)
+	}
+	if os.Getenv("GITPOD_WORKSPACE_ID") != "" || os.Getenv("GITPOD_INSTANCE_ID") != "" {
+		// anything derived is in the backup too, so rather not cache beyond this process
+		key := make([]byte, 32)
+		_, _ = rand.Read(key)
+		return key
+	}
+	host, _ := os.Hostname()
+	var uid string
+	if u, err := user.Current(); err == nil {
+		uid = u.Uid
+	}
+	mac := hmac.New(sha256.New, []byte("gitpod-idp credential cache"))
+	for _, part := range []string{host, uid} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return mac.Sum(nil)
+}
+
+// memoryCacheKey returns the cache key in fn, generating it the first time.
+func memoryCacheKey(fn string) ([]byte, error) {
+	key, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		key, err = createCacheKey(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the cache key in %s is damaged", fn)
+	}
+	return key, nil
+}
+
+// createCacheKey writes a random key to fn and returns it, or, if another process got there first, returns the
+// key that process wrote. The key is linked into place complete, so no process reads it half written.
+func createCacheKey(fn string) ([]byte, error) {
+	dir := filepath.Dir(fn)
+	err := mkdirPrivate(dir)
+	if err == nil {
+		// the directory is shared by all users where it's in /dev/shm
+		err = restrictPermissions(dir, 0700)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(dir, ".cache-key-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(key)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = os.Link(tmp.Name(), fn)
+	if errors.Is(err, fs.ErrExist) {
+		return os.ReadFile(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func cacheCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cacheKey())
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeSealedFile encrypts content with the cache key and writes it like writeSecretFile. Only this tool can
+// read such files, so they must not be handed to other tools.
+func writeSealedFile(fn string, content []byte) error {
+	aead, err := cacheCipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	res := append(append([]byte{}, sealedMagic...), nonce...)
+	res = aead.Seal(res, nonce, content, sealedMagic)
+	return writeSecretFile(fn, res)
+}
+
+// readSealedFile reads a file written by writeSealedFile. It returns errForeignCache if the file was sealed in
+// another workspace instance or isn't sealed, so that callers treat it like a missing file and write it again.
+func readSealedFile(fn string) ([]byte, error) {
+	fc, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(fc, sealedMagic) {
+		slog.Debug("ignoring a cache file which isn't sealed", "path", fn)
+		return nil, errForeignCache
+	}
+	aead, err := cacheCipher()
+	if err != nil {
+		return nil, err
+	}
+	fc = fc[len(sealedMagic):]
+	if len(fc) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s is truncated", fn)
+	}
+	res, err := aead.Open(nil, fc[:aead.NonceSize()], fc[aead.NonceSize():], sealedMagic)
+	if err != nil {
+		slog.Debug("cannot decrypt cached credentials", "path", fn, "error", err)
+		return nil, errForeignCache
+	}
+	return res, nil
+}
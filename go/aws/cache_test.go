@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSealedFileRoundTrip(t *testing.T) {
+	testWorkspace(t, &fakeRunner{})
+	t.Setenv("GITPOD_INSTANCE_ID", "instance-1")
+	fn := filepath.Join(t.TempDir(), "sealed")
+	content := []byte(`{"provider":"aws"}`)
+
+	err := writeSealedFile(fn, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(fc, sealedMagic) || bytes.Contains(fc, content) {
+		t.Fatalf("the file isn't sealed: %q", fc)
+	}
+
+	forgetTestCacheKey()
+	got, err := readSealedFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("readSealedFile() = %q, want %q", got, content)
+	}
+}
+
+func TestReadSealedFileRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(t *testing.T, fn string)
+	}{
+		{name: "not sealed", write: func(t *testing.T, fn string) {
+			err := os.WriteFile(fn, []byte(`{"provider":"aws"}`), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "restored into another instance", write: func(t *testing.T, fn string) {
+			err := writeSealedFile(fn, []byte(`{"provider":"aws"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a new instance starts with an empty runtime directory, but the same IDs as the backup shows
+			t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+			forgetTestCacheKey()
+		}},
+		{name: "tampered with", write: func(t *testing.T, fn string) {
+			err := writeSealedFile(fn, []byte(`{"provider":"aws"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fc, _ := os.ReadFile(fn)
+			fc[len(fc)-1] ^= 1
+			err = os.WriteFile(fn, fc, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testWorkspace(t, &fakeRunner{})
+			t.Setenv("GITPOD_INSTANCE_ID", "instance-1")
+			t.Setenv("GITPOD_WORKSPACE_ID", "ws-test")
+			fn := filepath.Join(t.TempDir(), "sealed")
+			tt.write(t, fn)
+
+			_, err := readSealedFile(fn)
+			if !errors.Is(err, errForeignCache) {
+				t.Errorf("readSealedFile() error = %v, want errForeignCache", err)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheKeyIsSharedByProcesses(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "gitpod-idp", "cache-key")
+	keys := make([][]byte, 8)
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key, err := memoryCacheKey(fn)
+			if err != nil {
+				t.Error(err)
+			}
+			keys[i] = key
+		}(i)
+	}
+	wg.Wait()
+	for _, key := range keys[1:] {
+		if len(key) != 32 || !bytes.Equal(key, keys[0]) {
+			t.Fatalf("memoryCacheKey() returned different keys: %x", keys)
+		}
+	}
+	fi, err := os.Stat(filepath.Dir(fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Errorf("the key's directory has mode %v, want 0700", fi.Mode().Perm())
+	}
+}
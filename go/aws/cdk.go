@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "cdk",
+		Usage:   "cdk [--qualifier hnb659fds] [--account id] [--region region] [--base-profile default] [--export] [deploy|file-publishing|image-publishing|lookup...]",
+		Summary: "assume the CDK bootstrap roles with the signed-in AWS credentials, for cdk deploy and the Serverless Framework",
+		Run:     runCDK,
+	})
+}
+
+// The defaults of the bootstrap stack, which cdk bootstrap --qualifier and a customised template change.
+const (
+	defaultCDKQualifier   = "hnb659fds"
+	defaultCDKRolePattern = "cdk-{qualifier}-{role}-role-{account}-{region}"
+)
+
+var cdkRoles = []string{"deploy", "file-publishing", "image-publishing", "lookup"}
+
+// cdkProfilePrefix starts the names of the profiles the roles' credentials are written to, e.g. cdk-deploy.
+const cdkProfilePrefix = "cdk-"
+
+// runCDK assumes the roles of the CDK bootstrap stack from the web identity session and writes each to a profile of
+// its own. The CDK CLI assumes them itself, but only if the session may, and the Serverless Framework and
+// other tools deploying with a single set of credentials don't at all.
+func runCDK(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("cdk", flag.ExitOnError)
+	qualifier := flags.String("qualifier", cdkQualifier(), "qualifier of the bootstrap stack")
+	account := flags.String("account", "", "account the stack is bootstrapped in (default that of the base profile)")
+	region := flags.String("region", awsRegion(), "region the stack is bootstrapped in")
+	baseProfile := flags.String("base-profile", "default", "profile with the web identity session the roles are assumed with")
+	export := flags.Bool("export", false, "print the first role's credentials as exports for eval instead of only writing the profiles")
+	_ = flags.Parse(args)
+
+	roles := flags.Args()
+	if len(roles) == 0 {
+		roles = cdkRoles
+	}
+	if *region == "" {
+		return exitErrorf(exitMissingConfig, "the region of the bootstrap stack is not configured - set IDP_AWS_REGION or use --region")
+	}
+	base, err := profileCredentials(*baseProfile)
+	if err != nil {
+		return err
+	}
+	if *account == "" {
+		id, err := gitpodidp.GetCallerIdentity(ctx, base, *region)
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "the %s profile's credentials aren't valid - run idp login aws: %w", *baseProfile, err)
+		}
+		*account = id.Account
+	}
+
+	pattern := setting("IDP_CDK_ROLE_PATTERN")
+	if pattern == "" {
+		pattern = defaultCDKRolePattern
+	}
+	var first *gitpodidp.AWSCredentials
+	for _, role := range roles {
+		roleARN := "arn:aws:iam::" + *account + ":role/" + strings.NewReplacer("{qualifier}", *qualifier, "{role}", role, "{account}", *account, "{region}", *region).Replace(pattern)
+		err := confirmRole(ctx, roleARN)
+		if err != nil {
+			return err
+		}
+		var creds *gitpodidp.AWSCredentials
+		err = traceStep(ctx, "exchange token", func(ctx context.Context) error {
+			return withProgress("assuming "+roleARN, func() (err error) {
+				creds, err = gitpodidp.AssumeRole(ctx, base, gitpodidp.AssumeRoleInput{RoleARN: roleARN, Region: *region})
+				return err
+			})
+		}, "idp.method", "cdk", "idp.role", role)
+		if err != nil {
+			return exitErrorf(exitExchangeFailed, "cannot assume the %s role: %w - the base role needs sts:AssumeRole on it, and its trust policy trusts account %s by default", role, err, *account)
+		}
+		registerSecret(creds.SecretAccessKey)
+		registerSecret(creds.SessionToken)
+		emitEvent(eventExchangeSucceeded, "aws", "method", "cdk", "roleArn", roleARN)
+
+		profile := cdkProfilePrefix + role
+		err = gitpodidp.WriteAWSProfile(profile, creds)
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot write the %s profile: %w", profile, err)
+		}
+		err = writeAWSRegion(profile, *region)
+		if err != nil {
+			return err
+		}
+		emitEvent(eventProfileWritten, "aws", "profile", profile)
+		if first == nil {
+			first = creds
+		}
+		if !*export {
+			printSuccess("profile %s: %s, until %s", profile, creds.AssumedRoleARN, localTime(creds.Expiration).Format("15:04"))
+		}
+	}
+
+	if *export {
+		vars := map[string]string{
+			"AWS_ACCESS_KEY_ID":     first.AccessKeyID,
+			"AWS_SECRET_ACCESS_KEY": first.SecretAccessKey,
+			"AWS_SESSION_TOKEN":     first.SessionToken,
+			"AWS_REGION":            *region,
+			"CDK_DEFAULT_ACCOUNT":   *account,
+			"CDK_DEFAULT_REGION":    *region,
+		}
+		for _, k := range sortedKeys(vars) {
+			fmt.Printf("export %s=%s\n", k, shellQuote(vars[k]))
+		}
+		return nil
+	}
+	fmt.Printf("  AWS_PROFILE=%s%s npx serverless deploy\n", cdkProfilePrefix, roles[0])
+	fmt.Println("  The sessions last an hour at most, as STS limits role chains to that - run this again to renew them.")
+	return nil
+}
+
+// cdkQualifier returns the qualifier of the bootstrap stack: IDP_CDK_QUALIFIER, the one cdk.json sets, or CDK's
+// default.
+func cdkQualifier() string {
+	if q := setting("IDP_CDK_QUALIFIER"); q != "" {
+		return q
+	}
+	dirs := []string{"."}
+	if root, err := repoRoot(); err == nil {
+		dirs = append(dirs, root)
+	}
+	for _, dir := range dirs {
+		fc, err := os.ReadFile(filepath.Join(dir, "cdk.json"))
+		if err != nil {
+			continue
+		}
+		var cdkJSON struct {
+			Context map[string]any `json:"context"`
+		}
+		if json.Unmarshal(fc, &cdkJSON) == nil {
+			if q, ok := cdkJSON.Context["@aws-cdk/core:bootstrapQualifier"].(string); ok && q != "" {
+				return q
+			}
+		}
+	}
+	return defaultCDKQualifier
+}
+
+// awsRegion returns IDP_AWS_REGION, or the region the AWS tools are set up with.
+func awsRegion() string {
+	if r := setting("IDP_AWS_REGION"); r != "" {
+		return r
+	}
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		return r
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// celExpr is a parsed CEL expression of the subset workload identity providers use in attribute mappings and
+// conditions: literals, lists, member access on assertion, attribute and google, the logical, comparison and in
+// operators, +, ?:, has(), size(), and the string functions startsWith, endsWith, contains, matches, lowerAscii,
+// upperAscii and Google's extract.
+type celExpr struct {
+	src  string
+	root *celNode
+}
+
+type celNode struct {
+	kind   string // lit, ident, select, index, call, unary, binary, cond, list
+	op     string // the operator, the selected field or the called function
+	val    interface{}
+	args   []*celNode
+	target *celNode // of select, index and method calls
+	start  int
+	end    int
+}
+
+// celError is an evaluation error, like a missing claim, which makes the whole expression fail unless a logical
+// operator absorbs it.
+type celError struct{ msg string }
+
+func (e *celError) Error() string { return e.msg }
+
+func celErrorf(format string, args ...interface{}) error {
+	return &celError{fmt.Sprintf(format, args...)}
+}
+
+func parseCEL(src string) (*celExpr, error) {
+	toks, err := lexCEL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &celParser{src: src, toks: toks}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at %d in %s", t.text, t.pos+1, src)
+	}
+	return &celExpr{src: src, root: root}, nil
+}
+
+type celToken struct {
+	kind string // ident, string, number, op or eof
+	text string
+	val  interface{}
+	pos  int
+}
+
+func lexCEL(src string) ([]celToken, error) {
+	var toks []celToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			var b strings.Builder
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+					switch src[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(src[j])
+					}
+					continue
+				}
+				b.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d in %s", i+1, src)
+			}
+			toks = append(toks, celToken{kind: "string", text: src[i : j+1], val: b.String(), pos: i})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q in %s", src[i:j], src)
+			}
+			toks = append(toks, celToken{kind: "number", text: src[i:j], val: n, pos: i})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, celToken{kind: "ident", text: src[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "<=", ">=", "(", ")", "[", "]", ".", ",", "?", ":", "!", "<", ">", "+"} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d in %s", c, i+1, src)
+			}
+			toks = append(toks, celToken{kind: "op", text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, celToken{kind: "eof", pos: len(src)}), nil
+}
+
+type celParser struct {
+	src  string
+	toks []celToken
+	i    int
+}
+
+func (p *celParser) peek() celToken { return p.toks[p.i] }
+
+func (p *celParser) next() celToken {
+	t := p.toks[p.i]
+	if t.kind != "eof" {
+		p.i++
+	}
+	return t
+}
+
+// end is the position after the last token consumed.
+func (p *celParser) end() int {
+	t := p.toks[p.i-1]
+	return t.pos + len(t.text)
+}
+
+func (p *celParser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != "op" && !(t.kind == "ident" && t.text == "in") {
+		return false
+	}
+	for _, o := range ops {
+		if t.text == o {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *celParser) expect(op string) error {
+	if t := p.next(); t.kind != "op" || t.text != op {
+		return fmt.Errorf("expected %q at %d in %s", op, t.pos+1, p.src)
+	}
+	return nil
+}
+
+func (p *celParser) expr() (*celNode, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.isOp("?") {
+		return cond, err
+	}
+	p.next()
+	a, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &celNode{kind: "cond", args: []*celNode{cond, a, b}, start: cond.start, end: b.end}, nil
+}
+
+// celPrecedence lists the binary operators from the loosest to the tightest binding.
+var celPrecedence = [][]string{{"||"}, {"&&"}, {"==", "!=", "<", "<=", ">", ">=", "in"}, {"+"}}
+
+func (p *celParser) binary(level int) (*celNode, error) {
+	if level == len(celPrecedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(celPrecedence[level]...) {
+		op := p.next().text
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &celNode{kind: "binary", op: op, args: []*celNode{left, right}, start: left.start, end: right.end}
+	}
+	return left, nil
+}
+
+func (p *celParser) unary() (*celNode, error) {
+	if p.isOp("!") {
+		start := p.next().pos
+		arg, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &celNode{kind: "unary", op: "!", args: []*celNode{arg}, start: start, end: arg.end}, nil
+	}
+	n, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp("."):
+			p.next()
+			t := p.next()
+			if t.kind != "ident" {
+				return nil, fmt.Errorf("expected a field or function name at %d in %s", t.pos+1, p.src)
+			}
+			if p.isOp("(") {
+				args, err := p.list(")")
+				if err != nil {
+					return nil, err
+				}
+				n = &celNode{kind: "call", op: t.text, target: n, args: args, start: n.start, end: p.end()}
+			} else {
+				n = &celNode{kind: "select", op: t.text, target: n, start: n.start, end: p.end()}
+			}
+		case p.isOp("["):
+			p.next()
+			idx, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &celNode{kind: "index", target: n, args: []*celNode{idx}, start: n.start, end: p.end()}
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (p *celParser) primary() (*celNode, error) {
+	t := p.next()
+	switch {
+	case t.kind == "string" || t.kind == "number":
+		return &celNode{kind: "lit", val: t.val, start: t.pos, end: p.end()}, nil
+	case t.kind == "ident" && (t.text == "true" || t.text == "false"):
+		return &celNode{kind: "lit", val: t.text == "true", start: t.pos, end: p.end()}, nil
+	case t.kind == "ident" && t.text == "null":
+		return &celNode{kind: "lit", start: t.pos, end: p.end()}, nil
+	case t.kind == "ident":
+		if p.isOp("(") {
+			args, err := p.list(")")
+			if err != nil {
+				return nil, err
+			}
+			return &celNode{kind: "call", op: t.text, args: args, start: t.pos, end: p.end()}, nil
+		}
+		return &celNode{kind: "ident", op: t.text, start: t.pos, end: p.end()}, nil
+	case t.kind == "op" && t.text == "(":
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		n.start, n.end = t.pos, p.end()
+		return n, nil
+	case t.kind == "op" && t.text == "[":
+		p.i--
+		elems, err := p.list("]")
+		if err != nil {
+			return nil, err
+		}
+		return &celNode{kind: "list", args: elems, start: t.pos, end: p.end()}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q at %d in %s", t.text, t.pos+1, p.src)
+}
+
+// list parses the comma-separated expressions between an opening bracket and closing.
+func (p *celParser) list(closing string) ([]*celNode, error) {
+	p.next()
+	var res []*celNode
+	for !p.isOp(closing) {
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	return res, p.expect(closing)
+}
+
+// eval evaluates the expression with the variables vars, e.g. assertion for the claims of the token.
+func (e *celExpr) eval(vars map[string]interface{}) (interface{}, error) {
+	return e.root.eval(vars)
+}
+
+func (n *celNode) eval(vars map[string]interface{}) (interface{}, error) {
+	switch n.kind {
+	case "lit":
+		return n.val, nil
+	case "ident":
+		v, ok := vars[n.op]
+		if !ok {
+			return nil, celErrorf("undeclared reference to %s", n.op)
+		}
+		return v, nil
+	case "list":
+		res := make([]interface{}, 0, len(n.args))
+		for _, a := range n.args {
+			v, err := a.eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+		}
+		return res, nil
+	case "select", "index":
+		target, err := n.target.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		key := interface{}(n.op)
+		if n.kind == "index" {
+			key, err = n.args[0].eval(vars)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return celIndex(target, key)
+	case "unary":
+		v, err := n.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return nil, celErrorf("! needs a bool, not %s", celTypeName(v))
+		}
+		return !b, nil
+	case "cond":
+		c, err := n.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := c.(bool)
+		if !ok {
+			return nil, celErrorf("?: needs a bool condition, not %s", celTypeName(c))
+		}
+		if b {
+			return n.args[1].eval(vars)
+		}
+		return n.args[2].eval(vars)
+	case "binary":
+		return n.evalBinary(vars)
+	case "call":
+		return n.evalCall(vars)
+	}
+	return nil, celErrorf("cannot evaluate %s", n.kind)
+}
+
+func (n *celNode) evalBinary(vars map[string]interface{}) (interface{}, error) {
+	a, errA := n.args[0].eval(vars)
+	b, errB := n.args[1].eval(vars)
+	if n.op == "&&" || n.op == "||" {
+		// like CEL, false && error is false and true || error is true, whichever side fails
+		short := n.op == "||"
+		for _, v := range []interface{}{a, b} {
+			if v == short {
+				return short, nil
+			}
+		}
+		if errA != nil {
+			return nil, errA
+		}
+		if errB != nil {
+			return nil, errB
+		}
+		if _, ok := a.(bool); !ok {
+			return nil, celErrorf("%s needs bools, not %s", n.op, celTypeName(a))
+		}
+		if _, ok := b.(bool); !ok {
+			return nil, celErrorf("%s needs bools, not %s", n.op, celTypeName(b))
+		}
+		return !short, nil
+	}
+	if errA != nil {
+		return nil, errA
+	}
+	if errB != nil {
+		return nil, errB
+	}
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(a, b), nil
+	case "!=":
+		return !reflect.DeepEqual(a, b), nil
+	case "in":
+		switch c := b.(type) {
+		case []interface{}:
+			for _, e := range c {
+				if reflect.DeepEqual(a, e) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			k, ok := a.(string)
+			_, found := c[k]
+			return ok && found, nil
+		}
+		return nil, celErrorf("in needs a list or map, not %s", celTypeName(b))
+	case "+":
+		switch x := a.(type) {
+		case string:
+			if y, ok := b.(string); ok {
+				return x + y, nil
+			}
+		case float64:
+			if y, ok := b.(float64); ok {
+				return x + y, nil
+			}
+		case []interface{}:
+			if y, ok := b.([]interface{}); ok {
+				return append(append([]interface{}{}, x...), y...), nil
+			}
+		}
+		return nil, celErrorf("cannot add %s and %s", celTypeName(a), celTypeName(b))
+	}
+	// <, <=, > and >= on numbers or strings
+	var cmp int
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return nil, celErrorf("cannot compare %s with %s", celTypeName(a), celTypeName(b))
+		}
+		cmp = map[bool]int{true: -1, false: 1}[x < y]
+		if x == y {
+			cmp = 0
+		}
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return nil, celErrorf("cannot compare %s with %s", celTypeName(a), celTypeName(b))
+		}
+		cmp = strings.Compare(x, y)
+	default:
+		return nil, celErrorf("cannot compare %s", celTypeName(a))
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+func (n *celNode) evalCall(vars map[string]interface{}) (interface{}, error) {
+	if n.target == nil && n.op == "has" {
+		// has(x.f) tests for the field rather than evaluating it
+		if len(n.args) != 1 || n.args[0].kind != "select" {
+			return nil, celErrorf("has() needs a field, e.g. has(assertion.groups)")
+		}
+		target, err := n.args[0].target.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := target.(map[string]interface{})
+		if !ok {
+			return nil, celErrorf("has() needs a field of a map, not of %s", celTypeName(target))
+		}
+		_, found := m[n.args[0].op]
+		return found, nil
+	}
+	var args []interface{}
+	if n.target != nil {
+		v, err := n.target.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	for _, a := range n.args {
+		v, err := a.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	if n.op == "size" && len(args) == 1 {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len([]rune(v))), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, celErrorf("size() needs a string, list or map, not %s", celTypeName(args[0]))
+	}
+	if n.op == "string" && len(args) == 1 {
+		return celString(args[0]), nil
+	}
+	strs := make([]string, len(args))
+	for i, a := range args {
+		s, ok := a.(string)
+		if !ok {
+			return nil, celErrorf("%s() needs strings, not %s", n.op, celTypeName(a))
+		}
+		strs[i] = s
+	}
+	switch {
+	case n.op == "startsWith" && len(strs) == 2:
+		return strings.HasPrefix(strs[0], strs[1]), nil
+	case n.op == "endsWith" && len(strs) == 2:
+		return strings.HasSuffix(strs[0], strs[1]), nil
+	case n.op == "contains" && len(strs) == 2:
+		return strings.Contains(strs[0], strs[1]), nil
+	case n.op == "matches" && len(strs) == 2:
+		re, err := regexp.Compile(strs[1])
+		if err != nil {
+			return nil, celErrorf("invalid regular expression %q: %v", strs[1], err)
+		}
+		return re.MatchString(strs[0]), nil
+	case n.op == "lowerAscii" && len(strs) == 1:
+		return strings.ToLower(strs[0]), nil
+	case n.op == "upperAscii" && len(strs) == 1:
+		return strings.ToUpper(strs[0]), nil
+	case n.op == "extract" && len(strs) == 2:
+		return celExtract(strs[0], strs[1]), nil
+	}
+	return nil, celErrorf("unsupported function %s() with %d arguments", n.op, len(args))
+}
+
+// celExtract is Google's extract: it returns the part of s which takes the place of {name} in template, e.g.
+// "repo:{repo}:ref" on "repo:acme/app:ref:main" yields "acme/app", or "" if s doesn't contain the template.
+func celExtract(s, template string) string {
+	open, close := strings.IndexByte(template, '{'), strings.IndexByte(template, '}')
+	if open < 0 || close < open {
+		return ""
+	}
+	prefix, suffix := template[:open], template[close+1:]
+	i := strings.Index(s, prefix)
+	if i < 0 {
+		return ""
+	}
+	rest := s[i+len(prefix):]
+	if suffix == "" {
+		return rest
+	}
+	j := strings.Index(rest, suffix)
+	if j < 0 {
+		return ""
+	}
+	return rest[:j]
+}
+
+func celIndex(target, key interface{}) (interface{}, error) {
+	switch t := target.(type) {
+	case map[string]interface{}:
+		k, ok := key.(string)
+		if !ok {
+			return nil, celErrorf("map keys are strings, not %s", celTypeName(key))
+		}
+		v, found := t[k]
+		if !found {
+			return nil, celErrorf("no such key: %s", k)
+		}
+		return v, nil
+	case []interface{}:
+		i, ok := key.(float64)
+		if !ok || i < 0 || int(i) >= len(t) {
+			return nil, celErrorf("index %v out of range", key)
+		}
+		return t[int(i)], nil
+	}
+	return nil, celErrorf("cannot select %v from %s", key, celTypeName(target))
+}
+
+func celTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func celString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// conjuncts returns the terms of the top-level && of the expression, or the expression itself.
+func (e *celExpr) conjuncts() []*celNode {
+	var res []*celNode
+	var walk func(n *celNode)
+	walk = func(n *celNode) {
+		if n.kind == "binary" && n.op == "&&" {
+			walk(n.args[0])
+			walk(n.args[1])
+			return
+		}
+		res = append(res, n)
+	}
+	walk(e.root)
+	return res
+}
+
+// references returns the source of the assertion, attribute and google fields n refers to, e.g. assertion.sub.
+func (e *celExpr) references(n *celNode) []string {
+	var res []string
+	var walk func(n *celNode)
+	walk = func(n *celNode) {
+		if n == nil {
+			return
+		}
+		if n.kind == "select" && n.target.kind == "ident" {
+			if src := e.src[n.start:n.end]; !slices.Contains(res, src) {
+				res = append(res, src)
+			}
+			return
+		}
+		walk(n.target)
+		for _, a := range n.args {
+			walk(a)
+		}
+	}
+	walk(n)
+	return res
+}
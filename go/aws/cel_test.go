@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCEL(t *testing.T) {
+	vars := map[string]interface{}{
+		"assertion": map[string]interface{}{
+			"sub":    "gitpod:org:acme:project:app:workspace:ws-1",
+			"email":  "Dev@Example.com",
+			"groups": []interface{}{"devs", "ops"},
+			"org":    map[string]interface{}{"id": "acme"},
+			"age":    float64(42),
+		},
+	}
+	tests := []struct {
+		expr    string
+		want    interface{}
+		wantErr bool
+	}{
+		{expr: `assertion.sub`, want: "gitpod:org:acme:project:app:workspace:ws-1"},
+		{expr: `assertion["org"].id`, want: "acme"},
+		{expr: `assertion.groups[1]`, want: "ops"},
+		{expr: `"devs" in assertion.groups`, want: true},
+		{expr: `"admins" in assertion.groups`, want: false},
+		{expr: `"org" in assertion`, want: true},
+		{expr: `assertion.sub.startsWith("gitpod:org:acme:") && assertion.email.endsWith("@Example.com")`, want: true},
+		{expr: `assertion.email.lowerAscii() == "dev@example.com"`, want: true},
+		{expr: `assertion.email.upperAscii()`, want: "DEV@EXAMPLE.COM"},
+		{expr: `assertion.sub.contains(":project:app:")`, want: true},
+		{expr: `assertion.sub.matches("^gitpod:org:[a-z]+:")`, want: true},
+		{expr: `assertion.sub.extract("project:{project}:")`, want: "app"},
+		{expr: `assertion.sub.extract("repo:{repo}:")`, want: ""},
+		{expr: `has(assertion.groups)`, want: true},
+		{expr: `has(assertion.repo)`, want: false},
+		{expr: `size(assertion.groups)`, want: float64(2)},
+		{expr: `size("héllo")`, want: float64(5)},
+		{expr: `"org:" + assertion.org.id`, want: "org:acme"},
+		{expr: `[1, 2] + [3]`, want: []interface{}{float64(1), float64(2), float64(3)}},
+		{expr: `assertion.age >= 18 ? "adult" : "minor"`, want: "adult"},
+		{expr: `assertion.age < 18`, want: false},
+		{expr: `"a" < "b"`, want: true},
+		{expr: `string(assertion.age)`, want: "42"},
+		{expr: `!(assertion.org.id != "acme")`, want: true},
+		{expr: `1 + 2 == 3 || false`, want: true},
+
+		// errors are absorbed by && and || where the other side decides, like in CEL
+		{expr: `false && assertion.repo == "app"`, want: false},
+		{expr: `assertion.repo == "app" || true`, want: true},
+		{expr: `true && assertion.repo == "app"`, wantErr: true},
+		{expr: `assertion.repo`, wantErr: true},
+		{expr: `attribute.sub`, wantErr: true},
+		{expr: `assertion.groups[2]`, wantErr: true},
+		{expr: `!assertion.sub`, wantErr: true},
+		{expr: `assertion.age + "years"`, wantErr: true},
+		{expr: `assertion.age < "b"`, wantErr: true},
+		{expr: `assertion.sub.matches("[")`, wantErr: true},
+		{expr: `assertion.sub.reverse()`, wantErr: true},
+		{expr: `has(assertion)`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, err := parseCEL(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCEL() error = %v", err)
+			}
+			got, err := expr.eval(vars)
+			if tt.wantErr {
+				var ce *celError
+				if !errors.As(err, &ce) {
+					t.Fatalf("eval() = %v, %v, want a celError", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("eval() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("eval() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCELRejects(t *testing.T) {
+	for _, src := range []string{
+		`assertion.sub ==`,
+		`assertion.sub == "unterminated`,
+		`(assertion.sub`,
+		`assertion.sub "extra"`,
+		`[1, 2`,
+		``,
+	} {
+		if _, err := parseCEL(src); err == nil {
+			t.Errorf("parseCEL(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestCELConjunctsAndReferences(t *testing.T) {
+	expr, err := parseCEL(`assertion.org == "acme" && (assertion.sub.startsWith("x") || "devs" in assertion.groups) && google.subject != ""`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terms := expr.conjuncts()
+	if len(terms) != 3 {
+		t.Fatalf("conjuncts() returned %d terms, want 3", len(terms))
+	}
+	want := [][]string{{"assertion.org"}, {"assertion.sub", "assertion.groups"}, {"google.subject"}}
+	for i, term := range terms {
+		if got := expr.references(term); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("references(term %d) = %q, want %q", i+1, got, want[i])
+		}
+	}
+}
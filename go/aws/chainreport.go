@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The results of the methods of the AWS sign-in chain.
+const (
+	attemptSucceeded = "succeeded"
+	attemptFailed    = "failed"
+	attemptSkipped   = "skipped"
+	attemptNotTried  = "not tried"
+	attemptLost      = "lost the race"
+)
+
+// signinAttempt is what became of one method of the sign-in chain.
+type signinAttempt struct {
+	Method string `json:"method"`
+	Result string `json:"result"`
+	// Reason explains why the method failed, was skipped or not tried.
+	Reason     string `json:"reason,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+}
+
+// chainReport collects the attempts of a run of the sign-in chain. The methods of a race report concurrently.
+type chainReport struct {
+	mu       sync.Mutex
+	Attempts []signinAttempt `json:"attempts"`
+}
+
+type chainReportKey struct{}
+
+// lastChainReport is the report of the last run of the sign-in chain, which login prints.
+var lastChainReport struct {
+	sync.Mutex
+	report *chainReport
+}
+
+func (r *chainReport) add(method, result, reason string, elapsed time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Attempts = append(r.Attempts, signinAttempt{Method: method, Result: result, Reason: reason, DurationMs: elapsed.Milliseconds()})
+}
+
+// result adds the outcome of a method which ran.
+func (r *chainReport) result(method string, err error, elapsed time.Duration) {
+	switch {
+	case err == nil:
+		r.add(method, attemptSucceeded, "", elapsed)
+	case err == errSigninRaceLost:
+		r.add(method, attemptLost, "another method signed in first", elapsed)
+	default:
+		r.add(method, attemptFailed, redactText(err.Error()), elapsed)
+	}
+}
+
+// publish makes r the last report, with the attempts in the order of the chain.
+func (r *chainReport) publish() {
+	order := make(map[string]int)
+	if chain, err := signinChain(); err == nil {
+		for i, step := range chain {
+			order[step.Method.Name()] = i
+		}
+	}
+	r.mu.Lock()
+	sort.SliceStable(r.Attempts, func(i, j int) bool { return order[r.Attempts[i].Method] < order[r.Attempts[j].Method] })
+	r.mu.Unlock()
+
+	lastChainReport.Lock()
+	lastChainReport.report = r
+	lastChainReport.Unlock()
+}
+
+// printChainReport prints the last report of the sign-in chain, if there is one: as JSON on stdout with asJSON,
+// and as a table on stderr otherwise, so that it doesn't get in the way of -porcelain events.
+func printChainReport(asJSON bool) error {
+	lastChainReport.Lock()
+	r := lastChainReport.report
+	lastChainReport.Unlock()
+	if r == nil {
+		return nil
+	}
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+	writeChainReport(os.Stderr, r)
+	return nil
+}
+
+func writeChainReport(w io.Writer, r *chainReport) {
+	fmt.Fprintln(w, "AWS sign-in methods:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, a := range r.Attempts {
+		elapsed := "-"
+		if a.Result == attemptSucceeded || a.Result == attemptFailed || a.Result == attemptLost {
+			elapsed = (time.Duration(a.DurationMs) * time.Millisecond).String()
+		}
+		// errors of gp and the like span lines; the first one tells what it is about
+		reason, _, _ := strings.Cut(a.Reason, "\n")
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", a.Method, a.Result, elapsed, reason)
+	}
+	tw.Flush()
+}
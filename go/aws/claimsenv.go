@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// claimEnvPrefix starts the names of the variables token claims are exported as, e.g. GITPOD_IDP_SUB.
+const claimEnvPrefix = "GITPOD_IDP_"
+
+// exportedClaims returns the claims IDP_EXPORT_CLAIMS lists, e.g. sub,email.
+func exportedClaims() []string {
+	var res []string
+	for _, c := range strings.Split(setting("IDP_EXPORT_CLAIMS"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+var nonEnvNameChars = regexp.MustCompile(`[^A-Z0-9_]+`)
+
+// claimEnvName returns the variable claim is exported as: upper case, with anything but letters and digits
+// replaced by underscores, e.g. repository_owner and repository-owner both become GITPOD_IDP_REPOSITORY_OWNER.
+func claimEnvName(claim string) string {
+	return claimEnvPrefix + nonEnvNameChars.ReplaceAllString(strings.ToUpper(claim), "_")
+}
+
+func claimsPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "claims.json"), nil
+}
+
+// recordTokenClaims stores the exported claims of a freshly minted token, so that env and everything built on it
+// can export them without minting a token of its own. Claims the token lacks are left out.
+func recordTokenClaims(token string) {
+	names := exportedClaims()
+	if len(names) == 0 && (cfg == nil || len(cfg.Templates) == 0) {
+		return
+	}
+	claims, err := gitpodidp.Claims(token)
+	if err != nil {
+		return
+	}
+	recordTemplateClaims(claims)
+	if len(names) == 0 {
+		return
+	}
+	env := make(map[string]string)
+	for _, name := range names {
+		switch v := claims[name].(type) {
+		case nil:
+		case float64:
+			// times like exp, which fmt would print in exponent notation
+			env[claimEnvName(name)] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			env[claimEnvName(name)] = strings.Join(claimValues(v), ",")
+		}
+	}
+	fn, err := claimsPath()
+	if err == nil {
+		var fc []byte
+		fc, err = json.Marshal(env)
+		if err == nil {
+			// emails and the like are personal data, so they are sealed like the credentials
+			err = writeSealedFile(fn, fc)
+		}
+	}
+	if err != nil {
+		slog.Warn("cannot record the token claims to export", "error", err)
+	}
+}
+
+// claimEnv returns the variables of the claims recorded at the last login which IDP_EXPORT_CLAIMS still lists.
+func claimEnv() (map[string]string, error) {
+	names := exportedClaims()
+	if len(names) == 0 {
+		return nil, nil
+	}
+	fn, err := claimsPath()
+	if err != nil {
+		return nil, err
+	}
+	fc, err := readSealedFile(fn)
+	if os.IsNotExist(err) || errors.Is(err, errForeignCache) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recorded map[string]string
+	err = json.Unmarshal(fc, &recorded)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for _, name := range names {
+		k := claimEnvName(name)
+		if v, ok := recorded[k]; ok {
+			res[k] = v
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// maxClockSkew is how far the local clock may deviate from the issuer's before token validation is likely to fail.
+const maxClockSkew = time.Minute
+
+// clockSkewTolerance is the skew below which expiries are taken as they are. Both the Date header and the iat
+// claim only have a resolution of a second, and requests take a while, so smaller measurements are noise.
+const clockSkewTolerance = 5 * time.Second
+
+// clockSkew is how far the clocks of the servers this process talks to are ahead of the local one, as last
+// measured. It's negative if the local clock is ahead.
+var clockSkew atomic.Int64
+
+// clockSkewWarned makes sure the user hears about a skewed clock once per run, not for every request.
+var clockSkewWarned atomic.Bool
+
+// observeServerTime records the skew between the local clock and now, as reported by source, and warns if it's
+// large enough for tokens to be rejected or credentials to be taken as expired.
+func observeServerTime(source string, now time.Time) {
+	skew := time.Until(now)
+	clockSkew.Store(int64(skew))
+	slog.Debug("measured clock skew", "source", source, "skew", skew.Round(time.Second))
+
+	if skew.Abs() <= maxClockSkew || !clockSkewWarned.CompareAndSwap(false, true) {
+		return
+	}
+	direction := "behind"
+	if skew < 0 {
+		direction = "ahead of"
+	}
+	printWarning("the local clock is %s %s %s - expiry times are adjusted, but synchronise the system clock: other tools may reject credentials as expired or not yet valid", skew.Abs().Round(time.Second), direction, source)
+}
+
+// observeTokenClock measures the clock skew through the iat claim of a freshly minted token.
+func observeTokenClock(token string) {
+	if *replayFlag != "" {
+		// replayed tokens were minted when the bundle was recorded
+		return
+	}
+	claims, err := gitpodidp.Claims(token)
+	if err != nil {
+		return
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return
+	}
+	source := "the token issuer"
+	if iss, ok := claims["iss"].(string); ok && iss != "" {
+		source = iss
+	}
+	observeServerTime(source, time.Unix(int64(iat), 0))
+}
+
+// localTime converts t, as reported by a server, to the local clock, so that comparing it with time.Now tells
+// reliably whether it has passed. Times from the local clock, and the zero time, must not be passed.
+func localTime(t time.Time) time.Time {
+	skew := time.Duration(clockSkew.Load())
+	if t.IsZero() || skew.Abs() <= clockSkewTolerance {
+		return t
+	}
+	return t.Add(-skew)
+}
+
+// clockObservingClient measures the clock skew through the Date header of the responses of remote servers.
+type clockObservingClient struct {
+	next gitpodidp.HTTPDoer
+}
+
+func (c *clockObservingClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.Do(req)
+	if err != nil || isLocalHost(req.URL.Hostname()) {
+		// the supervisor and other local services share the local clock
+		return resp, err
+	}
+	if date, derr := http.ParseTime(resp.Header.Get("Date")); derr == nil {
+		observeServerTime(req.URL.Hostname(), date)
+	}
+	return resp, err
+}
+
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// command is a subcommand of the CLI.
+type command struct {
+	Name    string
+	Usage   string
+	Summary string
+	Run     func(ctx context.Context, args []string) error
+}
+
+var commands []*command
+
+// helperCommands are the commands the binary runs when it's run by the name of a credential helper, as installed
+// by docker configure, bazel configure and install, so that a copy of the binary is the helper.
+var helperCommands = map[string][]string{
+	dockerHelperName:    {"docker"},
+	bazelHelperName:     {"bazel"},
+	gitHelperName:       {"git-credential"},
+	kubectlPluginName:   {"kubectl"},
+	earthlyProviderName: {"secrets", "get"},
+}
+
+func registerCommand(cmd *command) {
+	commands = append(commands, cmd)
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command] [args]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-32s %s\n", c.Usage, c.Summary)
+	}
+	fmt.Fprintf(out, "\nWithout a command, login aws is run.\n\nFlags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, `
+Exit codes:
+  %d  success
+  %d  failure without a more specific cause
+  %d  invalid usage
+  %d  not running in a Gitpod workspace
+  %d  missing configuration
+  %d  cannot mint an identity token
+  %d  the provider rejected the token exchange
+  %d  cannot persist the credentials
+`, exitOK, exitFailure, exitUsage, exitNotInGitpod, exitMissingConfig, exitTokenMintFailed, exitExchangeFailed, exitPersistFailed)
+}
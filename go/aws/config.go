@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// configFileName is the name of the repository-level configuration file in the repository root.
+const configFileName = ".gitpod-idp.json"
+
+// config is the repository-level configuration. Every value can be overridden by the environment variable it
+// corresponds to, e.g. aws.roleArns by IDP_AWS_ROLE_ARN.
+type config struct {
+	AWS   *awsConfig   `json:"aws,omitempty"`
+	GCP   *gcpConfig   `json:"gcp,omitempty"`
+	Azure *azureConfig `json:"azure,omitempty"`
+	Vault *vaultConfig `json:"vault,omitempty"`
+	Kafka *kafkaConfig `json:"kafka,omitempty"`
+
+	Dotenv   *dotenvConfig   `json:"dotenv,omitempty"`
+	Rclone   *rcloneConfig   `json:"rclone,omitempty"`
+	Policy   *policyConfig   `json:"policy,omitempty"`
+	Approval *approvalConfig `json:"approval,omitempty"`
+	Network  *networkConfig  `json:"network,omitempty"`
+	Hooks    *hooksConfig    `json:"hooks,omitempty"`
+	Errors   *errorsConfig   `json:"errorReporting,omitempty"`
+	Timeouts timeoutsConfig  `json:"timeouts,omitempty"`
+	Tags     tagsConfig      `json:"tags,omitempty"`
+
+	// Environments bundle settings which login --env selects together.
+	Environments environmentsConfig `json:"environments,omitempty"`
+
+	// ExportClaims lists the token claims env and the like export as GITPOD_IDP_* variables, e.g. sub.
+	ExportClaims []string `json:"exportClaims,omitempty"`
+
+	// Databases are signed into with IAM authentication tokens, which db sidecar keeps fresh.
+	Databases map[string]databaseConfig `json:"databases,omitempty"`
+
+	// Templates are files rendered with the credentials after each login and refresh.
+	Templates []templateSinkConfig `json:"templates,omitempty"`
+
+	// fromRepository is set for the repository's config file, as opposed to the user's.
+	fromRepository bool
+	// user is the user's config file while the repository's is in use, for the userOnlySettings.
+	user *config
+}
+
+// userOnlySettings are the settings the repository's config file may not set, as whoever can push a branch could
+// otherwise send the tokens to a server of theirs, have the tool trust a CA of theirs, or sign in from the
+// workspaces of their forks. They come from the environment, the project's settings and the user's config file only.
+var userOnlySettings = map[string]bool{
+	"IDP_CA_BUNDLE":                    true,
+	"IDP_TRUSTED_REPOSITORIES":         true,
+	"IDP_UNTRUSTED_CONTEXT_POLICY":     true,
+	"IDP_GITPOD_API_URL":               true,
+	"IDP_AWS_STS_ENDPOINT":             true,
+	"IDP_GCP_STS_ENDPOINT":             true,
+	"IDP_GCP_IAM_CREDENTIALS_ENDPOINT": true,
+	"IDP_AZURE_AUTHORITY_HOST":         true,
+}
+
+// networkConfig adapts the tool to restricted networks.
+type networkConfig struct {
+	// CABundle is a PEM file of certificates to trust in addition to the system roots, e.g. those of a
+	// TLS-intercepting proxy.
+	CABundle string `json:"caBundle,omitempty"`
+	// Endpoints replace the public endpoints of Gitpod and the cloud providers, e.g. with internal gateways.
+	Endpoints *endpointsConfig `json:"endpoints,omitempty"`
+}
+
+// errorsConfig says where failed and crashed commands are reported, for platform teams to spot failures across
+// their workspaces.
+type errorsConfig struct {
+	// Endpoint receives each report as JSON in a POST request.
+	Endpoint string `json:"endpoint,omitempty"`
+	// SentryDSN sends the reports to a Sentry project instead.
+	SentryDSN string `json:"sentryDsn,omitempty"`
+}
+
+type endpointsConfig struct {
+	GitpodAPI            string `json:"gitpodApi,omitempty"`
+	AWSSTS               string `json:"awsSts,omitempty"`
+	GoogleSTS            string `json:"googleSts,omitempty"`
+	GoogleIAMCredentials string `json:"googleIamCredentials,omitempty"`
+	EntraID              string `json:"entraId,omitempty"`
+}
+
+type awsConfig struct {
+	RoleARNs []string `json:"roleArns,omitempty"`
+	// SigninOrder lists the sign-in methods to try, each optionally followed by a condition, e.g. "sso:!gitpod".
+	SigninOrder []string `json:"signinOrder,omitempty"`
+	// SigninRace tries the applicable sign-in methods concurrently instead of one after the other.
+	SigninRace bool `json:"signinRace,omitempty"`
+	// Profiles are signed into instead of RoleARNs, each written to the AWS profile of its name.
+	Profiles map[string]awsProfile `json:"profiles,omitempty"`
+	// Audience replaces sts.amazonaws.com as the audience of the identity tokens.
+	Audience string `json:"audience,omitempty"`
+}
+
+// policyConfig restricts which AWS roles may be assumed, and when. Patterns are role ARNs in which * matches
+// anything, e.g. arn:aws:iam::*:role/dev-*.
+type policyConfig struct {
+	// AllowedRoles lists the only roles which may be assumed. All roles are allowed if it is empty.
+	AllowedRoles []string `json:"allowedRoles,omitempty"`
+	// PrivilegedRoles are only assumed after confirming it interactively, or with -confirm-privileged.
+	PrivilegedRoles []string `json:"privilegedRoles,omitempty"`
+	// ApprovalRoles are only assumed once an approver agreed to it, as asked for through the approval webhook.
+	ApprovalRoles []string `json:"approvalRoles,omitempty"`
+	// SharedWorkspace is what logins do while the workspace is shared: refuse, downgrade or allow.
+	SharedWorkspace string `json:"sharedWorkspace,omitempty"`
+	// TrustedRepositories are the only repositories, as owner/name patterns, whose workspaces are signed in from.
+	// Without them, workspaces of forks and of pull requests from them are untrusted.
+	TrustedRepositories []string `json:"trustedRepositories,omitempty"`
+	// UntrustedContext is what logins do in workspaces of untrusted repositories: skip, downgrade or allow.
+	UntrustedContext string `json:"untrustedContext,omitempty"`
+	// ReadOnlyRole is the AWS role a downgraded login assumes.
+	ReadOnlyRole string `json:"readOnlyRole,omitempty"`
+}
+
+type gcpConfig struct {
+	WorkloadIdentityProvider string `json:"workloadIdentityProvider,omitempty"`
+	ServiceAccount           string `json:"serviceAccount,omitempty"`
+	Project                  string `json:"project,omitempty"`
+	// Audience replaces the default audience, the provider's resource URL, for providers with allowed audiences.
+	Audience string `json:"audience,omitempty"`
+}
+
+type azureConfig struct {
+	ClientID       string `json:"clientId,omitempty"`
+	TenantID       string `json:"tenantId,omitempty"`
+	SubscriptionID string `json:"subscriptionId,omitempty"`
+	// Audience replaces the audience federated credentials default to in the cloud of the authority host.
+	Audience string `json:"audience,omitempty"`
+}
+
+type vaultConfig struct {
+	Address   string `json:"address,omitempty"`
+	Role      string `json:"role,omitempty"`
+	AuthPath  string `json:"authPath,omitempty"`
+	Audience  string `json:"audience,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// approvalConfig is where logins ask for approval to assume the policy's approval roles.
+type approvalConfig struct {
+	// Webhook receives the approval requests.
+	Webhook string `json:"webhook,omitempty"`
+	// Format is that of the requests: json for approval services (the default), or slack or teams for the
+	// incoming webhooks of a channel the approvers are in.
+	Format string `json:"format,omitempty"`
+	// StatusURL is polled for the decision, with {id} replaced by the request's. An approval service may answer the
+	// request with a statusUrl instead.
+	StatusURL string `json:"statusUrl,omitempty"`
+	// Audience is that of the identity token approval requests are authenticated with, by default the origin of the
+	// URL it's sent to.
+	Audience string `json:"audience,omitempty"`
+	// Timeout is how long logins wait for a decision.
+	Timeout jsonDuration `json:"timeout,omitempty"`
+}
+
+// kafkaConfig is the cluster kafka configure writes client configs for.
+type kafkaConfig struct {
+	// Kind is msk or confluent.
+	Kind             string `json:"kind,omitempty"`
+	BootstrapServers string `json:"bootstrapServers,omitempty"`
+	AWSProfile       string `json:"awsProfile,omitempty"`
+	// Audience, Cluster and IdentityPool are those of a Confluent Cloud identity pool.
+	Audience     string `json:"audience,omitempty"`
+	Cluster      string `json:"cluster,omitempty"`
+	IdentityPool string `json:"identityPool,omitempty"`
+	TokenAddr    string `json:"tokenAddr,omitempty"`
+}
+
+// settings returns the configured values keyed by the environment variable that overrides them.
+func (c *config) settings() map[string]string {
+	res := make(map[string]string)
+	if c == nil {
+		return res
+	}
+	if c.AWS != nil {
+		res["IDP_AWS_ROLE_ARN"] = strings.Join(c.AWS.RoleARNs, ",")
+		res["IDP_SIGNIN_ORDER"] = strings.Join(c.AWS.SigninOrder, ",")
+		if c.AWS.SigninRace {
+			res["IDP_SIGNIN_RACE"] = "true"
+		}
+		if len(c.AWS.Profiles) > 0 {
+			fc, _ := json.Marshal(c.AWS.Profiles)
+			res["IDP_AWS_PROFILES"] = string(fc)
+		}
+		res["IDP_AWS_AUDIENCE"] = c.AWS.Audience
+	}
+	if c.GCP != nil {
+		res["IDP_GCP_WORKLOAD_IDENTITY_PROVIDER"] = c.GCP.WorkloadIdentityProvider
+		res["IDP_GCP_SERVICE_ACCOUNT"] = c.GCP.ServiceAccount
+		res["IDP_GCP_PROJECT"] = c.GCP.Project
+		res["IDP_GCP_AUDIENCE"] = c.GCP.Audience
+	}
+	if c.Azure != nil {
+		res["IDP_AZURE_CLIENT_ID"] = c.Azure.ClientID
+		res["IDP_AZURE_TENANT_ID"] = c.Azure.TenantID
+		res["IDP_AZURE_SUBSCRIPTION_ID"] = c.Azure.SubscriptionID
+		res["IDP_AZURE_AUDIENCE"] = c.Azure.Audience
+	}
+	if c.Policy != nil {
+		res["IDP_AWS_ALLOWED_ROLES"] = strings.Join(c.Policy.AllowedRoles, ",")
+		res["IDP_AWS_PRIVILEGED_ROLES"] = strings.Join(c.Policy.PrivilegedRoles, ",")
+		res["IDP_AWS_APPROVAL_ROLES"] = strings.Join(c.Policy.ApprovalRoles, ",")
+		res["IDP_SHARED_WORKSPACE_POLICY"] = c.Policy.SharedWorkspace
+		res["IDP_AWS_READONLY_ROLE_ARN"] = c.Policy.ReadOnlyRole
+		res["IDP_TRUSTED_REPOSITORIES"] = strings.Join(c.Policy.TrustedRepositories, ",")
+		res["IDP_UNTRUSTED_CONTEXT_POLICY"] = c.Policy.UntrustedContext
+	}
+	if c.Approval != nil {
+		res["IDP_APPROVAL_WEBHOOK"] = c.Approval.Webhook
+		res["IDP_APPROVAL_FORMAT"] = c.Approval.Format
+		res["IDP_APPROVAL_STATUS_URL"] = c.Approval.StatusURL
+		res["IDP_APPROVAL_AUDIENCE"] = c.Approval.Audience
+		if c.Approval.Timeout > 0 {
+			res["IDP_APPROVAL_TIMEOUT"] = time.Duration(c.Approval.Timeout).String()
+		}
+	}
+	if c.Network != nil {
+		res["IDP_CA_BUNDLE"] = c.Network.CABundle
+		if e := c.Network.Endpoints; e != nil {
+			res["IDP_GITPOD_API_URL"] = e.GitpodAPI
+			res["IDP_AWS_STS_ENDPOINT"] = e.AWSSTS
+			res["IDP_GCP_STS_ENDPOINT"] = e.GoogleSTS
+			res["IDP_GCP_IAM_CREDENTIALS_ENDPOINT"] = e.GoogleIAMCredentials
+			res["IDP_AZURE_AUTHORITY_HOST"] = e.EntraID
+		}
+	}
+	if c.Errors != nil {
+		res["IDP_ERROR_REPORT_ENDPOINT"] = c.Errors.Endpoint
+		res["IDP_SENTRY_DSN"] = c.Errors.SentryDSN
+	}
+	if c.Rclone != nil {
+		res["IDP_RCLONE_PREFIX"] = c.Rclone.Prefix
+		res["IDP_AZURE_STORAGE_ACCOUNT"] = c.Rclone.AzureStorageAccount
+	}
+	if len(c.Databases) > 0 {
+		fc, _ := json.Marshal(c.Databases)
+		res["IDP_DATABASES"] = string(fc)
+	}
+	if len(c.ExportClaims) > 0 {
+		res["IDP_EXPORT_CLAIMS"] = strings.Join(c.ExportClaims, ",")
+	}
+	if c.Vault != nil {
+		res["VAULT_ADDR"] = c.Vault.Address
+		res["IDP_VAULT_ROLE"] = c.Vault.Role
+		res["IDP_VAULT_AUTH_PATH"] = c.Vault.AuthPath
+		res["IDP_VAULT_AUDIENCE"] = c.Vault.Audience
+		res["VAULT_NAMESPACE"] = c.Vault.Namespace
+	}
+	if c.Kafka != nil {
+		res["IDP_KAFKA_KIND"] = c.Kafka.Kind
+		res["IDP_KAFKA_BOOTSTRAP_SERVERS"] = c.Kafka.BootstrapServers
+		res["IDP_KAFKA_AWS_PROFILE"] = c.Kafka.AWSProfile
+		res["IDP_KAFKA_AUDIENCE"] = c.Kafka.Audience
+		res["IDP_KAFKA_CLUSTER"] = c.Kafka.Cluster
+		res["IDP_KAFKA_IDENTITY_POOL"] = c.Kafka.IdentityPool
+		res["IDP_KAFKA_TOKEN_ADDR"] = c.Kafka.TokenAddr
+	}
+	return res
+}
+
+// cfg is the configuration loaded at startup. It's nil if there is no config file.
+var cfg *config
+
+// setting returns the value of the environment variable name, falling back to the config file, and for the role
+// settings to the Gitpod project's variables. The selected environment overrides all of them. The userOnlySettings
+// come from the user's config file, not the repository's.
+func setting(name string) string {
+	c := cfg
+	if c != nil && c.fromRepository && userOnlySettings[name] {
+		c = c.user
+	}
+	if v, ok := c.environmentSettings()[name]; ok {
+		return v
+	}
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	if v := c.settings()[name]; v != "" {
+		return v
+	}
+	return projectSetting(name)
+}
+
+// repoRoot returns the root of the repository the tool runs in, or the working directory if it cannot be determined.
+func repoRoot() (string, error) {
+	if root := os.Getenv("GITPOD_REPO_ROOT"); root != "" {
+		return root, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for dir := wd; ; {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return wd, nil
+		}
+		dir = parent
+	}
+}
+
+// repoConfigPath returns the location of the repository's config file, which IDP_CONFIG can override.
+func repoConfigPath() (string, error) {
+	if fn := os.Getenv("IDP_CONFIG"); fn != "" {
+		return fn, nil
+	}
+	root, err := repoRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, configFileName), nil
+}
+
+// configPath returns the location of the config file in use. Repositories without a config file of their own use
+// the user's, config.json in userConfigDir, if there is one.
+func configPath() (string, error) {
+	fn, err := repoConfigPath()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(fn); err == nil || os.Getenv("IDP_CONFIG") != "" {
+		return fn, nil
+	}
+	if dir, err := userConfigDir(); err == nil {
+		if _, err := os.Stat(filepath.Join(dir, "config.json")); err == nil {
+			return filepath.Join(dir, "config.json"), nil
+		}
+	}
+	return fn, nil
+}
+
+// loadConfig reads the config file, and with the repository's the user's too. A missing config file is not an
+// error.
+func loadConfig() (*config, error) {
+	fn, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	res, err := readConfig(fn)
+	if res == nil || err != nil {
+		return res, err
+	}
+	dir, err := userConfigDir()
+	if err == nil && fn == filepath.Join(dir, "config.json") {
+		return res, nil
+	}
+	res.fromRepository = true
+	var ignored []string
+	for _, name := range sortedKeys(userOnlySettings) {
+		set := res.settings()[name] != ""
+		for _, env := range res.Environments {
+			set = set || env[name] != ""
+		}
+		if set {
+			ignored = append(ignored, name)
+		}
+	}
+	if len(ignored) > 0 {
+		slog.Warn("the repository's config file may not set these, set them in the environment or your own config file",
+			"file", fn, "settings", strings.Join(ignored, ", "))
+	}
+	if err == nil {
+		res.user, err = readConfig(filepath.Join(dir, "config.json"))
+	}
+	return res, err
+}
+
+// readConfig reads the config file fn, or returns nil if there is none.
+func readConfig(fn string) (*config, error) {
+	fc, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res config
+	err = json.Unmarshal(fc, &res)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", fn, err)
+	}
+	return &res, nil
+}
+
+func saveConfig(fn string, c *config) error {
+	fc, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, append(fc, '\n'), 0644)
+}
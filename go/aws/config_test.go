@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfigFiles writes the repository's config file, and the user's unless it's empty, and loads them.
+func writeConfigFiles(t *testing.T, repo, user string) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), configFileName)
+	t.Setenv("IDP_CONFIG", fn)
+	err := os.WriteFile(fn, []byte(repo), 0644)
+	if err == nil && user != "" {
+		dir, _ := userConfigDir()
+		err = mkdirPrivate(dir)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, "config.json"), []byte(user), 0644)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepositoryConfigUserOnlySettings(t *testing.T) {
+	testWorkspace(t, &fakeRunner{})
+	t.Setenv("IDP_ENVIRONMENT", "prod")
+	for _, name := range sortedKeys(userOnlySettings) {
+		t.Setenv(name, "")
+	}
+	writeConfigFiles(t, `{
+		"aws": {"roleArns": ["arn:aws:iam::123456789012:role/gitpod"]},
+		"policy": {"untrustedContext": "allow", "trustedRepositories": ["*"], "sharedWorkspace": "refuse"},
+		"network": {
+			"caBundle": "/workspace/app/attacker.pem",
+			"endpoints": {"gitpodApi": "https://attacker.example", "awsSts": "https://attacker.example/sts"}
+		},
+		"environments": {"prod": {"IDP_GCP_STS_ENDPOINT": "https://attacker.example/token"}}
+	}`, `{"network": {"endpoints": {"gitpodApi": "https://gitpod-api.internal"}}}`)
+
+	tests := []struct {
+		name, want string
+	}{
+		{name: "IDP_AWS_ROLE_ARN", want: "arn:aws:iam::123456789012:role/gitpod"},
+		{name: "IDP_GITPOD_API_URL", want: "https://gitpod-api.internal"},
+		{name: "IDP_AWS_STS_ENDPOINT"},
+		{name: "IDP_GCP_STS_ENDPOINT"},
+		{name: "IDP_CA_BUNDLE"},
+		{name: "IDP_SHARED_WORKSPACE_POLICY", want: "refuse"},
+		{name: "IDP_UNTRUSTED_CONTEXT_POLICY"},
+		{name: "IDP_TRUSTED_REPOSITORIES"},
+	}
+	for _, tt := range tests {
+		if got := setting(tt.name); got != tt.want {
+			t.Errorf("setting(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	t.Setenv("IDP_AWS_STS_ENDPOINT", "https://sts.internal/")
+	if got := setting("IDP_AWS_STS_ENDPOINT"); got != "https://sts.internal/" {
+		t.Errorf("setting(IDP_AWS_STS_ENDPOINT) = %q, want the environment's", got)
+	}
+}
+
+func TestUserConfigUserOnlySettings(t *testing.T) {
+	testWorkspace(t, &fakeRunner{})
+	t.Setenv("IDP_GITPOD_API_URL", "")
+	dir, _ := userConfigDir()
+	if err := mkdirPrivate(dir); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"network": {"endpoints": {"gitpodApi": "https://gitpod-api.internal"}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GITPOD_REPO_ROOT", t.TempDir())
+	t.Setenv("IDP_CONFIG", "")
+	cfg, err = loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := setting("IDP_GITPOD_API_URL"); got != "https://gitpod-api.internal" {
+		t.Errorf("setting(IDP_GITPOD_API_URL) = %q, want the user's config file's", got)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "containers",
+		Usage:   "containers [--compose file] [--service name]... [--env-file file] [--watch] [provider...]",
+		Summary: "write the credentials into a compose override or devcontainer.env for containers built in the workspace",
+		Run:     runContainers,
+	})
+}
+
+// containersWatchInterval is how often containers --watch looks for new credentials.
+const containersWatchInterval = 10 * time.Second
+
+// composeOverrideHeader starts the compose overrides this tool writes, so that it never overwrites one of the
+// user's.
+const composeOverrideHeader = "# Written by idp containers, which rewrites it whenever the credentials change - don't edit.\n"
+
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
+func runContainers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("containers", flag.ExitOnError)
+	compose := flags.String("compose", "", "write a compose override, e.g. docker-compose.override.yml")
+	var services stringList
+	flags.Var(&services, "service", "compose service to pass the credentials to, repeatable (default all services)")
+	envFile := flags.String("env-file", "", "write an env file, e.g. .devcontainer/devcontainer.env")
+	watch := flags.Bool("watch", false, "keep running and rewrite the files whenever the credentials change")
+	_ = flags.Parse(args)
+
+	if *compose == "" && *envFile == "" {
+		return exitErrorf(exitUsage, "pass --compose, --env-file or both")
+	}
+	selected, err := selectProviders(flags.Args())
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, fn := range []*string{compose, envFile} {
+		if *fn == "" {
+			continue
+		}
+		if !filepath.IsAbs(*fn) {
+			root, err := repoRoot()
+			if err != nil {
+				return err
+			}
+			*fn = filepath.Join(root, *fn)
+		}
+		err = ensureGitignored(ctx, *fn)
+		if err != nil {
+			return withExitCode(exitPersistFailed, err)
+		}
+		files = append(files, *fn)
+	}
+	if *compose != "" && len(services) == 0 {
+		services, err = composeServices(ctx, filepath.Dir(*compose))
+		if err != nil {
+			return err
+		}
+	}
+
+	var last map[string]string
+	for {
+		env, err := credentialEnv(selected)
+		if err != nil {
+			return err
+		}
+		if !equalEnv(env, last) {
+			if len(env) == 0 {
+				printWarning("no credentials to pass to containers yet - run idp login first")
+			}
+			err = writeContainerFiles(*compose, services, *envFile, env)
+			if err != nil {
+				return err
+			}
+			if last == nil {
+				for _, fn := range files {
+					printSuccess("wrote the credentials to %s", fn)
+				}
+				if dirs := credentialDirs(env); *envFile != "" && len(dirs) > 0 {
+					printWarning("some credentials are files - bind-mount %s into the container read-only at the same path", strings.Join(dirs, " and "))
+				}
+			}
+			last = env
+		}
+		if !*watch {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(containersWatchInterval):
+		}
+	}
+}
+
+func equalEnv(a, b map[string]string) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// composeServices lists the services of the compose project in dir.
+func composeServices(ctx context.Context, dir string) ([]string, error) {
+	out, err := runner.Output(ctx, "docker", "compose", "--project-directory", dir, "config", "--services")
+	if err != nil {
+		return nil, exitErrorf(exitUsage, "cannot list the compose services, pass them with --service: %w", err)
+	}
+	services := strings.Fields(string(out))
+	if len(services) == 0 {
+		return nil, exitErrorf(exitUsage, "the compose project in %s has no services", dir)
+	}
+	return services, nil
+}
+
+// credentialDirs returns the directories of the credential files env points to, which containers need mounted
+// at the same path.
+func credentialDirs(env map[string]string) []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, v := range env {
+		if !filepath.IsAbs(v) {
+			continue
+		}
+		if fi, err := os.Stat(v); err != nil || fi.IsDir() {
+			continue
+		}
+		if dir := filepath.Dir(v); !seen[dir] {
+			seen[dir] = true
+			res = append(res, dir)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func writeContainerFiles(compose string, services []string, envFile string, env map[string]string) error {
+	if envFile != "" {
+		keys := sortedKeys(env)
+		var buf bytes.Buffer
+		for _, k := range keys {
+			// env files take values literally, quotes included
+			fmt.Fprintf(&buf, "%s=%s\n", k, env[k])
+		}
+		err := writeWipedSecretFile(envFile, buf.Bytes())
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot write %s: %w", envFile, err)
+		}
+		recordArtifact(envFile)
+		emitEvent(eventProfileWritten, "", "path", envFile)
+	}
+	if compose != "" {
+		err := writeComposeOverride(compose, services, env)
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot write %s: %w", compose, err)
+		}
+		recordArtifact(compose)
+		emitEvent(eventProfileWritten, "", "path", compose)
+	}
+	return nil
+}
+
+type composeService struct {
+	Environment map[string]string `json:"environment"`
+	Volumes     []string          `json:"volumes,omitempty"`
+}
+
+// writeComposeOverride writes a compose file which passes env to services, and mounts the directories of
+// credential files read-only, rather than all of ~/.aws or the like.
+func writeComposeOverride(fn string, services []string, env map[string]string) error {
+	fc, err := os.ReadFile(fn)
+	if err == nil && len(fc) > 0 && !bytes.HasPrefix(fc, []byte(composeOverrideHeader)) {
+		return fmt.Errorf("it exists and wasn't written by idp containers - pass another file with --compose")
+	}
+
+	svc := composeService{Environment: make(map[string]string, len(env))}
+	for k, v := range env {
+		// compose interpolates variables in values
+		svc.Environment[k] = strings.ReplaceAll(v, "$", "$$")
+	}
+	for _, dir := range credentialDirs(env) {
+		svc.Volumes = append(svc.Volumes, dir+":"+dir+":ro")
+	}
+	override := struct {
+		Services map[string]composeService `json:"services"`
+	}{make(map[string]composeService, len(services))}
+	for _, s := range services {
+		override.Services[s] = svc
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(composeOverrideHeader)
+	err = writeYAML(&buf, override)
+	if err != nil {
+		return err
+	}
+	return writeWipedSecretFile(fn, buf.Bytes())
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "daemon",
+		Usage:   "daemon [--refresh-before 5m] [--warn-before 10m] [--no-refresh] [--metrics-addr host:port] [--health-addr host:port] [--dashboard-addr host:port] [--ready-file file] [--shutdown-timeout 8s] [--scrub-on-exit] [provider...] | install [--manager systemd|supervisord] [--print] [-- daemon flags] | uninstall",
+		Summary: "keep credentials fresh in the background, and warn before they expire",
+		Run:     runDaemon,
+	})
+}
+
+// daemonPollInterval is how often the daemon looks at the credential records.
+const daemonPollInterval = 30 * time.Second
+
+// defaultShutdownTimeout is how long a refresh may go on after the daemon is stopped. It's shorter than the time
+// systemd and supervisord give services to stop before killing them.
+const defaultShutdownTimeout = 8 * time.Second
+
+// daemon refreshes credentials shortly before they expire. Without refreshing, or if a refresh fails, it warns
+// the user instead, once per expiry.
+type daemon struct {
+	providers     []provider
+	refresh       bool
+	refreshBefore time.Duration
+	warnBefore    time.Duration
+	warned        map[string]time.Time
+
+	// readyFile is written whenever the readiness changes, if set.
+	readyFile string
+	ready     bool
+
+	mu        sync.Mutex
+	started   time.Time
+	lastCheck time.Time
+	// errors are the most recent failed refreshes and sign-ins, oldest first, for the dashboard.
+	errors []dashboardError
+}
+
+func runDaemon(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "install":
+			return runDaemonInstall(ctx, args[1:])
+		case "uninstall":
+			return runDaemonUninstall(ctx, args[1:])
+		}
+	}
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	refreshBefore := flags.Duration("refresh-before", 5*time.Minute, "refresh credentials this long before they expire")
+	warnBefore := flags.Duration("warn-before", 10*time.Minute, "warn this long before credentials expire, if they aren't refreshed")
+	noRefresh := flags.Bool("no-refresh", false, "only warn before credentials expire")
+	metricsAddr := flags.String("metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9464")
+	healthAddr := flags.String("health-addr", defaultHealthAddr, "serve /healthz and /readyz on this address, none if empty")
+	dashboardAddr := flags.String("dashboard-addr", "", "serve a page showing the credentials, with buttons to sign in and refresh, on this address, e.g. localhost:9467")
+	fileFlag := flags.String("ready-file", "", "write this file whenever the credentials become ready or stop being so, for idp wait (default IDP_READY_FILE)")
+	shutdownTimeout := flags.Duration("shutdown-timeout", defaultShutdownTimeout, "when stopped, give a refresh in progress this long to finish")
+	scrub := flags.Bool("scrub-on-exit", false, "when stopped, wipe the cache key and drop the secrets held in memory")
+	_ = flags.Parse(args)
+
+	selected, err := selectProviders(flags.Args())
+	if err != nil {
+		return err
+	}
+	d := &daemon{
+		providers:     selected,
+		refresh:       !*noRefresh,
+		refreshBefore: *refreshBefore,
+		warnBefore:    *warnBefore,
+		warned:        make(map[string]time.Time),
+		started:       time.Now(),
+		readyFile:     readyFile(*fileFlag),
+	}
+	if d.readyFile != "" {
+		err = clearReadyFile(d.readyFile)
+		if err != nil {
+			return err
+		}
+	}
+	err = d.serve(ctx, *metricsAddr, *healthAddr, *dashboardAddr)
+	if err != nil {
+		return err
+	}
+	slog.Info("watching credentials", "refresh", d.refresh, "refreshBefore", d.refreshBefore, "warnBefore", d.warnBefore)
+
+	// Stopping the daemon, e.g. with SIGTERM as the workspace stops, ends the checks, but a refresh in progress
+	// runs on for a while, so that its credentials are written and audited rather than lost halfway.
+	work, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelWork()
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-time.After(*shutdownTimeout):
+			cancelWork()
+		case <-work.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(daemonPollInterval)
+	defer ticker.Stop()
+	for {
+		d.check(ctx, work)
+		d.checked()
+		d.writeReady()
+		flushTraces()
+		select {
+		case <-ctx.Done():
+			d.shutdown(*scrub)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// shutdown finishes stopping the daemon after its last check: it waits for the metrics and health servers to
+// close their connections, and with scrub drops the secrets it holds in memory.
+func (d *daemon) shutdown(scrub bool) {
+	slog.Info("stopping", "uptime", time.Since(d.started).Round(time.Second).String())
+	httpServers.Wait()
+	if scrub {
+		forgetSecrets()
+	}
+}
+
+// serve serves the metrics on metricsAddr, the health endpoints on healthAddr and the dashboard on dashboardAddr,
+// which may be the same address.
+func (d *daemon) serve(ctx context.Context, metricsAddr, healthAddr, dashboardAddr string) error {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if metricsAddr != "" {
+		mux(metricsAddr).HandleFunc("/metrics", handleMetrics(d.providers))
+	}
+	if healthAddr != "" {
+		mux(healthAddr).HandleFunc("/healthz", handleHealth(d.liveness, healthOK))
+		mux(healthAddr).HandleFunc("/readyz", handleHealth(d.readiness, healthReady))
+	}
+	if dashboardAddr != "" {
+		h, err := d.handleDashboard()
+		if err != nil {
+			return err
+		}
+		mux(dashboardAddr).Handle("/", h)
+	}
+	for _, addr := range sortedKeys(muxes) {
+		what := "health checks"
+		switch addr {
+		case metricsAddr:
+			what = "metrics"
+		case dashboardAddr:
+			what = "the dashboard"
+		}
+		err := serveHTTP(ctx, addr, what, muxes[addr])
+		if err != nil && addr == defaultHealthAddr && addr != metricsAddr && addr != dashboardAddr {
+			// e.g. another daemon watching other providers; only an address asked for must be served
+			slog.Warn("not serving health checks", "error", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check refreshes or warns about the credentials of all providers which expire soon. It stops at the next
+// provider once stop is cancelled; refreshes run with ctx.
+func (d *daemon) check(stop, ctx context.Context) {
+	for _, p := range d.providers {
+		if stop.Err() != nil {
+			return
+		}
+		if !p.configured() {
+			continue
+		}
+		rec, err := loadCredentialRecord(p.Name)
+		if err != nil {
+			slog.Warn("cannot read credential record", "provider", p.Name, "error", err)
+			continue
+		}
+		if rec == nil || rec.Expiry.IsZero() {
+			continue
+		}
+
+		if rec.Method == elevateMethod {
+			// elevated credentials aren't refreshed or warned about; the elevation ends when they'd expire
+			if e, err := loadElevation(); err == nil && e != nil {
+				if time.Until(e.Until) <= 0 {
+					if _, err := endElevation(ctx, e.ID, returnFromElevation); err != nil {
+						d.recordError(p.Name, err)
+					}
+				}
+				continue
+			}
+		}
+
+		left := time.Until(rec.Expiry)
+		refreshFailed := false
+		if d.refresh && left <= d.refreshBefore {
+			err = refreshProvider(ctx, p)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				notify(ctx, notifyInfo, refreshedMessage(p.Name))
+				delete(d.warned, p.Name)
+				continue
+			}
+			slog.Warn("cannot refresh credentials", "provider", p.Name, "error", err)
+			d.recordError(p.Name, err)
+			refreshFailed = true
+		}
+		if (!d.refresh || refreshFailed) && left <= d.warnBefore && !d.warned[p.Name].Equal(rec.Expiry) {
+			d.warned[p.Name] = rec.Expiry
+			notify(ctx, notifyWarning, expiryWarning(p.Name, left))
+		}
+	}
+}
+
+func refreshedMessage(provider string) string {
+	rec, err := loadCredentialRecord(provider)
+	if err != nil || rec == nil || rec.Expiry.IsZero() {
+		return fmt.Sprintf("refreshed the %s credentials", provider)
+	}
+	return fmt.Sprintf("refreshed the %s credentials, they are valid until %s", provider, rec.Expiry.Local().Format(time.Kitchen))
+}
+
+func expiryWarning(provider string, left time.Duration) string {
+	if left <= 0 {
+		return fmt.Sprintf("the %s credentials have expired - run idp login %s", provider, provider)
+	}
+	return fmt.Sprintf("the %s credentials expire in %s - run idp login %s", provider, left.Round(time.Minute), provider)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// daemonUnitName is the name of the systemd unit and the supervisord program which run the daemon.
+const daemonUnitName = "gitpod-idp-daemon"
+
+// The service managers daemon install registers the daemon with.
+const (
+	managerSystemd     = "systemd"
+	managerSupervisord = "supervisord"
+)
+
+// supervisordConfigs are where supervisord looks for its config outside of its own directory.
+var supervisordConfigs = []string{"/etc/supervisord.conf", "/etc/supervisor/supervisord.conf"}
+
+// daemonEnvPrefixes select the environment variables the daemon's service gets from the environment daemon install
+// runs in. Service managers start services with an environment of their own, which lacks what the daemon needs to
+// reach the workspace's supervisor and to find its configuration.
+var daemonEnvPrefixes = []string{"GITPOD_", "SUPERVISOR_", "IDP_", "AWS_", "VAULT_", "GOOGLE_", "CLOUDSDK_", "AZURE_", "OTEL_", "XDG_"}
+
+var daemonEnvNames = []string{"PATH", "HOME", "USER", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy", "SSL_CERT_FILE"}
+
+// daemonEnvSecrets mark variables which are never written to unit files, as they hold credentials rather than
+// settings.
+var daemonEnvSecrets = []string{"SECRET", "PASSWORD", "TOKEN", "ACCESS_KEY"}
+
+// daemonService is what a unit needs to run the daemon.
+type daemonService struct {
+	Exe  string
+	Args []string
+	Env  map[string]string
+	// LogFile is where supervisord writes the daemon's output. systemd sends it to the journal.
+	LogFile string
+}
+
+func runDaemonInstall(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("daemon install", flag.ExitOnError)
+	manager := flags.String("manager", "", "register the daemon with systemd (a user unit) or supervisord (default whichever is running)")
+	binary := flags.String("binary", "", "run this binary (default the running one)")
+	unitDir := flags.String("unit-dir", "", "write the unit into this directory (default the manager's)")
+	supervisordConfig := flags.String("supervisord-config", "", "the supervisord config whose [include] section names where programs go")
+	printOnly := flags.Bool("print", false, "print the unit instead of writing and starting it")
+	noStart := flags.Bool("no-start", false, "write the unit without starting it")
+	_ = flags.Parse(args)
+
+	if *manager == "" {
+		*manager = detectServiceManager(ctx)
+		if *manager == "" {
+			return exitErrorf(exitMissingConfig, "neither a systemd user manager nor supervisord runs here - start the daemon from a Gitpod task instead, or pass --manager")
+		}
+	}
+	if *manager != managerSystemd && *manager != managerSupervisord {
+		return exitErrorf(exitUsage, "unknown service manager %q: use systemd or supervisord", *manager)
+	}
+	svc, err := newDaemonService(*binary, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	var unit []byte
+	if *manager == managerSystemd {
+		unit = systemdUnit(svc)
+	} else {
+		unit = supervisordProgram(svc)
+	}
+	if *printOnly {
+		_, err = os.Stdout.Write(unit)
+		return err
+	}
+	fn, err := daemonUnitPath(*manager, *unitDir, *supervisordConfig)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err == nil {
+		err = os.WriteFile(fn, unit, 0644)
+	}
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write the unit: %w", err)
+	}
+	emitEvent(eventProfileWritten, "", "tool", *manager, "path", fn)
+	if *noStart {
+		printSuccess("wrote %s - start it with %s", fn, daemonStartHint(*manager))
+		return nil
+	}
+	err = startDaemonService(ctx, *manager)
+	if err != nil {
+		return err
+	}
+	printSuccess("%s runs the daemon now and with every start (%s)", *manager, fn)
+	return nil
+}
+
+func runDaemonUninstall(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("daemon uninstall", flag.ExitOnError)
+	manager := flags.String("manager", "", "the service manager the daemon was registered with (default whichever is running)")
+	unitDir := flags.String("unit-dir", "", "the directory the unit was written to (default the manager's)")
+	supervisordConfig := flags.String("supervisord-config", "", "the supervisord config whose [include] section names where programs go")
+	_ = flags.Parse(args)
+
+	if *manager == "" {
+		*manager = detectServiceManager(ctx)
+	}
+	if *manager != managerSystemd && *manager != managerSupervisord {
+		return exitErrorf(exitUsage, "pass --manager systemd or supervisord")
+	}
+	fn, err := daemonUnitPath(*manager, *unitDir, *supervisordConfig)
+	if err != nil {
+		return err
+	}
+	if *manager == managerSystemd {
+		// the unit may be gone already
+		_, _ = runner.CombinedOutput(ctx, "systemctl", "--user", "disable", "--now", daemonUnitName+".service")
+	}
+	err = os.Remove(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return exitErrorf(exitPersistFailed, "cannot remove the unit: %w", err)
+	}
+	err = reloadServiceManager(ctx, *manager)
+	if err != nil {
+		return err
+	}
+	printSuccess("removed %s", fn)
+	return nil
+}
+
+// detectServiceManager returns the service manager running here: systemd if a user manager answers, as on
+// desktops and in images which boot systemd, and supervisord otherwise if it's installed. It returns "" if
+// neither is.
+func detectServiceManager(ctx context.Context) string {
+	if _, err := runner.LookPath("systemctl"); err == nil {
+		if _, err := runner.Output(ctx, "systemctl", "--user", "show-environment"); err == nil {
+			return managerSystemd
+		}
+	}
+	if _, err := runner.LookPath("supervisorctl"); err == nil {
+		if fn, _ := findSupervisordConfig(""); fn != "" {
+			return managerSupervisord
+		}
+	}
+	return ""
+}
+
+func newDaemonService(binary string, daemonArgs []string) (*daemonService, error) {
+	exe := binary
+	if exe == "" {
+		var err error
+		exe, err = os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		exe, err = filepath.EvalSymlinks(exe)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(exe, string(filepath.Separator)+"go-build") {
+			return nil, exitErrorf(exitUsage, "this binary was built by go run and will be gone once it exits - go install it, or pass --binary")
+		}
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, v, _ := strings.Cut(kv, "=")
+		if v != "" && daemonEnvWanted(name) {
+			env[name] = v
+		}
+	}
+	return &daemonService{
+		Exe:     exe,
+		Args:    append([]string{"daemon"}, daemonArgs...),
+		Env:     env,
+		LogFile: filepath.Join(dir, "daemon.log"),
+	}, nil
+}
+
+func daemonEnvWanted(name string) bool {
+	for _, s := range daemonEnvSecrets {
+		if strings.Contains(strings.ToUpper(name), s) {
+			return false
+		}
+	}
+	for _, n := range daemonEnvNames {
+		if name == n {
+			return true
+		}
+	}
+	for _, p := range daemonEnvPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// systemdUnit returns a user unit for svc. It restarts the daemon if it fails, giving up after five failures in
+// a minute, and logs to the journal.
+func systemdUnit(svc *daemonService) []byte {
+	var b bytes.Buffer
+	b.WriteString("# written by idp daemon install\n")
+	b.WriteString("[Unit]\nDescription=gitpod-idp credential refresh daemon\nStartLimitIntervalSec=60\nStartLimitBurst=5\n\n")
+	b.WriteString("[Service]\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", systemdCommandLine(append([]string{svc.Exe, "-log-file", "journald"}, svc.Args...)))
+	b.WriteString("Restart=on-failure\nRestartSec=5s\nSyslogIdentifier=gitpod-idp\n")
+	for _, k := range sortedKeys(svc.Env) {
+		fmt.Fprintf(&b, "Environment=%s\n", systemdQuote(k+"="+svc.Env[k]))
+	}
+	b.WriteString("\n[Install]\nWantedBy=default.target\n")
+	return b.Bytes()
+}
+
+func systemdCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = systemdQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// systemdQuote quotes s for unit files where it needs it, which also expand % specifiers and $ variables.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// supervisordProgram returns a program section for svc. supervisord restarts the daemon whenever it exits
+// unexpectedly, and rotates its log.
+func supervisordProgram(svc *daemonService) []byte {
+	var b bytes.Buffer
+	b.WriteString("; written by idp daemon install\n")
+	fmt.Fprintf(&b, "[program:%s]\n", daemonUnitName)
+	fmt.Fprintf(&b, "command=%s\n", supervisordCommandLine(append([]string{svc.Exe}, svc.Args...)))
+	if u, err := user.Current(); err == nil {
+		fmt.Fprintf(&b, "user=%s\n", u.Username)
+	}
+	b.WriteString("autostart=true\nautorestart=unexpected\nexitcodes=0\nstartsecs=5\nstartretries=10\nstopsignal=TERM\nstopwaitsecs=10\n")
+	b.WriteString("redirect_stderr=true\n")
+	fmt.Fprintf(&b, "stdout_logfile=%s\nstdout_logfile_maxbytes=10MB\nstdout_logfile_backups=5\n", strings.ReplaceAll(svc.LogFile, "%", "%%"))
+	var env []string
+	for _, k := range sortedKeys(svc.Env) {
+		env = append(env, k+"="+supervisordQuote(svc.Env[k]))
+	}
+	if len(env) > 0 {
+		fmt.Fprintf(&b, "environment=%s\n", strings.Join(env, ","))
+	}
+	return b.Bytes()
+}
+
+func supervisordCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = supervisordQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// supervisordQuote quotes s for supervisord, which splits values like a shell and expands %(name)s expressions.
+func supervisordQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s != "" && !strings.ContainsAny(s, " \t\"',;\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// daemonUnitPath returns where the unit of manager goes: dir if set, the user's systemd unit directory, or the
+// directory the [include] section of the supervisord config names.
+func daemonUnitPath(manager, dir, supervisordConfig string) (string, error) {
+	if manager == managerSystemd {
+		if dir == "" {
+			base := os.Getenv("XDG_CONFIG_HOME")
+			if base == "" {
+				home, err := os.UserHomeDir()
+				if err != nil {
+					return "", err
+				}
+				base = filepath.Join(home, ".config")
+			}
+			dir = filepath.Join(base, "systemd", "user")
+		}
+		return filepath.Join(dir, daemonUnitName+".service"), nil
+	}
+	ext := ".conf"
+	if dir == "" {
+		fn, err := findSupervisordConfig(supervisordConfig)
+		if err != nil {
+			return "", err
+		}
+		dir, ext, err = supervisordIncludeDir(fn)
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, daemonUnitName+ext), nil
+}
+
+func findSupervisordConfig(fn string) (string, error) {
+	if fn != "" {
+		return filepath.Abs(fn)
+	}
+	for _, c := range supervisordConfigs {
+		if _, err := os.Stat(c); err == nil {
+			return c, nil
+		}
+	}
+	return "", exitErrorf(exitMissingConfig, "cannot find the supervisord config in %s - pass --supervisord-config or --unit-dir", strings.Join(supervisordConfigs, " or "))
+}
+
+// supervisordIncludeDir returns the directory and the extension of the files the [include] section of the
+// supervisord config fn loads, e.g. /etc/supervisor/conf.d and .conf for conf.d/*.conf.
+func supervisordIncludeDir(fn string) (string, string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	var section string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[] ")
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if section != "include" || !ok || strings.TrimSpace(k) != "files" {
+			continue
+		}
+		globs := strings.Fields(v)
+		sort.SliceStable(globs, func(i, j int) bool { return strings.HasSuffix(globs[i], ".conf") })
+		for _, g := range globs {
+			dir, pattern := filepath.Split(g)
+			if !strings.HasPrefix(pattern, "*") || strings.ContainsAny(dir, "*?[") {
+				continue
+			}
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(filepath.Dir(fn), dir)
+			}
+			return filepath.Clean(dir), strings.TrimPrefix(pattern, "*"), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	return "", "", exitErrorf(exitMissingConfig, "%s has no [include] section with files=<dir>/*.conf - add one, or pass --unit-dir", fn)
+}
+
+// startDaemonService makes manager pick up the unit, start the daemon and start it again with every boot of the
+// workspace.
+func startDaemonService(ctx context.Context, manager string) error {
+	err := reloadServiceManager(ctx, manager)
+	if err != nil || manager != managerSystemd {
+		return err
+	}
+	out, err := runner.CombinedOutput(ctx, "systemctl", "--user", "enable", "--now", daemonUnitName+".service")
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "systemctl --user enable failure: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// reloadServiceManager makes manager read its units again. supervisorctl update also starts new programs and
+// stops removed ones.
+func reloadServiceManager(ctx context.Context, manager string) error {
+	var cmds [][]string
+	if manager == managerSystemd {
+		cmds = [][]string{{"systemctl", "--user", "daemon-reload"}}
+	} else {
+		cmds = [][]string{{"supervisorctl", "reread"}, {"supervisorctl", "update"}}
+	}
+	for _, c := range cmds {
+		out, err := runner.CombinedOutput(ctx, c[0], c[1:]...)
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "%s failure: %s: %w", strings.Join(c, " "), strings.TrimSpace(string(out)), err)
+		}
+	}
+	return nil
+}
+
+func daemonStartHint(manager string) string {
+	if manager == managerSystemd {
+		return "systemctl --user enable --now " + daemonUnitName + ".service"
+	}
+	return "supervisorctl reread && supervisorctl update"
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dashboardErrorLimit is how many of the most recent errors the dashboard shows.
+const dashboardErrorLimit = 20
+
+// dashboardError is a failed refresh or sign-in the dashboard shows.
+type dashboardError struct {
+	Time     time.Time
+	Provider string
+	Message  string
+}
+
+// dashboardProvider is a row of the dashboard's provider table.
+type dashboardProvider struct {
+	providerStatus
+	Error string
+}
+
+// recordError remembers the failure of a refresh or sign-in for the dashboard, redacted like log lines, dropping
+// the oldest beyond dashboardErrorLimit.
+func (d *daemon) recordError(provider string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errors = append(d.errors, dashboardError{Time: time.Now(), Provider: provider, Message: redactText(err.Error())})
+	if len(d.errors) > dashboardErrorLimit {
+		d.errors = d.errors[len(d.errors)-dashboardErrorLimit:]
+	}
+}
+
+// handleDashboard serves the dashboard page and the sign-in and refresh buttons on it. The buttons post a token
+// which only the page has, so that other sites the browser visits can't make the daemon sign in, and requests for
+// hosts dashboardHostAllowed doesn't know are refused, so that they can't read the page either.
+func (d *daemon) handleDashboard() (http.Handler, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b[:])
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		d.renderDashboard(w, token)
+	})
+	action := func(name string, run func(context.Context, provider) error) {
+		mux.HandleFunc("/"+name+"/", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(token)) != 1 {
+				http.Error(w, "invalid token - reload the dashboard", http.StatusForbidden)
+				return
+			}
+			p, ok := d.provider(strings.TrimPrefix(r.URL.Path, "/"+name+"/"))
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			// a sign-in goes on when the browser gives up waiting, so that its credentials aren't lost halfway
+			err := run(context.WithoutCancel(r.Context()), p)
+			if err != nil {
+				slog.Warn("cannot "+name, "provider", p.Name, "error", err)
+				d.recordError(p.Name, err)
+			}
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+		})
+	}
+	action("login", loginProvider)
+	action("refresh", refreshProvider)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dashboardHostAllowed(r.Host) {
+			http.Error(w, "unexpected host - open the dashboard on localhost or the workspace's URL for its port", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}), nil
+}
+
+// dashboardHostAllowed reports whether the dashboard answers requests for host, their Host header: localhost, IP
+// addresses and the URLs of the workspace's ports. Any other name may be that of a site which resolves to the
+// workspace, or the machine the browser runs on, to read the page and its token: DNS rebinding.
+func dashboardHostAllowed(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	if host == "localhost" || net.ParseIP(host) != nil {
+		return true
+	}
+	// ports are forwarded to e.g. https://9467-example-ws.ws-eu.gitpod.io, for https://example-ws.ws-eu.gitpod.io
+	u, err := url.Parse(os.Getenv("GITPOD_WORKSPACE_URL"))
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	port, rest, ok := strings.Cut(host, "-")
+	if _, err := strconv.Atoi(port); err != nil || !ok {
+		return false
+	}
+	return rest == strings.ToLower(u.Hostname())
+}
+
+// provider returns the provider of the daemon with the given name.
+func (d *daemon) provider(name string) (provider, bool) {
+	for _, p := range d.providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return provider{}, false
+}
+
+func (d *daemon) renderDashboard(w http.ResponseWriter, token string) {
+	d.mu.Lock()
+	recent := make([]dashboardError, len(d.errors))
+	for i, e := range d.errors {
+		recent[len(d.errors)-1-i] = e
+	}
+	lastCheck := d.lastCheck
+	d.mu.Unlock()
+
+	var rows []dashboardProvider
+	for _, p := range d.providers {
+		st, err := getProviderStatus(p)
+		row := dashboardProvider{providerStatus: st}
+		if err != nil {
+			row.Error = redactText(err.Error())
+		}
+		for _, e := range recent {
+			if e.Provider == p.Name && row.Error == "" && (st.IssuedAt == nil || e.Time.After(*st.IssuedAt)) {
+				row.Error = e.Message
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := dashboardTemplate.Execute(w, map[string]any{
+		"Providers": rows,
+		"Errors":    recent,
+		"LastCheck": lastCheck,
+		"Token":     token,
+		"Refresh":   d.refresh,
+	})
+	if err != nil {
+		slog.Warn("cannot render the dashboard", "error", err)
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="30">
+<title>Workspace cloud access</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2rem; }
+th, td { text-align: left; padding: .4rem 1rem .4rem 0; border-bottom: 1px solid #ddd; vertical-align: top; }
+.valid { color: #18794e; } .expired, .error { color: #cd2b31; } .none { color: #777; }
+form { display: inline; } button { margin-right: .3rem; }
+small { color: #777; }
+</style>
+</head>
+<body>
+<h1>Workspace cloud access</h1>
+<table>
+<tr><th>Provider</th><th>State</th><th>Identity</th><th>Expires</th><th></th></tr>
+{{range .Providers}}
+<tr>
+<td>{{.Provider}}</td>
+<td class="{{.State}}">{{if .Configured}}{{.State}}{{else}}not configured{{end}}</td>
+<td>{{.Identity}}</td>
+<td>{{if .Expiry}}<span data-expiry="{{.Expiry.Format "2006-01-02T15:04:05Z07:00"}}">{{.Expiry.Local.Format "15:04"}}</span>{{end}}{{if .Error}}<div class="error">{{.Error}}</div>{{end}}</td>
+<td>{{if .Configured}}
+<form method="post" action="/login/{{.Provider}}"><input type="hidden" name="token" value="{{$.Token}}"><button>Sign in</button></form>
+{{if ne .State "none"}}<form method="post" action="/refresh/{{.Provider}}"><input type="hidden" name="token" value="{{$.Token}}"><button>Refresh</button></form>{{end}}
+{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{if .Errors}}
+<h2>Recent errors</h2>
+<table>
+{{range .Errors}}<tr><td><small>{{.Time.Local.Format "15:04:05"}}</small></td><td>{{.Provider}}</td><td class="error">{{.Message}}</td></tr>
+{{end}}
+</table>
+{{end}}
+<p><small>{{if .Refresh}}The daemon refreshes credentials before they expire.{{else}}The daemon only warns before credentials expire.{{end}}
+{{if not .LastCheck.IsZero}}Last checked at <span>{{.LastCheck.Local.Format "15:04:05"}}</span>.{{end}}</small></p>
+<script>
+function countdown() {
+  for (const el of document.querySelectorAll("[data-expiry]")) {
+    const left = Math.round((new Date(el.dataset.expiry) - Date.now()) / 1000);
+    if (left <= 0) { el.textContent = "expired"; el.className = "expired"; continue; }
+    const h = Math.floor(left / 3600), m = Math.floor(left % 3600 / 60), s = left % 60;
+    el.textContent = "in " + (h ? h + "h " : "") + (h || m ? m + "m " : "") + s + "s";
+  }
+}
+countdown();
+setInterval(countdown, 1000);
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "db",
+		Usage:   "db list | token <name> | sidecar [--once] [--interval 1m] [name...]",
+		Summary: "obtain IAM authentication tokens for RDS and Cloud SQL databases, and keep connection files up to date with them",
+		Run:     runDB,
+	})
+}
+
+// The kinds of databases the tokens are for.
+const (
+	dbKindRDS      = "rds"
+	dbKindCloudSQL = "cloudsql"
+)
+
+// dbRefreshBefore is how long before a database token expires db sidecar replaces it. RDS tokens are valid for
+// 15 minutes, so they are replaced every 10.
+const dbRefreshBefore = 5 * time.Minute
+
+// databaseConfig is a database signed into with an IAM authentication token as password, which db sidecar writes to
+// the connection files of the clients and dev servers using it.
+type databaseConfig struct {
+	// Kind is rds, for RDS and Aurora, or cloudsql.
+	Kind string `json:"kind"`
+	Host string `json:"host"`
+	// Port defaults to that of the engine.
+	Port int `json:"port,omitempty"`
+	// Engine is postgres, the default, or mysql.
+	Engine   string `json:"engine,omitempty"`
+	User     string `json:"user"`
+	Database string `json:"database,omitempty"`
+	// Region of an RDS database, IDP_AWS_REGION by default.
+	Region string `json:"region,omitempty"`
+	// AWSProfile is the profile whose credentials sign the tokens of an RDS database, default by default.
+	AWSProfile string `json:"awsProfile,omitempty"`
+
+	// PgPass keeps the token in the password file of PostgreSQL clients, PGPASSFILE or ~/.pgpass.
+	PgPass bool `json:"pgpass,omitempty"`
+	// EnvFile is a dotenv file whose connection variables, like PGPASSWORD and DATABASE_URL, are kept up to date.
+	// It's relative to the repository root unless absolute.
+	EnvFile string `json:"envFile,omitempty"`
+	// EnvPrefix is prepended to the names of the variables, for env files with several databases.
+	EnvPrefix string `json:"envPrefix,omitempty"`
+	// Hook runs with every new token, which is in IDP_DB_TOKEN, e.g. to make a dev server reconnect.
+	Hook string `json:"hook,omitempty"`
+}
+
+func (db databaseConfig) engine() string {
+	if db.Engine == "" {
+		return "postgres"
+	}
+	return db.Engine
+}
+
+func (db databaseConfig) endpoint() string {
+	port := db.Port
+	if port == 0 {
+		port = 5432
+		if db.engine() == "mysql" {
+			port = 3306
+		}
+	}
+	return net.JoinHostPort(db.Host, strconv.Itoa(port))
+}
+
+// databases returns the databases of IDP_DATABASES, a JSON object of databaseConfig by name.
+func databases() (map[string]databaseConfig, error) {
+	v := setting("IDP_DATABASES")
+	if v == "" {
+		return nil, nil
+	}
+	var res map[string]databaseConfig
+	err := json.Unmarshal([]byte(v), &res)
+	if err != nil {
+		return nil, exitErrorf(exitUsage, "invalid IDP_DATABASES: %w", err)
+	}
+	for name, db := range res {
+		switch {
+		case db.Kind != dbKindRDS && db.Kind != dbKindCloudSQL:
+			return nil, exitErrorf(exitUsage, "database %s: unknown kind %q, use rds or cloudsql", name, db.Kind)
+		case db.engine() != "postgres" && db.engine() != "mysql":
+			return nil, exitErrorf(exitUsage, "database %s: unknown engine %q, use postgres or mysql", name, db.Engine)
+		case db.Host == "" || db.User == "":
+			return nil, exitErrorf(exitUsage, "database %s needs a host and a user", name)
+		}
+	}
+	return res, nil
+}
+
+func selectDatabases(names []string) (map[string]databaseConfig, error) {
+	all, err := databases()
+	if err != nil {
+		return nil, err
+	}
+	if len(all) == 0 {
+		return nil, exitErrorf(exitMissingConfig, "no databases are configured - add them to databases in %s or IDP_DATABASES", configFileName)
+	}
+	if len(names) == 0 {
+		return all, nil
+	}
+	res := make(map[string]databaseConfig)
+	for _, name := range names {
+		db, ok := all[name]
+		if !ok {
+			return nil, exitErrorf(exitUsage, "unknown database %q: use one of %s", name, strings.Join(sortedKeys(all), ", "))
+		}
+		res[name] = db
+	}
+	return res, nil
+}
+
+func runDB(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return exitErrorf(exitUsage, "usage: db list | token <name> | sidecar [name...]")
+	}
+	switch args[0] {
+	case "list":
+		return runDBList()
+	case "token":
+		if len(args) != 2 {
+			return exitErrorf(exitUsage, "usage: db token <name>")
+		}
+		dbs, err := selectDatabases(args[1:])
+		if err != nil {
+			return err
+		}
+		token, _, err := databaseToken(ctx, dbs[args[1]])
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	case "sidecar":
+		return runDBSidecar(ctx, args[1:])
+	}
+	return exitErrorf(exitUsage, "unknown db subcommand %q", args[0])
+}
+
+type databaseInfo struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Endpoint string `json:"endpoint"`
+	User     string `json:"user"`
+	Database string `json:"database,omitempty"`
+}
+
+func runDBList() error {
+	dbs, err := databases()
+	if err != nil {
+		return err
+	}
+	res := []databaseInfo{}
+	for _, name := range sortedKeys(dbs) {
+		db := dbs[name]
+		res = append(res, databaseInfo{Name: name, Kind: db.Kind, Endpoint: db.endpoint(), User: db.User, Database: db.Database})
+	}
+	return writeOutput(res, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tKIND\tENDPOINT\tUSER\tDATABASE")
+		for _, db := range res {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", db.Name, db.Kind, db.Endpoint, db.User, db.Database)
+		}
+		return w.Flush()
+	})
+}
+
+// runDBSidecar keeps the tokens of the databases fresh until interrupted, replacing them shortly before they
+// expire and writing them to the files the databases are configured with, so that dev servers running for
+// hours can still open connections. With --once, it writes the tokens once, e.g. in a task before the server
+// starts.
+func runDBSidecar(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("db sidecar", flag.ExitOnError)
+	once := flags.Bool("once", false, "write the tokens once and exit")
+	interval := flags.Duration("interval", time.Minute, "check the tokens this often")
+	_ = flags.Parse(args)
+
+	dbs, err := selectDatabases(flags.Args())
+	if err != nil {
+		return err
+	}
+	expiries := make(map[string]time.Time)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		var failed []string
+		for _, name := range sortedKeys(dbs) {
+			if time.Until(expiries[name]) > dbRefreshBefore {
+				continue
+			}
+			expiry, err := refreshDatabaseToken(ctx, name, dbs[name])
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				slog.Warn("cannot refresh the database token", "database", name, "error", err)
+				failed = append(failed, name)
+				continue
+			}
+			expiries[name] = expiry
+			slog.Info("refreshed the database token", "database", name, "expiry", expiry.Format(time.RFC3339))
+		}
+		if *once {
+			if len(failed) > 0 {
+				return exitErrorf(exitExchangeFailed, "cannot obtain tokens for %s", strings.Join(failed, ", "))
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshDatabaseToken obtains a new token for db and hands it to everything db is configured with.
+func refreshDatabaseToken(ctx context.Context, name string, db databaseConfig) (time.Time, error) {
+	token, expiry, err := databaseToken(ctx, db)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if db.PgPass {
+		err = updatePgpass(db, token)
+		if err != nil {
+			return time.Time{}, exitErrorf(exitPersistFailed, "cannot update the PostgreSQL password file: %w", err)
+		}
+	}
+	if db.EnvFile != "" {
+		err = writeDatabaseEnv(ctx, db, token)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	if db.Hook != "" {
+		hookCtx := withCommandEnv(ctx, "IDP_DB_NAME="+name, "IDP_DB_TOKEN="+token, "IDP_DB_EXPIRY="+expiry.UTC().Format(time.RFC3339))
+		shell, args := shellCommand(db.Hook)
+		out, err := runner.CombinedOutput(hookCtx, shell, args...)
+		if err != nil {
+			if msg := strings.TrimSpace(string(out)); msg != "" {
+				err = fmt.Errorf("%s: %w", msg, err)
+			}
+			return time.Time{}, fmt.Errorf("the hook %q failed: %w", db.Hook, err)
+		}
+	}
+	return expiry, nil
+}
+
+// databaseToken obtains a token for db and reports when it expires. RDS tokens are signed locally with the
+// credentials of the AWS profile; Cloud SQL takes a Google access token.
+func databaseToken(ctx context.Context, db databaseConfig) (string, time.Time, error) {
+	if db.Kind == dbKindCloudSQL {
+		token, err := gcpAccessToken(ctx, "cloudsql")
+		// Google access tokens are valid for an hour
+		return token, time.Now().Add(time.Hour), err
+	}
+
+	profile := db.AWSProfile
+	if profile == "" {
+		profile = "default"
+	}
+	creds, err := profileCredentials(profile)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	region := db.Region
+	if region == "" {
+		region = setting("IDP_AWS_REGION")
+	}
+	now := time.Now()
+	token, err := gitpodidp.RDSAuthToken(creds, db.endpoint(), region, db.User, now)
+	if err != nil {
+		return "", time.Time{}, withExitCode(exitMissingConfig, err)
+	}
+	registerSecret(token)
+	expiry := now.Add(gitpodidp.RDSAuthTokenLifetime)
+	// the token is only accepted while the credentials which signed it are valid
+	if rec, _ := loadCredentialRecord("aws"); rec != nil && !rec.Expiry.IsZero() && rec.Expiry.Before(expiry) {
+		expiry = rec.Expiry
+	}
+	return token, expiry, nil
+}
+
+// updatePgpass replaces the password of db's line in the PostgreSQL password file, keeping all other lines.
+func updatePgpass(db databaseConfig, token string) error {
+	fn, err := pgpassFile()
+	if err != nil {
+		return err
+	}
+	lines, err := pgpassLines(fn, pgpassKey(db))
+	if err != nil {
+		return err
+	}
+	lines = append(lines, pgpassKey(db)+pgpassEscape(token))
+	// libpq ignores password files other users can read
+	return writeWipedSecretFile(fn, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// pgpassFile returns the location of the PostgreSQL password file: PGPASSFILE, or ~/.pgpass.
+func pgpassFile() (string, error) {
+	if fn := os.Getenv("PGPASSFILE"); fn != "" {
+		return fn, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".pgpass"), nil
+}
+
+// pgpassKey returns the start of db's line in the password file, up to the password.
+func pgpassKey(db databaseConfig) string {
+	host, port, _ := net.SplitHostPort(db.endpoint())
+	database := db.Database
+	if database == "" {
+		database = "*"
+	}
+	return strings.Join([]string{pgpassEscape(host), port, pgpassEscape(database), pgpassEscape(db.User)}, ":") + ":"
+}
+
+// pgpassLines returns the lines of the password file fn, without those starting with key.
+func pgpassLines(fn, key string) ([]string, error) {
+	fc, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var lines []string
+	for _, l := range strings.Split(strings.TrimSuffix(string(fc), "\n"), "\n") {
+		if l != "" && !strings.HasPrefix(l, key) {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+func pgpassEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ":", `\:`).Replace(s)
+}
+
+// databaseEnvFile returns the location of db's env file, which is relative to the repository root unless absolute.
+func databaseEnvFile(db databaseConfig) (string, error) {
+	if filepath.IsAbs(db.EnvFile) {
+		return db.EnvFile, nil
+	}
+	root, err := repoRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, db.EnvFile), nil
+}
+
+// databaseEnv returns the connection variables of db's engine, and DATABASE_URL, with db's prefix.
+func databaseEnv(db databaseConfig, token string) map[string]string {
+	host, port, _ := net.SplitHostPort(db.endpoint())
+	u := url.URL{Scheme: db.engine(), User: url.UserPassword(db.User, token), Host: db.endpoint(), Path: "/" + db.Database}
+	var vars map[string]string
+	if db.engine() == "mysql" {
+		vars = map[string]string{"MYSQL_HOST": host, "MYSQL_TCP_PORT": port, "MYSQL_USER": db.User, "MYSQL_PWD": token, "MYSQL_DATABASE": db.Database}
+	} else {
+		// IAM authentication needs TLS
+		u.RawQuery = "sslmode=require"
+		vars = map[string]string{"PGHOST": host, "PGPORT": port, "PGUSER": db.User, "PGPASSWORD": token, "PGDATABASE": db.Database, "PGSSLMODE": "require"}
+	}
+	vars["DATABASE_URL"] = u.String()
+	res := make(map[string]string, len(vars))
+	for k, v := range vars {
+		res[db.EnvPrefix+k] = v
+	}
+	return res
+}
+
+// writeDatabaseEnv sets the connection variables of db's engine, and DATABASE_URL, in db's env file.
+func writeDatabaseEnv(ctx context.Context, db databaseConfig, token string) error {
+	fn, err := databaseEnvFile(db)
+	if err != nil {
+		return err
+	}
+	err = ensureGitignored(ctx, fn)
+	if err != nil {
+		return withExitCode(exitPersistFailed, err)
+	}
+	prefixed := make(map[string]string)
+	for k, v := range databaseEnv(db, token) {
+		if v != "" {
+			prefixed[k] = v
+		}
+	}
+	err = updateDotenvFile(fn, prefixed)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write %s: %w", fn, err)
+	}
+	emitEvent(eventProfileWritten, "", "path", fn)
+	return nil
+}
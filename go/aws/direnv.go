@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "direnv",
+		Usage:   "direnv [--lib]",
+		Summary: "print an .envrc stanza that switches cloud identities per directory",
+		Run:     runDirenv,
+	})
+}
+
+// direnvLib defines use_gitpod_idp for ~/.config/direnv/direnvrc. Each directory can bring its own config file,
+// and entering it signs into the identities that config asks for before exporting the credentials.
+const direnvLib = `# gitpod-idp: add to ~/.config/direnv/direnvrc, then put "use gitpod_idp [provider...]" in .envrc
+use_gitpod_idp() {
+  if [[ -f "$PWD/.gitpod-idp.json" ]]; then
+    export IDP_CONFIG="$PWD/.gitpod-idp.json"
+    watch_file "$IDP_CONFIG"
+  fi
+  eval "$(idp env --export --login "$@")"
+}
+`
+
+const direnvStanza = `# gitpod-idp: switch cloud identities with this directory
+if [[ -f "$PWD/.gitpod-idp.json" ]]; then
+  export IDP_CONFIG="$PWD/.gitpod-idp.json"
+  watch_file "$IDP_CONFIG"
+fi
+eval "$(idp env --export --login)"
+`
+
+func runDirenv(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("direnv", flag.ExitOnError)
+	lib := flags.Bool("lib", false, "print the use_gitpod_idp function for direnvrc instead of an .envrc stanza")
+	_ = flags.Parse(args)
+
+	if *lib {
+		fmt.Print(direnvLib)
+	} else {
+		fmt.Print(direnvStanza)
+	}
+	return nil
+}
@@ -0,0 +1,760 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "docker",
+		Usage:   "docker configure [--bin-dir dir] [registry...] | get | store | erase | list",
+		Summary: "act as Docker and podman credential helper for ECR, GAR, ACR, Artifactory and Harbor registries",
+		Run:     runDocker,
+	})
+}
+
+// dockerHelperName is the name Docker runs the credential helper by.
+const dockerHelperName = "docker-credential-gitpod-idp"
+
+// dockerCredentialsNotFound is the answer Docker expects from a credential helper which has nothing for a registry.
+const dockerCredentialsNotFound = "credentials not found in native keychain"
+
+// dockerCredentialMargin is how long before they expire cached registry credentials are no longer handed out, so
+// a push which takes a while doesn't fail half way.
+const dockerCredentialMargin = 5 * time.Minute
+
+// registryKind is a type of registry the helper knows how to get credentials for.
+type registryKind struct {
+	Name string
+	// Provider is the provider whose credentials the registry accepts, or empty if it takes the workspace's identity
+	// token directly.
+	Provider string
+	// Hosts matches the hostnames of the kind's hosted registries, which need no configuration.
+	Hosts *regexp.Regexp
+	// Username is the user name Docker lists for the registry, if it's always the same.
+	Username    string
+	Credentials func(ctx context.Context, host string) (*registryCredentials, error)
+}
+
+type registryCredentials struct {
+	Username string    `json:"username"`
+	Secret   string    `json:"secret"`
+	Expiry   time.Time `json:"expiry,omitempty"`
+}
+
+var registryKinds = []registryKind{
+	{Name: "ecr", Provider: "aws", Hosts: ecrHost, Username: "AWS", Credentials: ecrCredentials},
+	{Name: "gar", Provider: "gcp", Hosts: regexp.MustCompile(`^([a-z0-9-]+-docker\.pkg\.dev|([a-z]+\.)?gcr\.io)$`), Username: "oauth2accesstoken", Credentials: garCredentials},
+	{Name: "acr", Provider: "azure", Hosts: regexp.MustCompile(`^[a-z0-9]+\.azurecr\.(io|cn|us)$`), Username: acrUsername, Credentials: acrCredentials},
+	{Name: "artifactory", Hosts: regexp.MustCompile(`^[a-z0-9-]+\.jfrog\.io$`), Credentials: artifactoryCredentials},
+	{Name: "harbor", Provider: "vault", Credentials: harborCredentials},
+}
+
+var ecrHost = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// acrUsername is the user name ACR expects along with a refresh token.
+const acrUsername = "00000000-0000-0000-0000-000000000000"
+
+func findRegistryKind(name string) *registryKind {
+	for i := range registryKinds {
+		if registryKinds[i].Name == name {
+			return &registryKinds[i]
+		}
+	}
+	return nil
+}
+
+// configuredRegistries returns the registries of the setting name, e.g. IDP_DOCKER_REGISTRIES: a comma-separated
+// list of hostnames, each optionally followed by = and its kind for self-hosted registries, e.g.
+// "123456789012.dkr.ecr.eu-west-1.amazonaws.com,docker.corp.example=artifactory".
+func configuredRegistries(name string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, entry := range strings.Split(setting(name), ",") {
+		host, kind, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		kind = strings.TrimSpace(kind)
+		if kind != "" && findRegistryKind(kind) == nil {
+			return nil, exitErrorf(exitMissingConfig, "%s: unknown registry kind %q for %s, use one of %s", name, kind, host, strings.Join(registryKindNames(), ", "))
+		}
+		res[registryHost(host)] = kind
+	}
+	return res, nil
+}
+
+func registryKindNames() []string {
+	var res []string
+	for _, k := range registryKinds {
+		res = append(res, k.Name)
+	}
+	return res
+}
+
+// registryHost reduces what Docker passes as server URL, e.g. https://gcr.io/v1/, to the hostname.
+func registryHost(serverURL string) string {
+	s := serverURL
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return serverURL
+	}
+	return strings.ToLower(u.Host)
+}
+
+// registryKindFor returns the kind of the registry at host: the one it is configured with, or the one hosting it.
+// It returns nil if there are no credentials for host.
+func registryKindFor(host string, configured map[string]string) *registryKind {
+	if kind := configured[host]; kind != "" {
+		return findRegistryKind(kind)
+	}
+	for i, k := range registryKinds {
+		if k.Hosts != nil && k.Hosts.MatchString(host) {
+			return &registryKinds[i]
+		}
+	}
+	return nil
+}
+
+func runDocker(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return exitErrorf(exitUsage, "usage: docker configure [registry...], or get, store, erase or list as Docker credential helper")
+	}
+	switch args[0] {
+	case "configure":
+		return runDockerConfigure(ctx, args[1:])
+	case "get":
+		return dockerGet(ctx)
+	case "store", "erase":
+		// credentials are obtained on demand, so there is nothing to keep; docker login still calls these
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		return nil
+	case "list":
+		return dockerList()
+	case "version":
+		fmt.Println(version)
+		return nil
+	}
+	return exitErrorf(exitUsage, "unknown docker subcommand %q", args[0])
+}
+
+// dockerGet answers the get request of the credential helper protocol: the server URL on stdin, and the
+// credentials as JSON on stdout.
+func dockerGet(ctx context.Context) error {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	serverURL := strings.TrimSpace(line)
+	host := registryHost(serverURL)
+	configured, err := configuredRegistries("IDP_DOCKER_REGISTRIES")
+	if err != nil {
+		return err
+	}
+	kind := registryKindFor(host, configured)
+	if kind == nil {
+		fmt.Println(dockerCredentialsNotFound)
+		return withExitCode(exitFailure, fmt.Errorf("no credentials for %s", host))
+	}
+	if p, ok := findProvider(kind.Provider); ok && !p.configured() {
+		fmt.Println(dockerCredentialsNotFound)
+		return exitErrorf(exitMissingConfig, "%s is a %s registry, but %s is not configured - see idp providers list", host, kind.Name, kind.Provider)
+	}
+
+	creds, err := cachedRegistryCredentials(ctx, host, kind)
+	if err != nil {
+		return err
+	}
+	meterUsage(ctx, "docker", kind.Provider, host)
+	var out bytes.Buffer
+	err = json.NewEncoder(&out).Encode(struct {
+		ServerURL string
+		Username  string
+		Secret    string
+	}{serverURL, creds.Username, creds.Secret})
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out.Bytes())
+	if err != nil {
+		return err
+	}
+	if !creds.Expiry.IsZero() {
+		saveFastPath(out.Bytes(), creds.Expiry.Add(-dockerCredentialMargin), nil, &usageEntry{Channel: "docker", Provider: kind.Provider, Target: host})
+	}
+	return nil
+}
+
+// cachedRegistryCredentials returns the credentials for host, from the sealed cache while they are valid, as
+// Docker asks for them for every pull and push. Helpers asking for the same host at once, e.g. for the layers of
+// an image or the provider plugins terraform starts, take turns, and only the first one obtains the credentials;
+// the others get them from the cache. The shared workspace and untrusted context policies apply to cached
+// credentials like to fresh ones, and they are only used while the provider is signed in.
+func cachedRegistryCredentials(ctx context.Context, host string, kind *registryKind) (*registryCredentials, error) {
+	err := guardCredentials(ctx, "credentials for "+host)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	fn := filepath.Join(dir, "docker", host+".json")
+	cached := func() *registryCredentials {
+		fc, err := readSealedFile(fn)
+		if err != nil {
+			return nil
+		}
+		defer wipe(fc)
+		var creds registryCredentials
+		if json.Unmarshal(fc, &creds) != nil || time.Until(creds.Expiry) <= dockerCredentialMargin {
+			return nil
+		}
+		if kind.Provider != "" {
+			if rec, _ := loadCredentialRecord(kind.Provider); rec == nil {
+				return nil
+			}
+		}
+		registerSecret(creds.Secret)
+		return &creds
+	}
+	if creds := cached(); creds != nil {
+		return creds, nil
+	}
+	unlock, waited, err := acquireLock(ctx, "registry-"+host)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if waited {
+		if creds := cached(); creds != nil {
+			return creds, nil
+		}
+	}
+
+	creds, err := kind.Credentials(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	registerSecret(creds.Secret)
+	if kind.Provider != "" {
+		// registries accept their tokens only as long as the credentials they were obtained with
+		if rec, _ := loadCredentialRecord(kind.Provider); rec != nil && !rec.Expiry.IsZero() && (creds.Expiry.IsZero() || rec.Expiry.Before(creds.Expiry)) {
+			creds.Expiry = rec.Expiry
+		}
+	}
+	if !creds.Expiry.IsZero() {
+		fc, err := json.Marshal(creds)
+		if err == nil {
+			err = writeSealedFile(fn, fc)
+			wipe(fc)
+		}
+		if err != nil {
+			slog.Debug("cannot cache registry credentials", "registry", host, "error", err)
+		}
+	}
+	return creds, nil
+}
+
+// forgetRegistryCredentials removes the cached credentials of provider's registries, which stay valid after logging
+// out of it, and of those whose provider it cannot tell.
+func forgetRegistryCredentials(provider string) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "docker"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	configured, _ := configuredRegistries("IDP_DOCKER_REGISTRIES")
+	var fns []string
+	for _, e := range entries {
+		host, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if kind := registryKindFor(host, configured); kind == nil || kind.Provider == provider {
+			fns = append(fns, filepath.Join(dir, "docker", e.Name()))
+		}
+	}
+	return removeFiles(fns...)
+}
+
+// dockerList answers the list request: the registries the helper is configured for, and their user names.
+func dockerList() error {
+	res := make(map[string]string)
+	configured, err := configuredRegistries("IDP_DOCKER_REGISTRIES")
+	if err != nil {
+		return err
+	}
+	fn, err := dockerConfigPath()
+	if err != nil {
+		return err
+	}
+	cfg, err := readDockerConfig(fn)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", fn, err)
+	}
+	for host, helper := range cfg.CredHelpers {
+		if helper != dockerHelperSuffix() {
+			continue
+		}
+		res[host] = ""
+		if kind := registryKindFor(host, configured); kind != nil {
+			res[host] = kind.Username
+		}
+	}
+	return json.NewEncoder(os.Stdout).Encode(res)
+}
+
+func dockerHelperSuffix() string {
+	return strings.TrimPrefix(dockerHelperName, "docker-credential-")
+}
+
+func runDockerConfigure(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("docker configure", flag.ExitOnError)
+	binDir := flags.String("bin-dir", "", "install "+dockerHelperName+" into this directory on PATH (default ~/.local/bin)")
+	_ = flags.Parse(args)
+
+	configured, err := configuredRegistries("IDP_DOCKER_REGISTRIES")
+	if err != nil {
+		return err
+	}
+	hosts := sortedKeys(configured)
+	for _, arg := range flags.Args() {
+		hosts = append(hosts, registryHost(arg))
+	}
+	if len(hosts) == 0 {
+		return exitErrorf(exitUsage, "no registries to configure: pass their hostnames or set IDP_DOCKER_REGISTRIES")
+	}
+	for _, host := range hosts {
+		if registryKindFor(host, configured) == nil {
+			return exitErrorf(exitUsage, "don't know what kind of registry %s is - add it to IDP_DOCKER_REGISTRIES as %s=<kind>, with kind one of %s", host, host, strings.Join(registryKindNames(), ", "))
+		}
+	}
+
+	dir, err := helperDir(*binDir)
+	if err != nil {
+		return err
+	}
+	helper, err := installHelper(dir, dockerHelperName)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot install %s: %w", dockerHelperName, err)
+	}
+	if pth, _ := exec.LookPath(dockerHelperName); pth != helper {
+		printWarning("%s is not on PATH, so docker and podman won't find it - add it to PATH", dir)
+	}
+
+	for _, f := range registryAuthFiles() {
+		err = addCredHelpers(f.path, hosts)
+		if err != nil && f.optional {
+			slog.Warn("cannot configure the credential helper", "tool", f.tool, "path", f.path, "error", err)
+			continue
+		}
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot configure the credential helper in %s: %w", f.path, err)
+		}
+		emitEvent(eventProfileWritten, "", "tool", f.tool, "path", f.path)
+		printSuccess("%s uses %s for %s (%s)", f.tool, dockerHelperName, strings.Join(hosts, ", "), f.path)
+	}
+	return nil
+}
+
+// registryAuthFile is a file container tools read registry credentials and credential helpers from.
+type registryAuthFile struct {
+	tool string
+	path string
+	// optional files are skipped if they can't be written
+	optional bool
+}
+
+// registryAuthFiles returns the docker config and, where podman, buildah or skopeo are installed, the
+// containers-auth.json files they use: REGISTRY_AUTH_FILE if set, otherwise the one in the runtime directory
+// and ~/.config/containers/auth.json, which they fall back to once the runtime directory is cleared on reboot.
+func registryAuthFiles() []registryAuthFile {
+	var res []registryAuthFile
+	if fn, err := dockerConfigPath(); err == nil {
+		res = append(res, registryAuthFile{tool: "docker", path: fn})
+	}
+	var tool string
+	for _, t := range []string{"podman", "buildah", "skopeo"} {
+		if pth, _ := runner.LookPath(t); pth != "" {
+			tool = t
+			break
+		}
+	}
+	if fn := os.Getenv("REGISTRY_AUTH_FILE"); fn != "" {
+		if tool == "" {
+			tool = "podman"
+		}
+		return append(res, registryAuthFile{tool: tool, path: fn})
+	}
+	if tool == "" {
+		return res
+	}
+	// the same places containers/image looks, rootless or not. Elsewhere than on Linux, the runtime directory
+	// is inside the podman machine.
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" && runtime.GOOS == "linux" {
+		runtimeDir = fmt.Sprintf("/run/containers/%d", os.Getuid())
+	} else if runtimeDir != "" {
+		runtimeDir = filepath.Join(runtimeDir, "containers")
+	}
+	if runtimeDir != "" {
+		res = append(res, registryAuthFile{tool: tool, path: filepath.Join(runtimeDir, "auth.json"), optional: true})
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		res = append(res, registryAuthFile{tool: tool, path: filepath.Join(home, ".config", "containers", "auth.json")})
+	}
+	return res
+}
+
+// addCredHelpers makes the docker config or containers-auth.json fn use the helper for hosts. Both formats
+// share the credHelpers key.
+func addCredHelpers(fn string, hosts []string) error {
+	cfg, err := readDockerConfig(fn)
+	if err != nil {
+		return err
+	}
+	if cfg.CredHelpers == nil {
+		cfg.CredHelpers = make(map[string]string)
+	}
+	for _, host := range hosts {
+		cfg.CredHelpers[host] = dockerHelperSuffix()
+	}
+	return writeDockerConfig(fn, cfg)
+}
+
+// helperDir returns dir, or ~/.local/bin if it's empty, which credential helpers are installed into.
+func helperDir(dir string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "bin"), nil
+}
+
+// installHelper copies the running binary into dir as name, which makes it act as the credential helper of that
+// name. It's a copy rather than a link, so it keeps working when the binary was built by go run into a temporary
+// directory.
+func installHelper(dir, name string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	bin, err := os.ReadFile(exe)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	name = executableName(name)
+	fn := filepath.Join(dir, name)
+	tmp, err := os.CreateTemp(dir, "."+name+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(bin)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	err = os.Chmod(tmp.Name(), 0755)
+	if err != nil {
+		return "", err
+	}
+	return fn, os.Rename(tmp.Name(), fn)
+}
+
+// dockerConfig is the part of ~/.docker/config.json or containers-auth.json the helper changes. Other keys are
+// kept as they are.
+type dockerConfig struct {
+	CredHelpers map[string]string
+	// Auths holds the stored credentials by registry. Entries are kept as they are unless replaced.
+	Auths map[string]json.RawMessage
+	rest  map[string]json.RawMessage
+}
+
+// dockerAuth is an entry of auths, as docker login, podman login or helm registry login store them.
+type dockerAuth struct {
+	// Auth is the base64 encoded user:password.
+	Auth string `json:"auth"`
+}
+
+func dockerConfigPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// readDockerConfig reads the docker config or containers-auth.json fn, which may not exist yet.
+func readDockerConfig(fn string) (*dockerConfig, error) {
+	res := &dockerConfig{rest: make(map[string]json.RawMessage)}
+	fc, err := os.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(fc)) == 0 {
+		return res, nil
+	}
+	err = json.Unmarshal(fc, &res.rest)
+	if err != nil {
+		return nil, err
+	}
+	if raw, ok := res.rest["credHelpers"]; ok {
+		err = json.Unmarshal(raw, &res.CredHelpers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credHelpers: %w", err)
+		}
+	}
+	if raw, ok := res.rest["auths"]; ok {
+		err = json.Unmarshal(raw, &res.Auths)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auths: %w", err)
+		}
+	}
+	return res, nil
+}
+
+func writeDockerConfig(fn string, cfg *dockerConfig) error {
+	for key, v := range map[string]interface{}{"credHelpers": cfg.CredHelpers, "auths": cfg.Auths} {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if string(raw) != "null" {
+			cfg.rest[key] = raw
+		}
+	}
+	fc, err := json.MarshalIndent(cfg.rest, "", "\t")
+	if err != nil {
+		return err
+	}
+	// the config may hold the credentials of docker login or podman login
+	return writeWipedSecretFile(fn, append(fc, '\n'))
+}
+
+// ecrCredentials obtains an ECR authorization token with the aws CLI, using the credentials of idp login aws.
+func ecrCredentials(ctx context.Context, host string) (*registryCredentials, error) {
+	region := ecrHost.FindStringSubmatch(host)[2]
+	var out []byte
+	err := traceStep(ctx, "exchange token", func(ctx context.Context) (err error) {
+		out, err = runner.Output(ctx, "aws", "ecr", "get-login-password", "--region", region)
+		return err
+	}, "idp.method", "ecr")
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, exitErrorf(exitExchangeFailed, "aws ecr get-login-password failure: %s: %w", strings.TrimSpace(string(ee.Stderr)), err)
+		}
+		return nil, exitErrorf(exitExchangeFailed, "aws ecr get-login-password failure: %w", err)
+	}
+	// ECR authorization tokens are valid for 12 hours
+	return &registryCredentials{Username: "AWS", Secret: strings.TrimSpace(string(out)), Expiry: time.Now().Add(12 * time.Hour)}, nil
+}
+
+// garCredentials uses a Google access token, which Artifact Registry and Container Registry accept.
+func garCredentials(ctx context.Context, host string) (*registryCredentials, error) {
+	accessToken, err := gcpAccessToken(ctx, "gar")
+	if err != nil {
+		return nil, err
+	}
+	// Google access tokens are valid for an hour
+	return &registryCredentials{Username: "oauth2accesstoken", Secret: accessToken, Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+// acrCredentials exchanges an Entra ID access token, obtained with the token of idp login azure, for an ACR
+// refresh token.
+func acrCredentials(ctx context.Context, host string) (*registryCredentials, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	token, err := os.ReadFile(filepath.Join(dir, "azure-token"))
+	if err != nil {
+		return nil, exitErrorf(exitMissingConfig, "not signed into azure - run idp login azure: %w", err)
+	}
+	tenantID := setting("IDP_AZURE_TENANT_ID")
+	var refreshToken string
+	err = traceStep(ctx, "exchange token", func(ctx context.Context) error {
+		accessToken, err := gitpodidp.AzureAccessToken(ctx, tenantID, setting("IDP_AZURE_CLIENT_ID"), string(token), "https://management.azure.com/.default")
+		if err != nil {
+			return err
+		}
+		registerSecret(accessToken)
+		form := url.Values{
+			"grant_type":   {"access_token"},
+			"service":      {host},
+			"tenant":       {tenantID},
+			"access_token": {accessToken},
+		}
+		var resp struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		err = postRegistryToken(ctx, "https://"+host+"/oauth2/exchange", "application/x-www-form-urlencoded", []byte(form.Encode()), &resp)
+		refreshToken = resp.RefreshToken
+		return err
+	}, "idp.method", "acr")
+	if err != nil {
+		return nil, withExitCode(exitExchangeFailed, err)
+	}
+	return &registryCredentials{Username: acrUsername, Secret: refreshToken, Expiry: gitpodidp.Expiry(refreshToken)}, nil
+}
+
+// artifactoryCredentials exchanges an identity token for a JFrog access token, using the OIDC integration
+// IDP_ARTIFACTORY_OIDC_PROVIDER of the platform. The token's audience is IDP_ARTIFACTORY_AUDIENCE, by default
+// the platform's URL.
+func artifactoryCredentials(ctx context.Context, host string) (*registryCredentials, error) {
+	base := "https://" + host
+	provider := setting("IDP_ARTIFACTORY_OIDC_PROVIDER")
+	if provider == "" {
+		return nil, exitErrorf(exitMissingConfig, "%s is an Artifactory registry: set IDP_ARTIFACTORY_OIDC_PROVIDER to the name of its OIDC integration", host)
+	}
+	audience := setting("IDP_ARTIFACTORY_AUDIENCE")
+	if audience == "" {
+		audience = base
+	}
+	token, err := gitpodIDToken(ctx, audience)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]string{
+		"grant_type":         "urn:ietf:params:oauth:grant-type:token-exchange",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:id_token",
+		"subject_token":      token,
+		"provider_name":      provider,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		Username    string `json:"username"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = traceStep(ctx, "exchange token", func(ctx context.Context) error {
+		return postRegistryToken(ctx, base+"/access/api/v1/oidc/token", "application/json", body, &resp)
+	}, "idp.method", "artifactory")
+	if err != nil {
+		return nil, withExitCode(exitExchangeFailed, err)
+	}
+	res := &registryCredentials{Username: resp.Username, Secret: resp.AccessToken}
+	if resp.ExpiresIn > 0 {
+		res.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return res, nil
+}
+
+// harborCredentials reads the robot account for the Harbor registry from the Vault path IDP_HARBOR_VAULT_PATH,
+// e.g. secret/data/harbor/ci, with the token of idp login vault. Harbor has no token exchange of its own.
+func harborCredentials(ctx context.Context, host string) (*registryCredentials, error) {
+	path := setting("IDP_HARBOR_VAULT_PATH")
+	if path == "" {
+		return nil, exitErrorf(exitMissingConfig, "%s is a Harbor registry: set IDP_HARBOR_VAULT_PATH to the Vault secret holding its robot account", host)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	token, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return nil, exitErrorf(exitMissingConfig, "not signed into vault - run idp login vault: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(setting("VAULT_ADDR"), "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare Vault read: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+	if namespace := setting("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, exitErrorf(exitExchangeFailed, "cannot read %s from Vault: %w", path, err)
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, exitErrorf(exitExchangeFailed, "vault read of %s rejected (%s): %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&secret)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode Vault secret: %w", err)
+	}
+	// KV version 2 nests the fields once more
+	fields := secret.Data
+	if nested, ok := secret.Data["data"]; ok {
+		fields = nil
+		_ = json.Unmarshal(nested, &fields)
+	}
+	var res registryCredentials
+	_ = json.Unmarshal(fields["username"], &res.Username)
+	_ = json.Unmarshal(fields["secret"], &res.Secret)
+	if res.Username == "" || res.Secret == "" {
+		return nil, exitErrorf(exitMissingConfig, "the Vault secret %s needs the fields username and secret", path)
+	}
+	return &res, nil
+}
+
+// postRegistryToken posts body to a registry's token endpoint and decodes the JSON response into v.
+func postRegistryToken(ctx context.Context, endpoint, contentType string, body []byte, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%w: %s answered %s: %s", gitpodidp.ErrExchangeRejected, req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testECRHost = "123456789012.dkr.ecr.eu-west-1.amazonaws.com"
+
+// ecrWorkspace sets up a workspace signed into AWS whose ECR passwords are counted, and returns their count.
+func ecrWorkspace(t *testing.T) *int {
+	t.Helper()
+	var issued int
+	testWorkspace(t, &fakeRunner{run: func(name string, args ...string) ([]byte, error) {
+		if name == "aws" && strings.Join(args, " ") == "ecr get-login-password --region eu-west-1" {
+			issued++
+			return []byte("ecr-password-of-the-registry\n"), nil
+		}
+		return nil, errors.New("unexpected command")
+	}})
+	t.Setenv("IDP_SHARED_WORKSPACE_POLICY", sharedPolicyAllow)
+	t.Setenv("GITPOD_WORKSPACE_CONTEXT", ownContext)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "")
+	err := saveCredentialRecord(credentialRecord{Provider: "aws", Identity: "arn:aws:iam::123456789012:role/gitpod",
+		IssuedAt: time.Now(), Expiry: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &issued
+}
+
+func TestRegistryCredentialsAreCached(t *testing.T) {
+	issued := ecrWorkspace(t)
+	kind := registryKindFor(testECRHost, nil)
+	for i := 0; i < 2; i++ {
+		creds, err := cachedRegistryCredentials(context.Background(), testECRHost, kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.Secret != "ecr-password-of-the-registry" {
+			t.Errorf("got the secret %q", creds.Secret)
+		}
+	}
+	if *issued != 1 {
+		t.Errorf("obtained %d passwords, want 1 from ECR and 1 from the cache", *issued)
+	}
+}
+
+func TestRegistryCredentialsEndWithLogout(t *testing.T) {
+	tests := []struct {
+		name   string
+		logout func(t *testing.T)
+	}{
+		{name: "logout", logout: func(t *testing.T) {
+			p, _ := findProvider("aws")
+			if failed := logoutProviders(context.Background(), []provider{p}, false); len(failed) > 0 {
+				t.Fatalf("cannot log out of %q", failed)
+			}
+			dir, _ := stateDir()
+			if _, err := os.Stat(filepath.Join(dir, "docker", testECRHost+".json")); !os.IsNotExist(err) {
+				t.Errorf("the cached credentials are still there: %v", err)
+			}
+		}},
+		{name: "record gone", logout: func(t *testing.T) {
+			fn, _ := credentialRecordPath("aws")
+			if err := removeFiles(fn); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued := ecrWorkspace(t)
+			kind := registryKindFor(testECRHost, nil)
+			_, err := cachedRegistryCredentials(context.Background(), testECRHost, kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.logout(t)
+			if _, err := cachedRegistryCredentials(context.Background(), testECRHost, kind); err != nil {
+				t.Fatal(err)
+			}
+			if *issued != 2 {
+				t.Errorf("obtained %d passwords, want the cached one gone after logging out", *issued)
+			}
+		})
+	}
+}
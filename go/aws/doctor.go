@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "doctor",
+		Usage:   "doctor",
+		Summary: "check the environment for everything signing in needs",
+		Run:     runDoctor,
+	})
+}
+
+type checkResult int
+
+const (
+	checkPass checkResult = iota
+	checkWarn
+	checkFail
+)
+
+func (r checkResult) String() string {
+	switch r {
+	case checkPass:
+		return "PASS"
+	case checkWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// doctorCheck is a single diagnostic. Run returns the outcome, what was found, and how to fix a problem.
+type doctorCheck struct {
+	Name string
+	Run  func(ctx context.Context) (res checkResult, detail, fix string)
+}
+
+var doctorChecks = []doctorCheck{
+	{Name: "running in a Gitpod workspace", Run: checkInGitpod},
+	{Name: "gp CLI is installed", Run: checkGPInstalled},
+	{Name: "supervisor is reachable", Run: checkSupervisor},
+	{Name: "a provider is configured", Run: checkProviderConfigured},
+	{Name: "aws CLI is installed", Run: checkAWSCLI},
+	{Name: "OIDC issuer is reachable and the clock is in sync", Run: checkIssuer},
+	{Name: "credential files are private", Run: checkSecretPermissions},
+}
+
+func runDoctor(ctx context.Context, args []string) error {
+	// the issuer check reports the clock skew itself
+	clockSkewWarned.Store(true)
+	return runChecks(ctx, doctorChecks, false)
+}
+
+// runChecks runs checks one after the other and prints their outcomes, with stopOnFail stopping at the first which
+// fails because the others depend on it.
+func runChecks(ctx context.Context, checks []doctorCheck, stopOnFail bool) error {
+	var failed int
+	for _, c := range checks {
+		res, detail, fix := c.Run(ctx)
+		fmt.Printf("[%s] %s", res, c.Name)
+		if detail != "" {
+			fmt.Printf(": %s", detail)
+		}
+		fmt.Println()
+		if res != checkPass && fix != "" {
+			fmt.Printf("       fix: %s\n", fix)
+		}
+		if res == checkFail {
+			failed++
+			if stopOnFail {
+				break
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+func checkInGitpod(ctx context.Context) (checkResult, string, string) {
+	if os.Getenv("GITPOD_WORKSPACE_URL") == "" {
+		return checkFail, "GITPOD_WORKSPACE_URL is not set", "run this tool inside a Gitpod workspace"
+	}
+	return checkPass, os.Getenv("GITPOD_WORKSPACE_URL"), ""
+}
+
+func checkGPInstalled(ctx context.Context) (checkResult, string, string) {
+	pth, err := runner.LookPath("gp")
+	if err != nil {
+		return checkFail, "gp not found on PATH", "gp ships with every Gitpod workspace image - make sure /usr/bin or /.supervisor is on your PATH"
+	}
+	return checkPass, pth, ""
+}
+
+func checkSupervisor(ctx context.Context) (checkResult, string, string) {
+	addr := os.Getenv("SUPERVISOR_ADDR")
+	if addr == "" {
+		return checkFail, "SUPERVISOR_ADDR is not set", "SUPERVISOR_ADDR is set by Gitpod - check it isn't removed by your shell profile"
+	}
+	dialer := net.Dialer{Timeout: 2 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return checkFail, err.Error(), "the supervisor runs in every workspace - restart the workspace if it is unreachable"
+	}
+	conn.Close()
+	return checkPass, addr, ""
+}
+
+func checkProviderConfigured(ctx context.Context) (checkResult, string, string) {
+	var configured []string
+	for _, p := range providers {
+		if p.configured() {
+			configured = append(configured, p.Name)
+		}
+	}
+	if len(configured) == 0 {
+		return checkFail, "no provider is configured", "set up OIDC trust (https://www.gitpod.io/docs/integrations/aws) and set IDP_AWS_ROLE_ARN on your project"
+	}
+	return checkPass, strings.Join(configured, ", "), ""
+}
+
+func checkAWSCLI(ctx context.Context) (checkResult, string, string) {
+	if !awsConfigured() {
+		return checkPass, "not needed", ""
+	}
+	pth, err := runner.LookPath("aws")
+	if err != nil {
+		return checkFail, "aws not found on PATH", "install the AWS CLI (https://docs.aws.amazon.com/cli/latest/userguide/getting-started-install.html)"
+	}
+	return checkPass, pth, ""
+}
+
+func checkIssuer(ctx context.Context) (checkResult, string, string) {
+	issuer, err := gitpodIssuer()
+	if err != nil {
+		return checkFail, err.Error(), "GITPOD_HOST is set by Gitpod - check it isn't removed by your shell profile"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return checkFail, err.Error(), ""
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return checkFail, err.Error(), "check that the workspace can reach " + issuer
+	}
+	drainBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return checkFail, fmt.Sprintf("discovery document returned %s", resp.Status), "check that the workspace can reach " + issuer
+	}
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return checkWarn, "cannot determine clock skew: issuer sent no Date header", ""
+	}
+	skew := time.Since(date)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew {
+		return checkWarn, fmt.Sprintf("local clock is off by %s", skew.Round(time.Second)), "synchronise the system clock - tokens may be rejected as not yet valid or expired"
+	}
+	return checkPass, issuer, ""
+}
+
+func checkSecretPermissions(ctx context.Context) (checkResult, string, string) {
+	var fns []string
+	if fn, err := awsCredentialsFile(); err == nil {
+		fns = append(fns, fn)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		fns = append(fns, filepath.Join(home, ".vault-token"))
+	}
+	if fn, err := dotenvPath(); err == nil && fn != "" {
+		fns = append(fns, fn)
+	}
+	if dir, err := stateDir(); err == nil {
+		_ = filepath.WalkDir(dir, func(fn string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				fns = append(fns, fn)
+			}
+			return nil
+		})
+	}
+	exposed := exposedFiles(fns...)
+	if len(exposed) > 0 {
+		return checkWarn, "other users can read " + strings.Join(exposed, ", "), "run chmod 600 on them, or sign in again, which fixes them"
+	}
+	return checkPass, "", ""
+}
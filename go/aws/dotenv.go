@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dotenvConfig configures a .env file the credentials are written to after each login, for frameworks which
+// only read dotenv files at startup.
+type dotenvConfig struct {
+	// Path of the file, relative to the repository root unless absolute. IDP_DOTENV_PATH overrides it.
+	Path string `json:"path,omitempty"`
+	// Providers whose credentials to write. Defaults to all providers.
+	Providers []string `json:"providers,omitempty"`
+	// Keys renames variables, e.g. {"AWS_ACCESS_KEY_ID": "APP_AWS_KEY"}.
+	Keys map[string]string `json:"keys,omitempty"`
+}
+
+func dotenvPath() (string, error) {
+	fn := setting("IDP_DOTENV_PATH")
+	if fn == "" && cfg != nil && cfg.Dotenv != nil {
+		fn = cfg.Dotenv.Path
+	}
+	if fn == "" || filepath.IsAbs(fn) {
+		return fn, nil
+	}
+	root, err := repoRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, fn), nil
+}
+
+// writeDotenvSink updates the configured .env file with the current credentials. It does nothing if no file is configured.
+func writeDotenvSink(ctx context.Context) error {
+	fn, err := dotenvPath()
+	if err != nil || fn == "" {
+		return err
+	}
+	var dc dotenvConfig
+	if cfg != nil && cfg.Dotenv != nil {
+		dc = *cfg.Dotenv
+	}
+
+	err = ensureGitignored(ctx, fn)
+	if err != nil {
+		return withExitCode(exitPersistFailed, err)
+	}
+
+	selected, err := selectProviders(dc.Providers)
+	if err != nil {
+		return err
+	}
+	env, err := credentialEnv(selected)
+	if err != nil {
+		return err
+	}
+	vars := make(map[string]string, len(env))
+	for k, v := range env {
+		if renamed, ok := dc.Keys[k]; ok {
+			k = renamed
+		}
+		vars[k] = v
+	}
+
+	err = updateDotenvFile(fn, vars)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write %s: %w", fn, err)
+	}
+	emitEvent(eventProfileWritten, "", "path", fn)
+	return nil
+}
+
+// ensureGitignored fails if fn is inside a git repository and not ignored, so that credentials don't end up in a commit.
+func ensureGitignored(ctx context.Context, fn string) error {
+	_, err := runner.Output(ctx, "git", "-C", filepath.Dir(fn), "check-ignore", "--quiet", fn)
+	if err == nil {
+		return nil
+	}
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+		return fmt.Errorf("refusing to write credentials to %s: it is not gitignored - add it to .gitignore first", fn)
+	}
+	// not a git repository, or git is not installed
+	return nil
+}
+
+// updateDotenvFile sets vars in the dotenv file fn, keeping all other lines as they are.
+func updateDotenvFile(fn string, vars map[string]string) error {
+	fc, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var (
+		lines   []string
+		written = make(map[string]bool, len(vars))
+	)
+	if len(fc) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(fc), "\n"), "\n")
+	}
+	for i, l := range lines {
+		k, _, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(l), "export "), "=")
+		if !ok {
+			continue
+		}
+		k = strings.TrimSpace(k)
+		if v, ok := vars[k]; ok {
+			lines[i] = k + "=" + strconv.Quote(v)
+			written[k] = true
+		}
+	}
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		if !written[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, k+"="+strconv.Quote(vars[k]))
+	}
+
+	return writeWipedSecretFile(fn, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// dotenvKeys returns the keys set in the dotenv file fn. Missing files have none.
+func dotenvKeys(fn string) (map[string]bool, error) {
+	fc, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]bool)
+	for _, l := range strings.Split(string(fc), "\n") {
+		if k, _, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(l), "export "), "="); ok {
+			res[strings.TrimSpace(k)] = true
+		}
+	}
+	return res, nil
+}
+
+// removeDotenvKeys removes the lines setting keys from the dotenv file fn, keeping all other lines as they are.
+func removeDotenvKeys(fn string, keys []string) error {
+	fc, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	drop := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		drop[k] = true
+	}
+	var lines []string
+	for _, l := range strings.Split(strings.TrimSuffix(string(fc), "\n"), "\n") {
+		if k, _, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(l), "export "), "="); ok && drop[strings.TrimSpace(k)] {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return writeSecretFile(fn, []byte(strings.Join(lines, "\n")+"\n"))
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "editor",
+		Usage:   "editor [--poll 5s] [provider...]",
+		Summary: "speak JSON-RPC on stdio for editor extensions: status, login, refresh and notifications before credentials expire",
+		Run:     runEditor,
+	})
+}
+
+// editorServer answers an editor extension, which shows the credential state in the status bar and offers to sign
+// in again when it's told that credentials expire.
+type editorServer struct {
+	providers []provider
+	conn      *rpcConn
+	poll      time.Duration
+
+	// signin makes logins and refreshes asked for while one is running wait for it.
+	signin sync.Mutex
+
+	mu         sync.Mutex
+	subscribed bool
+	warnBefore time.Duration
+	last       map[string]providerStatus
+	warned     map[string]time.Time
+}
+
+// editorExpiringParams are the params of the credentials/expiring notification.
+type editorExpiringParams struct {
+	Provider  string    `json:"provider"`
+	Expiry    time.Time `json:"expiry"`
+	ExpiresIn int64     `json:"expiresInSeconds"`
+	Message   string    `json:"message"`
+}
+
+func runEditor(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("editor", flag.ExitOnError)
+	poll := flags.Duration("poll", 5*time.Second, "how often to look for changed credentials while subscribed")
+	_ = flags.Parse(args)
+
+	selected, err := selectProviders(flags.Args())
+	if err != nil {
+		return err
+	}
+	// stdout carries the protocol, so everything else printed while signing in goes to stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = out }()
+
+	s := &editorServer{
+		providers: selected,
+		conn:      newRPCConn(out),
+		poll:      *poll,
+		last:      make(map[string]providerStatus),
+		warned:    make(map[string]time.Time),
+	}
+	return s.serve(ctx, os.Stdin)
+}
+
+// serve answers the requests of in, each in a goroutine of its own so that status is answered while a login
+// runs, and watches the credentials for subscribers until in ends.
+func (s *editorServer) serve(ctx context.Context, in io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.watch(ctx)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	return s.conn.serve(in, func(req rpcRequest) error {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := s.handle(ctx, req)
+			_ = s.conn.reply(req, res, err)
+		}()
+		return nil
+	})
+}
+
+func (s *editorServer) handle(ctx context.Context, req rpcRequest) (any, error) {
+	switch req.Method {
+	case "initialize":
+		names := make([]string, 0, len(s.providers))
+		for _, p := range s.providers {
+			names = append(names, p.Name)
+		}
+		return map[string]any{"version": version, "providers": names}, nil
+	case "status":
+		return s.status()
+	case "login", "refresh":
+		var params struct {
+			Provider string `json:"provider"`
+		}
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, err
+		}
+		p, ok := s.provider(params.Provider)
+		if !ok {
+			return nil, fmt.Errorf("unknown provider %q", params.Provider)
+		}
+		signin := loginProvider
+		if req.Method == "refresh" {
+			signin = refreshProvider
+		}
+		s.signin.Lock()
+		err = signin(ctx, p)
+		s.signin.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return getProviderStatus(p)
+	case "subscribe":
+		params := struct {
+			WarnBefore int64 `json:"warnBeforeSeconds"`
+		}{WarnBefore: int64((10 * time.Minute).Seconds())}
+		if len(req.Params) > 0 {
+			err := json.Unmarshal(req.Params, &params)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.mu.Lock()
+		s.subscribed = true
+		s.warnBefore = time.Duration(params.WarnBefore) * time.Second
+		s.mu.Unlock()
+		// the current state, which later notifications change
+		return s.status()
+	case "unsubscribe":
+		s.mu.Lock()
+		s.subscribed = false
+		s.mu.Unlock()
+		return map[string]any{}, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+}
+
+func (s *editorServer) provider(name string) (provider, bool) {
+	for _, p := range s.providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return provider{}, false
+}
+
+// status returns the status of all providers, and remembers it as what subscribers know.
+func (s *editorServer) status() (any, error) {
+	res := []providerStatus{}
+	for _, p := range s.providers {
+		st, err := getProviderStatus(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, st)
+	}
+	s.mu.Lock()
+	for _, st := range res {
+		s.last[st.Provider] = st
+	}
+	s.mu.Unlock()
+	return map[string]any{"providers": res}, nil
+}
+
+// watch notifies subscribers of changed credentials with credentials/changed, and once per expiry with
+// credentials/expiring when they are about to expire.
+func (s *editorServer) watch(ctx context.Context) {
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		subscribed, warnBefore := s.subscribed, s.warnBefore
+		s.mu.Unlock()
+		if !subscribed {
+			continue
+		}
+		for _, p := range s.providers {
+			st, err := getProviderStatus(p)
+			if err != nil {
+				continue
+			}
+			s.mu.Lock()
+			changed := !sameProviderStatus(s.last[p.Name], st)
+			s.last[p.Name] = st
+			expiring := st.State == stateValid && st.Expiry != nil && time.Duration(st.ExpiresIn)*time.Second <= warnBefore && !s.warned[p.Name].Equal(*st.Expiry)
+			if expiring {
+				s.warned[p.Name] = *st.Expiry
+			}
+			s.mu.Unlock()
+
+			if changed {
+				_ = s.conn.notify("credentials/changed", st)
+			}
+			if expiring {
+				left := time.Duration(st.ExpiresIn) * time.Second
+				_ = s.conn.notify("credentials/expiring", editorExpiringParams{
+					Provider:  p.Name,
+					Expiry:    *st.Expiry,
+					ExpiresIn: st.ExpiresIn,
+					Message:   expiryWarning(p.Name, left),
+				})
+			}
+		}
+	}
+}
+
+// sameProviderStatus reports whether a and b describe the same credentials, regardless of the time left.
+func sameProviderStatus(a, b providerStatus) bool {
+	sameTime := func(x, y *time.Time) bool {
+		if x == nil || y == nil {
+			return x == y
+		}
+		return x.Equal(*y)
+	}
+	return a.Configured == b.Configured && a.State == b.State && a.Identity == b.Identity && sameTime(a.IssuedAt, b.IssuedAt) && sameTime(a.Expiry, b.Expiry)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "elevate",
+		Usage:   "elevate --role name|arn [--for 30m] | end [--wait id] | status",
+		Summary: "assume a privileged AWS role for a while, then sign back into the default role and scrub the elevated session",
+		Run:     runElevate,
+	})
+}
+
+// elevateMethod is the method of credential records of elevated sessions.
+const elevateMethod = "elevate"
+
+// minSTSDuration is the shortest session STS issues. Shorter elevations are ended by the watcher before their
+// credentials expire.
+const minSTSDuration = 15 * time.Minute
+
+// elevation is a time-boxed session in a privileged role, which ends at Until.
+type elevation struct {
+	ID    string    `json:"id"`
+	Role  string    `json:"role"`
+	Until time.Time `json:"until"`
+	// PreviousRole is the role the default profile was signed into before, which ending the elevation signs back
+	// into. It's empty for the configured default and for profiles logins.
+	PreviousRole string `json:"previousRole,omitempty"`
+	// WatcherPID is the process ending the elevation at Until.
+	WatcherPID int `json:"watcherPid,omitempty"`
+}
+
+func elevationPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "elevation.json"), nil
+}
+
+// loadElevation returns the current elevation, or nil if there is none.
+func loadElevation() (*elevation, error) {
+	fn, err := elevationPath()
+	if err != nil {
+		return nil, err
+	}
+	fc, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res elevation
+	err = json.Unmarshal(fc, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", fn, err)
+	}
+	return &res, nil
+}
+
+func saveElevation(e elevation) error {
+	fn, err := elevationPath()
+	if err != nil {
+		return err
+	}
+	fc, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeSecretFile(fn, fc)
+}
+
+func runElevate(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "end":
+			return runElevateEnd(ctx, args[1:])
+		case "status":
+			return runElevateStatus(ctx, args[1:])
+		}
+	}
+	flags := flag.NewFlagSet("elevate", flag.ExitOnError)
+	role := flags.String("role", "", "the role to assume: its ARN, or its name in the account of the configured roles")
+	window := flags.Duration("for", 30*time.Minute, "how long to stay elevated")
+	_ = flags.Parse(args)
+	if *role == "" || flags.NArg() > 0 {
+		return exitErrorf(exitUsage, "usage: elevate --role name|arn [--for 30m]")
+	}
+	if *window < time.Minute || *window > 12*time.Hour {
+		return exitErrorf(exitUsage, "--for must be between 1m and 12h")
+	}
+	roleARN, err := resolveElevationRole(*role)
+	if err != nil {
+		return err
+	}
+
+	// the approvers may take a while, longer than others wait for the lock
+	err = confirmRole(ctx, roleARN)
+	if err != nil {
+		return err
+	}
+	unlock, _, err := acquireLock(ctx, "elevate")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current, err := loadElevation()
+	if err != nil {
+		return err
+	}
+
+	e := elevation{ID: randomHex(8), Role: roleARN, Until: time.Now().Add(*window)}
+	switch {
+	case current != nil:
+		// elevating again extends or replaces the elevation, and ends in the same role
+		e.PreviousRole = current.PreviousRole
+	default:
+		if rec, _ := loadCredentialRecord("aws"); rec != nil && rec.Method != awsProfilesMethod {
+			e.PreviousRole = rec.Identity
+		}
+	}
+	// runSignin would downgrade to the read-only role rather than refuse, which is no elevation
+	err = guardCredentials(ctx, "elevated access to "+roleARN)
+	if err != nil {
+		return err
+	}
+	p, _ := findProvider("aws")
+	err = runSignin(ctx, p, "login", func(ctx context.Context) error { return elevateAWS(ctx, e) })
+	if err != nil {
+		return err
+	}
+	pid, err := startElevationWatcher(e.ID)
+	if err != nil {
+		printWarning("cannot start the process which ends the elevation, run idp elevate end when done: %v", err)
+	}
+	e.WatcherPID = pid
+	err = saveElevation(e)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot remember the elevation: %w", err)
+	}
+	back := e.PreviousRole
+	if back == "" {
+		back = "the default role"
+	}
+	printSuccess("elevated to %s until %s, then back to %s", roleARN, e.Until.Local().Format(time.Kitchen), back)
+	return nil
+}
+
+// elevateAWS assumes the role of e with a session lasting until e.Until, or the shortest session STS issues, and
+// writes it to the default profile. A session policy denies everything after e.Until, so that shorter elevations
+// end with it although the session stays valid for 15 minutes.
+func elevateAWS(ctx context.Context, e elevation) error {
+	duration := time.Until(e.Until).Round(time.Second)
+	if duration < minSTSDuration {
+		duration = minSTSDuration
+	}
+	token, err := gitpodIDToken(ctx, providerAudience("aws"))
+	if err != nil {
+		return err
+	}
+	sessionName := gitpodidp.DefaultSessionName()
+	var creds *gitpodidp.AWSCredentials
+	err = traceStep(ctx, "exchange token", func(ctx context.Context) error {
+		return withProgress("assuming "+e.Role+" for "+time.Until(e.Until).Round(time.Minute).String(), func() (err error) {
+			creds, err = gitpodidp.AssumeRoleWithWebIdentity(ctx, token, gitpodidp.AssumeRoleInput{
+				RoleARN:     e.Role,
+				SessionName: sessionName,
+				Duration:    duration,
+				Region:      setting("IDP_AWS_REGION"),
+				Policy:      elevationPolicy(e.Until),
+			})
+			return err
+		})
+	}, "idp.method", elevateMethod)
+	if err != nil {
+		return exitErrorf(exitExchangeFailed, "cannot assume %s: %w - its maximum session duration may be shorter than --for", e.Role, err)
+	}
+	registerSecret(creds.SecretAccessKey)
+	registerSecret(creds.SessionToken)
+	emitEvent(eventExchangeSucceeded, "aws", "method", elevateMethod, "roleArn", e.Role)
+
+	err = writeDefaultProfile(ctx, map[string]string{
+		"aws_access_key_id":     creds.AccessKeyID,
+		"aws_secret_access_key": creds.SecretAccessKey,
+		"aws_session_token":     creds.SessionToken,
+	})
+	if err != nil {
+		return err
+	}
+	emitEvent(eventProfileWritten, "aws", "profile", "default")
+	// the record expires with the elevation, which is when the daemon and refreshes end it
+	expiry := localTime(creds.Expiration)
+	if e.Until.Before(expiry) {
+		expiry = e.Until
+	}
+	recordLogin(credentialRecord{Provider: "aws", Identity: e.Role, Method: elevateMethod, SessionName: sessionName, Expiry: expiry})
+	return nil
+}
+
+// elevationPolicy is the session policy of elevated sessions: all the role allows, until the elevation is over.
+func elevationPolicy(until time.Time) string {
+	return snippetJSON(map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{{
+			"Effect":    "Allow",
+			"Action":    "*",
+			"Resource":  "*",
+			"Condition": map[string]interface{}{"DateLessThan": map[string]string{"aws:CurrentTime": until.UTC().Format(time.RFC3339)}},
+		}},
+	}, "")
+}
+
+// resolveElevationRole returns the ARN of the role name, which is an ARN already, the name of one of the
+// configured or privileged roles, or a role in the account of the configured roles.
+func resolveElevationRole(name string) (string, error) {
+	if strings.HasPrefix(name, "arn:") {
+		return name, nil
+	}
+	var known []string
+	for _, key := range []string{"IDP_AWS_ROLE_ARN", "IDP_AWS_PRIVILEGED_ROLES", "IDP_AWS_APPROVAL_ROLES"} {
+		for _, r := range rolePatterns(key) {
+			if !strings.Contains(r, "*") {
+				known = append(known, r)
+			}
+		}
+	}
+	if profiles, err := awsProfiles(); err == nil {
+		for _, p := range profiles {
+			known = append(known, p.RoleARN)
+		}
+	}
+	for _, r := range known {
+		if strings.HasSuffix(r, ":role/"+name) || strings.HasSuffix(r, "/"+name) {
+			return r, nil
+		}
+	}
+	for _, r := range known {
+		// arn:aws:iam::<account>:role/<name>
+		if parts := strings.SplitN(r, ":", 6); len(parts) == 6 && parts[4] != "" {
+			return strings.Join(parts[:5], ":") + ":role/" + name, nil
+		}
+	}
+	return "", exitErrorf(exitMissingConfig, "cannot tell the account of the role %s - pass its ARN", name)
+}
+
+// startElevationWatcher starts a process of this binary in the background which ends the elevation id once it's
+// over, and outlives the terminal it's started from.
+func startElevationWatcher(id string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(exe, "elevate", "end", "--wait", id)
+	cmd.Env = os.Environ()
+	detachProcess(cmd)
+	err = cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Release()
+	return pid, nil
+}
+
+func runElevateEnd(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("elevate end", flag.ExitOnError)
+	wait := flags.String("wait", "", "wait until the elevation with this ID is over before ending it, as the process elevate starts does")
+	_ = flags.Parse(args)
+
+	if *wait != "" {
+		for {
+			e, err := loadElevation()
+			if err != nil {
+				return err
+			}
+			// ended, or replaced by another elevation, which has a watcher of its own
+			if e == nil || e.ID != *wait {
+				return nil
+			}
+			left := time.Until(e.Until)
+			if left <= 0 {
+				break
+			}
+			// waking up every minute notices a suspended machine's clock jumping ahead
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(min(left, time.Minute)):
+			}
+		}
+	}
+	ended, err := endElevation(ctx, *wait, returnFromElevation)
+	if err != nil {
+		return err
+	}
+	if !ended && *wait == "" {
+		printSuccess("not elevated")
+	}
+	return nil
+}
+
+// endElevation ends the current elevation, or only the one with the given ID if it's set, and reports whether
+// there was one. The elevated session is logged out like idp logout aws would, so that no files keep it, and signin
+// signs the default profile back into the role it had before, or the default role if that's empty. The session
+// itself stays valid until STS expires it, but its policy denies everything once the elevation is over.
+func endElevation(ctx context.Context, id string, signin func(ctx context.Context, roleARN string) error) (bool, error) {
+	unlock, _, err := acquireLock(ctx, "elevate")
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	e, err := loadElevation()
+	if err != nil || e == nil || (id != "" && e.ID != id) {
+		return false, err
+	}
+	err = logoutAWS(ctx, false)
+	if err != nil {
+		return true, exitErrorf(exitPersistFailed, "cannot remove the elevated credentials of %s: %w", e.Role, err)
+	}
+	recordFile, err := credentialRecordPath("aws")
+	if err != nil {
+		return true, err
+	}
+	fn, err := elevationPath()
+	if err == nil {
+		err = removeFiles(recordFile, fn)
+	}
+	if err != nil {
+		return true, exitErrorf(exitPersistFailed, "cannot remove the elevation: %w", err)
+	}
+	if time.Until(e.Until) > 0 {
+		printWarning("STS sessions cannot be revoked, so the elevated session of %s stays usable by whoever has a copy until %s", e.Role, e.Until.Local().Format(time.Kitchen))
+	}
+	entry := newAuditEntry(credentialRecord{Provider: "aws", Identity: e.Role, Method: elevateMethod + "-end", IssuedAt: time.Now()})
+	if err := appendAuditEntry(entry); err != nil {
+		slog.Warn("cannot write the audit log", "provider", "aws", "error", err)
+	}
+
+	err = signin(ctx, e.PreviousRole)
+	if err != nil {
+		notify(ctx, notifyWarning, fmt.Sprintf("the elevated access to %s ended, but signing back into AWS failed - run idp login aws: %v", e.Role, err))
+		return true, err
+	}
+	back := e.PreviousRole
+	if back == "" {
+		back, _ = awsRoleARN()
+	}
+	notify(ctx, notifyInfo, fmt.Sprintf("the elevated access to %s ended, signed back into %s", e.Role, back))
+	return true, nil
+}
+
+// returnFromElevation signs back into roleARN, the role before an elevation, like a login. The role was confirmed
+// when it was signed into.
+func returnFromElevation(ctx context.Context, roleARN string) error {
+	p, _ := findProvider("aws")
+	return runSignin(ctx, p, "login", func(ctx context.Context) error { return loginAWSRole(ctx, roleARN, checkRefreshAllowed) })
+}
+
+// refreshElevated is the refresh of elevated credentials, which aren't renewed: it fails while the elevation lasts,
+// and ends it once it's over.
+func refreshElevated(ctx context.Context) error {
+	e, err := loadElevation()
+	if err != nil {
+		return err
+	}
+	if e != nil && time.Until(e.Until) > 0 {
+		return exitErrorf(exitMissingConfig, "the elevated session of %s isn't renewed, it ends at %s - run idp elevate again to extend it", e.Role, e.Until.Local().Format(time.Kitchen))
+	}
+	if e == nil {
+		// the elevation was ended without its record
+		return loginAWS(ctx)
+	}
+	// a refresh is a sign-in already, and the previous role was confirmed when it was signed into
+	_, err = endElevation(ctx, e.ID, func(ctx context.Context, roleARN string) error {
+		return loginAWSRole(ctx, roleARN, checkRefreshAllowed)
+	})
+	return err
+}
+
+func runElevateStatus(ctx context.Context, args []string) error {
+	e, err := loadElevation()
+	if err != nil {
+		return err
+	}
+	// JSON output is null while not elevated
+	return writeOutput(e, func(out io.Writer) error {
+		switch {
+		case e == nil:
+			fmt.Fprintln(out, "not elevated")
+		case time.Until(e.Until) <= 0:
+			fmt.Fprintf(out, "the elevation to %s was over at %s, but hasn't been ended - run idp elevate end\n", e.Role, e.Until.Local().Format(time.Kitchen))
+		default:
+			fmt.Fprintf(out, "elevated to %s for another %s, until %s\n", e.Role, time.Until(e.Until).Round(time.Minute), e.Until.Local().Format(time.Kitchen))
+		}
+		return nil
+	})
+}
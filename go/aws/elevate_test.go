@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEndElevationSignsBackIntoPreviousRole(t *testing.T) {
+	testWorkspace(t, &fakeRunner{})
+	previous := "arn:aws:iam::123456789012:role/dev"
+	err := saveElevation(elevation{ID: "e1", Role: "arn:aws:iam::123456789012:role/admin", Until: time.Now().Add(-time.Minute), PreviousRole: previous})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	ended, err := endElevation(context.Background(), "e1", func(ctx context.Context, roleARN string) error {
+		got = append(got, roleARN)
+		return nil
+	})
+	if err != nil || !ended {
+		t.Fatalf("endElevation() = %v, %v, want true, nil", ended, err)
+	}
+	if len(got) != 1 || got[0] != previous {
+		t.Errorf("signed back into %v, want [%s]", got, previous)
+	}
+	if *roleFlag != "" || *confirmPrivilegedFlag {
+		t.Errorf("endElevation changed -role to %q and -confirm-privileged to %v", *roleFlag, *confirmPrivilegedFlag)
+	}
+	if e, _ := loadElevation(); e != nil {
+		t.Errorf("the elevation %v is still there", e)
+	}
+
+	ended, err = endElevation(context.Background(), "e1", func(ctx context.Context, roleARN string) error {
+		t.Error("signed in although there was no elevation")
+		return nil
+	})
+	if err != nil || ended {
+		t.Errorf("endElevation() without elevation = %v, %v, want false, nil", ended, err)
+	}
+}
+
+func TestElevateConfirmsRoleBeforeLocking(t *testing.T) {
+	testWorkspace(t, &fakeRunner{run: fakeGitpodToken})
+	t.Setenv("IDP_AWS_ALLOWED_ROLES", "arn:aws:iam::*:role/dev-*")
+	unlock, _, err := acquireLock(context.Background(), "elevate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	start := time.Now()
+	err = runElevate(context.Background(), []string{"--role", "arn:aws:iam::123456789012:role/admin"})
+	if exitCode(err) != exitMissingConfig {
+		t.Fatalf("runElevate() error = %v, want the role refused", err)
+	}
+	if elapsed := time.Since(start); elapsed >= lockTimeout {
+		t.Errorf("waited %v for the lock before checking the role", elapsed)
+	}
+}
+
+func TestElevationPolicyEndsWithElevation(t *testing.T) {
+	until := time.Date(2026, 10, 14, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	var policy struct {
+		Statement []struct {
+			Effect    string
+			Condition map[string]map[string]string
+		}
+	}
+	err := json.Unmarshal([]byte(elevationPolicy(until)), &policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Statement) != 1 || policy.Statement[0].Effect != "Allow" {
+		t.Fatalf("policy statements = %+v, want a single Allow", policy.Statement)
+	}
+	if got := policy.Statement[0].Condition["DateLessThan"]["aws:CurrentTime"]; got != "2026-10-14T10:30:00Z" {
+		t.Errorf("policy ends at %q, want 2026-10-14T10:30:00Z", got)
+	}
+}
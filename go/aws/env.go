@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "env",
+		Usage:   "env [--export] [--format posix|fish|pwsh|nu] [provider...]",
+		Summary: "print the credentials as environment variables, e.g. for eval \"$(idp env --export)\"",
+		Run:     runEnv,
+	})
+}
+
+func runEnv(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("env", flag.ExitOnError)
+	export := flags.Bool("export", false, "print POSIX shell export statements, like --format posix")
+	format := flags.String("format", "", "print the variables for a shell: posix, fish, pwsh or nu (default KEY=value lines)")
+	login := flags.Bool("login", false, "sign in first where credentials are missing, expired or for a different identity than configured")
+	_ = flags.Parse(args)
+
+	if *export && *format == "" {
+		*format = "posix"
+	}
+	if _, ok := envFormats[*format]; !ok {
+		return exitErrorf(exitUsage, "unknown env format %q, use one of posix, fish, pwsh or nu", *format)
+	}
+	selected, err := selectProviders(flags.Args())
+	if err != nil {
+		return err
+	}
+	if *login {
+		err = loginWhereNeeded(ctx, selected, 0)
+		if err != nil {
+			return err
+		}
+	}
+	env, err := credentialEnv(selected)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	keys := sortedKeys(env)
+	if *format == "nu" {
+		// a record, for idp env --format nu | from json | load-env
+		err = json.NewEncoder(&out).Encode(env)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, k := range keys {
+			fmt.Fprintln(&out, envFormats[*format](k, env[k]))
+		}
+	}
+	_, err = os.Stdout.Write(out.Bytes())
+	if err != nil {
+		return err
+	}
+	saveFastPath(out.Bytes(), credentialsExpiry(selected), keys, nil)
+	return nil
+}
+
+// envFormats format a variable for env --format. nu prints JSON instead.
+var envFormats = map[string]func(k, v string) string{
+	"": func(k, v string) string { return k + "=" + v },
+	// for eval "$(idp env --export)"
+	"posix": func(k, v string) string { return "export " + k + "=" + shellQuote(v) },
+	// for idp env --format fish | source
+	"fish": func(k, v string) string {
+		return "set -gx " + k + " '" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+	},
+	// for idp env --format pwsh | Invoke-Expression
+	"pwsh": func(k, v string) string { return "$Env:" + k + " = '" + strings.ReplaceAll(v, "'", "''") + "'" },
+	"nu":   nil,
+}
+
+// selectProviders returns the providers with the given names, or all providers if names is empty.
+func selectProviders(names []string) ([]provider, error) {
+	if len(names) == 0 {
+		return providers, nil
+	}
+	res := make([]provider, 0, len(names))
+	for _, n := range names {
+		p, ok := findProvider(n)
+		if !ok {
+			return nil, exitErrorf(exitUsage, "unknown provider %q", n)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// loginWhereNeeded signs into every configured provider among selected whose credentials cannot be used as they are,
+// or expire within minValid.
+func loginWhereNeeded(ctx context.Context, selected []provider, minValid time.Duration) error {
+	for _, p := range selected {
+		if !p.configured() {
+			continue
+		}
+		rec, err := loadCredentialRecord(p.Name)
+		if err != nil {
+			return err
+		}
+		if rec != nil && rec.Identity == p.Identity() && (rec.Expiry.IsZero() || time.Until(rec.Expiry) > minValid) {
+			continue
+		}
+		if rec != nil && rec.Identity == p.Identity() {
+			err = refreshProvider(ctx, p)
+		} else {
+			err = loginProvider(ctx, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credentialEnv returns the environment variables for all selected providers which have credentials, and those of
+// the token claims IDP_EXPORT_CLAIMS lists if any of them has.
+func credentialEnv(selected []provider) (map[string]string, error) {
+	res := make(map[string]string)
+	signedIn := false
+	for _, p := range selected {
+		rec, err := loadCredentialRecord(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if rec == nil {
+			continue
+		}
+		signedIn = true
+		env, err := p.Env()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name, err)
+		}
+		for k, v := range env {
+			res[k] = v
+		}
+	}
+	if !signedIn {
+		return res, nil
+	}
+	claims, err := claimEnv()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the token claims to export: %w", err)
+	}
+	for k, v := range claims {
+		res[k] = v
+	}
+	return res, nil
+}
+
+// credentialsExpiry returns when the first of the credentials of the selected providers expires, or zero if none
+// do.
+func credentialsExpiry(selected []provider) time.Time {
+	var res time.Time
+	for _, p := range selected {
+		if rec, _ := loadCredentialRecord(p.Name); rec != nil {
+			res = earliest(res, rec.Expiry)
+		}
+	}
+	return res
+}
+
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func envAWS() (map[string]string, error) {
+	if rec, _ := loadCredentialRecord("aws"); rec != nil && rec.Method == awsProfilesMethod {
+		return envAWSProfiles()
+	}
+	fn, err := awsCredentialsFile()
+	if err != nil {
+		return nil, err
+	}
+	profile, err := readINISection(fn, "default")
+	if err != nil {
+		return nil, err
+	}
+	if profile["aws_access_key_id"] == "" {
+		return nil, fmt.Errorf("the default profile in %s has no credentials", fn)
+	}
+	res := map[string]string{
+		"AWS_ACCESS_KEY_ID":     profile["aws_access_key_id"],
+		"AWS_SECRET_ACCESS_KEY": profile["aws_secret_access_key"],
+		"AWS_SESSION_TOKEN":     profile["aws_session_token"],
+	}
+	if region := setting("IDP_AWS_REGION"); region != "" {
+		res["AWS_REGION"] = region
+		res["AWS_DEFAULT_REGION"] = region
+	}
+	return res, nil
+}
+
+func envGCP() (map[string]string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	credFile := filepath.Join(dir, "gcp-credentials.json")
+	res := map[string]string{
+		"GOOGLE_APPLICATION_CREDENTIALS":         credFile,
+		"CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE": credFile,
+	}
+	if project := setting("IDP_GCP_PROJECT"); project != "" {
+		res["GOOGLE_CLOUD_PROJECT"] = project
+	}
+	return res, nil
+}
+
+func envAzure() (map[string]string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{
+		"AZURE_CLIENT_ID":            setting("IDP_AZURE_CLIENT_ID"),
+		"AZURE_TENANT_ID":            setting("IDP_AZURE_TENANT_ID"),
+		"AZURE_FEDERATED_TOKEN_FILE": filepath.Join(dir, "azure-token"),
+	}
+	if sub := setting("IDP_AZURE_SUBSCRIPTION_ID"); sub != "" {
+		res["AZURE_SUBSCRIPTION_ID"] = sub
+	}
+	if host := setting("IDP_AZURE_AUTHORITY_HOST"); host != "" {
+		res["AZURE_AUTHORITY_HOST"] = host
+	}
+	return res, nil
+}
+
+func envVault() (map[string]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	token, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read Vault token: %w", err)
+	}
+	res := map[string]string{
+		"VAULT_ADDR":  setting("VAULT_ADDR"),
+		"VAULT_TOKEN": strings.TrimSpace(string(token)),
+	}
+	if ns := setting("VAULT_NAMESPACE"); ns != "" {
+		res["VAULT_NAMESPACE"] = ns
+	}
+	return res, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// environmentsConfig maps the names of target environments, e.g. staging, to the settings they override, keyed
+// by the environment variable which sets them otherwise, e.g. {"IDP_AWS_ROLE_ARN": "...", "IDP_AWS_REGION": "..."}.
+type environmentsConfig map[string]map[string]string
+
+// environmentFlag is the environment login --env selected, if it was given.
+var environmentFlag *string
+
+// sessionEnvironment is the environment selected by an earlier login in this workspace session.
+var sessionEnvironment struct {
+	once sync.Once
+	name string
+}
+
+// environmentName returns the selected environment: that of login --env, or of IDP_ENVIRONMENT, or the one the
+// last login --env of this workspace session selected. It's empty if none is selected.
+func environmentName() string {
+	if environmentFlag != nil {
+		return *environmentFlag
+	}
+	if name, ok := os.LookupEnv("IDP_ENVIRONMENT"); ok {
+		return name
+	}
+	sessionEnvironment.once.Do(func() {
+		sessionEnvironment.name = loadSessionState().Environment
+	})
+	return sessionEnvironment.name
+}
+
+// environmentSettings returns the settings of the selected environment, which take precedence over both the
+// environment variables and the rest of the config file.
+func environmentSettings() map[string]string {
+	return cfg.environmentSettings()
+}
+
+func (c *config) environmentSettings() map[string]string {
+	if c == nil || len(c.Environments) == 0 {
+		return nil
+	}
+	name := environmentName()
+	if name == "" {
+		return nil
+	}
+	return c.Environments[name]
+}
+
+// selectEnvironment makes name the environment of this command and of the rest of the workspace session. An empty
+// name goes back to the plain settings.
+func selectEnvironment(name string) error {
+	if name != "" {
+		if cfg == nil || cfg.Environments[name] == nil {
+			var known []string
+			if cfg != nil {
+				known = sortedKeys(cfg.Environments)
+			}
+			if len(known) == 0 {
+				return exitErrorf(exitMissingConfig, "unknown environment %q: the config file defines no environments", name)
+			}
+			return exitErrorf(exitUsage, "unknown environment %q, use one of %s", name, strings.Join(known, ", "))
+		}
+		slog.Info("using environment", "environment", name)
+	}
+	environmentFlag = &name
+
+	session := loadSessionState()
+	if session.Environment == name {
+		return nil
+	}
+	session.Environment = name
+	err := saveSessionState(session)
+	if err != nil {
+		slog.Warn("cannot remember the environment", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// errorReportTimeout bounds sending an error report, so that a failing command still fails promptly.
+const errorReportTimeout = 3 * time.Second
+
+// errorReport describes a failed or crashed command, for platform teams to spot failures many workspaces share.
+// Everything in it is redacted like the logs are, and it names no user.
+type errorReport struct {
+	EventID  string    `json:"eventId"`
+	Time     time.Time `json:"time"`
+	Command  string    `json:"command"`
+	ExitCode int       `json:"exitCode"`
+	Error    string    `json:"error"`
+	// Crashed is set if the command panicked, and Stack then is where.
+	Crashed bool         `json:"crashed,omitempty"`
+	Stack   []stackFrame `json:"stack,omitempty"`
+	Chain   *chainReport `json:"signinChain,omitempty"`
+	Version string       `json:"version"`
+	OS      string       `json:"os"`
+	Arch    string       `json:"arch"`
+	Gitpod  string       `json:"gitpodHost,omitempty"`
+}
+
+type stackFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// errorReportingEnabled reports whether a destination for error reports is configured, with IDP_SENTRY_DSN or
+// IDP_ERROR_REPORT_ENDPOINT. IDP_ERROR_REPORTING=false opts out of a destination the config file sets.
+func errorReportingEnabled() bool {
+	if os.Getenv("IDP_ERROR_REPORTING") == "false" {
+		return false
+	}
+	return setting("IDP_SENTRY_DSN") != "" || setting("IDP_ERROR_REPORT_ENDPOINT") != ""
+}
+
+// reportableError reports whether err is worth an error report. Invalid usage, running outside of Gitpod and
+// interrupts are what the user did rather than failures.
+func reportableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch exitCode(err) {
+	case exitUsage, exitNotInGitpod:
+		return false
+	}
+	return true
+}
+
+// reportError sends a report of command failing with err, if error reporting is on. Failing to send it is only
+// logged.
+func reportError(command string, err error) {
+	if !errorReportingEnabled() || !reportableError(err) {
+		return
+	}
+	sendErrorReport(newErrorReport(command, exitCode(err), err.Error()))
+}
+
+// reportCrash is deferred by main to report a panic of command, after which it exits like a failed command. Only
+// panics of the main goroutine reach it.
+func reportCrash(command string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	msg := fmt.Sprintf("panic: %v", r)
+	fmt.Fprintf(os.Stderr, "%s\n", msg)
+	if errorReportingEnabled() {
+		report := newErrorReport(command, exitFailure, msg)
+		report.Crashed = true
+		report.Stack = panicStack()
+		sendErrorReport(report)
+	}
+	printFailure("idp crashed - please report this as a bug")
+	os.Exit(exitFailure)
+}
+
+func newErrorReport(command string, code int, msg string) *errorReport {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	lastChainReport.Lock()
+	chain := lastChainReport.report
+	lastChainReport.Unlock()
+	report := &errorReport{
+		EventID:  hex.EncodeToString(id),
+		Time:     time.Now().UTC(),
+		Command:  command,
+		ExitCode: code,
+		Error:    redactText(msg),
+		Chain:    chain,
+		Version:  version,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Gitpod:   os.Getenv("GITPOD_HOST"),
+	}
+	if u, err := url.Parse(report.Gitpod); err == nil && u.Host != "" {
+		report.Gitpod = u.Host
+	}
+	return report
+}
+
+// panicStack returns the stack of the panicking goroutine, innermost frame first, without the frames of the
+// runtime's panic handling and of reportCrash.
+func panicStack() []stackFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var res []stackFrame
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, "runtime.") {
+			res = append(res, stackFrame{Function: f.Function, File: trimGoPath(f.File), Line: f.Line})
+		}
+		if !more {
+			return res
+		}
+	}
+}
+
+// trimGoPath cuts the build machine's directories off fn, keeping the path within the module or package.
+func trimGoPath(fn string) string {
+	for _, marker := range []string{"/go/aws/", "/pkg/mod/", "/src/"} {
+		if i := strings.LastIndex(fn, marker); i >= 0 {
+			return fn[i+len(marker):]
+		}
+	}
+	return fn
+}
+
+func sendErrorReport(report *errorReport) {
+	ctx, cancel := context.WithTimeout(context.Background(), errorReportTimeout)
+	defer cancel()
+	var err error
+	if dsn := setting("IDP_SENTRY_DSN"); dsn != "" {
+		err = sendSentryEvent(ctx, dsn, report)
+	} else {
+		err = postErrorReport(ctx, setting("IDP_ERROR_REPORT_ENDPOINT"), nil, report)
+	}
+	if err != nil {
+		slog.Debug("cannot send error report", "error", err)
+	}
+}
+
+// sendSentryEvent sends report to the Sentry project of dsn, e.g. https://<key>@o1.ingest.sentry.io/2, as an event
+// of its store endpoint.
+func sendSentryEvent(ctx context.Context, dsn string, report *errorReport) error {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return fmt.Errorf("IDP_SENTRY_DSN is not a Sentry DSN")
+	}
+	prefix, project := "", strings.TrimPrefix(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	endpoint := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: prefix + "/api/" + project + "/store/"}).String()
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=gitpod-idp/%s, sentry_key=%s", version, u.User.Username())
+
+	type frame struct {
+		Function string `json:"function"`
+		Filename string `json:"filename"`
+		Lineno   int    `json:"lineno"`
+		InApp    bool   `json:"in_app"`
+	}
+	// Sentry wants the outermost frame first
+	var frames []frame
+	for i := len(report.Stack) - 1; i >= 0; i-- {
+		f := report.Stack[i]
+		frames = append(frames, frame{Function: f.Function, Filename: f.File, Lineno: f.Line, InApp: strings.HasPrefix(f.Function, "main.") || strings.Contains(f.Function, "gitpodidp.")})
+	}
+	exception := map[string]interface{}{"type": exitCodeName(report.ExitCode), "value": report.Error}
+	level := "error"
+	if report.Crashed {
+		exception["type"] = "panic"
+		exception["stacktrace"] = map[string]interface{}{"frames": frames}
+		level = "fatal"
+	}
+	event := map[string]interface{}{
+		"event_id":  report.EventID,
+		"timestamp": report.Time.Format(time.RFC3339),
+		"platform":  "go",
+		"level":     level,
+		"logger":    "idp",
+		"release":   report.Version,
+		"tags": map[string]string{
+			"command":   report.Command,
+			"exit_code": fmt.Sprint(report.ExitCode),
+			"os":        report.OS,
+			"arch":      report.Arch,
+			"gitpod":    report.Gitpod,
+		},
+		"exception": map[string]interface{}{"values": []interface{}{exception}},
+	}
+	if report.Chain != nil {
+		event["extra"] = map[string]interface{}{"signinChain": report.Chain.Attempts}
+	}
+	return postErrorReport(ctx, endpoint, map[string]string{"X-Sentry-Auth": auth}, event)
+}
+
+func postErrorReport(ctx context.Context, endpoint string, header map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error reporting endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// exitCodeName names the class of failures code stands for, by which error reports group.
+func exitCodeName(code int) string {
+	switch code {
+	case exitMissingConfig:
+		return "MissingConfig"
+	case exitTokenMintFailed:
+		return "TokenMintFailed"
+	case exitExchangeFailed:
+		return "ExchangeFailed"
+	case exitPersistFailed:
+		return "PersistFailed"
+	default:
+		return "Failure"
+	}
+}
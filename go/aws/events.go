@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"sync"
+	"time"
+)
+
+var porcelainFlag = flag.Bool("porcelain", false, "emit progress as newline-delimited JSON events on stdout")
+
+// Event types emitted in porcelain mode.
+const (
+	eventProviderStarted   = "provider_started"
+	eventProviderSucceeded = "provider_succeeded"
+	eventProviderFailed    = "provider_failed"
+	eventTokenMinted       = "token_minted"
+	eventExchangeSucceeded = "exchange_succeeded"
+	eventProfileWritten    = "profile_written"
+)
+
+// event is a single line of porcelain output. Fields carries event-specific details and never contains secrets.
+type event struct {
+	Time     time.Time         `json:"time"`
+	Type     string            `json:"type"`
+	Provider string            `json:"provider,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+var eventMu sync.Mutex
+
+// emitEvent writes an event to stdout if porcelain mode is enabled. fields are given as key/value pairs.
+func emitEvent(typ, provider string, fields ...string) {
+	if !*porcelainFlag {
+		return
+	}
+	evt := event{Time: time.Now().UTC(), Type: typ, Provider: provider}
+	if len(fields) > 0 {
+		evt.Fields = make(map[string]string, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			evt.Fields[fields[i]] = fields[i+1]
+		}
+	}
+	writeEvent(evt)
+}
+
+// emitProviderResult emits provider_succeeded or provider_failed depending on err.
+func emitProviderResult(provider string, err error) {
+	if !*porcelainFlag {
+		return
+	}
+	if err == nil {
+		emitEvent(eventProviderSucceeded, provider)
+		return
+	}
+
+	writeEvent(event{Time: time.Now().UTC(), Type: eventProviderFailed, Provider: provider, Error: redactText(err.Error())})
+}
+
+func writeEvent(evt event) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	_ = json.NewEncoder(os.Stdout).Encode(evt)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// Exit codes of the CLI. Scripts can branch on these, so existing values must never change.
+const (
+	exitOK              = 0
+	exitFailure         = 1
+	exitUsage           = 2
+	exitNotInGitpod     = 3
+	exitMissingConfig   = 4
+	exitTokenMintFailed = 5
+	exitExchangeFailed  = 6
+	exitPersistFailed   = 7
+)
+
+// exitError attaches an exit code to an error.
+type exitError struct {
+	Code int
+	Err  error
+}
+
+func (e *exitError) Error() string { return e.Err.Error() }
+func (e *exitError) Unwrap() error { return e.Err }
+
+// withExitCode wraps err so that the CLI exits with code if err makes it to main. It returns nil if err is nil.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{Code: code, Err: err}
+}
+
+// exitErrorf is like fmt.Errorf but attaches an exit code.
+func exitErrorf(code int, format string, args ...interface{}) error {
+	return withExitCode(code, fmt.Errorf(format, args...))
+}
+
+// exitCode returns the exit code for err. Errors without an explicit code get one from the gitpodidp error they
+// wrap, if any.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.Code
+	}
+	switch {
+	case errors.Is(err, gitpodidp.ErrNotInGitpod):
+		return exitNotInGitpod
+	case errors.Is(err, gitpodidp.ErrRoleNotConfigured):
+		return exitMissingConfig
+	case errors.Is(err, gitpodidp.ErrTokenMint):
+		return exitTokenMintFailed
+	case errors.Is(err, gitpodidp.ErrExchangeRejected):
+		return exitExchangeFailed
+	}
+	return exitFailure
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner answers commands with run instead of running them, and records them. Every program is installed.
+type fakeRunner struct {
+	// run answers a command, or fails it if run is nil.
+	run func(name string, args ...string) ([]byte, error)
+
+	mu    sync.Mutex
+	calls []string
+	// stdin is what the last command run with Pipe read.
+	stdin []byte
+}
+
+func (r *fakeRunner) LookPath(name string) (string, error) {
+	return "/fake/bin/" + name, nil
+}
+
+func (r *fakeRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, strings.Join(append([]string{name}, args...), " "))
+	r.mu.Unlock()
+	if r.run == nil {
+		return nil, fmt.Errorf("%s is faked to fail", name)
+	}
+	return r.run(name, args...)
+}
+
+func (r *fakeRunner) CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return r.Output(ctx, name, args...)
+}
+
+func (r *fakeRunner) Pipe(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	r.stdin = append([]byte(nil), stdin...)
+	r.mu.Unlock()
+	return r.Output(ctx, name, args...)
+}
+
+// ran reports whether a command starting with prefix was run.
+func (r *fakeRunner) ran(prefix string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.calls {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeDoer answers HTTP requests with respond instead of sending them, and records them.
+type fakeDoer struct {
+	// respond answers a request, or fails it if respond is nil.
+	respond func(req *http.Request) (*http.Response, error)
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (d *fakeDoer) Do(req *http.Request) (*http.Response, error) {
+	d.mu.Lock()
+	d.requests = append(d.requests, req.Method+" "+req.URL.String())
+	d.mu.Unlock()
+	if d.respond == nil {
+		return nil, fmt.Errorf("%s %s is faked to fail", req.Method, req.URL)
+	}
+	return d.respond(req)
+}
+
+// sent returns the requests sent, as method and URL.
+func (d *fakeDoer) sent() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.requests...)
+}
+
+// fakeResponse returns a response to req with status, a content type and body.
+func fakeResponse(req *http.Request, status int, contentType, body string) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+// testWorkspace isolates a test from the user's files, config and settings, and runs its subprocesses with r. It
+// looks like a Gitpod workspace to the code under test.
+func testWorkspace(t testing.TB, r *fakeRunner) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("IDP_CACHE_DIR", filepath.Join(dir, "cache"))
+	t.Setenv("IDP_CONFIG_DIR", filepath.Join(dir, "config"))
+	t.Setenv("IDP_PROJECT_SETTINGS", "false")
+	t.Setenv("IDP_KEYCHAIN", "false")
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+	t.Setenv("GITPOD_WORKSPACE_URL", "https://ws-test.gitpod.example")
+	t.Setenv("GITPOD_HOST", "https://gitpod.example")
+	t.Setenv("GITPOD_WORKSPACE_ID", "")
+	t.Setenv("GITPOD_INSTANCE_ID", "")
+	t.Setenv("GITPOD_WORKSPACE_CONTEXT", "")
+	for _, name := range []string{"IDP_SHARED_WORKSPACE_POLICY", "IDP_UNTRUSTED_CONTEXT_POLICY", "IDP_TRUSTED_REPOSITORIES",
+		"IDP_AWS_READONLY_ROLE_ARN", "IDP_AWS_ROLE_ARN", "IDP_AWS_PROFILES", "IDP_DOCKER_REGISTRIES"} {
+		t.Setenv(name, "")
+	}
+
+	oldRunner, oldCfg := runner, cfg
+	runner, cfg = r, nil
+	forgetTestCacheKey()
+	// the role is resolved once per process
+	awsRoleResolved = false
+	t.Cleanup(func() {
+		runner, cfg = oldRunner, oldCfg
+		forgetTestCacheKey()
+		awsRoleResolved = false
+	})
+}
+
+// forgetTestCacheKey makes the next cacheKey call obtain the key again, like a new process would.
+func forgetTestCacheKey() {
+	cachedKey.once = sync.Once{}
+	cachedKey.key = nil
+}
+
+// fakeStdin makes content the standard input of the test.
+func fakeStdin(t *testing.T, content string) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "stdin")
+	err := os.WriteFile(fn, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() {
+		os.Stdin = oldStdin
+		stdin.Close()
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "fake-server",
+		Usage:   "fake-server [--addr host:port] [--subject sub] [--shared] [--project-env name=value...]",
+		Summary: "serve the supervisor and Gitpod IDP APIs locally with test tokens, for offline development",
+		Run:     runFakeServer,
+	})
+}
+
+const (
+	fakeGitpodHost    = "fake.gitpod.local"
+	fakeWorkspaceID   = "fake-workspace"
+	fakeProjectID     = "fake-project"
+	fakeAPIToken      = "fake-gitpod-api-token"
+	fakeSigningKeyID  = "fake-server"
+	fakeTokenLifetime = time.Hour
+)
+
+// fakeIDP issues identity tokens signed with a key that only lives as long as the server.
+type fakeIDP struct {
+	issuer  string
+	subject string
+	shared  bool
+	// projectEnv are the variables of the workspace's project. Without any, the workspace has no project.
+	projectEnv map[string]string
+	key        *rsa.PrivateKey
+}
+
+func runFakeServer(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("fake-server", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:0", "address to listen on")
+	subject := flags.String("subject", "https://github.com/example/repo", "sub claim of the issued tokens")
+	shared := flags.Bool("shared", false, "report the workspace as shared")
+	projectEnv := make(map[string]string)
+	flags.Func("project-env", "name=value of an environment variable of the workspace's project (repeatable)", func(kv string) error {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("expected name=value")
+		}
+		projectEnv[k] = v
+		return nil
+	})
+	_ = flags.Parse(args)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	baseURL := "http://" + l.Addr().String()
+	idp := &fakeIDP{issuer: baseURL + "/idp", subject: *subject, shared: *shared, projectEnv: projectEnv, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_supervisor/v1/token/gitpod/", idp.serveAPIToken)
+	mux.HandleFunc("/gitpod.experimental.v1.IdentityProviderService/GetIDToken", idp.serveIDToken)
+	mux.HandleFunc("/gitpod.experimental.v1.WorkspacesService/GetWorkspace", idp.serveWorkspace)
+	mux.HandleFunc("/gitpod.v1.EnvironmentVariableService/ListConfigurationEnvironmentVariables", idp.serveProjectEnv)
+	mux.HandleFunc("/idp/.well-known/openid-configuration", idp.serveDiscovery)
+	mux.HandleFunc("/idp/keys", idp.serveKeys)
+	mux.HandleFunc("/_supervisor/v1/notification/notify", serveFakeNotification)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	fmt.Fprintf(os.Stderr, "fake supervisor and IDP listening on %s - point the tool at it with\n\n", baseURL)
+	for _, kv := range [][2]string{
+		{"GITPOD_HOST", "https://" + fakeGitpodHost},
+		{"GITPOD_WORKSPACE_ID", fakeWorkspaceID},
+		{"GITPOD_WORKSPACE_URL", "https://" + fakeWorkspaceID + "." + fakeGitpodHost},
+		{"SUPERVISOR_ADDR", l.Addr().String()},
+		{"IDP_GITPOD_API_URL", baseURL},
+	} {
+		fmt.Printf("export %s=%s\n", kv[0], shellQuote(kv[1]))
+	}
+	fmt.Fprintln(os.Stderr)
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	err = srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// serveFakeNotification prints notifications the IDE would show.
+func serveFakeNotification(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Level   string `json:"level"`
+		Message string `json:"message"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "notification [%s]: %s\n", req.Level, req.Message)
+	writeFakeJSON(w, map[string]string{})
+}
+
+func (idp *fakeIDP) serveAPIToken(w http.ResponseWriter, r *http.Request) {
+	writeFakeJSON(w, map[string]string{"token": fakeAPIToken})
+}
+
+// serveWorkspace reports the project and admission level of the workspace, which is all of it the tool looks at.
+func (idp *fakeIDP) serveWorkspace(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+fakeAPIToken {
+		http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		return
+	}
+	admission := "ADMISSION_LEVEL_OWNER_ONLY"
+	if idp.shared {
+		admission = gitpodidp.AdmissionEveryone
+	}
+	var projectID string
+	if len(idp.projectEnv) > 0 {
+		projectID = fakeProjectID
+	}
+	writeFakeJSON(w, map[string]interface{}{
+		"result": map[string]interface{}{
+			"workspaceId": fakeWorkspaceID,
+			"projectId":   projectID,
+			"status": map[string]interface{}{
+				"instance": map[string]interface{}{
+					"status": map[string]string{"admission": admission},
+				},
+			},
+		},
+	})
+}
+
+func (idp *fakeIDP) serveProjectEnv(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+fakeAPIToken {
+		http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		return
+	}
+	var vars []map[string]string
+	for _, name := range sortedKeys(idp.projectEnv) {
+		vars = append(vars, map[string]string{"name": name, "value": idp.projectEnv[name], "configurationId": fakeProjectID})
+	}
+	writeFakeJSON(w, map[string]interface{}{"environmentVariables": vars})
+}
+
+func (idp *fakeIDP) serveIDToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+fakeAPIToken {
+		http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		WorkspaceID string   `json:"workspace_id"`
+		Audience    []string `json:"audience"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Audience) == 0 {
+		http.Error(w, "invalid request: an audience is required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": idp.issuer,
+		"sub": idp.subject,
+		"aud": req.Audience,
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(fakeTokenLifetime).Unix(),
+	}
+	if len(req.Audience) == 1 {
+		claims["aud"] = req.Audience[0]
+	}
+	token, err := idp.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeFakeJSON(w, map[string]string{"token": token})
+}
+
+func (idp *fakeIDP) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeFakeJSON(w, map[string]interface{}{
+		"issuer":                                idp.issuer,
+		"jwks_uri":                              idp.issuer + "/keys",
+		"response_types_supported":              []string{"id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *fakeIDP) serveKeys(w http.ResponseWriter, r *http.Request) {
+	writeFakeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": fakeSigningKeyID,
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+// sign produces an RS256 JWT with claims.
+func (idp *fakeIDP) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": fakeSigningKeyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func writeFakeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
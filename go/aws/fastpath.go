@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fastPathCommand is a command which runs all the time, from shell init files or for every request of a tool, and
+// mostly prints what it printed the time before.
+type fastPathCommand struct {
+	args []string
+	// input reads what the command reads from stdin, for commands whose answer depends on it.
+	input func(r *bufio.Reader) ([]byte, error)
+	// guarded commands hand out credentials the shared workspace policy applies to.
+	guarded bool
+}
+
+var fastPathCommands = []fastPathCommand{
+	{args: []string{"env"}},
+	{args: []string{"docker", "get"}, input: readLine, guarded: true},
+	{args: []string{"git-credential", "get"}, input: readParagraph, guarded: true},
+}
+
+// fastPathVariables are the prefixes of the environment variables answers may depend on: the tool's settings and
+// those of Gitpod and of the tools it signs into. Others, which shells change all the time, don't count.
+var fastPathVariables = []string{"IDP_", "GITPOD_", "AWS_", "GOOGLE_", "CLOUDSDK_", "AZURE_", "VAULT_", "DOCKER_",
+	"REGISTRY_AUTH_FILE", "KUBECONFIG", "XDG_", "HOME", "PATH"}
+
+// fastPathEntry is the last answer to a command with the same arguments, input and working directory.
+type fastPathEntry struct {
+	// Fingerprint is a hash of everything else the answer depends on, see fastPathFingerprint.
+	Fingerprint string `json:"fingerprint"`
+	// Exported are the variables the answer sets, which don't count towards the fingerprint, so that a shell
+	// which evaluated the answer gets it again.
+	Exported []string `json:"exported,omitempty"`
+	Output   []byte   `json:"output"`
+	// Until is when the credentials in the answer expire, if they do.
+	Until time.Time `json:"until,omitempty"`
+	// Usage is what answering meters, for credential helpers.
+	Usage *usageEntry `json:"usage,omitempty"`
+}
+
+// fastPath is where the answer of this process goes, if the command is one the fast path may answer.
+var fastPath struct {
+	fn  string
+	cmd *fastPathCommand
+}
+
+// runFastPath answers the command with args from the answer to the same command with the same input, if nothing it
+// depends on changed since and its credentials are still valid. It runs before the config is loaded, the network
+// and tracing are set up and PATH is searched for plugins, and neither runs a subprocess nor sends a request, so
+// that shells and tools which run the command all the time don't wait for it. It reports whether it answered.
+//
+// Outside of workspaces, where the cache key is in the keychain, and with tracing it doesn't apply, and
+// IDP_FAST_PATH=false turns it off.
+func runFastPath(args []string) (bool, error) {
+	cmd := fastPathCommandFor(args)
+	if cmd == nil || os.Getenv("IDP_FAST_PATH") == "false" || keychainEnabled() ||
+		os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		return false, nil
+	}
+	var input []byte
+	if cmd.input != nil {
+		if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice != 0 {
+			// someone typing the input expects the command to answer it as they type it
+			return false, nil
+		}
+		r := bufio.NewReader(os.Stdin)
+		var err error
+		input, err = cmd.input(r)
+		if err != nil {
+			return false, err
+		}
+		// the command reads it again if the fast path doesn't answer
+		err = replayStdin(input, r)
+		if err != nil {
+			return false, err
+		}
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return false, nil
+	}
+	wd, _ := os.Getwd()
+	key := sha256.Sum256([]byte(strings.Join(args, "\x00") + "\x00" + string(input) + "\x00" + wd))
+	fastPath.fn = filepath.Join(dir, "fastpath", hex.EncodeToString(key[:16])+".json")
+	fastPath.cmd = cmd
+
+	entry, ok := loadFastPathEntry(fastPath.fn)
+	if !ok || (!entry.Until.IsZero() && !time.Now().Before(entry.Until)) || (cmd.guarded && snapshotInProgress()) {
+		return false, nil
+	}
+	if entry.Usage != nil {
+		if _, err := os.Readlink("/proc/self/exe"); err != nil {
+			// telling the program which asked apart would take ps
+			return false, nil
+		}
+	}
+	_, err = os.Stdout.Write(entry.Output)
+	if err != nil {
+		return true, err
+	}
+	if entry.Usage != nil {
+		recordUsage(helperUsage(context.Background(), entry.Usage.Channel, entry.Usage.Provider, entry.Usage.Target))
+	}
+	return true, nil
+}
+
+func fastPathCommandFor(args []string) *fastPathCommand {
+	for i, cmd := range fastPathCommands {
+		if len(args) >= len(cmd.args) && slices.Equal(args[:len(cmd.args)], cmd.args) {
+			return &fastPathCommands[i]
+		}
+	}
+	return nil
+}
+
+func loadFastPathEntry(fn string) (*fastPathEntry, bool) {
+	fc, err := readSealedFile(fn)
+	if err != nil {
+		return nil, false
+	}
+	defer wipe(fc)
+	var entry fastPathEntry
+	if json.Unmarshal(fc, &entry) != nil || entry.Fingerprint != fastPathFingerprint(entry.Exported) {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// saveFastPath keeps the answer of the command for runFastPath, if it may answer it, until the credentials expire
+// at until, unless until is zero. usage is what answering meters, if anything.
+func saveFastPath(output []byte, until time.Time, exported []string, usage *usageEntry) {
+	if fastPath.cmd == nil {
+		return
+	}
+	if fn, err := projectSettingsPath(); err == nil {
+		if fi, err := os.Stat(fn); err == nil {
+			until = earliest(until, fi.ModTime().Add(projectSettingsMaxAge))
+		}
+	}
+	if fastPath.cmd.guarded {
+		// whether the workspace is shared is checked as often as the daemon checks it
+		if policy, _ := sharedWorkspacePolicy(); policy != sharedPolicyAllow {
+			until = earliest(until, time.Now().Add(sharingCheckInterval))
+		}
+	}
+	if usage != nil && setting("IDP_USAGE_METERING") == "false" {
+		usage = nil
+	}
+	sort.Strings(exported)
+	fc, err := json.Marshal(fastPathEntry{
+		Fingerprint: fastPathFingerprint(exported),
+		Exported:    exported,
+		Output:      output,
+		Until:       until,
+		Usage:       usage,
+	})
+	if err == nil {
+		err = writeSealedFile(fastPath.fn, fc)
+		wipe(fc)
+	}
+	if err != nil {
+		slog.Debug("cannot keep the answer for the fast path", "error", err)
+	}
+}
+
+// forgetFastPath removes the answers runFastPath answers from, which may hold credentials.
+func forgetFastPath() error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(dir, "fastpath"))
+}
+
+// earliest returns the earlier of two times, where zero is never.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// fastPathFingerprint hashes what answers depend on besides the arguments, input and working directory: the
+// variables with one of the fastPathVariables prefixes that the answer doesn't set itself, and the size and
+// modification time of the config files, of the records and caches that signing in and out changes, and of the
+// directories on PATH plugins are installed into.
+func fastPathFingerprint(exported []string) string {
+	var vars []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if slices.Contains(exported, k) || !slices.ContainsFunc(fastPathVariables, func(p string) bool { return strings.HasPrefix(k, p) }) {
+			continue
+		}
+		vars = append(vars, kv)
+	}
+	sort.Strings(vars)
+	h := sha256.New()
+	for _, kv := range vars {
+		fmt.Fprintf(h, "%s\x00", kv)
+	}
+	for _, fn := range fastPathFiles() {
+		fmt.Fprintf(h, "%s", fn)
+		if fi, err := os.Stat(fn); err == nil {
+			fmt.Fprintf(h, " %d %d", fi.Size(), fi.ModTime().UnixNano())
+		}
+		fmt.Fprintf(h, "\x00")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func fastPathFiles() []string {
+	var res []string
+	if fn, err := repoConfigPath(); err == nil {
+		res = append(res, fn)
+	}
+	if dir, err := userConfigDir(); err == nil {
+		res = append(res, filepath.Join(dir, "config.json"))
+	}
+	for _, path := range []func() (string, error){claimsPath, projectSettingsPath, sessionStatePath} {
+		if fn, err := path(); err == nil {
+			res = append(res, fn)
+		}
+	}
+	if dir, err := stateDir(); err == nil {
+		for _, sub := range []string{"credentials", "plugins"} {
+			entries, _ := os.ReadDir(filepath.Join(dir, sub))
+			for _, e := range entries {
+				res = append(res, filepath.Join(dir, sub, e.Name()))
+			}
+		}
+	}
+	return append(res, filepath.SplitList(os.Getenv("PATH"))...)
+}
+
+// replayStdin makes stdin read the input the fast path read, followed by the rest of r.
+func replayStdin(input []byte, r io.Reader) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("cannot read stdin again: %w", err)
+	}
+	go func() {
+		_, _ = io.Copy(pw, io.MultiReader(bytes.NewReader(input), r))
+		pw.Close()
+	}()
+	os.Stdin = pr
+	return nil
+}
+
+// readLine reads a line, like docker get.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return line, err
+}
+
+// readParagraph reads lines up to an empty one, like git-credential get.
+func readParagraph(r *bufio.Reader) ([]byte, error) {
+	var res []byte
+	for {
+		line, err := readLine(r)
+		res = append(res, line...)
+		if err != nil || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return res, err
+		}
+	}
+}
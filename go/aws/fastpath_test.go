@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// fastPathTarget is how long answering on the fast path may take at most.
+const fastPathTarget = 50 * time.Millisecond
+
+var envLoginArgs = []string{"env", "--export", "--login"}
+
+// signedIntoAWS sets up credentials for AWS which are valid for validFor, and a client which records requests.
+func signedIntoAWS(t testing.TB, validFor time.Duration) *fakeDoer {
+	t.Setenv("IDP_AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/gitpod")
+	fn := filepath.Join(t.TempDir(), "credentials")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", fn)
+	err := os.WriteFile(fn, []byte("[default]\naws_access_key_id = ASIAEXAMPLE\naws_secret_access_key = secret\naws_session_token = token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aws, _ := findProvider("aws")
+	err = saveCredentialRecord(credentialRecord{Provider: "aws", Identity: aws.Identity(), IssuedAt: time.Now(), Expiry: time.Now().Add(validFor)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeDoer{}
+	oldClient := httpClient
+	httpClient = d
+	gitpodidp.SetHTTPClient(d)
+	t.Cleanup(func() {
+		httpClient = oldClient
+		gitpodidp.SetHTTPClient(oldClient)
+	})
+	return d
+}
+
+// runFastPathOrCommand runs a new process's fast path for args, and the command if it doesn't answer, and
+// returns the output and whether the fast path answered.
+func runFastPathOrCommand(t testing.TB, args []string) (string, bool) {
+	t.Helper()
+	fastPath.fn, fastPath.cmd = "", nil
+	t.Cleanup(func() { fastPath.fn, fastPath.cmd = "", nil })
+	forgetTestCacheKey()
+	var out strings.Builder
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(&out, r)
+		close(done)
+	}()
+	oldStdout := os.Stdout
+	os.Stdout = w
+	answered, err := runFastPath(args)
+	if err == nil && !answered {
+		err = findCommand(args[0]).Run(context.Background(), args[1:])
+	}
+	os.Stdout = oldStdout
+	w.Close()
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), answered
+}
+
+func TestFastPathAnswersEnvWithoutSubprocessesOrRequests(t *testing.T) {
+	r := &fakeRunner{}
+	testWorkspace(t, r)
+	d := signedIntoAWS(t, time.Hour)
+
+	want, answered := runFastPathOrCommand(t, envLoginArgs)
+	if answered {
+		t.Fatal("the fast path answered before the command ran")
+	}
+	if !strings.Contains(want, "export AWS_ACCESS_KEY_ID='ASIAEXAMPLE'") {
+		t.Fatalf("env printed %q", want)
+	}
+
+	r.calls = nil
+	var fastest time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		got, answered := runFastPathOrCommand(t, envLoginArgs)
+		if took := time.Since(start); i == 0 || took < fastest {
+			fastest = took
+		}
+		if !answered {
+			t.Fatal("the fast path didn't answer")
+		}
+		if got != want {
+			t.Errorf("the fast path printed %q, want %q", got, want)
+		}
+	}
+	if len(r.calls) > 0 {
+		t.Errorf("the fast path ran %q", r.calls)
+	}
+	if sent := d.sent(); len(sent) > 0 {
+		t.Errorf("the fast path sent %q", sent)
+	}
+	if fastest > fastPathTarget {
+		t.Errorf("the fast path took %v, want at most %v", fastest, fastPathTarget)
+	}
+}
+
+func TestFastPathAnswersOnlyWhatDidNotChange(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T)
+		// args are those of the second command, if they differ
+		args []string
+	}{
+		{name: "signed in again", change: func(t *testing.T) {
+			aws, _ := findProvider("aws")
+			err := saveCredentialRecord(credentialRecord{Provider: "aws", Identity: aws.Identity(), IssuedAt: time.Now(), Expiry: time.Now().Add(2 * time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "settings", change: func(t *testing.T) { t.Setenv("IDP_AWS_REGION", "eu-central-1") }},
+		{name: "config file", change: func(t *testing.T) {
+			t.Setenv("IDP_CONFIG", filepath.Join(t.TempDir(), ".gitpod-idp.json"))
+		}},
+		{name: "turned off", change: func(t *testing.T) { t.Setenv("IDP_FAST_PATH", "false") }},
+		{name: "tracing", change: func(t *testing.T) { t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318") }},
+		{name: "other arguments", change: func(t *testing.T) {}, args: []string{"env", "--login"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testWorkspace(t, &fakeRunner{})
+			signedIntoAWS(t, time.Hour)
+			runFastPathOrCommand(t, envLoginArgs)
+
+			tt.change(t)
+			args := envLoginArgs
+			if tt.args != nil {
+				args = tt.args
+			}
+			if _, answered := runFastPathOrCommand(t, args); answered {
+				t.Error("the fast path answered")
+			}
+		})
+	}
+}
+
+func TestFastPathAnswersUntilCredentialsExpire(t *testing.T) {
+	testWorkspace(t, &fakeRunner{})
+	signedIntoAWS(t, time.Hour)
+	runFastPathOrCommand(t, []string{"env"})
+	fn := fastPath.fn
+
+	entry, ok := loadFastPathEntry(fn)
+	if !ok {
+		t.Fatal("env kept no answer")
+	}
+	if until := time.Until(entry.Until); until <= 0 || until > time.Hour {
+		t.Fatalf("the answer is valid for %v, want until the credentials expire", until)
+	}
+	entry.Until = time.Now().Add(-time.Second)
+	saveFastPathEntry(t, fn, entry)
+	if _, answered := runFastPathOrCommand(t, []string{"env"}); answered {
+		t.Error("the fast path answered with expired credentials")
+	}
+}
+
+// saveFastPathEntry writes entry to fn, as saveFastPath would have.
+func saveFastPathEntry(t *testing.T, fn string, entry *fastPathEntry) {
+	t.Helper()
+	fastPath.fn, fastPath.cmd = fn, &fastPathCommand{}
+	saveFastPath(entry.Output, entry.Until, entry.Exported, entry.Usage)
+}
+
+func TestFastPathReplaysStdin(t *testing.T) {
+	testWorkspace(t, &fakeRunner{})
+	const input = "protocol=https\nhost=example.com\n\nignored\n"
+	fakeStdin(t, input)
+	fastPath.fn, fastPath.cmd = "", nil
+	t.Cleanup(func() { fastPath.fn, fastPath.cmd = "", nil })
+
+	answered, err := runFastPath([]string{"git-credential", "get"})
+	if err != nil || answered {
+		t.Fatalf("runFastPath() = %v, %v, want false, nil", answered, err)
+	}
+	got, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != input {
+		t.Errorf("the command reads %q, want %q", got, input)
+	}
+}
+
+func BenchmarkFastPath(b *testing.B) {
+	testWorkspace(b, &fakeRunner{})
+	signedIntoAWS(b, time.Hour)
+	runFastPathOrCommand(b, envLoginArgs)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, answered := runFastPathOrCommand(b, envLoginArgs); !answered {
+			b.Fatal("the fast path didn't answer")
+		}
+	}
+	if perOp := b.Elapsed() / time.Duration(b.N); perOp > fastPathTarget {
+		b.Errorf("the fast path took %v, want at most %v", perOp, fastPathTarget)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// federationHint explains why a provider rejected the workspace's token and how to fix its configuration.
+type federationHint struct {
+	Problem string `json:"problem"`
+	Fix     string `json:"fix"`
+	// Command makes the fix, with the values of the token filled in.
+	Command string `json:"command,omitempty"`
+}
+
+// tokenFacts are the claims of the rejected token which the provider's configuration has to admit.
+type tokenFacts struct {
+	Issuer   string
+	Subject  string
+	Audience []string
+}
+
+func newTokenFacts(token string) tokenFacts {
+	claims, err := gitpodidp.Claims(token)
+	if err != nil {
+		return tokenFacts{}
+	}
+	iss, _ := claims["iss"].(string)
+	if iss == "" {
+		iss, _ = gitpodIssuer()
+	}
+	sub, _ := claims["sub"].(string)
+	return tokenFacts{Issuer: iss, Subject: sub, Audience: claimValues(claims["aud"])}
+}
+
+// explainGCPRejection prints how to fix the workload identity pool, or the service account, if err is a refusal of
+// Google to exchange token.
+func explainGCPRejection(err error, token string) {
+	if !errors.Is(err, gitpodidp.ErrExchangeRejected) {
+		return
+	}
+	writeFederationHints(os.Stderr, gcpRejectionHints(err.Error(), newTokenFacts(token)))
+}
+
+// explainAzureRejection prints how to fix the federated credentials of the app registration, if msg, an error or
+// the output of az login, is a refusal of Entra ID to accept token.
+func explainAzureRejection(msg, token string) {
+	writeFederationHints(os.Stderr, azureRejectionHints(msg, newTokenFacts(token)))
+}
+
+func writeFederationHints(w io.Writer, hints []federationHint) {
+	for _, h := range hints {
+		fmt.Fprintf(w, "%s %s\n  fix: %s\n", colorize(ansiYellow, "!"), h.Problem, h.Fix)
+		if h.Command != "" {
+			fmt.Fprintf(w, "  %s\n", h.Command)
+		}
+	}
+}
+
+// gcpProviderRef is a workload identity pool provider
+// projects/<number>/locations/<location>/workloadIdentityPools/<pool>/providers/<provider>, split up to fill in
+// gcloud commands.
+type gcpProviderRef struct {
+	Project, Location, Pool, Provider string
+}
+
+var gcpProviderName = regexp.MustCompile(`^projects/([^/]+)/locations/([^/]+)/workloadIdentityPools/([^/]+)/providers/([^/]+)$`)
+
+func parseGCPProvider(name string) (gcpProviderRef, bool) {
+	m := gcpProviderName.FindStringSubmatch(name)
+	if m == nil {
+		return gcpProviderRef{}, false
+	}
+	return gcpProviderRef{Project: m[1], Location: m[2], Pool: m[3], Provider: m[4]}, true
+}
+
+func (r gcpProviderRef) update(flags ...string) string {
+	return fmt.Sprintf("gcloud iam workload-identity-pools providers update-oidc %s --project=%s --location=%s --workload-identity-pool=%s %s",
+		r.Provider, r.Project, r.Location, r.Pool, strings.Join(flags, " "))
+}
+
+// bracketed matches the values STS quotes from the token, e.g. The audience in ID Token [https://...].
+var bracketed = regexp.MustCompile(`\[([^\]]+)\]`)
+
+// gcpRejectionHints decodes the error of Google's STS, or of impersonating the service account, in msg. STS
+// answers e.g. {"error":"invalid_grant","error_description":"The audience in ID Token [...] does not match the
+// expected audience."}.
+func gcpRejectionHints(msg string, tok tokenFacts) []federationHint {
+	name := gcpWorkloadIdentityProvider()
+	ref, ok := parseGCPProvider(name)
+	if !ok {
+		return []federationHint{{
+			Problem: fmt.Sprintf("IDP_GCP_WORKLOAD_IDENTITY_PROVIDER %q is not the resource name of a workload identity pool provider", name),
+			Fix:     "set it to projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>, as this lists it",
+			Command: "gcloud iam workload-identity-pools providers list --location=global --workload-identity-pool=<pool> --format='value(name)'",
+		}}
+	}
+	pool := fmt.Sprintf("projects/%s/locations/%s/workloadIdentityPools/%s", ref.Project, ref.Location, ref.Pool)
+
+	if strings.HasPrefix(msg, "cannot impersonate ") {
+		sa := setting("IDP_GCP_SERVICE_ACCOUNT")
+		if !strings.Contains(msg, "iam.serviceAccounts.getAccessToken") {
+			return nil
+		}
+		return []federationHint{{
+			Problem: fmt.Sprintf("the pool's principal for subject %q may not impersonate %s", tok.Subject, sa),
+			Fix:     "grant it roles/iam.workloadIdentityUser on the service account",
+			Command: fmt.Sprintf("gcloud iam service-accounts add-iam-policy-binding %s --role=roles/iam.workloadIdentityUser --member=%s",
+				sa, shellQuote(fmt.Sprintf("principal://iam.googleapis.com/%s/subject/%s", pool, tok.Subject))),
+		}}
+	}
+
+	desc := msg
+	if idx := strings.Index(msg, "{"); idx >= 0 {
+		var res struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if json.Unmarshal([]byte(msg[idx:]), &res) == nil && res.ErrorDescription != "" {
+			desc = res.ErrorDescription
+		}
+	}
+	lower := strings.ToLower(desc)
+	switch {
+	// checked first, as STS says the "audience" parameter is invalid
+	case strings.Contains(msg, "invalid_target"), strings.Contains(lower, "target service"), strings.Contains(lower, "disabled"):
+		return []federationHint{{
+			Problem: fmt.Sprintf("provider %s doesn't exist or is disabled", name),
+			Fix:     "check IDP_GCP_WORKLOAD_IDENTITY_PROVIDER against the provider, and that neither it nor its pool is disabled",
+			Command: fmt.Sprintf("gcloud iam workload-identity-pools providers describe %s --project=%s --location=%s --workload-identity-pool=%s",
+				ref.Provider, ref.Project, ref.Location, ref.Pool),
+		}}
+	case strings.Contains(lower, "audience"):
+		if m := bracketed.FindStringSubmatch(desc); len(tok.Audience) == 0 && m != nil {
+			tok.Audience = strings.Split(m[1], ",")
+		}
+		return []federationHint{{
+			Problem: fmt.Sprintf("provider %s doesn't accept the token's audience %s", ref.Provider, quoteAll(tok.Audience)),
+			Fix:     "allow the audience, or clear the allowed audiences so that the default " + gitpodidp.GCPAudience(name) + " applies",
+			Command: ref.update("--allowed-audiences=" + shellQuote(strings.Join(tok.Audience, ","))),
+		}}
+	case strings.Contains(lower, "issuer"):
+		return []federationHint{{
+			Problem: fmt.Sprintf("provider %s doesn't trust the token's issuer %q", ref.Provider, tok.Issuer),
+			Fix:     "set the issuer of the provider to the one of this Gitpod installation",
+			Command: ref.update("--issuer-uri=" + shellQuote(tok.Issuer)),
+		}}
+	case strings.Contains(lower, "attribute condition"):
+		return []federationHint{{
+			Problem: fmt.Sprintf("the attribute condition of provider %s rejects the token with subject %q", ref.Provider, tok.Subject),
+			Fix:     "make the condition admit this subject, e.g. by matching it exactly",
+			Command: ref.update("--attribute-condition=" + shellQuote(fmt.Sprintf("assertion.sub == %q", tok.Subject))),
+		}}
+	case strings.Contains(lower, "attribute mapping"), strings.Contains(lower, "google.subject"):
+		return []federationHint{{
+			Problem: fmt.Sprintf("the attribute mapping of provider %s doesn't yield a valid google.subject for subject %q", ref.Provider, tok.Subject),
+			Fix:     "map google.subject to the token's sub claim, which Gitpod always sets",
+			Command: ref.update("--attribute-mapping=" + shellQuote("google.subject=assertion.sub")),
+		}}
+	}
+	return nil
+}
+
+var aadstsCode = regexp.MustCompile(`AADSTS(\d+)`)
+
+// azureRejectionHints decodes the AADSTS error code in msg, e.g. AADSTS70021 "No matching federated identity
+// record found for presented assertion".
+func azureRejectionHints(msg string, tok tokenFacts) []federationHint {
+	m := aadstsCode.FindStringSubmatch(msg)
+	if m == nil {
+		return nil
+	}
+	var (
+		clientID = setting("IDP_AZURE_CLIENT_ID")
+		tenantID = setting("IDP_AZURE_TENANT_ID")
+	)
+	switch m[1] {
+	case "70021", "700211", "700212", "700213":
+		whose := map[string]string{
+			"70021":  "the token",
+			"700211": fmt.Sprintf("the token's issuer %q", tok.Issuer),
+			"700212": fmt.Sprintf("the token's audience %s", quoteAll(tok.Audience)),
+			"700213": fmt.Sprintf("the token's subject %q", tok.Subject),
+		}[m[1]]
+		params, _ := json.Marshal(map[string]interface{}{
+			"name":      "gitpod-" + federatedCredentialName(tok.Subject),
+			"issuer":    tok.Issuer,
+			"subject":   tok.Subject,
+			"audiences": []string{providerAudience("azure")},
+		})
+		return []federationHint{{
+			Problem: fmt.Sprintf("no federated credential of app %s matches %s (Entra ID compares issuer, subject and audience exactly)", clientID, whose),
+			Fix:     "add a federated credential for this workspace's token",
+			Command: fmt.Sprintf("az ad app federated-credential create --id %s --parameters %s", clientID, shellQuote(string(params))),
+		}}
+	case "700016":
+		return []federationHint{{
+			Problem: fmt.Sprintf("there is no app %s in tenant %s", clientID, tenantID),
+			Fix:     "set IDP_AZURE_CLIENT_ID to the application (client) ID of the app registration, and IDP_AZURE_TENANT_ID to its tenant",
+			Command: fmt.Sprintf("az ad app show --id %s --query '{appId:appId,publisherDomain:publisherDomain}'", clientID),
+		}}
+	case "90002":
+		return []federationHint{{
+			Problem: fmt.Sprintf("there is no tenant %s", tenantID),
+			Fix:     "set IDP_AZURE_TENANT_ID to the directory (tenant) ID of the app registration",
+			Command: "az account show --query tenantId",
+		}}
+	case "700024":
+		return []federationHint{{
+			Problem: "Entra ID considers the token expired or not yet valid",
+			Fix:     "check the clock of the workspace, then sign in again for a fresh token",
+			Command: "idp login azure",
+		}}
+	}
+	return nil
+}
+
+var nonCredentialNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// federatedCredentialName derives a name for a federated credential from subject, as names may only contain
+// letters, digits, dashes and underscores.
+func federatedCredentialName(subject string) string {
+	name := strings.Trim(nonCredentialNameChars.ReplaceAllString(subject, "-"), "-")
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	if name == "" {
+		name = "workspace"
+	}
+	return name
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeSecretFile writes content to fn so that only the current user can read it, whatever the umask.
+// Directories it creates are private as well, as is the state directory if fn is in it. Should fn already exist
+// with looser permissions, they are fixed before the content is written.
+func writeSecretFile(fn string, content []byte) error {
+	err := mkdirPrivate(filepath.Dir(fn))
+	if err != nil {
+		return err
+	}
+	if dir, err := stateDir(); err == nil && strings.HasPrefix(fn, dir+string(filepath.Separator)) {
+		err = restrictPermissions(dir, 0700)
+		if err != nil {
+			return err
+		}
+	}
+	err = restrictPermissions(fn, 0600)
+	if err != nil {
+		return err
+	}
+	return replaceFile(fn, content)
+}
+
+// replaceFile writes content to a temporary file next to fn, which then takes fn's place. Readers, and a process
+// killed halfway through, never see a partly written file. Like the temporary file, fn is only readable by the
+// current user afterwards. Symlinks are followed, so that fn stays one.
+func replaceFile(fn string, content []byte) error {
+	if target, err := filepath.EvalSymlinks(fn); err == nil {
+		fn = target
+	}
+	f, err := os.CreateTemp(filepath.Dir(fn), "."+filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fn)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// mkdirPrivate creates dir and its missing parents so that only the current user can access them. Existing
+// directories are left alone.
+func mkdirPrivate(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	for _, d := range missing {
+		err = os.Chmod(d, 0700)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restrictPermissions sets the permissions of fn to perm, with a warning, if other users can access it. Missing
+// files are not an error.
+func restrictPermissions(fn string, perm os.FileMode) error {
+	fi, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0077 == 0 || !filePermissionsApply() {
+		return nil
+	}
+	slog.Warn("other users could access this file, restricting it to you", "path", fn, "mode", fmt.Sprintf("%#o", fi.Mode().Perm()))
+	return os.Chmod(fn, perm)
+}
+
+// exposedFiles returns those of fns which exist and which other users can access.
+func exposedFiles(fns ...string) []string {
+	var res []string
+	for _, fn := range fns {
+		fi, err := os.Stat(fn)
+		if err == nil && fi.Mode().Perm()&0077 != 0 && filePermissionsApply() {
+			res = append(res, fn)
+		}
+	}
+	return res
+}
+
+// removeINIKeys removes keys from section of the INI file fn, dropping the section altogether if it ends up empty.
+// Missing files are not an error.
+func removeINIKeys(fn, section string, keys ...string) error {
+	fc, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	drop := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		drop[k] = true
+	}
+
+	var (
+		res       []string
+		sectStart = -1
+		inSection bool
+	)
+	flushSection := func() {
+		if sectStart < 0 {
+			return
+		}
+		empty := true
+		for _, l := range res[sectStart+1:] {
+			if strings.TrimSpace(l) != "" {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			res = res[:sectStart]
+		}
+		sectStart = -1
+	}
+	for _, line := range strings.Split(string(fc), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			if inSection {
+				flushSection()
+			}
+			inSection = strings.TrimSpace(trimmed[1:len(trimmed)-1]) == section
+			if inSection {
+				sectStart = len(res)
+			}
+			res = append(res, line)
+			continue
+		}
+		if inSection {
+			if k, _, ok := strings.Cut(trimmed, "="); ok && drop[strings.TrimSpace(k)] {
+				continue
+			}
+		}
+		res = append(res, line)
+	}
+	if inSection {
+		flushSection()
+	}
+
+	out := strings.Join(res, "\n")
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	return writeSecretFile(fn, []byte(out))
+}
+
+// removeFiles removes all given files, ignoring those which don't exist.
+func removeFiles(fns ...string) error {
+	for _, fn := range fns {
+		err := os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readINISection returns the key/value pairs of section in the INI file fn. Missing files yield an empty result.
+func readINISection(fn, section string) (map[string]string, error) {
+	fc, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	var inSection bool
+	for _, line := range strings.Split(string(fc), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			inSection = strings.TrimSpace(trimmed[1:len(trimmed)-1]) == section
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		if k, v, ok := strings.Cut(trimmed, "="); ok {
+			res[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return res, nil
+}
+
+// iniSections returns the names of the sections of the INI file fn, in their order. Missing files have none.
+func iniSections(fn string) ([]string, error) {
+	fc, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, line := range strings.Split(string(fc), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			res = append(res, strings.TrimSpace(trimmed[1:len(trimmed)-1]))
+		}
+	}
+	return res, nil
+}
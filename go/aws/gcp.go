@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func gcpMissingConfig() []string {
+	return missingSettings("IDP_GCP_WORKLOAD_IDENTITY_PROVIDER")
+}
+
+// gcpWorkloadIdentityProvider returns the resource name of the configured workload identity pool provider,
+// i.e. projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>.
+func gcpWorkloadIdentityProvider() string {
+	res := setting("IDP_GCP_WORKLOAD_IDENTITY_PROVIDER")
+	res = strings.TrimPrefix(res, "https:")
+	res = strings.TrimPrefix(res, "//iam.googleapis.com/")
+	return res
+}
+
+// gcpIdentity returns the service account to impersonate, or the workload identity provider if there's none.
+func gcpIdentity() string {
+	if sa := setting("IDP_GCP_SERVICE_ACCOUNT"); sa != "" {
+		return sa
+	}
+	return gcpWorkloadIdentityProvider()
+}
+
+// loginGCP writes an external account credential configuration that lets gcloud and the Google client libraries
+// exchange the workspace's identity token for Google credentials, and activates it in gcloud.
+func loginGCP(ctx context.Context) error {
+	provider := gcpWorkloadIdentityProvider()
+	token, err := gitpodIDToken(ctx, providerAudience("gcp"))
+	if err != nil {
+		return err
+	}
+
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	tokenFile := filepath.Join(dir, "gcp-token")
+	err = writeWipedSecretFile(tokenFile, []byte(token))
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write GCP token file: %w", err)
+	}
+
+	cfg := map[string]interface{}{
+		"type":               "external_account",
+		"audience":           "//iam.googleapis.com/" + provider,
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          gitpodidp.GoogleSTSEndpoint(),
+		"credential_source": map[string]string{
+			"file": tokenFile,
+		},
+	}
+	if sa := setting("IDP_GCP_SERVICE_ACCOUNT"); sa != "" {
+		cfg["service_account_impersonation_url"] = gitpodidp.GoogleImpersonationURL(sa)
+	}
+	fc, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	credFile := filepath.Join(dir, "gcp-credentials.json")
+	err = writeSecretFile(credFile, fc)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write GCP credential configuration: %w", err)
+	}
+	emitEvent(eventProfileWritten, "gcp", "path", credFile)
+
+	if pth, _ := runner.LookPath("gcloud"); pth != "" {
+		var out []byte
+		err = traceStep(ctx, "persist credentials", func(ctx context.Context) error {
+			return withProgress("activating the credentials in gcloud", func() (err error) {
+				out, err = runner.CombinedOutput(ctx, "gcloud", "auth", "login", "--quiet", "--cred-file", credFile)
+				return err
+			})
+		}, "idp.tool", "gcloud")
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "gcloud auth login failure: %s: %w", string(out), err)
+		}
+		emitEvent(eventProfileWritten, "gcp", "tool", "gcloud")
+		if project := setting("IDP_GCP_PROJECT"); project != "" {
+			out, err := runner.CombinedOutput(ctx, "gcloud", "config", "set", "project", project)
+			if err != nil {
+				return exitErrorf(exitPersistFailed, "gcloud config set project failure: %s: %w", string(out), err)
+			}
+		}
+	} else {
+		slog.Info("gcloud is not installed - set this variable to use the Google client libraries", "GOOGLE_APPLICATION_CREDENTIALS", credFile)
+	}
+
+	recordLogin(credentialRecord{Provider: "gcp", Identity: gcpIdentity(), Expiry: localTime(gitpodidp.Expiry(token))})
+
+	return nil
+}
+
+// whoamiGCP verifies the stored workspace token is accepted by Google and returns the identity it maps to.
+func whoamiGCP(ctx context.Context) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	token, err := os.ReadFile(filepath.Join(dir, "gcp-token"))
+	if err != nil {
+		return "", fmt.Errorf("cannot read GCP token file: %w", err)
+	}
+	federated, err := gitpodidp.GCPExchangeToken(ctx, gcpWorkloadIdentityProvider(), string(token))
+	if err != nil {
+		explainGCPRejection(err, string(token))
+		return "", err
+	}
+	registerSecret(federated)
+
+	if sa := setting("IDP_GCP_SERVICE_ACCOUNT"); sa != "" {
+		_, err = gitpodidp.GCPImpersonate(ctx, federated, sa)
+		if err != nil {
+			explainGCPRejection(err, string(token))
+			return "", err
+		}
+		return sa, nil
+	}
+
+	claims, err := gitpodidp.Claims(string(token))
+	if err != nil {
+		return "", err
+	}
+	pool := gcpWorkloadIdentityProvider()
+	if idx := strings.Index(pool, "/providers/"); idx >= 0 {
+		pool = pool[:idx]
+	}
+	return fmt.Sprintf("principal://iam.googleapis.com/%s/subject/%v", pool, claims["sub"]), nil
+}
+
+// gcpAccessToken exchanges the token of idp login gcp for a Google access token, impersonating the service
+// account if one is configured. method names what it's for in traces.
+func gcpAccessToken(ctx context.Context, method string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	token, err := os.ReadFile(filepath.Join(dir, "gcp-token"))
+	if err != nil {
+		return "", exitErrorf(exitMissingConfig, "not signed into gcp - run idp login gcp: %w", err)
+	}
+	var accessToken string
+	err = traceStep(ctx, "exchange token", func(ctx context.Context) error {
+		accessToken, err = gitpodidp.GCPExchangeToken(ctx, gcpWorkloadIdentityProvider(), string(token))
+		if err != nil {
+			return err
+		}
+		if sa := setting("IDP_GCP_SERVICE_ACCOUNT"); sa != "" {
+			registerSecret(accessToken)
+			accessToken, err = gitpodidp.GCPImpersonate(ctx, accessToken, sa)
+		}
+		return err
+	}, "idp.method", method)
+	if err != nil {
+		explainGCPRejection(err, string(token))
+		return "", withExitCode(exitExchangeFailed, err)
+	}
+	registerSecret(accessToken)
+	return accessToken, nil
+}
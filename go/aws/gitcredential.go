@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "git-credential",
+		Usage:   "git-credential configure [--bin-dir dir] [url...] | get | store | erase",
+		Summary: "act as git credential helper for Azure Repos, Cloud Source Repositories and Secure Source Manager",
+		Run:     runGitCredential,
+	})
+}
+
+// gitHelperName is the name the git credential helper is installed as, which git runs for credential.helper
+// gitpod-idp.
+const gitHelperName = "git-credential-gitpod-idp"
+
+// gitHostKinds are the git hosts the helper gets credentials for. They are like registries: a provider's access
+// token is the password.
+var gitHostKinds = []registryKind{
+	{Name: "azure-repos", Provider: "azure", Hosts: regexp.MustCompile(`^(dev\.azure\.com|[a-z0-9-]+\.visualstudio\.com)$`), Username: "gitpod-idp", Credentials: azureReposCredentials},
+	{Name: "google-source", Provider: "gcp", Hosts: regexp.MustCompile(`^(source\.developers\.google\.com|[a-z0-9-]+-git\.[a-z0-9-]+\.sourcemanager\.dev)$`), Username: "oauth2accesstoken", Credentials: googleSourceCredentials},
+}
+
+// gitHostURLs are the URLs git configure sets the helper up for by provider, unless it's given others.
+var gitHostURLs = map[string][]string{
+	"azure": {"https://dev.azure.com", "https://*.visualstudio.com"},
+	"gcp":   {"https://source.developers.google.com", "https://*.sourcemanager.dev"},
+}
+
+// azureDevOpsScope is the scope of Entra ID access tokens for Azure DevOps, whose application ID is fixed.
+const azureDevOpsScope = "499b84ac-1321-427f-aa17-267ca6975798/.default"
+
+func gitHostKindFor(host string) *registryKind {
+	for i, k := range gitHostKinds {
+		if k.Hosts.MatchString(host) {
+			return &gitHostKinds[i]
+		}
+	}
+	return nil
+}
+
+func runGitCredential(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return exitErrorf(exitUsage, "usage: git-credential configure [url...], or get, store or erase as git credential helper")
+	}
+	switch args[0] {
+	case "configure":
+		return runGitCredentialConfigure(ctx, args[1:])
+	case "get":
+		return gitCredentialGet(ctx)
+	case "store", "erase":
+		// credentials are obtained on demand, so there is nothing to keep or forget
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		return nil
+	}
+	return exitErrorf(exitUsage, "unknown git-credential subcommand %q", args[0])
+}
+
+// gitCredentialGet answers the get request of the git credential protocol: attributes like host=dev.azure.com on
+// stdin, and the username and password on stdout. For hosts it knows nothing about, it answers nothing, and git
+// asks the next helper.
+func gitCredentialGet(ctx context.Context) error {
+	attrs := make(map[string]string)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		k, v, _ := strings.Cut(line, "=")
+		attrs[k] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if attrs["protocol"] != "https" {
+		return nil
+	}
+	host := strings.ToLower(attrs["host"])
+	kind := gitHostKindFor(host)
+	if kind == nil {
+		return nil
+	}
+	if p, ok := findProvider(kind.Provider); ok && !p.configured() {
+		return exitErrorf(exitMissingConfig, "%s is hosted on %s, but %s is not configured - see idp providers list", host, kind.Provider, kind.Provider)
+	}
+	creds, err := cachedRegistryCredentials(ctx, host, kind)
+	if err != nil {
+		return err
+	}
+	meterUsage(ctx, "git", kind.Provider, host)
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "username=%s\npassword=%s\n", creds.Username, creds.Secret)
+	if !creds.Expiry.IsZero() {
+		fmt.Fprintf(&out, "password_expiry_utc=%d\n", creds.Expiry.Unix())
+	}
+	_, err = os.Stdout.Write(out.Bytes())
+	if err != nil {
+		return err
+	}
+	if !creds.Expiry.IsZero() {
+		saveFastPath(out.Bytes(), creds.Expiry.Add(-dockerCredentialMargin), nil, &usageEntry{Channel: "git", Provider: kind.Provider, Target: host})
+	}
+	return nil
+}
+
+// azureReposCredentials uses an Entra ID access token for Azure DevOps, which Azure Repos accept as password.
+func azureReposCredentials(ctx context.Context, host string) (*registryCredentials, error) {
+	accessToken, err := azureAccessToken(ctx, azureDevOpsScope, "azure-repos")
+	if err != nil {
+		return nil, err
+	}
+	return &registryCredentials{Username: "gitpod-idp", Secret: accessToken, Expiry: gitpodidp.Expiry(accessToken)}, nil
+}
+
+// googleSourceCredentials uses a Google access token, which Cloud Source Repositories and Secure Source Manager
+// accept as password.
+func googleSourceCredentials(ctx context.Context, host string) (*registryCredentials, error) {
+	accessToken, err := gcpAccessToken(ctx, "google-source")
+	if err != nil {
+		return nil, err
+	}
+	// Google access tokens are valid for an hour
+	return &registryCredentials{Username: "oauth2accesstoken", Secret: accessToken, Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+// runGitCredentialConfigure installs the helper and adds it to the global git config for urls, by default those
+// of the configured providers' hosts. The helpers git already has for them stay, after this one.
+func runGitCredentialConfigure(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("git-credential configure", flag.ExitOnError)
+	binDir := flags.String("bin-dir", "", "install "+gitHelperName+" into this directory on PATH (default ~/.local/bin)")
+	_ = flags.Parse(args)
+
+	urls := flags.Args()
+	if len(urls) == 0 {
+		for _, name := range sortedKeys(gitHostURLs) {
+			if p, ok := findProvider(name); ok && p.configured() {
+				urls = append(urls, gitHostURLs[name]...)
+			}
+		}
+	}
+	if len(urls) == 0 {
+		return exitErrorf(exitMissingConfig, "no git hosts to configure: configure azure or gcp, or pass the URLs of the hosts")
+	}
+
+	dir, err := helperDir(*binDir)
+	if err != nil {
+		return err
+	}
+	helper, err := installHelper(dir, gitHelperName)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot install %s: %w", gitHelperName, err)
+	}
+	if pth, _ := exec.LookPath(gitHelperName); pth != helper {
+		printWarning("%s is not on PATH, so git won't find it - add it to PATH", dir)
+	}
+
+	name := strings.TrimPrefix(gitHelperName, "git-credential-")
+	for _, u := range urls {
+		key := "credential." + strings.TrimSuffix(u, "/") + ".helper"
+		out, _ := runner.Output(ctx, "git", "config", "--global", "--get-all", key)
+		if containsLine(string(out), name) {
+			continue
+		}
+		out, err = runner.CombinedOutput(ctx, "git", "config", "--global", "--add", key, name)
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot add the credential helper to the git config: %s: %w", strings.TrimSpace(string(out)), err)
+		}
+	}
+	emitEvent(eventProfileWritten, "", "tool", "git")
+	printSuccess("git uses %s for %s", gitHelperName, strings.Join(urls, ", "))
+	return nil
+}
+
+func containsLine(s, line string) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// gitpodIDToken produces an identity token for the current workspace for the given audience, unless the shared
+// workspace policy refuses it.
+func gitpodIDToken(ctx context.Context, audience string) (string, error) {
+	if !runningInGitpod() {
+		return "", gitpodidp.ErrNotInGitpod
+	}
+	err := guardCredentials(ctx, "a token for "+audience)
+	if err != nil {
+		return "", err
+	}
+	var out []byte
+	err = traceStep(ctx, "mint identity token", func(ctx context.Context) error {
+		return withProgress("minting an identity token for "+audience, func() (err error) {
+			out, err = runner.Output(ctx, "gp", "idp", "token", "--audience", audience)
+			return err
+		})
+	}, "idp.audience", audience)
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("%w: gp idp token failure: %s: %w", gitpodidp.ErrTokenMint, string(ee.Stderr), err)
+		}
+		return "", fmt.Errorf("%w: gp idp token failure: %w", gitpodidp.ErrTokenMint, err)
+	}
+	emitEvent(eventTokenMinted, "", "audience", audience)
+	token := strings.TrimSpace(string(out))
+	wipe(out)
+	registerSecret(token)
+	observeTokenClock(token)
+	recordTokenClaims(token)
+	return token, nil
+}
+
+// gitpodHost returns the host name of the Gitpod installation the workspace runs on, e.g. gitpod.io.
+func gitpodHost() (string, error) {
+	u, err := url.Parse(os.Getenv("GITPOD_HOST"))
+	if err != nil {
+		return "", fmt.Errorf("invalid Gitpod host url: %w", err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("GITPOD_HOST is not set")
+	}
+	return u.Host, nil
+}
+
+// gitpodIssuer returns the OIDC issuer of the workspace's identity tokens.
+func gitpodIssuer() (string, error) {
+	if apiURL := setting("IDP_GITPOD_API_URL"); apiURL != "" {
+		return strings.TrimSuffix(apiURL, "/") + "/idp", nil
+	}
+	host, err := gitpodHost()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://api.%s/idp", host), nil
+}
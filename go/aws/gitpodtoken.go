@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// gitpodTokenMargin is how long before it expires a cached Gitpod API token is no longer handed out.
+const gitpodTokenMargin = time.Minute
+
+// gitpodTokenCache shares the Gitpod API token the supervisor issues among the processes of the workspace,
+// sealed like the credential records, so that credential helpers and parallel logins don't ask the supervisor for
+// one each. Processes which find no valid token take turns fetching one, and those after the first use it.
+type gitpodTokenCache struct{}
+
+type cachedGitpodToken struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+func gitpodTokenFile(host string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gitpod", host+".json"), nil
+}
+
+func (gitpodTokenCache) APIToken(ctx context.Context, host string, fetch func(ctx context.Context) (string, time.Time, error)) (string, error) {
+	fn, err := gitpodTokenFile(host)
+	if err != nil {
+		token, _, err := fetch(ctx)
+		return token, err
+	}
+	cached := func() string {
+		fc, err := readSealedFile(fn)
+		if err != nil {
+			return ""
+		}
+		defer wipe(fc)
+		var t cachedGitpodToken
+		if json.Unmarshal(fc, &t) != nil || time.Until(t.Expiry) <= gitpodTokenMargin {
+			return ""
+		}
+		registerSecret(t.Token)
+		return t.Token
+	}
+	if token := cached(); token != "" {
+		return token, nil
+	}
+	unlock, waited, err := acquireLock(ctx, "gitpod-"+host)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if waited {
+		if token := cached(); token != "" {
+			return token, nil
+		}
+	}
+
+	token, expiry, err := fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	registerSecret(token)
+	fc, err := json.Marshal(cachedGitpodToken{Token: token, Expiry: expiry})
+	if err == nil {
+		err = writeSealedFile(fn, fc)
+		wipe(fc)
+	}
+	if err != nil {
+		slog.Debug("cannot cache the Gitpod API token", "host", host, "error", err)
+	}
+	return token, nil
+}
+
+func (gitpodTokenCache) ForgetAPIToken(host string) {
+	fn, err := gitpodTokenFile(host)
+	if err != nil {
+		return
+	}
+	err = os.Remove(fn)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Debug("cannot remove the cached Gitpod API token", "host", host, "error", err)
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/gitpod-io/example-idp-integration/go/aws
 
-go 1.20
+go 1.21
 
 require golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63 // indirect
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "health",
+		Usage:   "health [--addr localhost:9465] [--live] [--wait 2m]",
+		Summary: "ask the daemon whether it is running and the credentials are ready",
+		Run:     runHealth,
+	})
+}
+
+// defaultHealthAddr is where the daemon serves its health endpoints unless told otherwise.
+const defaultHealthAddr = "localhost:9465"
+
+// daemonStallTimeout is how much longer than daemonPollInterval a round of checks may take before the daemon
+// counts as stuck. Refreshing is bounded by the exchange timeouts, which are well below it.
+const daemonStallTimeout = 5 * time.Minute
+
+// healthReport is the answer of /healthz and /readyz.
+type healthReport struct {
+	Status    string           `json:"status"`
+	Started   time.Time        `json:"started"`
+	LastCheck *time.Time       `json:"lastCheck,omitempty"`
+	Providers []providerStatus `json:"providers,omitempty"`
+}
+
+const (
+	healthOK       = "ok"
+	healthStalled  = "stalled"
+	healthReady    = "ready"
+	healthStarting = "starting"
+	healthUnready  = "unready"
+)
+
+// checked records that a round of checks finished.
+func (d *daemon) checked() {
+	d.mu.Lock()
+	d.lastCheck = time.Now()
+	d.mu.Unlock()
+}
+
+// liveness reports whether the daemon still gets round to checking the credentials.
+func (d *daemon) liveness() healthReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := healthReport{Status: healthOK, Started: d.started}
+	since := d.started
+	if !d.lastCheck.IsZero() {
+		last := d.lastCheck
+		res.LastCheck = &last
+		since = last
+	}
+	if time.Since(since) > daemonPollInterval+daemonStallTimeout {
+		res.Status = healthStalled
+	}
+	return res
+}
+
+// writeReady writes the ready file when the credentials have become ready, or stopped being so since the last
+// check. Failed refreshes are retried, so the file never carries an error.
+func (d *daemon) writeReady() {
+	if d.readyFile == "" {
+		return
+	}
+	ready := d.readiness().Status == healthReady
+	if ready == d.ready {
+		return
+	}
+	var err error
+	if ready {
+		err = writeReadyFile(d.readyFile, nil)
+	} else {
+		err = clearReadyFile(d.readyFile)
+	}
+	if err != nil {
+		slog.Warn("cannot update the ready file", "path", d.readyFile, "error", err)
+		return
+	}
+	d.ready = ready
+}
+
+// readiness reports whether the daemon has looked at the credentials and all configured providers have valid
+// ones, so that steps which need them can go ahead.
+func (d *daemon) readiness() healthReport {
+	res := d.liveness()
+	if res.Status == healthStalled {
+		return res
+	}
+	if res.LastCheck == nil {
+		res.Status = healthStarting
+		return res
+	}
+	res.Status = healthReady
+	for _, p := range d.providers {
+		if !p.configured() {
+			continue
+		}
+		st, err := getProviderStatus(p)
+		if err != nil {
+			slog.Warn("cannot determine readiness", "provider", p.Name, "error", err)
+			st.State = stateNone
+		}
+		if st.State != stateValid {
+			res.Status = healthUnready
+		}
+		res.Providers = append(res.Providers, st)
+	}
+	return res
+}
+
+// handleHealth serves report as JSON, with 503 Service Unavailable unless its status is one of good.
+func handleHealth(report func() healthReport, good ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep := report()
+		code := http.StatusServiceUnavailable
+		for _, g := range good {
+			if rep.Status == g {
+				code = http.StatusOK
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(rep)
+	}
+}
+
+// httpServers tracks the servers serveHTTP started until they have shut down.
+var httpServers sync.WaitGroup
+
+// serveHTTP serves handler on addr until ctx is cancelled, letting requests in flight finish then. what names the
+// endpoints in log messages. httpServers.Wait waits for the shutdown.
+func serveHTTP(ctx context.Context, addr, what string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return exitErrorf(exitUsage, "cannot serve %s: %w", what, err)
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("serving "+what, "url", "http://"+l.Addr().String())
+
+	httpServers.Add(1)
+	go func() {
+		defer httpServers.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		err := srv.Serve(l)
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Warn("cannot serve "+what, "error", err)
+		}
+	}()
+	return nil
+}
+
+// healthPollInterval is how often health --wait asks the daemon again.
+const healthPollInterval = time.Second
+
+func runHealth(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("health", flag.ExitOnError)
+	addr := flags.String("addr", defaultHealthAddr, "address the daemon serves its health endpoints on")
+	live := flags.Bool("live", false, "only check that the daemon is running, not that the credentials are ready")
+	wait := flags.Duration("wait", 0, "wait this long for the daemon to become healthy, e.g. while it starts")
+	_ = flags.Parse(args)
+
+	path := "/readyz"
+	if *live {
+		path = "/healthz"
+	}
+	url := "http://" + *addr + path
+	deadline := time.Now().Add(*wait)
+	for {
+		rep, err := queryHealth(ctx, url)
+		if err == nil || time.Now().After(deadline) || ctx.Err() != nil {
+			if rep != nil {
+				if werr := writeHealthReport(*rep); werr != nil {
+					return werr
+				}
+			}
+			return err
+		}
+		slog.Debug("daemon is not healthy yet", "error", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+// queryHealth asks the daemon at url for its health report. It fails unless the daemon answers 200 OK, and returns
+// the report along with the error if the daemon sent one.
+func queryHealth(ctx context.Context, url string) (*healthReport, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, exitErrorf(exitUsage, "invalid health address: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("the daemon is not running - start it with idp daemon: %w", err)
+	}
+	defer drainBody(resp.Body)
+	var rep healthReport
+	err = json.NewDecoder(resp.Body).Decode(&rep)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the health report of %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &rep, fmt.Errorf("the daemon is %s", rep.Status)
+	}
+	return &rep, nil
+}
+
+func writeHealthReport(rep healthReport) error {
+	return writeOutput(rep, func(out io.Writer) error {
+		fmt.Fprintf(out, "daemon is %s, running since %s\n", rep.Status, rep.Started.Local().Format(time.Kitchen))
+		if len(rep.Providers) == 0 {
+			return nil
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PROVIDER\tCREDENTIALS\tEXPIRES")
+		for _, st := range rep.Providers {
+			expires := "-"
+			if st.Expiry != nil {
+				expires = humanizeExpiry(time.Until(*st.Expiry))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", st.Provider, st.State, expires)
+		}
+		return w.Flush()
+	})
+}
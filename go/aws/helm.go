@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+func init() {
+	providers = append(providers, provider{
+		Name:     "helm",
+		Missing:  helmMissingConfig,
+		Login:    loginHelm,
+		Whoami:   whoamiHelm,
+		Logout:   logoutHelm,
+		Env:      envHelm,
+		EnvNames: []string{"HELM_REGISTRY_CONFIG"},
+		Identity: helmIdentity,
+		After:    true,
+	})
+}
+
+func helmMissingConfig() []string {
+	return missingSettings("IDP_HELM_REGISTRIES")
+}
+
+// helmRegistries returns the OCI registries of IDP_HELM_REGISTRIES, which is written like IDP_DOCKER_REGISTRIES.
+func helmRegistries() ([]string, map[string]string, error) {
+	configured, err := configuredRegistries("IDP_HELM_REGISTRIES")
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts := sortedKeys(configured)
+	for _, host := range hosts {
+		if registryKindFor(host, configured) == nil {
+			return nil, nil, exitErrorf(exitMissingConfig, "IDP_HELM_REGISTRIES: don't know what kind of registry %s is - write it as %s=<kind>, with kind one of %s", host, host, strings.Join(registryKindNames(), ", "))
+		}
+	}
+	return hosts, configured, nil
+}
+
+func helmIdentity() string {
+	hosts, _, _ := helmRegistries()
+	return strings.Join(hosts, ",")
+}
+
+// helmRegistryConfig returns the file helm registry login writes to.
+func helmRegistryConfig() (string, error) {
+	if fn := os.Getenv("HELM_REGISTRY_CONFIG"); fn != "" {
+		return fn, nil
+	}
+	if dir := os.Getenv("HELM_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "registry", "config.json"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	// like helm, XDG_CONFIG_HOME takes precedence over the platform's convention
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	switch {
+	case dir != "":
+	case runtime.GOOS == "darwin":
+		dir = filepath.Join(home, "Library", "Preferences")
+	case runtime.GOOS == "windows" && os.Getenv("APPDATA") != "":
+		dir = os.Getenv("APPDATA")
+	default:
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "helm", "registry", "config.json"), nil
+}
+
+// loginHelm obtains credentials for the chart registries of IDP_HELM_REGISTRIES from the providers hosting them,
+// like the Docker credential helper, and stores them in helm's registry config as helm registry login would. The
+// login expires with the first of them.
+func loginHelm(ctx context.Context) error {
+	hosts, configured, err := helmRegistries()
+	if err != nil {
+		return err
+	}
+	fn, err := helmRegistryConfig()
+	if err != nil {
+		return err
+	}
+	cfg, err := readDockerConfig(fn)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot read %s: %w", fn, err)
+	}
+	if cfg.Auths == nil {
+		cfg.Auths = make(map[string]json.RawMessage)
+	}
+
+	var expiry time.Time
+	for _, host := range hosts {
+		kind := registryKindFor(host, configured)
+		if p, ok := findProvider(kind.Provider); ok && !p.configured() {
+			return exitErrorf(exitMissingConfig, "%s is a %s registry, but %s is not configured - see idp providers list", host, kind.Name, kind.Provider)
+		}
+		var creds *registryCredentials
+		err = withProgress("obtaining credentials for "+host, func() (err error) {
+			creds, err = cachedRegistryCredentials(ctx, host, kind)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", host, err)
+		}
+		auth, err := json.Marshal(dockerAuth{Auth: base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Secret))})
+		if err != nil {
+			return err
+		}
+		cfg.Auths[host] = auth
+		if !creds.Expiry.IsZero() && (expiry.IsZero() || creds.Expiry.Before(expiry)) {
+			expiry = creds.Expiry
+		}
+	}
+
+	err = writeDockerConfig(fn, cfg)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write %s: %w", fn, err)
+	}
+	emitEvent(eventProfileWritten, "helm", "path", fn)
+	recordLogin(credentialRecord{Provider: "helm", Identity: strings.Join(hosts, ","), Expiry: expiry})
+	return nil
+}
+
+// whoamiHelm returns the registries helm has credentials for, and the user names of those.
+func whoamiHelm(ctx context.Context) (string, error) {
+	fn, err := helmRegistryConfig()
+	if err != nil {
+		return "", err
+	}
+	cfg, err := readDockerConfig(fn)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %w", fn, err)
+	}
+	hosts, _, err := helmRegistries()
+	if err != nil {
+		return "", err
+	}
+	var res []string
+	for _, host := range hosts {
+		var auth dockerAuth
+		if json.Unmarshal(cfg.Auths[host], &auth) != nil {
+			return "", fmt.Errorf("not signed into %s - run idp login helm", host)
+		}
+		userpass, _ := base64.StdEncoding.DecodeString(auth.Auth)
+		user, _, _ := strings.Cut(string(userpass), ":")
+		res = append(res, fmt.Sprintf("%s as %s", host, user))
+	}
+	return strings.Join(res, ", "), nil
+}
+
+// logoutHelm removes the credentials of the registries of IDP_HELM_REGISTRIES from helm's registry config.
+func logoutHelm(ctx context.Context, revoke bool) error {
+	fn, err := helmRegistryConfig()
+	if err != nil {
+		return err
+	}
+	cfg, err := readDockerConfig(fn)
+	if err != nil || cfg.Auths == nil {
+		return err
+	}
+	hosts, _, err := helmRegistries()
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		delete(cfg.Auths, host)
+	}
+	return writeDockerConfig(fn, cfg)
+}
+
+func envHelm() (map[string]string, error) {
+	fn, err := helmRegistryConfig()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"HELM_REGISTRY_CONFIG": fn}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// hooksConfig declares shell commands to run around each sign-in, keyed by provider name, or * for all providers.
+// Refreshes run them too, so that e.g. a port-forward holding the old credentials is restarted.
+type hooksConfig struct {
+	// PreLogin runs before signing in. If one fails, the provider isn't signed into.
+	PreLogin map[string][]string `json:"preLogin,omitempty"`
+	// PostLogin runs once signed in, with the provider's credentials in the environment. Failures are only
+	// reported, as the credentials are in place by then.
+	PostLogin map[string][]string `json:"postLogin,omitempty"`
+}
+
+// hookCommands returns the commands of stage for provider name: those for all providers first.
+func hookCommands(stage map[string][]string, name string) []string {
+	return append(append([]string{}, stage["*"]...), stage[name]...)
+}
+
+// runHooks runs the hooks of stage, preLogin or postLogin, for p in sh, or cmd.exe on Windows without sh. They get the provider's credentials as
+// environment variables where it has any, and IDP_PROVIDER, IDP_HOOK (the stage) and IDP_SIGNIN, which is login or
+// refresh.
+func runHooks(ctx context.Context, p provider, stage, kind string) error {
+	if cfg == nil || cfg.Hooks == nil {
+		return nil
+	}
+	var commands []string
+	switch stage {
+	case "preLogin":
+		commands = hookCommands(cfg.Hooks.PreLogin, p.Name)
+	case "postLogin":
+		commands = hookCommands(cfg.Hooks.PostLogin, p.Name)
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+
+	env := []string{"IDP_PROVIDER=" + p.Name, "IDP_HOOK=" + stage, "IDP_SIGNIN=" + kind}
+	creds, err := credentialEnv([]provider{p})
+	if err != nil {
+		slog.Debug("cannot pass the credentials to hooks", "provider", p.Name, "error", err)
+	}
+	for _, k := range sortedKeys(creds) {
+		env = append(env, k+"="+creds[k])
+	}
+	hookCtx := withCommandEnv(ctx, env...)
+	for _, c := range commands {
+		err := traceStep(hookCtx, "run hook", func(ctx context.Context) error {
+			shell, args := shellCommand(c)
+			out, err := runner.CombinedOutput(ctx, shell, args...)
+			if err != nil {
+				if msg := strings.TrimSpace(string(out)); msg != "" {
+					err = fmt.Errorf("%s: %w", msg, err)
+				}
+				return fmt.Errorf("%s hook %q of %s failed: %w", stage, c, p.Name, err)
+			}
+			slog.Debug("ran hook", "provider", p.Name, "hook", stage, "command", c, "output", string(out))
+			return nil
+		}, "idp.hook", stage)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "init",
+		Usage:   "init",
+		Summary: "set up the repository config and a Gitpod task interactively",
+		Run:     runInit,
+	})
+}
+
+// loginTaskCommand is what the Gitpod task added by init runs. It assumes the tool is installed as idp.
+const loginTaskCommand = "idp login all"
+
+func runInit(ctx context.Context, args []string) error {
+	p, err := newPrompter()
+	if err != nil {
+		return exitErrorf(exitUsage, "init is interactive: %w", err)
+	}
+
+	fn, err := repoConfigPath()
+	if err != nil {
+		return err
+	}
+	c := cfg
+	if inUse, _ := configPath(); inUse != fn {
+		// the user's config applies to all repositories; this one gets a config of its own
+		c = nil
+	}
+	if c != nil {
+		ok, err := p.confirm(fmt.Sprintf("%s exists already. Update it?", fn), true)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	} else {
+		c = &config{}
+	}
+
+	var defaultProviders []string
+	for _, prov := range providers {
+		if prov.configured() {
+			defaultProviders = append(defaultProviders, prov.Name)
+		}
+	}
+	if len(defaultProviders) == 0 {
+		defaultProviders = []string{"aws"}
+	}
+	answer, err := p.ask("Which providers does this project use (aws, gcp, azure, vault)?", strings.Join(defaultProviders, ","))
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(answer, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		err = askProviderConfig(p, c, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = saveConfig(fn, c)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write config: %w", err)
+	}
+	slog.Info("wrote configuration", "path", fn)
+
+	ok, err := p.confirm("Add a task to .gitpod.yml that signs in when a workspace starts?", true)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	root, err := repoRoot()
+	if err != nil {
+		return err
+	}
+	gitpodYML := filepath.Join(root, ".gitpod.yml")
+	err = addGitpodTask(gitpodYML, "Sign into cloud providers", loginTaskCommand)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot update .gitpod.yml: %w", err)
+	}
+	slog.Info("added login task", "path", gitpodYML)
+	return nil
+}
+
+func askProviderConfig(p *prompter, c *config, name string) error {
+	// ask returns early on the first error, so that the flow below can ignore errors until the end
+	var err error
+	ask := func(question, def string) string {
+		if err != nil {
+			return ""
+		}
+		var res string
+		res, err = p.ask(question, def)
+		return res
+	}
+
+	switch name {
+	case "aws":
+		if c.AWS == nil {
+			c.AWS = &awsConfig{}
+		}
+		roles := ask("AWS role ARNs to assume (comma-separated)", setting("IDP_AWS_ROLE_ARN"))
+		c.AWS.RoleARNs = nil
+		for _, r := range strings.Split(roles, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				c.AWS.RoleARNs = append(c.AWS.RoleARNs, r)
+			}
+		}
+	case "gcp":
+		if c.GCP == nil {
+			c.GCP = &gcpConfig{}
+		}
+		c.GCP.WorkloadIdentityProvider = ask("GCP workload identity provider (projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>)", setting("IDP_GCP_WORKLOAD_IDENTITY_PROVIDER"))
+		c.GCP.ServiceAccount = ask("GCP service account to impersonate (optional)", setting("IDP_GCP_SERVICE_ACCOUNT"))
+		c.GCP.Project = ask("GCP project (optional)", setting("IDP_GCP_PROJECT"))
+	case "azure":
+		if c.Azure == nil {
+			c.Azure = &azureConfig{}
+		}
+		c.Azure.ClientID = ask("Azure client ID", setting("IDP_AZURE_CLIENT_ID"))
+		c.Azure.TenantID = ask("Azure tenant ID", setting("IDP_AZURE_TENANT_ID"))
+		c.Azure.SubscriptionID = ask("Azure subscription ID (optional)", setting("IDP_AZURE_SUBSCRIPTION_ID"))
+	case "vault":
+		if c.Vault == nil {
+			c.Vault = &vaultConfig{}
+		}
+		c.Vault.Address = ask("Vault address", setting("VAULT_ADDR"))
+		c.Vault.Role = ask("Vault role", setting("IDP_VAULT_ROLE"))
+		c.Vault.AuthPath = ask("Vault JWT auth mount path (optional)", setting("IDP_VAULT_AUTH_PATH"))
+		c.Vault.Audience = ask("Vault token audience (optional)", setting("IDP_VAULT_AUDIENCE"))
+	default:
+		slog.Warn("skipping unknown provider", "provider", name)
+	}
+	return err
+}
+
+// addGitpodTask adds a task running command to the tasks of the .gitpod.yml file fn, creating the file if needed.
+// The file is edited textually to preserve its formatting and comments.
+func addGitpodTask(fn, name, command string) error {
+	fc, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	content := string(fc)
+	if strings.Contains(content, command) {
+		return nil
+	}
+
+	lines := strings.Split(content, "\n")
+	tasksIdx := -1
+	for i, l := range lines {
+		if strings.HasPrefix(l, "tasks:") {
+			tasksIdx = i
+			break
+		}
+	}
+	if tasksIdx < 0 {
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += fmt.Sprintf("tasks:\n  - name: %s\n    before: %s\n", name, command)
+		return os.WriteFile(fn, []byte(content), 0644)
+	}
+
+	// match the indentation of the existing task list
+	indent := "  "
+	for _, l := range lines[tasksIdx+1:] {
+		trimmed := strings.TrimLeft(l, " ")
+		if strings.HasPrefix(trimmed, "- ") {
+			indent = l[:len(l)-len(trimmed)]
+			break
+		}
+	}
+	task := []string{
+		fmt.Sprintf("%s- name: %s", indent, name),
+		fmt.Sprintf("%s  before: %s", indent, command),
+	}
+	res := append([]string{}, lines[:tasksIdx+1]...)
+	res = append(res, task...)
+	res = append(res, lines[tasksIdx+1:]...)
+	return os.WriteFile(fn, []byte(strings.Join(res, "\n")), 0644)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "install",
+		Usage:   "install [--bin-dir dir] [docker|bazel|git|kubectl|direnv|starship...]",
+		Summary: "install the credential helpers, kubectl plugin and shell hooks which apply here, e.g. in a workspace image",
+		Run:     runInstall,
+	})
+}
+
+// integration is something install sets up: a helper and the config which makes its tool use it.
+type integration struct {
+	Name string
+	// Applies returns why the integration doesn't apply, or "" if it does. Integrations given by name are
+	// installed regardless.
+	Applies func() string
+	Install func(ctx context.Context, binDir string) error
+}
+
+var integrations = []integration{
+	{Name: "docker", Applies: settingApplies("IDP_DOCKER_REGISTRIES"), Install: func(ctx context.Context, binDir string) error {
+		return runDockerConfigure(ctx, binDirArgs(binDir))
+	}},
+	{Name: "bazel", Applies: settingApplies("IDP_BAZEL_ENDPOINTS"), Install: func(ctx context.Context, binDir string) error {
+		return runBazelConfigure(ctx, binDirArgs(binDir))
+	}},
+	{Name: "git", Applies: gitApplies, Install: func(ctx context.Context, binDir string) error {
+		return runGitCredentialConfigure(ctx, binDirArgs(binDir))
+	}},
+	{Name: "kubectl", Applies: toolApplies("kubectl"), Install: installKubectlPlugin},
+	{Name: "direnv", Applies: toolApplies("direnv"), Install: installDirenvLib},
+	{Name: "starship", Applies: toolApplies("starship"), Install: installStarshipModule},
+}
+
+func settingApplies(name string) func() string {
+	return func() string {
+		if setting(name) == "" {
+			return name + " is not set"
+		}
+		return ""
+	}
+}
+
+func toolApplies(name string) func() string {
+	return func() string {
+		if _, err := runner.LookPath(name); err != nil {
+			return name + " is not installed"
+		}
+		return ""
+	}
+}
+
+func gitApplies() string {
+	if reason := toolApplies("git")(); reason != "" {
+		return reason
+	}
+	for name := range gitHostURLs {
+		if p, ok := findProvider(name); ok && p.configured() {
+			return ""
+		}
+	}
+	return "neither azure nor gcp is configured"
+}
+
+func binDirArgs(binDir string) []string {
+	if binDir == "" {
+		return nil
+	}
+	return []string{"--bin-dir", binDir}
+}
+
+// runInstall sets up the integrations given, or all those which apply, so that a single command in the
+// workspace image or the dotfiles enables them. Running it again updates them. It keeps going past integrations
+// which fail.
+func runInstall(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("install", flag.ExitOnError)
+	binDir := flags.String("bin-dir", "", "install the helpers into this directory on PATH (default ~/.local/bin)")
+	_ = flags.Parse(args)
+
+	selected := integrations
+	if flags.NArg() > 0 {
+		selected = nil
+		for _, name := range flags.Args() {
+			found := false
+			for _, in := range integrations {
+				if in.Name == name {
+					selected, found = append(selected, in), true
+				}
+			}
+			if !found {
+				return exitErrorf(exitUsage, "unknown integration %q: use docker, bazel, git, kubectl, direnv or starship", name)
+			}
+		}
+	}
+
+	var errs []error
+	for _, in := range selected {
+		if flags.NArg() == 0 {
+			if reason := in.Applies(); reason != "" {
+				fmt.Fprintf(os.Stderr, "skipping %s: %s\n", in.Name, reason)
+				continue
+			}
+		}
+		err := in.Install(ctx, *binDir)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			printFailure("%s: %v", in.Name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", in.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return withExitCode(exitCode(errs[0]), fmt.Errorf("cannot install %d of %d integrations:\n%w", len(errs), len(selected), errors.Join(errs...)))
+	}
+	return nil
+}
+
+// installKubectlPlugin installs the binary as kubectl-idp. Kubeconfigs then use it for their users with
+// kubectl config set-credentials.
+func installKubectlPlugin(ctx context.Context, binDir string) error {
+	dir, err := helperDir(binDir)
+	if err != nil {
+		return err
+	}
+	plugin, err := installHelper(dir, kubectlPluginName)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot install %s: %w", kubectlPluginName, err)
+	}
+	if pth, _ := exec.LookPath(kubectlPluginName); pth != plugin {
+		printWarning("%s is not on PATH, so kubectl won't find it - add it to PATH", dir)
+	}
+	emitEvent(eventProfileWritten, "", "tool", "kubectl", "path", plugin)
+	printSuccess("kubectl idp token eks|gke|aks is available (%s)", plugin)
+	return nil
+}
+
+// installDirenvLib adds use_gitpod_idp to direnv's library directory, whose scripts direnv loads before every .envrc.
+func installDirenvLib(ctx context.Context, binDir string) error {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	fn := filepath.Join(dir, "direnv", "lib", "gitpod-idp.sh")
+	err := os.MkdirAll(filepath.Dir(fn), 0755)
+	if err == nil {
+		err = os.WriteFile(fn, []byte(direnvLib), 0644)
+	}
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot install the direnv library: %w", err)
+	}
+	emitEvent(eventProfileWritten, "", "tool", "direnv", "path", fn)
+	printSuccess("direnv provides use gitpod_idp to .envrc files (%s)", fn)
+	return nil
+}
+
+// installStarshipModule adds the gitpod_idp module to the starship config, unless it's there already.
+func installStarshipModule(ctx context.Context, binDir string) error {
+	fn := os.Getenv("STARSHIP_CONFIG")
+	if fn == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		fn = filepath.Join(home, ".config", "starship.toml")
+	}
+	fc, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if bytes.Contains(fc, []byte("[custom.gitpod_idp]")) {
+		printSuccess("starship shows the AWS profile already (%s)", fn)
+		return nil
+	}
+	if len(fc) > 0 && !bytes.HasSuffix(fc, []byte("\n")) {
+		fc = append(fc, '\n')
+	}
+	snippet := strings.TrimPrefix(starshipSnippet, "# ~/.config/starship.toml\n")
+	if len(fc) > 0 {
+		snippet = "\n" + snippet
+	}
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err == nil {
+		err = os.WriteFile(fn, append(fc, snippet...), 0644)
+	}
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot add the module to the starship config: %w", err)
+	}
+	emitEvent(eventProfileWritten, "", "tool", "starship", "path", fn)
+	printSuccess("starship shows the AWS profile and its expiry (%s)", fn)
+	return nil
+}
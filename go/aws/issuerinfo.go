@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "issuer-info",
+		Usage:   "issuer-info [--issuer url] [--subject pattern...] [aws|gcp|azure|vault...]",
+		Summary: "show the Gitpod OIDC issuer, its keys and claims, and the trust configuration each cloud needs for it",
+		Run:     runIssuerInfo,
+	})
+}
+
+// trustTargets are the providers issuer-info writes trust configuration for, in the order it shows them.
+var trustTargets = []string{"aws", "gcp", "azure", "vault"}
+
+// issuerInfo is what a provider needs to know about the Gitpod issuer to trust its tokens.
+type issuerInfo struct {
+	Issuer            string    `json:"issuer"`
+	DiscoveryURL      string    `json:"discoveryUrl"`
+	JWKSURI           string    `json:"jwksUri"`
+	SigningAlgorithms []string  `json:"signingAlgorithms,omitempty"`
+	Keys              []jwkInfo `json:"keys"`
+	// Thumbprint is the SHA-1 thumbprint of the issuer's top intermediate certificate, which IAM asks for.
+	Thumbprint string `json:"thumbprint,omitempty"`
+	// Claims are the claims the discovery document lists or, if the workspace has a token, it carries, with the
+	// values of the workspace's token.
+	Claims map[string]interface{} `json:"claims"`
+	// Subjects are the patterns the trust configuration admits the subjects of.
+	Subjects []string          `json:"subjects"`
+	Trust    map[string]string `json:"trust"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+// jwkInfo is the public part of a signing key which identifies it; the key material is left out.
+type jwkInfo struct {
+	KeyID     string `json:"kid"`
+	Type      string `json:"kty"`
+	Algorithm string `json:"alg,omitempty"`
+	Use       string `json:"use,omitempty"`
+}
+
+func runIssuerInfo(ctx context.Context, args []string) error {
+	defaultIssuer, _ := gitpodIssuer()
+	flags := flag.NewFlagSet("issuer-info", flag.ExitOnError)
+	issuer := flags.String("issuer", defaultIssuer, "OIDC issuer of the workspace identity tokens")
+	var subjects stringList
+	flags.Var(&subjects, "subject", "pattern the token's sub claim must match, repeatable (default this repository's workspaces)")
+	_ = flags.Parse(args)
+	targets := trustTargets
+	if flags.NArg() > 0 {
+		targets = flags.Args()
+		for _, t := range targets {
+			if !slices.Contains(trustTargets, t) {
+				return exitErrorf(exitUsage, "no trust configuration for %q: use %s", t, strings.Join(trustTargets, ", "))
+			}
+		}
+	}
+	if *issuer == "" {
+		return exitErrorf(exitMissingConfig, "cannot determine the issuer outside of a workspace: pass --issuer, e.g. https://api.gitpod.io/idp")
+	}
+	*issuer = strings.TrimSuffix(*issuer, "/")
+
+	info, err := fetchIssuerInfo(ctx, *issuer)
+	if err != nil {
+		return err
+	}
+
+	// the workspace's own token shows the actual claims and subject
+	var tokenSubject string
+	if token, err := gitpodIDToken(ctx, gitpodidp.AWSAudience); err == nil {
+		if claims, err := gitpodidp.Claims(token); err == nil {
+			for k, v := range claims {
+				info.Claims[k] = v
+			}
+			tokenSubject, _ = claims["sub"].(string)
+		}
+	} else if runningInGitpod() {
+		info.Warnings = append(info.Warnings, fmt.Sprintf("cannot get this workspace's token to show its claims: %v", err))
+	}
+	info.Subjects = subjects
+	if len(info.Subjects) == 0 {
+		info.Subjects = repositorySubjects(gitRepositoryURL(ctx))
+	}
+	if len(info.Subjects) == 0 && tokenSubject != "" {
+		info.Subjects = []string{tokenSubject}
+	}
+	if len(info.Subjects) == 0 {
+		return exitErrorf(exitMissingConfig, "cannot determine the repository URL: pass --subject to scope the trust to your repository")
+	}
+	if tokenSubject != "" && !subjectsMatch(info.Subjects, tokenSubject) {
+		info.Warnings = append(info.Warnings, fmt.Sprintf("this workspace's subject %q doesn't match %s, so the configuration wouldn't admit it", tokenSubject, quoteAll(info.Subjects)))
+	}
+
+	if slices.Contains(targets, "aws") {
+		info.Thumbprint, err = oidcThumbprint(ctx, info.Issuer)
+		if err != nil {
+			info.Warnings = append(info.Warnings, fmt.Sprintf("cannot determine the certificate thumbprint: %v", err))
+		}
+	}
+	for _, t := range targets {
+		info.Trust[t] = trustSnippet(t, info, tokenSubject)
+	}
+
+	return writeOutput(info, func(out io.Writer) error {
+		writeIssuerInfo(out, info, targets)
+		return nil
+	})
+}
+
+// fetchIssuerInfo reads the discovery document and the keys of issuer.
+func fetchIssuerInfo(ctx context.Context, issuer string) (*issuerInfo, error) {
+	info := &issuerInfo{
+		Issuer:       issuer,
+		DiscoveryURL: issuer + "/.well-known/openid-configuration",
+		Claims:       make(map[string]interface{}),
+		Trust:        make(map[string]string),
+	}
+	var discovery struct {
+		Issuer            string   `json:"issuer"`
+		JWKSURI           string   `json:"jwks_uri"`
+		SigningAlgorithms []string `json:"id_token_signing_alg_values_supported"`
+		ClaimsSupported   []string `json:"claims_supported"`
+	}
+	err := getJSON(ctx, info.DiscoveryURL, "", &discovery)
+	if err != nil {
+		return nil, exitErrorf(exitExchangeFailed, "cannot read the discovery document of %s: %w", issuer, err)
+	}
+	if discovery.Issuer != issuer {
+		// providers compare the iss claim with the issuer they were configured with
+		info.Warnings = append(info.Warnings, fmt.Sprintf("the discovery document names the issuer %q, so providers will only accept tokens configured for that", discovery.Issuer))
+		info.Issuer = discovery.Issuer
+	}
+	info.JWKSURI = discovery.JWKSURI
+	info.SigningAlgorithms = discovery.SigningAlgorithms
+	for _, c := range discovery.ClaimsSupported {
+		info.Claims[c] = nil
+	}
+
+	var jwks struct {
+		Keys []jwkInfo `json:"keys"`
+	}
+	err = getJSON(ctx, info.JWKSURI, "", &jwks)
+	if err != nil {
+		return nil, exitErrorf(exitExchangeFailed, "cannot read the signing keys of %s: %w", issuer, err)
+	}
+	info.Keys = jwks.Keys
+	return info, nil
+}
+
+// trustSnippet returns the commands or documents which make target trust the issuer's tokens for the subject.
+// Values which can't be known here, like the AWS account, are filled in from the settings where they are set
+// and left as <placeholders> otherwise.
+func trustSnippet(target string, info *issuerInfo, tokenSubject string) string {
+	issuerHost := strings.TrimPrefix(info.Issuer, "https://")
+	switch target {
+	case "aws":
+		account := "<account-id>"
+		// arn:aws:iam::<account>:role/<name>
+		if parts := strings.SplitN(setting("IDP_AWS_ROLE_ARN"), ":", 6); len(parts) == 6 && parts[4] != "" {
+			account = parts[4]
+		}
+		thumbprint := info.Thumbprint
+		if thumbprint == "" {
+			thumbprint = "<thumbprint>"
+		}
+		policy := snippetJSON(awsTrustPolicy(fmt.Sprintf("arn:aws:iam::%s:oidc-provider/%s", account, issuerHost), issuerHost, info.Subjects), "  ")
+		return fmt.Sprintf("aws iam create-open-id-connect-provider --url %s --client-id-list %s --thumbprint-list %s\n\n# trust policy of the role\n%s",
+			info.Issuer, gitpodidp.AWSAudience, thumbprint, policy)
+	case "gcp":
+		ref, ok := parseGCPProvider(gcpWorkloadIdentityProvider())
+		if !ok {
+			ref = gcpProviderRef{Project: "<project>", Location: "global", Pool: "<pool>", Provider: "gitpod"}
+		}
+		return fmt.Sprintf("gcloud iam workload-identity-pools providers create-oidc %s --project=%s --location=%s --workload-identity-pool=%s --issuer-uri=%s --attribute-mapping=%s --attribute-condition=%s",
+			ref.Provider, ref.Project, ref.Location, ref.Pool, shellQuote(info.Issuer), shellQuote("google.subject=assertion.sub"), shellQuote(celSubjectCondition(info.Subjects)))
+	case "azure":
+		clientID := setting("IDP_AZURE_CLIENT_ID")
+		if clientID == "" {
+			clientID = "<app-id>"
+		}
+		// federated credentials match the subject exactly
+		sub := info.Subjects[0]
+		note := ""
+		if len(info.Subjects) > 1 || strings.ContainsAny(sub, "*?") {
+			sub = "<subject>"
+			if tokenSubject != "" && subjectsMatch(info.Subjects, tokenSubject) {
+				sub = tokenSubject
+			}
+			note = "# Entra ID compares the subject exactly: add a credential for each subject\n"
+		}
+		params := snippetJSON(map[string]interface{}{
+			"name":      "gitpod-" + federatedCredentialName(sub),
+			"issuer":    info.Issuer,
+			"subject":   sub,
+			"audiences": []string{gitpodidp.AzureAudienceFor(setting("IDP_AZURE_AUTHORITY_HOST"))},
+		}, "")
+		return fmt.Sprintf("%saz ad app federated-credential create --id %s --parameters %s", note, clientID, shellQuote(params))
+	case "vault":
+		mount := setting("IDP_VAULT_AUTH_PATH")
+		if mount == "" {
+			mount = "jwt"
+		}
+		role := setting("IDP_VAULT_ROLE")
+		if role == "" {
+			role = "gitpod"
+		}
+		boundClaims := snippetJSON(map[string][]string{"sub": info.Subjects}, "")
+		return fmt.Sprintf("vault auth enable -path=%s jwt\nvault write auth/%s/config oidc_discovery_url=%s bound_issuer=%s\nvault write auth/%s/role/%s role_type=jwt user_claim=sub bound_audiences=%s bound_claims_type=glob bound_claims=%s token_policies=<policy> token_ttl=1h",
+			mount, mount, shellQuote(info.Issuer), shellQuote(info.Issuer), mount, role, providerAudience("vault"), shellQuote(boundClaims))
+	}
+	return ""
+}
+
+// snippetJSON encodes v for pasting, indented by indent if it isn't empty. Unlike json.Marshal it leaves <, > and
+// & alone, so that placeholders stay readable.
+func snippetJSON(v interface{}, indent string) string {
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	_ = enc.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// celSubjectCondition turns IAM StringLike subject patterns into a workload identity attribute condition which
+// admits subjects matching any of them. Patterns are matched by their prefix up to the first wildcard.
+func celSubjectCondition(patterns []string) string {
+	terms := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		prefix, _, wildcard := strings.Cut(pattern, "*")
+		if !wildcard && !strings.Contains(pattern, "?") {
+			terms[i] = fmt.Sprintf("assertion.sub == %q", pattern)
+			continue
+		}
+		if i := strings.IndexByte(prefix, '?'); i >= 0 {
+			prefix = prefix[:i]
+		}
+		terms[i] = fmt.Sprintf("assertion.sub.startsWith(%q)", prefix)
+	}
+	return strings.Join(terms, " || ")
+}
+
+func writeIssuerInfo(out io.Writer, info *issuerInfo, targets []string) {
+	fmt.Fprintf(out, "Issuer:     %s\n", info.Issuer)
+	fmt.Fprintf(out, "Discovery:  %s\n", info.DiscoveryURL)
+	fmt.Fprintf(out, "Keys:       %s\n", info.JWKSURI)
+	for _, k := range info.Keys {
+		fmt.Fprintf(out, "  %s %s %s\n", k.KeyID, k.Type, k.Algorithm)
+	}
+	if len(info.SigningAlgorithms) > 0 {
+		fmt.Fprintf(out, "Algorithms: %s\n", strings.Join(info.SigningAlgorithms, ", "))
+	}
+	if info.Thumbprint != "" {
+		fmt.Fprintf(out, "Thumbprint: %s\n", info.Thumbprint)
+	}
+	if len(info.Claims) > 0 {
+		fmt.Fprintln(out, "Claims:")
+		for _, k := range sortedKeys(info.Claims) {
+			switch v := info.Claims[k].(type) {
+			case nil:
+				fmt.Fprintf(out, "  %s\n", k)
+			case string:
+				fmt.Fprintf(out, "  %-14s %s\n", k, v)
+			default:
+				// numbers as they are in the token, e.g. exp as seconds rather than 1.9e+09
+				b, _ := json.Marshal(v)
+				fmt.Fprintf(out, "  %-14s %s\n", k, b)
+			}
+		}
+	}
+	fmt.Fprintf(out, "Subjects:   %s\n", strings.Join(info.Subjects, ", "))
+	for _, t := range targets {
+		fmt.Fprintf(out, "\n%s\n%s\n", colorize(ansiCyan, strings.ToUpper(t)), info.Trust[t])
+	}
+	for _, w := range info.Warnings {
+		printWarning("%s", w)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "kafka",
+		Usage:   "kafka configure [--kind msk|confluent] [--bootstrap-servers servers] [--dir dir] | token-server [--addr 127.0.0.1:9466]",
+		Summary: "write client configs for Kafka clusters behind MSK IAM or Confluent Cloud OAuth, and serve their clients identity tokens",
+		Run:     runKafka,
+	})
+}
+
+// The kinds of Kafka clusters kafka configure writes client configs for.
+const (
+	kafkaKindMSK       = "msk"
+	kafkaKindConfluent = "confluent"
+)
+
+// defaultKafkaTokenAddr is where kafka token-server serves the clients of OAuth clusters their tokens.
+const defaultKafkaTokenAddr = "127.0.0.1:9466"
+
+// kafkaTokenMargin is how long before an identity token expires the token server mints a new one, so that clients
+// refreshing their token late still get one which is valid for a while.
+const kafkaTokenMargin = 5 * time.Minute
+
+// kafkaSettings are the settings of the cluster the client configs are for.
+type kafkaSettings struct {
+	Kind             string
+	BootstrapServers string
+	// AWSProfile holds the credentials the MSK IAM library signs with.
+	AWSProfile string
+	// Audience, LogicalCluster and IdentityPool are those of a Confluent Cloud identity pool trusting Gitpod.
+	Audience       string
+	LogicalCluster string
+	IdentityPool   string
+	TokenAddr      string
+}
+
+func loadKafkaSettings() kafkaSettings {
+	res := kafkaSettings{
+		Kind:             setting("IDP_KAFKA_KIND"),
+		BootstrapServers: setting("IDP_KAFKA_BOOTSTRAP_SERVERS"),
+		AWSProfile:       setting("IDP_KAFKA_AWS_PROFILE"),
+		Audience:         setting("IDP_KAFKA_AUDIENCE"),
+		LogicalCluster:   setting("IDP_KAFKA_CLUSTER"),
+		IdentityPool:     setting("IDP_KAFKA_IDENTITY_POOL"),
+		TokenAddr:        setting("IDP_KAFKA_TOKEN_ADDR"),
+	}
+	if res.Kind == "" {
+		res.Kind = kafkaKindMSK
+		if res.IdentityPool != "" {
+			res.Kind = kafkaKindConfluent
+		}
+	}
+	if res.AWSProfile == "" {
+		res.AWSProfile = "default"
+	}
+	if res.TokenAddr == "" {
+		res.TokenAddr = defaultKafkaTokenAddr
+	}
+	return res
+}
+
+func runKafka(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return exitErrorf(exitUsage, "usage: kafka configure | token-server")
+	}
+	switch args[0] {
+	case "configure":
+		return runKafkaConfigure(args[1:])
+	case "token-server":
+		return runKafkaTokenServer(ctx, args[1:])
+	}
+	return exitErrorf(exitUsage, "unknown kafka subcommand %q", args[0])
+}
+
+// runKafkaConfigure writes client.properties and a JAAS config for the Java clients and the Kafka CLI tools, and for
+// Confluent Cloud a config for kcat and other librdkafka clients. None of them contain credentials: MSK clients
+// sign with the credentials login keeps in the AWS profile, and Confluent clients fetch their tokens from the token
+// server.
+func runKafkaConfigure(args []string) error {
+	ks := loadKafkaSettings()
+	flags := flag.NewFlagSet("kafka configure", flag.ExitOnError)
+	flags.StringVar(&ks.Kind, "kind", ks.Kind, "kind of cluster: msk, for IAM access control, or confluent, for OAuth")
+	flags.StringVar(&ks.BootstrapServers, "bootstrap-servers", ks.BootstrapServers, "comma-separated host:port of the brokers")
+	flags.StringVar(&ks.AWSProfile, "aws-profile", ks.AWSProfile, "AWS profile MSK clients sign with")
+	flags.StringVar(&ks.LogicalCluster, "cluster", ks.LogicalCluster, "ID of the Confluent Cloud cluster, lkc-...")
+	flags.StringVar(&ks.IdentityPool, "identity-pool", ks.IdentityPool, "ID of the Confluent Cloud identity pool, pool-...")
+	flags.StringVar(&ks.TokenAddr, "token-addr", ks.TokenAddr, "address kafka token-server serves the tokens on")
+	dir := flags.String("dir", "", "directory to write the configs to (default the kafka directory in the state directory)")
+	_ = flags.Parse(args)
+
+	switch {
+	case ks.Kind != kafkaKindMSK && ks.Kind != kafkaKindConfluent:
+		return exitErrorf(exitUsage, "unknown kind %q: use msk or confluent", ks.Kind)
+	case ks.BootstrapServers == "":
+		return exitErrorf(exitMissingConfig, "the bootstrap servers are not configured - set IDP_KAFKA_BOOTSTRAP_SERVERS or use --bootstrap-servers")
+	case ks.Kind == kafkaKindConfluent && (ks.LogicalCluster == "" || ks.IdentityPool == ""):
+		return exitErrorf(exitMissingConfig, "Confluent Cloud needs the cluster and the identity pool - set IDP_KAFKA_CLUSTER and IDP_KAFKA_IDENTITY_POOL")
+	}
+	if *dir == "" {
+		sd, err := stateDir()
+		if err != nil {
+			return err
+		}
+		*dir = filepath.Join(sd, "kafka")
+	}
+
+	files := map[string]string{
+		"client.properties":      kafkaClientProperties(ks),
+		"kafka_client_jaas.conf": "KafkaClient {\n  " + kafkaJAASLogin(ks) + "\n};\n",
+	}
+	if ks.Kind == kafkaKindConfluent {
+		files["kcat.conf"] = kafkaLibrdkafkaConfig(ks)
+	}
+	for _, name := range sortedKeys(files) {
+		fn := filepath.Join(*dir, name)
+		err := writeWipedSecretFile(fn, []byte(files[name]))
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot write %s: %w", fn, err)
+		}
+		recordArtifact(fn)
+		emitEvent(eventProfileWritten, "", "tool", "kafka", "path", fn)
+	}
+
+	printSuccess("Kafka client configs are in %s", *dir)
+	fmt.Printf("  kafka-topics.sh --bootstrap-server %s --command-config %s --list\n", ks.BootstrapServers, filepath.Join(*dir, "client.properties"))
+	switch ks.Kind {
+	case kafkaKindMSK:
+		fmt.Println("  Java clients need the aws-msk-iam-auth library on their classpath; librdkafka clients like kcat don't support MSK IAM.")
+	case kafkaKindConfluent:
+		fmt.Printf("  kcat -F %s -L\n", filepath.Join(*dir, "kcat.conf"))
+		fmt.Println("  The clients fetch their tokens from kafka token-server, which needs to be running.")
+	}
+	return nil
+}
+
+// kafkaClientProperties returns the client.properties which the Java clients and the Kafka CLI tools read.
+func kafkaClientProperties(ks kafkaSettings) string {
+	lines := []string{
+		"bootstrap.servers=" + ks.BootstrapServers,
+		"security.protocol=SASL_SSL",
+	}
+	switch ks.Kind {
+	case kafkaKindMSK:
+		lines = append(lines,
+			"sasl.mechanism=AWS_MSK_IAM",
+			"sasl.client.callback.handler.class=software.amazon.msk.auth.iam.IAMClientCallbackHandler",
+		)
+	case kafkaKindConfluent:
+		lines = append(lines,
+			"sasl.mechanism=OAUTHBEARER",
+			"sasl.login.callback.handler.class=org.apache.kafka.common.security.oauthbearer.OAuthBearerLoginCallbackHandler",
+			"sasl.oauthbearer.token.endpoint.url="+kafkaTokenURL(ks),
+		)
+	}
+	lines = append(lines, "sasl.jaas.config="+kafkaJAASLogin(ks))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// kafkaJAASLogin returns the login module entry of the JAAS config, which client.properties has inline and
+// kafka_client_jaas.conf for clients configured with -Djava.security.auth.login.config.
+func kafkaJAASLogin(ks kafkaSettings) string {
+	if ks.Kind == kafkaKindMSK {
+		return fmt.Sprintf("software.amazon.msk.auth.iam.IAMLoginModule required awsProfileName=%q;", ks.AWSProfile)
+	}
+	// the token server ignores the client credentials, but the login module requires them
+	return fmt.Sprintf("org.apache.kafka.common.security.oauthbearer.OAuthBearerLoginModule required clientId=\"gitpod-idp\" clientSecret=\"unused\" extension_logicalCluster=%q extension_identityPoolId=%q;", ks.LogicalCluster, ks.IdentityPool)
+}
+
+// kafkaLibrdkafkaConfig returns the config of kcat and the other librdkafka clients, which fetch their tokens from
+// the token server with the OIDC client credentials flow.
+func kafkaLibrdkafkaConfig(ks kafkaSettings) string {
+	return strings.Join([]string{
+		"bootstrap.servers=" + ks.BootstrapServers,
+		"security.protocol=SASL_SSL",
+		"sasl.mechanisms=OAUTHBEARER",
+		"sasl.oauthbearer.method=oidc",
+		"sasl.oauthbearer.token.endpoint.url=" + kafkaTokenURL(ks),
+		"sasl.oauthbearer.client.id=gitpod-idp",
+		"sasl.oauthbearer.client.secret=unused",
+		fmt.Sprintf("sasl.oauthbearer.extensions=logicalCluster=%s,identityPoolId=%s", ks.LogicalCluster, ks.IdentityPool),
+	}, "\n") + "\n"
+}
+
+func kafkaTokenURL(ks kafkaSettings) string {
+	return "http://" + ks.TokenAddr + "/token"
+}
+
+// runKafkaTokenServer serves the clients of Confluent Cloud identity tokens for the identity pool's audience, as
+// token endpoint of the OAuth client credentials flow. It's only reachable locally unless --addr says otherwise.
+func runKafkaTokenServer(ctx context.Context, args []string) error {
+	ks := loadKafkaSettings()
+	flags := flag.NewFlagSet("kafka token-server", flag.ExitOnError)
+	flags.StringVar(&ks.TokenAddr, "addr", ks.TokenAddr, "address to serve the token endpoint on")
+	flags.StringVar(&ks.Audience, "audience", ks.Audience, "audience of the tokens, as the identity pool's filter expects it")
+	_ = flags.Parse(args)
+	if ks.Audience == "" {
+		return exitErrorf(exitMissingConfig, "the audience of the tokens is not configured - set IDP_KAFKA_AUDIENCE or use --audience")
+	}
+
+	ts := &kafkaTokenSource{audience: ks.Audience}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", ts.serveToken)
+	err := serveHTTP(ctx, ks.TokenAddr, "Kafka tokens", mux)
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	httpServers.Wait()
+	return nil
+}
+
+// kafkaTokenSource mints the identity tokens of the token server, and hands out the same one until shortly before it
+// expires.
+type kafkaTokenSource struct {
+	audience string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (ts *kafkaTokenSource) get(ctx context.Context) (string, time.Time, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Until(ts.expiry) > kafkaTokenMargin {
+		return ts.token, ts.expiry, nil
+	}
+	token, err := gitpodIDToken(ctx, ts.audience)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ts.token, ts.expiry = token, gitpodidp.Expiry(token)
+	return ts.token, ts.expiry, nil
+}
+
+// serveToken answers token requests as an OAuth token endpoint, regardless of the grant and client credentials.
+func (ts *kafkaTokenSource) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	token, expiry, err := ts.get(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "temporarily_unavailable", "error_description": err.Error()})
+		return
+	}
+	meterRequest(r, "kafka-token-server", "", ts.audience)
+	res := map[string]any{"access_token": token, "token_type": "Bearer"}
+	if !expiry.IsZero() {
+		res["expires_in"] = int(time.Until(expiry).Seconds())
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
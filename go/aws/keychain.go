@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// keychainService is the service the tool's items in the platform's keychain are stored under.
+const keychainService = "gitpod-idp"
+
+// keychainTimeout bounds how long the keychain gets to answer, e.g. while it's locked.
+const keychainTimeout = 10 * time.Second
+
+var (
+	// errNoKeychain is returned by the keychain functions where there's no keychain the tool can use.
+	errNoKeychain = errors.New("no keychain is available")
+	// errKeychainItemNotFound is returned by keychainGet for items which don't exist.
+	errKeychainItemNotFound = errors.New("the keychain holds no such item")
+)
+
+// keychainEnabled reports whether secrets may be kept in the platform's keychain: the macOS keychain, the Windows
+// Credential Manager or, through secret-tool, the Secret Service of Linux desktops. Workspaces have none, and
+// IDP_KEYCHAIN=false turns it off.
+func keychainEnabled() bool {
+	if os.Getenv("GITPOD_WORKSPACE_ID") != "" || os.Getenv("GITPOD_INSTANCE_ID") != "" {
+		return false
+	}
+	return os.Getenv("IDP_KEYCHAIN") != "false"
+}
+
+// keychainCacheKey returns the key the credential cache is encrypted with outside of workspaces, generating and
+// storing one in the keychain the first time.
+func keychainCacheKey() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), keychainTimeout)
+	defer cancel()
+	const account = "cache-key"
+	stored, err := keychainGet(ctx, account)
+	if err == nil {
+		key, err := hex.DecodeString(stored)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("the cache key in the keychain is damaged")
+		}
+		return key, nil
+	}
+	if !errors.Is(err, errKeychainItemNotFound) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	err = keychainSet(ctx, account, hex.EncodeToString(key))
+	if err != nil {
+		return nil, fmt.Errorf("cannot store the cache key in the keychain: %w", err)
+	}
+	return key, nil
+}
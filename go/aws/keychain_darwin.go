@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// securityItemNotFound is the exit code of security for items which don't exist.
+const securityItemNotFound = 44
+
+// keychainGet returns the secret of account in the user's login keychain, which security reads.
+func keychainGet(ctx context.Context, account string) (string, error) {
+	out, err := runner.Output(ctx, "security", "find-generic-password", "-s", keychainService, "-a", account, "-w")
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == securityItemNotFound {
+		return "", errKeychainItemNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// keychainSet stores secret as account in the user's login keychain, replacing what was there. The command goes
+// to security on stdin, so that the secret doesn't show up in the process list.
+func keychainSet(ctx context.Context, account, secret string) error {
+	script := "add-generic-password -U -s " + keychainService + " -a " + account + " -w " + secret + "\n"
+	_, err := runner.Pipe(ctx, []byte(script), "security", "-i")
+	return err
+}
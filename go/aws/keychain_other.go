@@ -0,0 +1,37 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// keychainGet returns the secret of account in the Secret Service of the desktop session, which secret-tool reads.
+func keychainGet(ctx context.Context, account string) (string, error) {
+	if _, err := runner.LookPath("secret-tool"); err != nil {
+		return "", errNoKeychain
+	}
+	out, err := runner.Output(ctx, "secret-tool", "lookup", "service", keychainService, "account", account)
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == 1 && len(ee.Stderr) == 0 {
+		// secret-tool fails silently for items which don't exist
+		return "", errKeychainItemNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// keychainSet stores secret as account in the Secret Service, replacing what was there. secret-tool reads the
+// secret from stdin.
+func keychainSet(ctx context.Context, account, secret string) error {
+	if _, err := runner.LookPath("secret-tool"); err != nil {
+		return errNoKeychain
+	}
+	_, err := runner.Pipe(ctx, []byte(secret), "secret-tool", "store", "--label", keychainService+" "+account, "service", keychainService, "account", account)
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "kubectl",
+		Usage:   "kubectl token eks|gke|aks [--cluster name] [--region region]",
+		Summary: "act as kubectl plugin and exec credential plugin for EKS, GKE and AKS clusters",
+		Run:     runKubectl,
+	})
+}
+
+// kubectlPluginName is the name the kubectl plugin is installed as, which kubectl runs for kubectl idp.
+const kubectlPluginName = "kubectl-idp"
+
+// aksServerScope is the scope of Entra ID access tokens for the API servers of AKS clusters with Entra ID
+// integration, whose application ID is fixed.
+const aksServerScope = "6dae42f8-4368-4678-94ff-3960e28e3630/.default"
+
+// execCredential is the ExecCredential of client.authentication.k8s.io, which exec credential plugins print.
+type execCredential struct {
+	Kind       string `json:"kind"`
+	APIVersion string `json:"apiVersion"`
+	Spec       struct {
+		Interactive bool `json:"interactive,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Token               string    `json:"token"`
+		ExpirationTimestamp time.Time `json:"expirationTimestamp,omitempty"`
+	} `json:"status"`
+}
+
+func runKubectl(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "token" {
+		return exitErrorf(exitUsage, "usage: kubectl idp token eks|gke|aks [--cluster name] [--region region]")
+	}
+	if len(args) < 2 {
+		return exitErrorf(exitUsage, "kubectl idp token needs the kind of cluster: eks, gke or aks")
+	}
+	kind := args[1]
+	flags := flag.NewFlagSet("kubectl token", flag.ExitOnError)
+	cluster := flags.String("cluster", "", "name of the EKS cluster")
+	region := flags.String("region", "", "region of the EKS cluster (default IDP_AWS_REGION)")
+	_ = flags.Parse(args[2:])
+
+	var (
+		token  string
+		expiry time.Time
+		err    error
+	)
+	switch kind {
+	case "eks":
+		if *cluster == "" {
+			return exitErrorf(exitUsage, "kubectl idp token eks needs --cluster")
+		}
+		if *region == "" {
+			*region = setting("IDP_AWS_REGION")
+		}
+		token, expiry, err = eksToken(ctx, *cluster, *region)
+	case "gke":
+		token, err = gcpAccessToken(ctx, "gke")
+		// Google access tokens are valid for an hour
+		expiry = time.Now().Add(time.Hour)
+	case "aks":
+		token, err = azureAccessToken(ctx, aksServerScope, "aks")
+		expiry = gitpodidp.Expiry(token)
+	default:
+		return exitErrorf(exitUsage, "unknown kind of cluster %q: use eks, gke or aks", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	meterUsage(ctx, "kubectl", map[string]string{"eks": "aws", "gke": "gcp", "aks": "azure"}[kind], *cluster)
+
+	res := execCredential{Kind: "ExecCredential", APIVersion: execCredentialAPIVersion()}
+	res.Status.Token = token
+	res.Status.ExpirationTimestamp = expiry.UTC().Truncate(time.Second)
+	return json.NewEncoder(os.Stdout).Encode(res)
+}
+
+// execCredentialAPIVersion returns the version of ExecCredential kubectl asks for in KUBERNETES_EXEC_INFO, which
+// the kubeconfig chooses.
+func execCredentialAPIVersion() string {
+	var info struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	_ = json.Unmarshal([]byte(os.Getenv("KUBERNETES_EXEC_INFO")), &info)
+	if info.APIVersion != "" {
+		return info.APIVersion
+	}
+	return "client.authentication.k8s.io/v1beta1"
+}
+
+// eksToken obtains a token for the EKS cluster with the aws CLI, using the credentials of idp login aws.
+func eksToken(ctx context.Context, cluster, region string) (string, time.Time, error) {
+	args := []string{"eks", "get-token", "--cluster-name", cluster, "--output", "json"}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	var out []byte
+	err := traceStep(ctx, "exchange token", func(ctx context.Context) (err error) {
+		out, err = runner.Output(ctx, "aws", args...)
+		return err
+	}, "idp.method", "eks")
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return "", time.Time{}, exitErrorf(exitExchangeFailed, "aws eks get-token failure: %s: %w", strings.TrimSpace(string(ee.Stderr)), err)
+		}
+		return "", time.Time{}, exitErrorf(exitExchangeFailed, "aws eks get-token failure: %w", err)
+	}
+	var cred execCredential
+	err = json.Unmarshal(out, &cred)
+	if err != nil || cred.Status.Token == "" {
+		return "", time.Time{}, fmt.Errorf("cannot decode the output of aws eks get-token: %v", err)
+	}
+	registerSecret(cred.Status.Token)
+	return cred.Status.Token, cred.Status.ExpirationTimestamp, nil
+}
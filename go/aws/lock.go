@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockTimeout bounds how long a process waits for another one holding a lock, in case that one hangs. The OS
+// releases the locks of processes which exit.
+const lockTimeout = 30 * time.Second
+
+// lockPollInterval is how often a process waiting for a lock tries again.
+const lockPollInterval = 50 * time.Millisecond
+
+// acquireLock takes the lock name, which all processes of the user share, waiting while another process holds it.
+// It reports whether it had to wait, i.e. whether another process may have done meanwhile what the lock guards,
+// so that the caller can look for its result first. Where the lock cannot be had, within lockTimeout or at all,
+// the caller goes ahead without it. Only a cancelled ctx is an error.
+func acquireLock(ctx context.Context, name string) (unlock func(), waited bool, err error) {
+	noop := func() {}
+	dir, err := stateDir()
+	if err != nil {
+		return noop, false, nil
+	}
+	fn := filepath.Join(dir, "locks", name+".lock")
+	err = mkdirPrivate(filepath.Dir(fn))
+	if err != nil {
+		slog.Debug("cannot create the lock", "lock", name, "error", err)
+		return noop, false, nil
+	}
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		slog.Debug("cannot create the lock", "lock", name, "error", err)
+		return noop, false, nil
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		ok, err := tryLockFile(f)
+		if ok {
+			return func() { f.Close() }, waited, nil
+		}
+		if err != nil || time.Now().After(deadline) {
+			slog.Debug("going ahead without the lock", "lock", name, "error", err)
+			f.Close()
+			return noop, waited, nil
+		}
+		if !waited {
+			slog.Debug("waiting for another process", "lock", name)
+			waited = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return noop, waited, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+var (
+	logLevelFlag  = flag.String("log-level", "", "log level: debug, info, warn or error (default info, or IDP_LOG_LEVEL)")
+	logFormatFlag = flag.String("log-format", "", "log format: plain, text or json (default plain, or IDP_LOG_FORMAT)")
+)
+
+// setupLogging installs the logger selected by -log-level and -log-format for the CLI and the gitpodidp package,
+// which also writes to the persistent log of -log-file. Credentials are redacted from everything it logs.
+func setupLogging() error {
+	levelName := *logLevelFlag
+	if levelName == "" {
+		levelName = os.Getenv("IDP_LOG_LEVEL")
+	}
+	var level slog.Level
+	if levelName != "" {
+		err := level.UnmarshalText([]byte(levelName))
+		if err != nil {
+			return exitErrorf(exitUsage, "unsupported log level %q: use debug, info, warn or error", levelName)
+		}
+	}
+
+	format := *logFormatFlag
+	if format == "" {
+		format = os.Getenv("IDP_LOG_FORMAT")
+	}
+	var (
+		opts    = &slog.HandlerOptions{Level: level}
+		handler slog.Handler
+	)
+	switch format {
+	case "", "plain":
+		handler = &plainHandler{out: os.Stderr, level: level, mu: new(sync.Mutex)}
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return exitErrorf(exitUsage, "unsupported log format %q: use plain, text or json", format)
+	}
+
+	sink, err := openLogSink(level)
+	if err != nil {
+		return err
+	}
+	if sink != nil {
+		logSink = slog.New(redactingHandler{sink})
+		handler = fanoutHandler{handler, sink}
+	}
+
+	logger := slog.New(redactingHandler{handler})
+	slog.SetDefault(logger)
+	gitpodidp.SetLogger(logger)
+	return nil
+}
+
+// plainHandler writes log records for humans: the message followed by its attributes, without a timestamp and
+// with the level only if it isn't info.
+type plainHandler struct {
+	out   io.Writer
+	level slog.Level
+	attrs string
+	group string
+	mu    *sync.Mutex
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var line strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		line.WriteString("error: ")
+	case r.Level >= slog.LevelWarn:
+		line.WriteString("warning: ")
+	case r.Level < slog.LevelInfo:
+		line.WriteString("debug: ")
+	}
+	line.WriteString(r.Message)
+	line.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		line.WriteString(formatPlainAttr(h.group, a))
+		return true
+	})
+	line.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.out, line.String())
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	res := *h
+	for _, a := range attrs {
+		res.attrs += formatPlainAttr(h.group, a)
+	}
+	return &res
+}
+
+func (h *plainHandler) WithGroup(name string) slog.Handler {
+	res := *h
+	res.group += name + "."
+	return &res
+}
+
+func formatPlainAttr(group string, a slog.Attr) string {
+	if a.Equal(slog.Attr{}) {
+		return ""
+	}
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		var res string
+		for _, ga := range v.Group() {
+			res += formatPlainAttr(group+a.Key+".", ga)
+		}
+		return res
+	}
+	s := v.String()
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		s = fmt.Sprintf("%q", s)
+	}
+	return " " + group + a.Key + "=" + s
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// provider signs into a single cloud or service using the workspace's identity.
+type provider struct {
+	Name string
+	// Missing lists the configuration the provider still needs before it can be used.
+	Missing func() []string
+	Login   func(ctx context.Context) error
+	// Refresh renews expired credentials of the same identity without asking the user anything. Providers
+	// without it log in again.
+	Refresh func(ctx context.Context) error
+	Whoami  func(ctx context.Context) (string, error)
+	Logout  func(ctx context.Context, revoke bool) error
+	// Env returns the environment variables that make tools use the credentials.
+	Env func() (map[string]string, error)
+	// EnvNames are all the variables Env may return, for removing them once the credentials are gone. Plugin
+	// providers, which only tell them along with their values, have none.
+	EnvNames []string
+	// Identity returns the identity the configuration asks for, as recorded on login.
+	Identity func() string
+	// After providers sign in with the credentials of the others, so login all signs into them last.
+	After bool
+}
+
+func (p provider) configured() bool {
+	return len(p.Missing()) == 0
+}
+
+var providers = []provider{
+	{
+		Name:     "aws",
+		Missing:  awsMissingConfig,
+		Login:    loginAWS,
+		Refresh:  refreshAWS,
+		Whoami:   whoamiAWS,
+		Logout:   logoutAWS,
+		Env:      envAWS,
+		EnvNames: []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_SHARED_CREDENTIALS_FILE", "AWS_CONFIG_FILE"},
+		Identity: awsIdentity,
+	},
+	{
+		Name:     "gcp",
+		Missing:  gcpMissingConfig,
+		Login:    loginGCP,
+		Whoami:   whoamiGCP,
+		Logout:   logoutGCP,
+		Env:      envGCP,
+		EnvNames: []string{"GOOGLE_APPLICATION_CREDENTIALS", "CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE", "GOOGLE_CLOUD_PROJECT"},
+		Identity: gcpIdentity,
+	},
+	{
+		Name:     "azure",
+		Missing:  azureMissingConfig,
+		Login:    loginAzure,
+		Whoami:   whoamiAzure,
+		Logout:   logoutAzure,
+		Env:      envAzure,
+		EnvNames: []string{"AZURE_CLIENT_ID", "AZURE_TENANT_ID", "AZURE_FEDERATED_TOKEN_FILE", "AZURE_SUBSCRIPTION_ID", "AZURE_AUTHORITY_HOST"},
+		Identity: azureIdentity,
+	},
+	{
+		Name:     "vault",
+		Missing:  vaultMissingConfig,
+		Login:    loginVault,
+		Whoami:   whoamiVault,
+		Logout:   logoutVault,
+		Env:      envVault,
+		EnvNames: []string{"VAULT_ADDR", "VAULT_TOKEN", "VAULT_NAMESPACE"},
+		Identity: vaultIdentity,
+	},
+}
+
+func findProvider(name string) (provider, bool) {
+	for _, p := range providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return provider{}, false
+}
+
+func init() {
+	registerCommand(&command{
+		Name:    "login",
+		Usage:   "login [--env name] [--ready-file file] [--json] [aws|gcp|azure|vault|helm|all]",
+		Summary: "sign into a provider, or all configured providers concurrently",
+		Run:     runLogin,
+	})
+}
+
+func runLogin(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	fileFlag := flags.String("ready-file", "", "write this file once signed in, for idp wait in other tasks (default IDP_READY_FILE)")
+	asJSON := flags.Bool("json", false, "print the report of the AWS sign-in methods as JSON on stdout")
+	var env *string
+	flags.Func("env", "select the named environment of the config file for this and later commands (\"\" for none)", func(name string) error {
+		env = &name
+		return nil
+	})
+	args = parseInterspersed(flags, args)
+	if env != nil {
+		err := selectEnvironment(*env)
+		if err != nil {
+			return err
+		}
+	}
+
+	ready := readyFile(*fileFlag)
+	if ready != "" {
+		err := clearReadyFile(ready)
+		if err != nil {
+			return err
+		}
+	}
+	err := login(ctx, args)
+	if reportErr := printChainReport(*asJSON); reportErr != nil {
+		err = errors.Join(err, reportErr)
+	}
+	// write sinks even if some providers failed during login all, so that those which succeeded are usable
+	if sinkErr := writeDotenvSink(ctx); sinkErr != nil {
+		err = errors.Join(err, sinkErr)
+	}
+	if sinkErr := writeRcloneSink(ctx); sinkErr != nil {
+		err = errors.Join(err, sinkErr)
+	}
+	if ready != "" {
+		if readyErr := writeReadyFile(ready, err); readyErr != nil {
+			err = errors.Join(err, exitErrorf(exitPersistFailed, "cannot write the ready file: %w", readyErr))
+		}
+	}
+	return err
+}
+
+// parseInterspersed parses flags wherever they are among the arguments, e.g. in login aws --env staging, and
+// returns the other arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func login(ctx context.Context, args []string) error {
+	name := "aws"
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if name == "all" {
+		return loginAll(ctx)
+	}
+
+	p, ok := findProvider(name)
+	if !ok {
+		return exitErrorf(exitUsage, "unknown provider %q", name)
+	}
+	if p.Name != "aws" && !p.configured() {
+		return exitErrorf(exitMissingConfig, "%s is not configured", p.Name)
+	}
+	err := loginProvider(ctx, p)
+	if errors.Is(err, errSigninSkipped) {
+		printWarning("%v", err)
+		return nil
+	}
+	if err == nil {
+		printSuccess("signed into %s", p.Name)
+	}
+	return err
+}
+
+// loginProvider signs into p, emitting the corresponding porcelain events.
+func loginProvider(ctx context.Context, p provider) error {
+	return runSignin(ctx, p, "login", p.Login)
+}
+
+// refreshProvider renews p's credentials, emitting the same porcelain events as loginProvider.
+func refreshProvider(ctx context.Context, p provider) error {
+	// processes refreshing the same provider at once, like daemons of several terminals, take turns, and those
+	// which find that another one has refreshed meanwhile are done
+	start := time.Now()
+	unlock, waited, err := acquireLock(ctx, "refresh-"+p.Name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if waited {
+		if rec, _ := loadCredentialRecord(p.Name); rec != nil && rec.IssuedAt.After(start) {
+			slog.Debug("another process has refreshed the credentials", "provider", p.Name)
+			return nil
+		}
+	}
+	if p.Refresh == nil {
+		return runSignin(ctx, p, "refresh", p.Login)
+	}
+	return runSignin(ctx, p, "refresh", p.Refresh)
+}
+
+// runSignin runs p's login or refresh with porcelain events, a trace span and metrics, and the configured hooks
+// around it, and renders the templates after it, unless the shared workspace or untrusted context policies refuse it.
+func runSignin(ctx context.Context, p provider, kind string, signin func(ctx context.Context) error) error {
+	ctx, span := startSpan(withSigninProvider(ctx, p.Name), kind, "idp.provider", p.Name)
+	timeout := phaseTimeout(ctx, "login")
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	emitEvent(eventProviderStarted, p.Name)
+	signin, err := guardSharedWorkspace(ctx, p, signin)
+	if err == nil {
+		signin, err = guardUntrustedContext(ctx, p, signin)
+	}
+	if err == nil {
+		ctx = withSigninGuarded(ctx)
+		err = runHooks(ctx, p, "preLogin", kind)
+	}
+	if err == nil {
+		err = signin(ctx)
+	}
+	if err != nil && timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("signing into %s timed out after %s: %w", p.Name, timeout, err)
+	}
+	emitProviderResult(p.Name, err)
+	observeExchange(p.Name, kind == "refresh", time.Since(start), err)
+	if err == nil {
+		// before the hooks, which may start tools reading the files
+		writeTemplateSinks(ctx, p)
+		if hookErr := runHooks(ctx, p, "postLogin", kind); hookErr != nil {
+			printWarning("%v", hookErr)
+		}
+	}
+	span.end(err)
+	return err
+}
+
+// loginAll signs into all configured providers concurrently and reports the outcome for each of them.
+func loginAll(ctx context.Context) error {
+	var configured []provider
+	for _, p := range providers {
+		if p.configured() {
+			configured = append(configured, p)
+		}
+	}
+	if len(configured) == 0 {
+		return exitErrorf(exitMissingConfig, "no provider is configured")
+	}
+
+	// select the AWS role before the concurrent logins, as that may ask the user
+	if awsConfigured() {
+		_, _ = awsRoleARN()
+	}
+
+	errs := make([]error, len(configured))
+	_ = withProgress(fmt.Sprintf("signing into %d provider(s)", len(configured)), func() error {
+		for _, after := range []bool{false, true} {
+			var wg sync.WaitGroup
+			for i, p := range configured {
+				if p.After != after {
+					continue
+				}
+				wg.Add(1)
+				go func(i int, p provider) {
+					defer wg.Done()
+					errs[i] = loginProvider(ctx, p)
+				}(i, p)
+			}
+			wg.Wait()
+		}
+		return errors.Join(errs...)
+	})
+
+	var (
+		failed []string
+		code   = exitOK
+	)
+	for i, p := range configured {
+		if errors.Is(errs[i], errSigninSkipped) {
+			printWarning("%v", errs[i])
+			continue
+		}
+		if errs[i] != nil {
+			printFailure("%s: %v", p.Name, errs[i])
+			failed = append(failed, p.Name)
+			// all providers failing for the same reason keep the specific exit code
+			if c := exitCode(errs[i]); code == exitOK || code == c {
+				code = c
+			} else {
+				code = exitFailure
+			}
+			continue
+		}
+		printSuccess("%s: signed in", p.Name)
+	}
+	if len(failed) > 0 {
+		return exitErrorf(code, "cannot sign into %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
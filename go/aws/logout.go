@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "logout",
+		Usage:   "logout [--revoke] [provider|all]",
+		Summary: "remove credentials this tool wrote, optionally revoking them where supported",
+		Run:     runLogout,
+	})
+}
+
+func runLogout(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("logout", flag.ExitOnError)
+	revoke := flags.Bool("revoke", false, "revoke credentials with the provider where supported (Vault, gcloud, az)")
+	_ = flags.Parse(args)
+
+	name := "all"
+	if flags.NArg() > 0 {
+		name = flags.Arg(0)
+	}
+	var selected []provider
+	if name == "all" {
+		selected = providers
+	} else {
+		p, ok := findProvider(name)
+		if !ok {
+			return exitErrorf(exitUsage, "unknown provider %q", name)
+		}
+		selected = []provider{p}
+	}
+
+	failed := logoutProviders(ctx, selected, *revoke)
+	if name == "all" {
+		fn, err := sessionStatePath()
+		if err == nil {
+			err = removeFiles(fn)
+		}
+		if err != nil {
+			slog.Warn("cannot remove session state", "error", err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot log out of %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// logoutProviders logs out of the selected providers and removes their credential records and cached registry
+// credentials, returning those it couldn't log out of.
+func logoutProviders(ctx context.Context, selected []provider, revoke bool) []string {
+	var failed []string
+	for _, p := range selected {
+		err := p.Logout(ctx, revoke)
+		if err == nil {
+			var fn string
+			fn, err = credentialRecordPath(p.Name)
+			if err == nil {
+				err = removeFiles(fn)
+			}
+			if err == nil {
+				err = forgetRegistryCredentials(p.Name)
+			}
+		}
+		if err != nil {
+			slog.Warn("cannot log out", "provider", p.Name, "error", err)
+			failed = append(failed, p.Name)
+		}
+	}
+	if err := forgetFastPath(); err != nil {
+		slog.Warn("cannot remove the answers of the fast path", "error", err)
+	}
+	return failed
+}
+
+// awsCredentialsFile returns the location of the shared AWS credentials file.
+func awsCredentialsFile() (string, error) {
+	if fn := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); fn != "" {
+		return fn, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".aws", "credentials"), nil
+}
+
+// logoutAWS removes the session credentials from the default profile, those of IDP_AWS_PROFILES and those of the
+// CDK roles. STS sessions cannot be revoked individually, hence revoke has no effect.
+func logoutAWS(ctx context.Context, revoke bool) error {
+	if revoke {
+		slog.Warn("STS sessions cannot be revoked individually - they stay valid until they expire", "provider", "aws")
+	}
+	fn, err := awsCredentialsFile()
+	if err != nil {
+		return err
+	}
+	sections := []string{"default"}
+	if profiles, _ := awsProfiles(); len(profiles) > 0 {
+		sections = append(sections, sortedKeys(profiles)...)
+	}
+	// the roles assumed with the session, like those of idp cdk
+	all, err := iniSections(fn)
+	if err != nil {
+		return err
+	}
+	for _, section := range all {
+		if strings.HasPrefix(section, cdkProfilePrefix) {
+			sections = append(sections, section)
+		}
+	}
+	for _, section := range sections {
+		err = removeINIKeys(fn, section, "aws_access_key_id", "aws_secret_access_key", "aws_session_token")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func logoutGCP(ctx context.Context, revoke bool) error {
+	if revoke {
+		if pth, _ := runner.LookPath("gcloud"); pth != "" {
+			rec, _ := loadCredentialRecord("gcp")
+			if rec != nil {
+				out, err := runner.CombinedOutput(ctx, "gcloud", "auth", "revoke", rec.Identity)
+				if err != nil {
+					slog.Warn("gcloud auth revoke failure", "provider", "gcp", "output", strings.TrimSpace(string(out)), "error", err)
+				}
+			}
+		}
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	return removeFiles(filepath.Join(dir, "gcp-token"), filepath.Join(dir, "gcp-credentials.json"))
+}
+
+func logoutAzure(ctx context.Context, revoke bool) error {
+	if revoke {
+		if pth, _ := runner.LookPath("az"); pth != "" && setting("IDP_AZURE_CLIENT_ID") != "" {
+			out, err := runner.CombinedOutput(ctx, "az", "logout", "--username", setting("IDP_AZURE_CLIENT_ID"))
+			if err != nil {
+				slog.Warn("az logout failure", "provider", "azure", "output", strings.TrimSpace(string(out)), "error", err)
+			}
+		}
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	return removeFiles(filepath.Join(dir, "azure-token"))
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logFileFlag = flag.String("log-file", "", "also log to this file, rotating it, or to the systemd journal with journald (default IDP_LOG_FILE)")
+
+// Defaults of IDP_LOG_MAX_SIZE, IDP_LOG_MAX_BACKUPS and IDP_LOG_MAX_AGE.
+const (
+	defaultLogMaxSize    = 10 << 20
+	defaultLogMaxBackups = 5
+	defaultLogMaxAge     = 7 * 24 * time.Hour
+)
+
+// journalSocket is where journald accepts log entries in its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// logSink is the persistent log of -log-file, or nil. Commands running unattended, like the daemon, log their
+// start and outcome to it, so their failures leave a trace.
+var logSink *slog.Logger
+
+// openLogSink returns the handler for the persistent log selected by -log-file or IDP_LOG_FILE, or nil if there
+// is none. journald falls back to a log file in the state directory where the journal isn't available, as in most
+// containers.
+func openLogSink(level slog.Level) (slog.Handler, error) {
+	target := *logFileFlag
+	if target == "" {
+		target = os.Getenv("IDP_LOG_FILE")
+	}
+	if target == "" {
+		return nil, nil
+	}
+	if target == "journald" {
+		if _, err := os.Stat(journalSocket); err == nil {
+			return &journalHandler{level: level}, nil
+		}
+		dir, err := stateDir()
+		if err != nil {
+			return nil, err
+		}
+		target = filepath.Join(dir, "idp.log")
+	}
+
+	w := &rotatingFile{fn: target, maxSize: defaultLogMaxSize, maxBackups: defaultLogMaxBackups, maxAge: defaultLogMaxAge}
+	if v := os.Getenv("IDP_LOG_MAX_SIZE"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb <= 0 {
+			return nil, exitErrorf(exitUsage, "invalid IDP_LOG_MAX_SIZE %q: use a size in megabytes", v)
+		}
+		w.maxSize = int64(mb) << 20
+	}
+	if v := os.Getenv("IDP_LOG_MAX_BACKUPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, exitErrorf(exitUsage, "invalid IDP_LOG_MAX_BACKUPS %q: use a number of files", v)
+		}
+		w.maxBackups = n
+	}
+	if v := os.Getenv("IDP_LOG_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, exitErrorf(exitUsage, "invalid IDP_LOG_MAX_AGE %q: use a duration, e.g. 168h", v)
+		}
+		w.maxAge = d
+	}
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}).WithAttrs([]slog.Attr{slog.Int("pid", os.Getpid())}), nil
+}
+
+// logCommandStart records in the persistent log that the command name is run with args.
+func logCommandStart(name string, args []string) {
+	if logSink != nil {
+		logSink.Info("command started", "command", name, "args", args)
+	}
+}
+
+// logCommandResult records in the persistent log how the command name, started at start, ended.
+func logCommandResult(name string, start time.Time, err error) {
+	if logSink == nil {
+		return
+	}
+	took := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		logSink.Error("command failed", "command", name, "duration", took.String(), "exitCode", exitCode(err), "error", err)
+		return
+	}
+	logSink.Info("command finished", "command", name, "duration", took.String())
+}
+
+// rotatingFile appends to a log file which is rotated to fn.1, fn.2 and so on once it reaches maxSize or its first
+// entry is older than maxAge. At most maxBackups rotated files are kept. The file is reopened for every write, so
+// that several processes, e.g. the daemon and the commands run in a terminal, can share it.
+type rotatingFile struct {
+	fn         string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+
+	mu sync.Mutex
+}
+
+func (w *rotatingFile) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if fi, err := os.Stat(w.fn); err == nil && fi.Size() > 0 {
+		if fi.Size()+int64(len(p)) > w.maxSize || time.Since(logStarted(w.fn)) > w.maxAge {
+			w.rotate()
+		}
+	}
+	err := mkdirPrivate(filepath.Dir(w.fn))
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(w.fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.Write(p)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// rotate shifts the rotated files by one, dropping the oldest beyond maxBackups. Failures are ignored: the log
+// then just grows, which beats losing it.
+func (w *rotatingFile) rotate() {
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", w.fn, i) }
+	_ = os.Remove(backup(w.maxBackups))
+	for i := w.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(backup(i), backup(i+1))
+	}
+	if w.maxBackups > 0 {
+		_ = os.Rename(w.fn, backup(1))
+	} else {
+		_ = os.Remove(w.fn)
+	}
+}
+
+// logStarted returns the time of the first entry of the log file fn, or now if it cannot be determined.
+func logStarted(fn string) time.Time {
+	f, err := os.Open(fn)
+	if err != nil {
+		return time.Now()
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadSlice('\n')
+	var entry struct {
+		Time time.Time `json:"time"`
+	}
+	if json.Unmarshal(line, &entry) != nil || entry.Time.IsZero() {
+		return time.Now()
+	}
+	return entry.Time
+}
+
+// journalHandler sends log records to journald, with the attributes as IDP_* fields.
+type journalHandler struct {
+	level slog.Level
+	attrs []slog.Attr
+	group string
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var entry bytes.Buffer
+	writeJournalField(&entry, "MESSAGE", r.Message)
+	writeJournalField(&entry, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	writeJournalField(&entry, "SYSLOG_IDENTIFIER", filepath.Base(os.Args[0]))
+	for _, a := range h.attrs {
+		writeJournalAttr(&entry, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeJournalAttr(&entry, h.group, a)
+		return true
+	})
+
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(entry.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	res := *h
+	res.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &res
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	res := *h
+	res.group += name + "_"
+	return &res
+}
+
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+func writeJournalAttr(buf *bytes.Buffer, group string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			writeJournalAttr(buf, group+a.Key+"_", ga)
+		}
+		return
+	}
+	name := "IDP_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, group+a.Key)
+	writeJournalField(buf, name, v.String())
+}
+
+// writeJournalField encodes a field in journald's native protocol, which needs a length prefix for values
+// spanning several lines.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	buf.WriteString(name + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// fanoutHandler passes log records on to several handlers, e.g. the terminal and the log file.
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, hh := range h {
+		if hh.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, hh := range h {
+		if hh.Enabled(ctx, r.Level) {
+			if herr := hh.Handle(ctx, r.Clone()); herr != nil && err == nil {
+				err = herr
+			}
+		}
+	}
+	return err
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	res := make(fanoutHandler, len(h))
+	for i, hh := range h {
+		res[i] = hh.WithAttrs(attrs)
+	}
+	return res
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	res := make(fanoutHandler, len(h))
+	for i, hh := range h {
+		res[i] = hh.WithGroup(name)
+	}
+	return res
+}
@@ -2,166 +2,409 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"net/http"
-	"net/url"
+	"log/slog"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
 )
 
-type SigninMethodFunc func() (didSignIn bool, err error)
+// gpAWSSessionDuration is the session duration gp idp login aws requests by default.
+const gpAWSSessionDuration = time.Hour
+
+var (
+	roleFlag    = flag.String("role", "", "AWS role ARN to assume. Required when IDP_AWS_ROLE_ARN lists several roles and no terminal is attached.")
+	timeoutFlag = flag.Duration("timeout", 0, "abort the command if it takes longer than this, e.g. 30s (0 means no timeout)")
+)
 
 func main() {
-	var signinMethods = []SigninMethodFunc{
-		signinWithGitpod,
-		signinWithGitpodVerbose,
-		signinWithSSO,
-	}
-	for _, signin := range signinMethods {
-		didSignIn, err := signin()
-		if didSignIn {
-			return
-		}
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error while logging in: %v\n", err)
-		}
+	flag.Usage = usage
+	if cmd, ok := helperCommands[commandName(os.Args[0])]; ok {
+		os.Args = append(append([]string{os.Args[0]}, cmd...), os.Args[1:]...)
+	}
+	if answered, err := runFastPath(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	} else if answered {
+		return
+	}
+	flag.Parse()
+	if err := setupLogging(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if err := validateOutputFormat(*outputFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+	var err error
+	cfg, err = loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitMissingConfig)
+	}
+	if err := setupNetwork(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
 	}
+	setupTracing()
+	if err := setupRecording(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+	setupVerbose()
+	gitpodidp.SetHTTPClient(httpClient)
+	gitpodidp.SetAPITokenCache(gitpodTokenCache{})
+	discoverPlugins()
 
-	fmt.Fprintf(os.Stderr, "don't know how to sign in - I've tried everythin 🤷\n")
+	args := flag.Args()
+	name := "login"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	defer reportCrash(cmd.Name)
+	ctx, cancel := commandContext()
+	ctx, span := startSpan(ctx, "idp "+cmd.Name)
+	start := time.Now()
+	logCommandStart(cmd.Name, args)
+	err = cmd.Run(ctx, args)
+	if err != nil && ctx.Err() != nil {
+		err = contextError(ctx, err)
+	}
+	cancel()
+	logCommandResult(cmd.Name, start, err)
+	span.end(err)
+	flushTraces()
+	recordTelemetry(cmd.Name, err)
+	reportError(cmd.Name, err)
+	if err != nil {
+		printFailure("%v", err)
+		os.Exit(exitCode(err))
+	}
 }
 
-func signinWithGitpod() (didSignIn bool, err error) {
-	if !runningInGitpod() {
-		return false, nil
+// commandContext returns the context commands run in. It is cancelled on SIGINT and SIGTERM, and once the
+// -timeout has elapsed.
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// a second interrupt aborts right away, e.g. while waiting for input
+		<-ctx.Done()
+		stop()
+	}()
+	if *timeoutFlag <= 0 {
+		return ctx, stop
 	}
-	if os.Getenv("IDP_AWS_ROLE_ARN") == "" {
-		fmt.Fprintf(os.Stderr, "Running in a Gitpod workspace, but the IDP_AWS_ROLE_ARN environment variable is not set.\nPlease setup OIDC trust (https://www.gitpod.io/docs/integrations/aws) and set the IDP_AWS_ROLE_ARN environment variable on your project\n\n")
-		return false, nil
+	ctx, cancel := context.WithTimeout(ctx, *timeoutFlag)
+	return ctx, func() {
+		cancel()
+		stop()
 	}
+}
 
-	out, err := exec.Command("gp", "idp", "login", "aws").CombinedOutput()
-	if err != nil {
-		return false, fmt.Errorf("gp idp login failure: %s: %w", string(out), err)
+// contextError explains that err happened because ctx was cancelled.
+func contextError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s: %w", *timeoutFlag, err)
 	}
+	return fmt.Errorf("interrupted: %w", err)
+}
 
-	return true, nil
+func awsMissingConfig() []string {
+	if *roleFlag != "" || setting("IDP_AWS_PROFILES") != "" {
+		return nil
+	}
+	return missingSettings("IDP_AWS_ROLE_ARN")
 }
 
-// signinWithGitpodVerbose demonstrates how Gitpod's APIs can be used without the gp CLI.
-//
-// Note: this is considerably more brittle than using the gp CLI, as some of the APIs are not entirely stable yet and may change without prior notice.
-func signinWithGitpodVerbose() (didSignIn bool, err error) {
-	if !runningInGitpod() {
-		return false, nil
-	}
-	roleARN := os.Getenv("IDP_AWS_ROLE_ARN")
-	if roleARN == "" {
-		fmt.Fprintf(os.Stderr, "Running in a Gitpod workspace, but the IDP_AWS_ROLE_ARN environment variable is not set.\nPlease setup OIDC trust (https://www.gitpod.io/docs/integrations/aws) and set the IDP_AWS_ROLE_ARN environment variable on your project\n\n")
-		return false, nil
-	}
-
-	// 1. Get token to talk to Gitpod
-	var (
-		supervisorAddr = os.Getenv("SUPERVISOR_ADDR")
-		gitpodHostRaw  = os.Getenv("GITPOD_HOST")
-		workspaceID    = os.Getenv("GITPOD_WORKSPACE_ID")
-	)
-	gitpodHost, err := url.Parse(gitpodHostRaw)
-	if err != nil {
-		return false, fmt.Errorf("invalid Gitpod host url: %w", err)
+func awsIdentity() string {
+	if profiles, _ := awsProfiles(); len(profiles) > 0 && *roleFlag == "" {
+		return awsProfilesIdentity(profiles)
+	}
+	role, _ := awsRoleARN()
+	return role
+}
+
+func awsConfigured() bool {
+	return len(awsMissingConfig()) == 0
+}
+
+// gitpodCLISignin signs in using gp idp login aws.
+type gitpodCLISignin struct{}
+
+func (gitpodCLISignin) Name() string { return "gp" }
+
+func (gitpodCLISignin) Available() bool { return runningInGitpod() }
+
+func (gitpodCLISignin) Requires() string { return "a Gitpod workspace with the gp CLI" }
+
+func (m gitpodCLISignin) Refresh(ctx context.Context, rec credentialRecord) error {
+	return m.Login(ctx, rec.Identity)
+}
+
+func (gitpodCLISignin) Login(ctx context.Context, roleARN string) error {
+	var err error
+	var out []byte
+	gpCtx := ctx
+	var scratch string
+	if racingSignin(ctx) {
+		// gp writes the profile itself. While racing, it writes a scratch file instead, from which its credentials
+		// are copied if it wins, so that a loser killed half way can't garble the winner's profile.
+		dir, err := stateDir()
+		if err != nil {
+			return err
+		}
+		err = mkdirPrivate(dir)
+		if err != nil {
+			return err
+		}
+		tmp, err := os.MkdirTemp(dir, "gp-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		scratch = filepath.Join(tmp, "credentials")
+		gpCtx = withCommandEnv(ctx, "AWS_SHARED_CREDENTIALS_FILE="+scratch)
 	}
-	client := http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(fmt.Sprintf("http://%s/_supervisor/v1/token/gitpod/%s/", supervisorAddr, gitpodHost.Host))
+	err = traceStep(gpCtx, "exchange token", func(ctx context.Context) error {
+		return withProgress("signing into AWS using gp idp login", func() (err error) {
+			for n := 0; ; n++ {
+				out, err = runner.CombinedOutput(ctx, "gp", "idp", "login", "aws", "--role-arn", roleARN)
+				if err == nil || n == gitpodidp.MaxThrottleRetries || !throttledOutput(out) {
+					return err
+				}
+				wait := gitpodidp.ThrottleBackoff(n)
+				slog.WarnContext(ctx, "STS throttled gp idp login, retrying", "retryIn", wait, "attempt", n+1)
+				select {
+				case <-ctx.Done():
+					return err
+				case <-time.After(wait):
+				}
+			}
+		})
+	}, "idp.method", "gp")
 	if err != nil {
-		return false, fmt.Errorf("cannot get gitpod token: %w", err)
+		return exitErrorf(exitExchangeFailed, "gp idp login failure: %s: %w", string(out), err)
 	}
-	defer resp.Body.Close()
-	var tkn struct {
-		Token string `json:"token"`
+	emitEvent(eventExchangeSucceeded, "aws", "method", "gp", "roleArn", roleARN)
+	if scratch != "" {
+		vars, err := readINISection(scratch, "default")
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot read the credentials gp wrote: %w", err)
+		}
+		err = persistCredentials(ctx, func() error {
+			return writeDefaultProfile(ctx, map[string]string{
+				"aws_access_key_id":     vars["aws_access_key_id"],
+				"aws_secret_access_key": vars["aws_secret_access_key"],
+				"aws_session_token":     vars["aws_session_token"],
+			})
+		})
+		if err != nil {
+			return err
+		}
 	}
-	err = json.NewDecoder(resp.Body).Decode(&tkn)
-	if err != nil {
-		return false, fmt.Errorf("cannot decode gitpod token: %w", err)
+	emitEvent(eventProfileWritten, "aws", "profile", "default")
+	now := time.Now()
+	recordLogin(credentialRecord{Provider: "aws", Identity: roleARN, Method: "gp", IssuedAt: now, Expiry: now.Add(gpAWSSessionDuration)})
+
+	return nil
+}
+
+// throttledOutput reports whether the output of gp idp login says STS throttled it, which the gp CLI doesn't retry.
+func throttledOutput(out []byte) bool {
+	for _, s := range []string{"Throttling", "RequestLimitExceeded", "Rate exceeded", "TooManyRequests"} {
+		if bytes.Contains(out, []byte(s)) {
+			return true
+		}
 	}
+	return false
+}
 
-	// 2. Produce identity token
-	idpReq, err := json.Marshal(struct {
-		WorkspaceID string   `json:"workspace_id"`
-		Audience    []string `json:"audience"`
-	}{
-		WorkspaceID: workspaceID,
-		Audience:    []string{"sts.amazonaws.com"},
-	})
-	if err != nil {
-		return false, fmt.Errorf("cannot marshal ID token request: %w", err)
+// gitpodAPISignin demonstrates how Gitpod's APIs can be used without the gp CLI, using the gitpodidp package to
+// mint the token and talk to AWS STS directly.
+//
+// Note: this is considerably more brittle than using the gp CLI, as some of the APIs are not entirely stable yet and may change without prior notice.
+type gitpodAPISignin struct{}
+
+func (gitpodAPISignin) Name() string { return "api" }
+
+// Available reports whether the workspace's supervisor can be reached and the aws CLI is there to store the
+// credentials.
+func (gitpodAPISignin) Available() bool {
+	if os.Getenv("GITPOD_WORKSPACE_ID") == "" || os.Getenv("SUPERVISOR_ADDR") == "" {
+		return false
 	}
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://api.%s/gitpod.experimental.v1.IdentityProviderService/GetIDToken", gitpodHost.Host), bytes.NewReader(idpReq))
+	pth, _ := runner.LookPath("aws")
+	return pth != ""
+}
+
+func (gitpodAPISignin) Requires() string {
+	return "GITPOD_WORKSPACE_ID, SUPERVISOR_ADDR and the aws CLI"
+}
+
+func (m gitpodAPISignin) Refresh(ctx context.Context, rec credentialRecord) error {
+	return m.Login(ctx, rec.Identity)
+}
+
+func (gitpodAPISignin) Login(ctx context.Context, roleARN string) error {
+	var err error
+	// 1. Produce identity token using the supervisor and Gitpod's API
+	var token string
+	audience := providerAudience("aws")
+	err = traceStep(ctx, "mint identity token", func(ctx context.Context) error {
+		return withProgress("minting an identity token", func() (err error) {
+			token, err = gitpodidp.GetIDToken(ctx, audience)
+			return err
+		})
+	}, "idp.audience", audience)
 	if err != nil {
-		return false, fmt.Errorf("cannot prepare ID token request: %w", err)
+		return err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tkn.Token))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err = client.Do(req)
+	registerSecret(token)
+	observeTokenClock(token)
+	emitEvent(eventTokenMinted, "aws", "audience", audience)
+
+	// 2. Exchange ID token for AWS credentials
+	var creds *gitpodidp.AWSCredentials
+	sessionName := gitpodidp.DefaultSessionName()
+	err = traceStep(ctx, "exchange token", func(ctx context.Context) error {
+		return withProgress("exchanging the identity token for AWS credentials", func() (err error) {
+			creds, err = gitpodidp.AssumeRoleWithWebIdentity(ctx, token, gitpodidp.AssumeRoleInput{RoleARN: roleARN, SessionName: sessionName, Region: setting("IDP_AWS_REGION")})
+			return err
+		})
+	}, "idp.method", "api")
 	if err != nil {
-		return false, fmt.Errorf("cannot make ID token request: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
-	var idtkn struct {
-		Token string `json:"token"`
-	}
-	err = json.NewDecoder(resp.Body).Decode(&tkn)
+
+	registerSecret(creds.SecretAccessKey)
+	registerSecret(creds.SessionToken)
+
+	// 3. Persist credentials as AWS profile
+	emitEvent(eventExchangeSucceeded, "aws", "method", "sts", "roleArn", roleARN)
+	err = persistCredentials(ctx, func() error {
+		return writeDefaultProfile(ctx, map[string]string{
+			"aws_access_key_id":     creds.AccessKeyID,
+			"aws_secret_access_key": creds.SecretAccessKey,
+			"aws_session_token":     creds.SessionToken,
+		})
+	})
 	if err != nil {
-		return false, fmt.Errorf("cannot decode ID token response: %w", err)
+		return err
 	}
+	emitEvent(eventProfileWritten, "aws", "profile", "default")
+	recordLogin(credentialRecord{Provider: "aws", Identity: roleARN, Method: "api", SessionName: sessionName, Expiry: localTime(creds.Expiration)})
 
-	// 3. Exchange ID token for AWS credentials
-	awsCmd := exec.Command("aws", "sts", "assume-role-with-web-identity", "--role-arn", roleARN, "--role-session-name", fmt.Sprintf("%s-%d", workspaceID, time.Now().Unix()), "--web-identity-token", idtkn.Token)
-	out, err := awsCmd.CombinedOutput()
-	if err != nil {
-		return false, fmt.Errorf("%w: %s", err, string(out))
+	return nil
+}
+
+// writeDefaultProfile sets vars in the default AWS profile using the aws CLI.
+func writeDefaultProfile(ctx context.Context, vars map[string]string) error {
+	return traceStep(ctx, "persist credentials", func(ctx context.Context) error {
+		return withProgress("writing the default AWS profile", func() error {
+			for k, v := range vars {
+				out, err := runner.CombinedOutput(ctx, "aws", "configure", "set", "--profile", "default", k, v)
+				if err != nil {
+					return exitErrorf(exitPersistFailed, "%w: %s", err, string(out))
+				}
+			}
+			return nil
+		})
+	})
+}
+
+var (
+	awsRoleResolved bool
+	awsRoleSelected string
+	awsRoleErr      error
+)
+
+// awsRoleARN returns the role to assume, or an empty string if none is configured. IDP_AWS_ROLE_ARN may list
+// several roles separated by commas, in which case the -role flag decides, then the choice made earlier in this
+// workspace session, and finally an interactive selection.
+func awsRoleARN() (string, error) {
+	if !awsRoleResolved {
+		awsRoleSelected, awsRoleErr = resolveAWSRoleARN()
+		awsRoleResolved = true
 	}
+	return awsRoleSelected, awsRoleErr
+}
 
-	// 4. Persist credentials as AWS profile
-	var result struct {
-		Credentials struct {
-			AccessKeyId     string
-			SecretAccessKey string
-			SessionToken    string
-		}
+func resolveAWSRoleARN() (string, error) {
+	if *roleFlag != "" {
+		return *roleFlag, nil
 	}
-	err = json.Unmarshal(out, &result)
-	if err != nil {
-		return false, err
+
+	var roles []string
+	for _, r := range strings.Split(setting("IDP_AWS_ROLE_ARN"), ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			roles = append(roles, r)
+		}
 	}
-	vars := map[string]string{
-		"aws_access_key_id":     result.Credentials.AccessKeyId,
-		"aws_secret_access_key": result.Credentials.SecretAccessKey,
-		"aws_session_token":     result.Credentials.SessionToken,
+	switch len(roles) {
+	case 0:
+		return "", nil
+	case 1:
+		return roles[0], nil
 	}
-	for k, v := range vars {
-		awsCmd := exec.Command("aws", "configure", "set", "--profile", "default", k, v)
-		out, err := awsCmd.CombinedOutput()
-		if err != nil {
-			return false, fmt.Errorf("%w: %s", err, string(out))
+
+	session := loadSessionState()
+	for _, r := range roles {
+		if r == session.AWSRoleARN {
+			return r, nil
 		}
 	}
 
-	return true, nil
+	role, err := pickInteractive("IDP_AWS_ROLE_ARN lists several roles. Which one do you want to assume?", roles)
+	if err != nil {
+		return "", exitErrorf(exitMissingConfig, "cannot select AWS role (use -role to pick one of %s): %w", strings.Join(roles, ", "), err)
+	}
+	session.AWSRoleARN = role
+	err = saveSessionState(session)
+	if err != nil {
+		slog.Warn("cannot remember role selection", "error", err)
+	}
+	return role, nil
 }
 
 func runningInGitpod() bool {
 	if os.Getenv("GITPOD_WORKSPACE_URL") == "" {
 		return false
 	}
-	if pth, _ := exec.LookPath("gp"); pth == "" {
+	if pth, _ := runner.LookPath("gp"); pth == "" {
 		return false
 	}
 	return true
 }
 
-func signinWithSSO() (didSignIn bool, err error) {
-	// NOTE(cw): only here for demo purposes - no need to implement this
-	return false, nil
+// ssoSignin would sign in using AWS IAM Identity Center.
+type ssoSignin struct{}
+
+func (ssoSignin) Name() string { return "sso" }
+
+// NOTE(cw): only here for demo purposes - no need to implement this
+func (ssoSignin) Available() bool { return false }
+
+func (ssoSignin) Requires() string { return "an implementation, which doesn't exist yet" }
+
+func (ssoSignin) Login(ctx context.Context, roleARN string) error {
+	return fmt.Errorf("signing in using SSO is not implemented")
+}
+
+func (ssoSignin) Refresh(ctx context.Context, rec credentialRecord) error {
+	return fmt.Errorf("signing in using SSO is not implemented")
 }
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "mcp",
+		Usage:   "mcp [--max-duration 1h] [provider...]",
+		Summary: "serve the credential status and short-lived, scoped credentials to AI coding agents as a Model Context Protocol server on stdio",
+		Run:     runMCP,
+	})
+}
+
+// mcpProtocolVersion is the revision of the Model Context Protocol the server speaks, unless the client asks for
+// another one it knows.
+const mcpProtocolVersion = "2025-06-18"
+
+var mcpProtocolVersions = []string{"2024-11-05", "2025-03-26", mcpProtocolVersion}
+
+// defaultMCPDuration is how long the AWS sessions handed to agents last unless they ask for longer. It's the
+// shortest STS allows.
+const defaultMCPDuration = 15 * time.Minute
+
+// defaultAzureScope is the scope of the Azure access tokens handed to agents unless they ask for another one.
+const defaultAzureScope = "https://management.azure.com/.default"
+
+// mcpTool is a tool the server offers, with the JSON schema of its arguments.
+type mcpTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+	call        func(ctx context.Context, args json.RawMessage) (any, error)
+}
+
+// mcpServer answers the requests of one MCP client. Handing out credentials needs a reason, which goes into the
+// audit log along with the client's name, and no credentials are handed out which couldn't be audited.
+type mcpServer struct {
+	providers   []provider
+	maxDuration time.Duration
+	client      string
+	tools       []mcpTool
+}
+
+// runMCP serves MCP on stdin and stdout until the client closes stdin. Agents get credentials only through the
+// tools, for a single session each, instead of reading the shared ones in ~/.aws and elsewhere.
+func runMCP(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("mcp", flag.ExitOnError)
+	maxDuration := flags.Duration("max-duration", time.Hour, "longest AWS session an agent may ask for")
+	_ = flags.Parse(args)
+
+	selected, err := selectProviders(flags.Args())
+	if err != nil {
+		return err
+	}
+	if *maxDuration < defaultMCPDuration {
+		return exitErrorf(exitUsage, "--max-duration must be at least %s, the shortest session STS allows", defaultMCPDuration)
+	}
+	s := &mcpServer{providers: selected, maxDuration: *maxDuration}
+	s.tools = s.availableTools()
+
+	// stdout carries the protocol, so everything else printed while signing in goes to stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = out }()
+	return s.serve(ctx, os.Stdin, out)
+}
+
+// serve answers the requests of in on out, one at a time.
+func (s *mcpServer) serve(ctx context.Context, in io.Reader, out io.Writer) error {
+	conn := newRPCConn(out)
+	return conn.serve(in, func(req rpcRequest) error {
+		res, err := s.handle(ctx, req)
+		return conn.reply(req, res, err)
+	})
+}
+
+func (s *mcpServer) handle(ctx context.Context, req rpcRequest) (any, error) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+			ClientInfo      struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"clientInfo"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		s.client = strings.TrimSpace(params.ClientInfo.Name + " " + params.ClientInfo.Version)
+		protocol := mcpProtocolVersion
+		for _, v := range mcpProtocolVersions {
+			if v == params.ProtocolVersion {
+				protocol = v
+			}
+		}
+		return map[string]any{
+			"protocolVersion": protocol,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "gitpod-idp", "version": version},
+			"instructions":    "Ask for credentials with the tools of this server rather than reading credential files. Every request is audited with the reason you give.",
+		}, nil
+	case "ping", "notifications/initialized", "notifications/cancelled":
+		return map[string]any{}, nil
+	case "tools/list":
+		return map[string]any{"tools": s.tools}, nil
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range s.tools {
+			if t.Name != params.Name {
+				continue
+			}
+			if len(params.Arguments) == 0 {
+				params.Arguments = json.RawMessage("{}")
+			}
+			var res any
+			if t.Name != "status" {
+				err = guardCredentials(ctx, "credentials to agents")
+			}
+			if err == nil {
+				res, err = t.call(ctx, params.Arguments)
+			}
+			if err != nil {
+				// failures of the tool are for the agent to read, not protocol errors
+				return map[string]any{
+					"content": []map[string]any{{"type": "text", "text": redactText(err.Error())}},
+					"isError": true,
+				}, nil
+			}
+			text, err := json.MarshalIndent(res, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{
+				"content":           []map[string]any{{"type": "text", "text": string(text)}},
+				"structuredContent": res,
+			}, nil
+		}
+		return nil, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("unknown tool %q", params.Name)}
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+}
+
+// availableTools returns the status tool and the credential tools of the configured providers.
+func (s *mcpServer) availableTools() []mcpTool {
+	reason := map[string]any{"type": "string", "description": "what the credentials are for, recorded in the audit log"}
+	tools := []mcpTool{{
+		Name:        "status",
+		Description: "Show which cloud providers the workspace is signed into, as which identity, and when the credentials expire.",
+		InputSchema: map[string]any{"type": "object", "properties": map[string]any{}},
+		call:        s.status,
+	}}
+	for _, p := range s.providers {
+		if !p.configured() {
+			continue
+		}
+		switch p.Name {
+		case "aws":
+			tools = append(tools, mcpTool{
+				Name:        "aws_credentials",
+				Description: "Get temporary AWS credentials of their own, as environment variables. A session policy narrows them to what the task needs.",
+				InputSchema: map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"reason":           reason,
+						"role_arn":         map[string]any{"type": "string", "description": "one of the roles the workspace may assume, by default the signed-in one"},
+						"policy":           map[string]any{"type": "string", "description": "JSON IAM session policy limiting the credentials"},
+						"duration_seconds": map[string]any{"type": "integer", "minimum": int(defaultMCPDuration.Seconds()), "maximum": int(s.maxDuration.Seconds())},
+					},
+					"required": []string{"reason"},
+				},
+				call: s.awsCredentials,
+			})
+		case "gcp":
+			tools = append(tools, mcpTool{
+				Name:        "gcp_access_token",
+				Description: "Get a Google Cloud access token, valid for an hour at most.",
+				InputSchema: map[string]any{"type": "object", "properties": map[string]any{"reason": reason}, "required": []string{"reason"}},
+				call:        s.gcpAccessToken,
+			})
+		case "azure":
+			tools = append(tools, mcpTool{
+				Name:        "azure_access_token",
+				Description: "Get a Microsoft Entra ID access token for one resource.",
+				InputSchema: map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"reason": reason,
+						"scope":  map[string]any{"type": "string", "description": "scope of the token, by default " + defaultAzureScope},
+					},
+					"required": []string{"reason"},
+				},
+				call: s.azureAccessToken,
+			})
+		}
+	}
+	return tools
+}
+
+func (s *mcpServer) status(ctx context.Context, args json.RawMessage) (any, error) {
+	res := []providerStatus{}
+	for _, p := range s.providers {
+		st, err := getProviderStatus(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, st)
+	}
+	return map[string]any{"providers": res}, nil
+}
+
+func (s *mcpServer) awsCredentials(ctx context.Context, raw json.RawMessage) (any, error) {
+	var args struct {
+		Reason          string `json:"reason"`
+		RoleARN         string `json:"role_arn"`
+		Policy          string `json:"policy"`
+		DurationSeconds int    `json:"duration_seconds"`
+	}
+	err := decodeMCPArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := mcpAWSRoles()
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		return nil, errors.New("no AWS role is configured")
+	}
+	if args.RoleARN == "" {
+		args.RoleARN = roles[0]
+	} else if !slices.Contains(roles, args.RoleARN) {
+		return nil, fmt.Errorf("%s is not one of the configured roles %s", args.RoleARN, strings.Join(roles, ", "))
+	}
+	err = checkRoleAllowed(args.RoleARN)
+	if err != nil {
+		return nil, err
+	}
+	if matchesRolePattern(args.RoleARN, rolePatterns("IDP_AWS_PRIVILEGED_ROLES")) || requiresApproval(args.RoleARN) {
+		return nil, fmt.Errorf("%s is a privileged role, which only people signing in themselves may assume", args.RoleARN)
+	}
+	duration := defaultMCPDuration
+	if args.DurationSeconds != 0 {
+		duration = time.Duration(args.DurationSeconds) * time.Second
+	}
+	if duration < defaultMCPDuration || duration > s.maxDuration {
+		return nil, fmt.Errorf("duration_seconds must be between %d and %d", int(defaultMCPDuration.Seconds()), int(s.maxDuration.Seconds()))
+	}
+	if args.Policy != "" && !json.Valid([]byte(args.Policy)) {
+		return nil, errors.New("policy is not a JSON document")
+	}
+
+	token, err := gitpodIDToken(ctx, providerAudience("aws"))
+	if err != nil {
+		return nil, err
+	}
+	sessionName := gitpodidp.DefaultSessionName()
+	var creds *gitpodidp.AWSCredentials
+	err = traceStep(ctx, "exchange token", func(ctx context.Context) (err error) {
+		creds, err = gitpodidp.AssumeRoleWithWebIdentity(ctx, token, gitpodidp.AssumeRoleInput{
+			RoleARN:     args.RoleARN,
+			SessionName: sessionName,
+			Duration:    duration,
+			Region:      setting("IDP_AWS_REGION"),
+			Policy:      args.Policy,
+		})
+		return err
+	}, "idp.method", "mcp")
+	if err != nil {
+		return nil, err
+	}
+	registerSecret(creds.SecretAccessKey)
+	registerSecret(creds.SessionToken)
+	err = s.audit(credentialRecord{Provider: "aws", Identity: args.RoleARN, SessionName: sessionName, Expiry: creds.Expiration}, args.Reason)
+	if err != nil {
+		return nil, err
+	}
+	emitEvent(eventExchangeSucceeded, "aws", "method", "mcp", "roleArn", args.RoleARN)
+
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":     creds.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY": creds.SecretAccessKey,
+		"AWS_SESSION_TOKEN":     creds.SessionToken,
+	}
+	if region := awsRegion(); region != "" {
+		env["AWS_REGION"] = region
+	}
+	return map[string]any{"env": env, "roleArn": creds.AssumedRoleARN, "expiration": creds.Expiration}, nil
+}
+
+// mcpAWSRoles returns the roles agents may ask for: those of IDP_AWS_ROLE_ARN and IDP_AWS_PROFILES, the signed-in
+// one first.
+func mcpAWSRoles() ([]string, error) {
+	var roles []string
+	if rec, _ := loadCredentialRecord("aws"); rec != nil && rec.Method != awsProfilesMethod {
+		roles = append(roles, rec.Identity)
+	}
+	for _, r := range strings.Split(setting("IDP_AWS_ROLE_ARN"), ",") {
+		if r = strings.TrimSpace(r); r != "" && !slices.Contains(roles, r) {
+			roles = append(roles, r)
+		}
+	}
+	profiles, err := awsProfiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range sortedKeys(profiles) {
+		if r := profiles[name].RoleARN; !slices.Contains(roles, r) {
+			roles = append(roles, r)
+		}
+	}
+	return roles, nil
+}
+
+func (s *mcpServer) gcpAccessToken(ctx context.Context, raw json.RawMessage) (any, error) {
+	var args struct {
+		Reason string `json:"reason"`
+	}
+	err := decodeMCPArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	p, _ := findProvider("gcp")
+	err = loginWhereNeeded(ctx, []provider{p}, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	token, err := gcpAccessToken(ctx, "mcp")
+	if err != nil {
+		return nil, err
+	}
+	identity := setting("IDP_GCP_SERVICE_ACCOUNT")
+	if identity == "" {
+		identity = gcpWorkloadIdentityProvider()
+	}
+	err = s.audit(credentialRecord{Provider: "gcp", Identity: identity}, args.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"accessToken": token, "tokenType": "Bearer"}, nil
+}
+
+func (s *mcpServer) azureAccessToken(ctx context.Context, raw json.RawMessage) (any, error) {
+	var args struct {
+		Reason string `json:"reason"`
+		Scope  string `json:"scope"`
+	}
+	err := decodeMCPArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	if args.Scope == "" {
+		args.Scope = defaultAzureScope
+	}
+	p, _ := findProvider("azure")
+	err = loginWhereNeeded(ctx, []provider{p}, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	token, err := azureAccessToken(ctx, args.Scope, "mcp")
+	if err != nil {
+		return nil, err
+	}
+	rec := credentialRecord{Provider: "azure", Identity: setting("IDP_AZURE_CLIENT_ID")}
+	if exp := gitpodidp.Expiry(token); !exp.IsZero() {
+		rec.Expiry = localTime(exp)
+	}
+	err = s.audit(rec, args.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"accessToken": token, "tokenType": "Bearer", "scope": args.Scope, "expiration": rec.Expiry}, nil
+}
+
+// audit records credentials handed to the client, with the reason it gave.
+func (s *mcpServer) audit(rec credentialRecord, reason string) error {
+	rec.Method = "mcp"
+	rec.IssuedAt = time.Now()
+	entry := newAuditEntry(rec)
+	entry.Client = s.client
+	entry.Reason = reason
+	err := appendAuditEntry(entry)
+	if err != nil {
+		return fmt.Errorf("cannot write the audit log, so not handing out the credentials: %w", err)
+	}
+	return nil
+}
+
+// decodeMCPArgs decodes the arguments of a credential tool, which must give a reason.
+func decodeMCPArgs(raw json.RawMessage, args any) error {
+	err := json.Unmarshal(raw, args)
+	if err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	var reason struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.Unmarshal(raw, &reason)
+	if strings.TrimSpace(reason.Reason) == "" {
+		return errors.New("say what the credentials are for in reason")
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exchangeBuckets are the upper bounds in seconds of the exchange duration histogram. Exchanges usually take a
+// second or two; the long tail is hanging CLIs and throttled APIs.
+var exchangeBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics counts the sign-ins of this process, for the /metrics endpoint of the daemon.
+var metrics struct {
+	mu sync.Mutex
+	// exchanges and refreshes count by provider and result
+	exchanges map[[2]string]int
+	refreshes map[[2]string]int
+	durations map[string]*histogram
+}
+
+type histogram struct {
+	counts []int // per bucket of exchangeBuckets, not cumulative
+	count  int
+	sum    float64
+}
+
+// observeExchange counts a login or refresh of provider which took d and failed with err, if not nil.
+func observeExchange(provider string, refresh bool, d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.exchanges == nil {
+		metrics.exchanges = make(map[[2]string]int)
+		metrics.refreshes = make(map[[2]string]int)
+		metrics.durations = make(map[string]*histogram)
+	}
+	metrics.exchanges[[2]string{provider, result}]++
+	if refresh {
+		metrics.refreshes[[2]string{provider, result}]++
+	}
+	h := metrics.durations[provider]
+	if h == nil {
+		h = &histogram{counts: make([]int, len(exchangeBuckets))}
+		metrics.durations[provider] = h
+	}
+	secs := d.Seconds()
+	for i, le := range exchangeBuckets {
+		if secs <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+// handleMetrics serves the metrics of the credentials of selected in the Prometheus text format.
+func handleMetrics(selected []provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, selected)
+	}
+}
+
+// writeMetrics writes the counters collected by observeExchange and the age and remaining lifetime of the
+// recorded credentials of selected.
+func writeMetrics(w io.Writer, selected []provider) {
+	metrics.mu.Lock()
+	writeCounter(w, "idp_exchanges_total", "Logins and refreshes by provider and result.", metrics.exchanges)
+	writeCounter(w, "idp_refreshes_total", "Refreshes by provider and result.", metrics.refreshes)
+
+	fmt.Fprintln(w, "# HELP idp_exchange_duration_seconds How long logins and refreshes took, by provider.")
+	fmt.Fprintln(w, "# TYPE idp_exchange_duration_seconds histogram")
+	for _, p := range sortedKeys(metrics.durations) {
+		h := metrics.durations[p]
+		cumulative := 0
+		for i, le := range exchangeBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "idp_exchange_duration_seconds_bucket{provider=%q,le=%q} %d\n", p, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "idp_exchange_duration_seconds_bucket{provider=%q,le=\"+Inf\"} %d\n", p, h.count)
+		fmt.Fprintf(w, "idp_exchange_duration_seconds_sum{provider=%q} %g\n", p, h.sum)
+		fmt.Fprintf(w, "idp_exchange_duration_seconds_count{provider=%q} %d\n", p, h.count)
+	}
+	metrics.mu.Unlock()
+
+	var age, left strings.Builder
+	for _, p := range selected {
+		rec, err := loadCredentialRecord(p.Name)
+		if err != nil || rec == nil {
+			continue
+		}
+		if !rec.IssuedAt.IsZero() {
+			fmt.Fprintf(&age, "idp_credential_age_seconds{provider=%q} %g\n", p.Name, time.Since(rec.IssuedAt).Seconds())
+		}
+		if !rec.Expiry.IsZero() {
+			fmt.Fprintf(&left, "idp_credential_expiry_seconds{provider=%q} %g\n", p.Name, time.Until(rec.Expiry).Seconds())
+		}
+	}
+	fmt.Fprintln(w, "# HELP idp_credential_age_seconds Time since the current credentials were issued, by provider.")
+	fmt.Fprintln(w, "# TYPE idp_credential_age_seconds gauge")
+	fmt.Fprint(w, age.String())
+	fmt.Fprintln(w, "# HELP idp_credential_expiry_seconds Time until the current credentials expire, negative once they have, by provider.")
+	fmt.Fprintln(w, "# TYPE idp_credential_expiry_seconds gauge")
+	fmt.Fprint(w, left.String())
+}
+
+func writeCounter(w io.Writer, name, help string, values map[[2]string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	keys := make([][2]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{provider=%q,result=%q} %d\n", name, k[0], k[1], values[k])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// caBundleEnv are the variables through which the CLIs this tool runs accept a custom CA bundle.
+var caBundleEnv = []string{"AWS_CA_BUNDLE", "REQUESTS_CA_BUNDLE", "CLOUDSDK_CORE_CUSTOM_CA_CERTS_FILE"}
+
+// setupNetwork configures the HTTP clients for the network the workspace is in. Requests go through the proxies
+// of HTTP_PROXY, HTTPS_PROXY and NO_PROXY, and certificates are verified against the system roots plus the CA
+// bundle of IDP_CA_BUNDLE, to support TLS-intercepting proxies. The endpoints of Gitpod and the cloud providers
+// can be replaced for networks which only reach them through gateways.
+func setupNetwork() error {
+	transport := gitpodidp.NewTransport()
+
+	if fn := setting("IDP_CA_BUNDLE"); fn != "" {
+		pem, err := os.ReadFile(fn)
+		if err != nil {
+			return exitErrorf(exitMissingConfig, "cannot read the CA bundle: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return exitErrorf(exitMissingConfig, "the CA bundle %s contains no PEM certificates", fn)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	// one client for all API calls, so that they share connections
+	httpClient = &clockObservingClient{next: &http.Client{Timeout: gitpodidp.RequestTimeout, Transport: transport}}
+	downloadClient = &http.Client{Timeout: 60 * time.Second, Transport: transport}
+
+	gitpodidp.SetEndpoints(gitpodidp.Endpoints{
+		GitpodAPI:            setting("IDP_GITPOD_API_URL"),
+		AWSSTS:               setting("IDP_AWS_STS_ENDPOINT"),
+		GoogleSTS:            setting("IDP_GCP_STS_ENDPOINT"),
+		GoogleIAMCredentials: setting("IDP_GCP_IAM_CREDENTIALS_ENDPOINT"),
+		EntraID:              setting("IDP_AZURE_AUTHORITY_HOST"),
+	})
+	return nil
+}
+
+// drainBody reads what's left of a response body before closing it, so that the connection can be reused.
+func drainBody(body io.ReadCloser) {
+	_, _ = io.CopyN(io.Discard, body, 64<<10)
+	body.Close()
+}
+
+// subprocessEnv returns the environment of the CLIs this tool runs, which are pointed at IDP_CA_BUNDLE and the
+// AWS STS endpoint unless the user configured their own. It returns nil, i.e. this process's environment, if
+// there's nothing to add.
+func subprocessEnv() []string {
+	add := make(map[string]string)
+	if fn := setting("IDP_CA_BUNDLE"); fn != "" {
+		for _, name := range caBundleEnv {
+			add[name] = fn
+		}
+	}
+	if sts := setting("IDP_AWS_STS_ENDPOINT"); sts != "" {
+		add["AWS_ENDPOINT_URL_STS"] = sts
+	}
+
+	var env []string
+	for name, v := range add {
+		if os.Getenv(name) == "" {
+			env = append(env, fmt.Sprintf("%s=%s", name, v))
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
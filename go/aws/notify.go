@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+)
+
+type notifyLevel string
+
+const (
+	notifyInfo    notifyLevel = "INFO"
+	notifyWarning notifyLevel = "WARNING"
+)
+
+// notify tells the user about msg wherever they might be looking: on the terminal (ringing the bell for warnings),
+// as a Gitpod notification in the IDE, and on the desktop where a notification tool is installed. Channels which
+// aren't available are skipped silently.
+func notify(ctx context.Context, level notifyLevel, msg string) {
+	if level == notifyWarning {
+		printWarning("%s", msg)
+		if isTerminal(os.Stderr) {
+			fmt.Fprint(os.Stderr, "\a")
+		}
+	} else {
+		printSuccess("%s", msg)
+	}
+
+	if os.Getenv("SUPERVISOR_ADDR") != "" {
+		err := notifyGitpod(ctx, level, msg)
+		if err != nil {
+			slog.Debug("cannot send Gitpod notification", "error", err)
+		}
+	}
+	err := notifyDesktop(ctx, msg)
+	if err != nil {
+		slog.Debug("cannot send desktop notification", "error", err)
+	}
+}
+
+// notifyGitpod shows msg in the IDE through the supervisor's notification service.
+func notifyGitpod(ctx context.Context, level notifyLevel, msg string) error {
+	body, err := json.Marshal(struct {
+		Level   notifyLevel `json:"level"`
+		Message string      `json:"message"`
+	}{level, msg})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+os.Getenv("SUPERVISOR_ADDR")+"/_supervisor/v1/notification/notify", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("supervisor rejected the notification (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// notifyDesktop shows msg with notify-send on Linux or osascript on macOS, if they are installed.
+func notifyDesktop(ctx context.Context, msg string) error {
+	var name string
+	var args []string
+	switch runtime.GOOS {
+	case "darwin":
+		name, args = "osascript", []string{"-e", fmt.Sprintf("display notification %q with title %q", msg, "gitpod-idp")}
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return nil
+		}
+		name, args = "notify-send", []string{"gitpod-idp", msg}
+	}
+	if _, err := runner.LookPath(name); err != nil {
+		return nil
+	}
+	out, err := runner.CombinedOutput(ctx, name, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var outputFlag = flag.String("output", "table", "output format of informational commands: table, json or yaml")
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+func validateOutputFormat(format string) error {
+	switch format {
+	case outputTable, outputJSON, outputYAML:
+		return nil
+	default:
+		return exitErrorf(exitUsage, "unsupported output format %q: use table, json or yaml", format)
+	}
+}
+
+// writeOutput prints v to stdout in the format selected by --output. For the table format, table renders v for humans.
+func writeOutput(v interface{}, table func(w io.Writer) error) error {
+	return writeOutputAs(*outputFlag, v, table)
+}
+
+func writeOutputAs(format string, v interface{}, table func(w io.Writer) error) error {
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case outputYAML:
+		return writeYAML(os.Stdout, v)
+	default:
+		return table(os.Stdout)
+	}
+}
+
+// writeYAML renders v as YAML. v is serialised through its JSON representation, so json struct tags apply and
+// fields keep their declaration order.
+func writeYAML(w io.Writer, v interface{}) error {
+	fc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(fc))
+	dec.UseNumber()
+	node, err := decodeOrdered(dec)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	encodeYAML(&buf, node, 0)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+type orderedField struct {
+	Key   string
+	Value interface{}
+}
+
+type orderedObject []orderedField
+
+// decodeOrdered decodes the next JSON value, preserving the order of object keys.
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	switch delim {
+	case '{':
+		obj := orderedObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			val, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, orderedField{Key: key.(string), Value: val})
+		}
+		_, err = dec.Token()
+		return obj, err
+	case '[':
+		arr := []interface{}{}
+		for dec.More() {
+			val, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+		}
+		_, err = dec.Token()
+		return arr, err
+	default:
+		return nil, fmt.Errorf("unexpected JSON delimiter %v", delim)
+	}
+}
+
+func encodeYAML(buf *bytes.Buffer, node interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch n := node.(type) {
+	case orderedObject:
+		if len(n) == 0 {
+			fmt.Fprintf(buf, "%s{}\n", pad)
+			return
+		}
+		for _, f := range n {
+			if isYAMLScalar(f.Value) {
+				fmt.Fprintf(buf, "%s%s: %s\n", pad, yamlString(f.Key), yamlScalar(f.Value))
+				continue
+			}
+			fmt.Fprintf(buf, "%s%s:\n", pad, yamlString(f.Key))
+			encodeYAML(buf, f.Value, indent+2)
+		}
+	case []interface{}:
+		if len(n) == 0 {
+			fmt.Fprintf(buf, "%s[]\n", pad)
+			return
+		}
+		for _, item := range n {
+			if isYAMLScalar(item) {
+				fmt.Fprintf(buf, "%s- %s\n", pad, yamlScalar(item))
+				continue
+			}
+			// render the item one level deeper, then turn its first line's indentation into the sequence marker
+			var sub bytes.Buffer
+			encodeYAML(&sub, item, indent+2)
+			buf.WriteString(pad + "- ")
+			buf.Write(sub.Bytes()[indent+2:])
+		}
+	default:
+		fmt.Fprintf(buf, "%s%s\n", pad, yamlScalar(n))
+	}
+}
+
+func isYAMLScalar(node interface{}) bool {
+	switch n := node.(type) {
+	case orderedObject:
+		return len(n) == 0
+	case []interface{}:
+		return len(n) == 0
+	default:
+		return true
+	}
+}
+
+func yamlScalar(node interface{}) string {
+	switch n := node.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(n)
+	case json.Number:
+		return n.String()
+	case string:
+		return yamlString(n)
+	case orderedObject:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	default:
+		return fmt.Sprint(n)
+	}
+}
+
+// yamlString returns s as a plain YAML scalar, or double-quoted if it would otherwise be misread.
+func yamlString(s string) string {
+	if s == "" || strings.TrimSpace(s) != s || strings.ContainsAny(s, ":#{}[],&*?|<>=!%@`\"'\\\n\t") || strings.HasPrefix(s, "-") {
+		return strconv.Quote(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~":
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	return s
+}
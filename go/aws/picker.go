@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pickInteractive asks the user to choose one of options on the terminal. Users can either enter the
+// number of an option, or a search term which narrows the list shown down further using fuzzy matching. An
+// empty line shows all options again.
+func pickInteractive(prompt string, options []string) (string, error) {
+	if len(options) == 0 {
+		return "", fmt.Errorf("nothing to choose from")
+	}
+	if !isTerminal(os.Stdin) {
+		return "", fmt.Errorf("cannot prompt for a selection: stdin is not a terminal")
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	candidates := options
+	for {
+		fmt.Fprintln(os.Stderr, prompt)
+		for i, c := range candidates {
+			fmt.Fprintf(os.Stderr, "  %d) %s\n", i+1, c)
+		}
+		fmt.Fprint(os.Stderr, "Enter a number or search term: ")
+		if !in.Scan() {
+			if err := in.Err(); err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("no selection made")
+		}
+		input := strings.TrimSpace(in.Text())
+		if input == "" {
+			candidates = options
+			continue
+		}
+		if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(candidates) {
+			return candidates[n-1], nil
+		}
+
+		matches := fuzzyFilter(input, candidates)
+		switch len(matches) {
+		case 0:
+			fmt.Fprintf(os.Stderr, "nothing matches %q\n\n", input)
+		case 1:
+			return matches[0], nil
+		default:
+			fmt.Fprintln(os.Stderr)
+			candidates = matches
+		}
+	}
+}
+
+// fuzzyFilter returns the options pattern matches, in their order.
+func fuzzyFilter(pattern string, options []string) []string {
+	var res []string
+	for _, o := range options {
+		if fuzzyMatch(pattern, o) {
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// fuzzyMatch reports whether all characters of pattern appear in s in the same order, ignoring case.
+func fuzzyMatch(pattern, s string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(pattern) {
+		idx := strings.IndexRune(s, r)
+		if idx < 0 {
+			return false
+		}
+		s = s[idx+len(string(r)):]
+	}
+	return true
+}
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// prompter asks the user questions on the terminal.
+type prompter struct {
+	in *bufio.Scanner
+}
+
+func newPrompter() (*prompter, error) {
+	if !isTerminal(os.Stdin) {
+		return nil, fmt.Errorf("cannot ask questions: stdin is not a terminal")
+	}
+	return &prompter{in: bufio.NewScanner(os.Stdin)}, nil
+}
+
+// ask prints question and returns the answer, or def if the user just hits enter.
+func (p *prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: ", question)
+	}
+	if !p.in.Scan() {
+		if err := p.in.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("no answer given")
+	}
+	answer := strings.TrimSpace(p.in.Text())
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// confirm asks a yes/no question.
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer, err := p.ask(question+" ("+hint+")", "")
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(answer) {
+	case "":
+		return def, nil
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFuzzyFilter(t *testing.T) {
+	roles := []string{
+		"arn:aws:iam::111111111111:role/dev",
+		"arn:aws:iam::111111111111:role/admin",
+		"arn:aws:iam::222222222222:role/dev",
+	}
+	tests := []struct {
+		pattern string
+		options []string
+		want    []string
+	}{
+		{pattern: "dev", options: roles, want: []string{roles[0], roles[2]}},
+		{pattern: "DEV", options: roles, want: []string{roles[0], roles[2]}},
+		{pattern: "2dev", options: roles, want: []string{roles[2]}},
+		{pattern: "adm", options: roles, want: []string{roles[1]}},
+		{pattern: "xyz", options: roles},
+		// a second search narrows down the result of the first rather than searching all options again
+		{pattern: "111", options: fuzzyFilter("dev", roles), want: []string{roles[0]}},
+	}
+	for _, tt := range tests {
+		if got := fuzzyFilter(tt.pattern, tt.options); !slices.Equal(got, tt.want) {
+			t.Errorf("fuzzyFilter(%q, %q) = %q, want %q", tt.pattern, tt.options, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package gitpodidp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// APITokenTTL is how long a Gitpod API token is cached at most, or until it expires if that's sooner. Should the
+// Gitpod API reject a cached token earlier, it's replaced right away.
+const APITokenTTL = 10 * time.Minute
+
+// APITokenCache keeps the Gitpod API tokens the supervisor issues, so that processes signing in or calling the
+// Gitpod API, possibly many at once, can share one rather than each asking the supervisor.
+type APITokenCache interface {
+	// APIToken returns the cached token for the Gitpod host while it's valid. Otherwise it obtains one with fetch,
+	// which also says until when the token is valid, and caches it. Implementations shared by several processes
+	// should let only one of them fetch at a time.
+	APIToken(ctx context.Context, host string, fetch func(ctx context.Context) (string, time.Time, error)) (string, error)
+	// ForgetAPIToken drops the token for host, which the Gitpod API has rejected.
+	ForgetAPIToken(host string)
+}
+
+var apiTokenCache atomic.Pointer[APITokenCache]
+
+// SetAPITokenCache makes the package keep Gitpod API tokens in c. Until it is called, every identity token and
+// Gitpod API call asks the supervisor for a token first.
+func SetAPITokenCache(c APITokenCache) {
+	apiTokenCache.Store(&c)
+}
+
+// postAuthorized posts body to url with the workspace's API token, for the request what. Should the Gitpod API
+// reject a cached token, the request is sent again with a fresh one.
+func (ws *Workspace) postAuthorized(ctx context.Context, o *options, what, url string, body []byte) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		apiToken, cached, err := ws.apiToken(ctx, o)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("cannot prepare %s request: %w", what, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := doThrottled(o, req, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot make %s request: %w", what, err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized || !cached || retried {
+			return resp, nil
+		}
+		closeBody(resp.Body)
+		o.logger.DebugContext(ctx, "the Gitpod API rejected the cached token, getting a new one", "host", ws.Host)
+		(*apiTokenCache.Load()).ForgetAPIToken(ws.Host)
+	}
+}
+
+// apiToken returns a token for the Gitpod API, from the cache set with SetAPITokenCache if there is one. It
+// reports whether the token came from the cache.
+func (ws *Workspace) apiToken(ctx context.Context, o *options) (string, bool, error) {
+	c := apiTokenCache.Load()
+	if c == nil {
+		token, _, err := ws.fetchAPIToken(ctx, o)
+		return token, false, err
+	}
+	fetched := false
+	token, err := (*c).APIToken(ctx, ws.Host, func(ctx context.Context) (string, time.Time, error) {
+		fetched = true
+		return ws.fetchAPIToken(ctx, o)
+	})
+	return token, !fetched, err
+}
+
+// fetchAPIToken obtains a token for the Gitpod API from the workspace's supervisor, and when it expires.
+func (ws *Workspace) fetchAPIToken(ctx context.Context, o *options) (string, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/_supervisor/v1/token/gitpod/%s/", ws.SupervisorAddr, ws.Host), nil)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot prepare gitpod token request: %w", err)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot get gitpod token: %w", err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", time.Time{}, fmt.Errorf("cannot get gitpod token (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tkn struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tkn)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot decode gitpod token: %w", err)
+	}
+	expiry := Expiry(tkn.Token)
+	if expiry.IsZero() || time.Until(expiry) > APITokenTTL {
+		expiry = time.Now().Add(APITokenTTL)
+	}
+	return tkn.Token, expiry, nil
+}
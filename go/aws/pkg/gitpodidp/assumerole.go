@@ -0,0 +1,92 @@
+package gitpodidp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AssumeRole exchanges creds, e.g. those of AssumeRoleWithWebIdentity, for temporary credentials of another role.
+// STS caps the sessions of such role chains at an hour. Errors returned by STS are *STSError.
+func AssumeRole(ctx context.Context, creds *AWSCredentials, in AssumeRoleInput, opts ...Option) (*AWSCredentials, error) {
+	if in.RoleARN == "" {
+		return nil, ErrRoleNotConfigured
+	}
+	o := newOptions(opts)
+	sessionName := in.SessionName
+	if sessionName == "" {
+		sessionName = DefaultSessionName()
+	}
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {in.RoleARN},
+		"RoleSessionName": {sessionName},
+	}
+	if in.Duration > 0 {
+		form.Set("DurationSeconds", strconv.Itoa(int(in.Duration.Seconds())))
+	}
+	if in.Policy != "" {
+		form.Set("Policy", in.Policy)
+	}
+	body := form.Encode()
+	endpoint := o.endpoints.awsSTS(in.Region)
+
+	o.logger.DebugContext(ctx, "assuming role", "roleArn", in.RoleARN, "sessionName", sessionName, "endpoint", endpoint)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	region := in.Region
+	if region == "" {
+		// the global endpoint is in us-east-1
+		region = "us-east-1"
+	}
+	signSTSRequest(req, []byte(body), creds, region, time.Now())
+
+	resp, err := doThrottled(o, req, stsThrottled)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make STS request: %w", err)
+	}
+	defer closeBody(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read STS response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseSTSError(resp, respBody)
+	}
+
+	var res struct {
+		Result struct {
+			Credentials struct {
+				AccessKeyID     string `xml:"AccessKeyId"`
+				SecretAccessKey string
+				SessionToken    string
+				Expiration      time.Time
+			}
+			AssumedRoleUser struct {
+				Arn string
+			}
+		} `xml:"AssumeRoleResult"`
+	}
+	err = xml.Unmarshal(respBody, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode STS response: %w", err)
+	}
+	o.logger.DebugContext(ctx, "assumed role", "arn", res.Result.AssumedRoleUser.Arn, "expiration", res.Result.Credentials.Expiration)
+	return &AWSCredentials{
+		AccessKeyID:     res.Result.Credentials.AccessKeyID,
+		SecretAccessKey: res.Result.Credentials.SecretAccessKey,
+		SessionToken:    res.Result.Credentials.SessionToken,
+		Expiration:      res.Result.Credentials.Expiration,
+		AssumedRoleARN:  res.Result.AssumedRoleUser.Arn,
+	}, nil
+}
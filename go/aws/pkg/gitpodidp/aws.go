@@ -0,0 +1,208 @@
+package gitpodidp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWSAudience is the audience AWS STS expects on web identity tokens.
+const AWSAudience = "sts.amazonaws.com"
+
+// AssumeRoleInput configures AssumeRoleWithWebIdentity.
+type AssumeRoleInput struct {
+	RoleARN string
+	// SessionName defaults to the workspace ID followed by the current unix time.
+	SessionName string
+	// Duration of the session. STS defaults to one hour if it is zero.
+	Duration time.Duration
+	// Region selects a regional STS endpoint. The global endpoint is used if it is empty.
+	Region string
+	// Policy is a JSON session policy, which limits the session to the permissions both it and the role's
+	// policies grant.
+	Policy string
+}
+
+// AWSCredentials are temporary credentials for an assumed role.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+	// AssumedRoleARN is the ARN of the role session, e.g. arn:aws:sts::123456789012:assumed-role/gitpod/session.
+	AssumedRoleARN string
+}
+
+// STSError is an error returned by AWS STS.
+type STSError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *STSError) Error() string {
+	return fmt.Sprintf("STS %s: %s", e.Code, e.Message)
+}
+
+// Is makes STS errors match ErrExchangeRejected.
+func (e *STSError) Is(target error) bool { return target == ErrExchangeRejected }
+
+// parseSTSError returns the *STSError of a failed STS response with body. Responses without an STS error
+// document, e.g. from a proxy, keep their status and body as code and message.
+func parseSTSError(resp *http.Response, body []byte) error {
+	var stsErr struct {
+		Error struct {
+			Code    string
+			Message string
+		}
+	}
+	_ = xml.Unmarshal(body, &stsErr)
+	if stsErr.Error.Code == "" {
+		stsErr.Error.Code = resp.Status
+		stsErr.Error.Message = strings.TrimSpace(string(body))
+	}
+	return &STSError{StatusCode: resp.StatusCode, Code: stsErr.Error.Code, Message: stsErr.Error.Message}
+}
+
+// AssumeRoleWithWebIdentity exchanges a web identity token for temporary AWS credentials. Errors returned by STS
+// are *STSError.
+func AssumeRoleWithWebIdentity(ctx context.Context, token string, in AssumeRoleInput, opts ...Option) (*AWSCredentials, error) {
+	return assumeRoleWithWebIdentity(ctx, newOptions(opts), token, in)
+}
+
+func assumeRoleWithWebIdentity(ctx context.Context, o *options, token string, in AssumeRoleInput) (*AWSCredentials, error) {
+	if in.RoleARN == "" {
+		return nil, ErrRoleNotConfigured
+	}
+	sessionName := in.SessionName
+	if sessionName == "" {
+		sessionName = DefaultSessionName()
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {in.RoleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {token},
+	}
+	if in.Duration > 0 {
+		form.Set("DurationSeconds", strconv.Itoa(int(in.Duration.Seconds())))
+	}
+	if in.Policy != "" {
+		form.Set("Policy", in.Policy)
+	}
+	endpoint := o.endpoints.awsSTS(in.Region)
+
+	o.logger.DebugContext(ctx, "assuming role with web identity", "roleArn", in.RoleARN, "sessionName", sessionName, "endpoint", endpoint)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := doThrottled(o, req, stsThrottled)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make STS request: %w", err)
+	}
+	defer closeBody(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read STS response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseSTSError(resp, body)
+	}
+
+	var res struct {
+		Result struct {
+			Credentials struct {
+				AccessKeyID     string `xml:"AccessKeyId"`
+				SecretAccessKey string
+				SessionToken    string
+				Expiration      time.Time
+			}
+			AssumedRoleUser struct {
+				Arn string
+			}
+		} `xml:"AssumeRoleWithWebIdentityResult"`
+	}
+	err = xml.Unmarshal(body, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode STS response: %w", err)
+	}
+	o.logger.DebugContext(ctx, "assumed role", "arn", res.Result.AssumedRoleUser.Arn, "expiration", res.Result.Credentials.Expiration)
+	return &AWSCredentials{
+		AccessKeyID:     res.Result.Credentials.AccessKeyID,
+		SecretAccessKey: res.Result.Credentials.SecretAccessKey,
+		SessionToken:    res.Result.Credentials.SessionToken,
+		Expiration:      res.Result.Credentials.Expiration,
+		AssumedRoleARN:  res.Result.AssumedRoleUser.Arn,
+	}, nil
+}
+
+// AWSCredentialsForRole obtains a token for the current workspace and exchanges it for credentials of roleARN.
+func AWSCredentialsForRole(ctx context.Context, roleARN string, opts ...Option) (*AWSCredentials, error) {
+	return NewAWS(roleARN, opts...).Credentials(ctx)
+}
+
+// AWS obtains credentials for an AWS role.
+type AWS struct {
+	RoleARN string
+	opts    *options
+}
+
+// NewAWS returns a client for roleARN. WithProfile, WithDuration, WithAudience, WithHTTPClient, WithLogger and
+// WithRefreshMargin apply.
+func NewAWS(roleARN string, opts ...Option) *AWS {
+	return &AWS{RoleARN: roleARN, opts: newOptions(opts)}
+}
+
+// Credentials mints a token for the current workspace and assumes the role with it. With WithProfile, the
+// credentials are written to that profile, too.
+func (a *AWS) Credentials(ctx context.Context) (*AWSCredentials, error) {
+	token, err := getIDToken(ctx, a.opts, a.opts.audienceOr(AWSAudience))
+	if err != nil {
+		return nil, err
+	}
+	creds, err := assumeRoleWithWebIdentity(ctx, a.opts, token, AssumeRoleInput{RoleARN: a.RoleARN, Duration: a.opts.duration})
+	if err != nil {
+		return nil, err
+	}
+	if a.opts.profile != "" {
+		err = WriteAWSProfile(a.opts.profile, creds)
+		if err != nil {
+			return nil, err
+		}
+		a.opts.logger.DebugContext(ctx, "wrote AWS profile", "profile", a.opts.profile)
+	}
+	return creds, nil
+}
+
+// Refresher keeps credentials for the role fresh in the background, writing each of them to the profile if
+// WithProfile is set.
+func (a *AWS) Refresher(ctx context.Context) (*Refresher[*AWSCredentials], error) {
+	return NewRefresher(ctx, func(ctx context.Context) (*AWSCredentials, time.Time, error) {
+		creds, err := a.Credentials(ctx)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return creds, creds.Expiration, nil
+	}, withOptions(a.opts))
+}
+
+// DefaultSessionName returns the workspace ID followed by the current unix time, which makes sessions traceable
+// to workspaces in CloudTrail.
+func DefaultSessionName() string {
+	name := fmt.Sprintf("%s-%d", os.Getenv("GITPOD_WORKSPACE_ID"), time.Now().Unix())
+	// role session names are limited to 64 characters
+	if len(name) > 64 {
+		name = name[len(name)-64:]
+	}
+	return strings.TrimPrefix(name, "-")
+}
@@ -0,0 +1,121 @@
+package gitpodidp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSTS answers every request with status and body.
+type fakeSTS struct {
+	status   int
+	body     string
+	requests []*http.Request
+}
+
+func (f *fakeSTS) Do(req *http.Request) (*http.Response, error) {
+	f.requests = append(f.requests, req)
+	return &http.Response{
+		Status:     http.StatusText(f.status),
+		StatusCode: f.status,
+		Header:     http.Header{"Content-Type": {"text/xml"}},
+		Body:       io.NopCloser(strings.NewReader(f.body)),
+		Request:    req,
+	}, nil
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+const stsErrorDocument = `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>InvalidIdentityToken</Code>
+    <Message>Couldn't retrieve verification key from your identity provider</Message>
+  </Error>
+  <RequestId>c6104cbe-af31-11e0-8154-cbc7ccf896c7</RequestId>
+</ErrorResponse>`
+
+func TestSTSErrors(t *testing.T) {
+	calls := []struct {
+		name string
+		call func(ctx context.Context, opts ...Option) error
+	}{
+		{name: "AssumeRoleWithWebIdentity", call: func(ctx context.Context, opts ...Option) error {
+			_, err := AssumeRoleWithWebIdentity(ctx, "token", AssumeRoleInput{RoleARN: "arn:aws:iam::123456789012:role/gitpod"}, opts...)
+			return err
+		}},
+		{name: "AssumeRole", call: func(ctx context.Context, opts ...Option) error {
+			_, err := AssumeRole(ctx, &AWSCredentials{AccessKeyID: "ASIA", SecretAccessKey: "secret"}, AssumeRoleInput{RoleARN: "arn:aws:iam::123456789012:role/admin"}, opts...)
+			return err
+		}},
+		{name: "GetCallerIdentity", call: func(ctx context.Context, opts ...Option) error {
+			_, err := GetCallerIdentity(ctx, &AWSCredentials{AccessKeyID: "ASIA", SecretAccessKey: "secret"}, "", opts...)
+			return err
+		}},
+	}
+	responses := []struct {
+		name   string
+		status int
+		body   string
+		want   STSError
+	}{
+		{name: "STS error", status: http.StatusBadRequest, body: stsErrorDocument,
+			want: STSError{StatusCode: http.StatusBadRequest, Code: "InvalidIdentityToken", Message: "Couldn't retrieve verification key from your identity provider"}},
+		{name: "not an STS error", status: http.StatusBadGateway, body: " upstream unavailable\n",
+			want: STSError{StatusCode: http.StatusBadGateway, Code: "Bad Gateway", Message: "upstream unavailable"}},
+	}
+	for _, c := range calls {
+		for _, r := range responses {
+			t.Run(c.name+"/"+r.name, func(t *testing.T) {
+				sts := &fakeSTS{status: r.status, body: r.body}
+				err := c.call(context.Background(), WithHTTPClient(sts), WithLogger(discardLogger()))
+
+				var stsErr *STSError
+				if !errors.As(err, &stsErr) {
+					t.Fatalf("error = %v, want *STSError", err)
+				}
+				if *stsErr != r.want {
+					t.Errorf("error = %+v, want %+v", *stsErr, r.want)
+				}
+				if !errors.Is(err, ErrExchangeRejected) {
+					t.Error("the error doesn't match ErrExchangeRejected")
+				}
+				if len(sts.requests) != 1 {
+					t.Errorf("sent %d requests, want 1 through the client of WithHTTPClient", len(sts.requests))
+				}
+			})
+		}
+	}
+}
+
+func TestAssumeRoleWithWebIdentity(t *testing.T) {
+	sts := &fakeSTS{status: http.StatusOK, body: `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult>
+  <Credentials>
+    <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+    <SecretAccessKey>secret</SecretAccessKey>
+    <SessionToken>session</SessionToken>
+    <Expiration>2026-10-14T13:00:00Z</Expiration>
+  </Credentials>
+  <AssumedRoleUser><Arn>arn:aws:sts::123456789012:assumed-role/gitpod/ws</Arn></AssumedRoleUser>
+</AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`}
+	creds, err := AssumeRoleWithWebIdentity(context.Background(), "token", AssumeRoleInput{RoleARN: "arn:aws:iam::123456789012:role/gitpod", SessionName: "ws", Region: "eu-west-1"},
+		WithHTTPClient(sts), WithLogger(discardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AWSCredentials{AccessKeyID: "ASIAEXAMPLE", SecretAccessKey: "secret", SessionToken: "session",
+		Expiration: time.Date(2026, 10, 14, 13, 0, 0, 0, time.UTC), AssumedRoleARN: "arn:aws:sts::123456789012:assumed-role/gitpod/ws"}
+	if *creds != want {
+		t.Errorf("AssumeRoleWithWebIdentity() = %+v, want %+v", *creds, want)
+	}
+	if got := sts.requests[0].URL.Host; got != "sts.eu-west-1.amazonaws.com" {
+		t.Errorf("sent the request to %s, want the regional endpoint", got)
+	}
+}
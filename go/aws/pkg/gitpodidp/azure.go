@@ -0,0 +1,121 @@
+package gitpodidp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AzureAudience is the audience Entra ID expects on federated identity credentials.
+const AzureAudience = "api://AzureADTokenExchange"
+
+// The audiences of federated identity credentials in the national clouds, whose Entra ID has an authority host of
+// its own.
+const (
+	AzureChinaAudience        = "api://AzureADTokenExchangeChina"
+	AzureUSGovernmentAudience = "api://AzureADTokenExchangeUSGov"
+)
+
+// AzureAudienceFor returns the audience federated identity credentials default to in the cloud of the Entra ID
+// authority host, e.g. https://login.chinacloudapi.cn, or AzureAudience for the global cloud and unknown hosts.
+func AzureAudienceFor(authorityHost string) string {
+	host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(authorityHost, "https://"), "http://"), "/")
+	switch host {
+	case "login.chinacloudapi.cn", "login.partner.microsoftonline.cn":
+		return AzureChinaAudience
+	case "login.microsoftonline.us":
+		return AzureUSGovernmentAudience
+	}
+	return AzureAudience
+}
+
+// AzureAccessToken exchanges a workspace identity token for an Entra ID access token for scope, authenticating
+// as the app registration clientID in tenantID using a federated credential.
+func AzureAccessToken(ctx context.Context, tenantID, clientID, token, scope string) (string, error) {
+	res, err := azureAccessToken(ctx, newOptions(nil), tenantID, clientID, token, scope)
+	if err != nil {
+		return "", err
+	}
+	return res.Token, nil
+}
+
+func azureAccessToken(ctx context.Context, o *options, tenantID, clientID, token, scope string) (*OAuthToken, error) {
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {token},
+		"scope":                 {scope},
+	}
+	o.logger.DebugContext(ctx, "requesting Entra ID access token", "tenantId", tenantID, "clientId", clientID, "scope", scope)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s/oauth2/v2.0/token", o.endpoints.entraID(), url.PathEscape(tenantID)), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare Entra ID token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := doThrottled(o, req, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make Entra ID token request: %w", err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, rejectedf("Entra ID rejected the token (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode Entra ID token response: %w", err)
+	}
+	return &OAuthToken{Token: res.AccessToken, Expiry: expiresIn(res.ExpiresIn)}, nil
+}
+
+// Azure obtains Entra ID access tokens for an app registration with a federated credential.
+type Azure struct {
+	TenantID string
+	ClientID string
+	opts     *options
+}
+
+// NewAzure returns a client for the app registration clientID in tenantID. WithAudience, WithHTTPClient,
+// WithLogger and WithRefreshMargin apply.
+func NewAzure(tenantID, clientID string, opts ...Option) *Azure {
+	return &Azure{TenantID: tenantID, ClientID: clientID, opts: newOptions(opts)}
+}
+
+// AccessToken mints a token for the current workspace and exchanges it for an access token for scope, e.g.
+// https://management.azure.com/.default.
+func (a *Azure) AccessToken(ctx context.Context, scope string) (string, error) {
+	res, err := a.accessToken(ctx, scope)
+	if err != nil {
+		return "", err
+	}
+	return res.Token, nil
+}
+
+// Refresher keeps an access token for scope fresh in the background.
+func (a *Azure) Refresher(ctx context.Context, scope string) (*Refresher[OAuthToken], error) {
+	return NewRefresher(ctx, func(ctx context.Context) (OAuthToken, time.Time, error) {
+		res, err := a.accessToken(ctx, scope)
+		if err != nil {
+			return OAuthToken{}, time.Time{}, err
+		}
+		return *res, res.Expiry, nil
+	}, withOptions(a.opts))
+}
+
+func (a *Azure) accessToken(ctx context.Context, scope string) (*OAuthToken, error) {
+	token, err := getIDToken(ctx, a.opts, a.opts.audienceOr(AzureAudienceFor(a.opts.endpoints.entraID())))
+	if err != nil {
+		return nil, err
+	}
+	return azureAccessToken(ctx, a.opts, a.TenantID, a.ClientID, token, scope)
+}
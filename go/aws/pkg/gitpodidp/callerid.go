@@ -0,0 +1,130 @@
+package gitpodidp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CallerIdentity is whom AWS credentials belong to, as STS GetCallerIdentity reports it.
+type CallerIdentity struct {
+	Account string
+	ARN     string
+	UserID  string
+}
+
+// GetCallerIdentity asks STS whom creds belong to, which fails unless they are valid. region selects a regional
+// STS endpoint like for AssumeRoleWithWebIdentity.
+func GetCallerIdentity(ctx context.Context, creds *AWSCredentials, region string, opts ...Option) (*CallerIdentity, error) {
+	o := newOptions(opts)
+	body := url.Values{"Action": {"GetCallerIdentity"}, "Version": {"2011-06-15"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoints.awsSTS(region), strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if region == "" {
+		// the global endpoint is in us-east-1
+		region = "us-east-1"
+	}
+	signSTSRequest(req, []byte(body), creds, region, time.Now())
+
+	resp, err := doThrottled(o, req, stsThrottled)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make STS request: %w", err)
+	}
+	defer closeBody(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read STS response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseSTSError(resp, respBody)
+	}
+	var res struct {
+		Result struct {
+			Account string
+			Arn     string
+			UserID  string `xml:"UserId"`
+		} `xml:"GetCallerIdentityResult"`
+	}
+	err = xml.Unmarshal(respBody, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode STS response: %w", err)
+	}
+	return &CallerIdentity{Account: res.Result.Account, ARN: res.Result.Arn, UserID: res.Result.UserID}, nil
+}
+
+// signSTSRequest signs req, whose body is body, with creds using AWS Signature Version 4.
+func signSTSRequest(req *http.Request, body []byte, creds *AWSCredentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{
+		"content-type": req.Header.Get("Content-Type"),
+		"host":         req.URL.Host,
+		"x-amz-date":   amzDate,
+	}
+	if creds.SessionToken != "" {
+		headers["x-amz-security-token"] = creds.SessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/sts/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(creds, date, region, "sts"), stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsSigningKey derives the Signature Version 4 key of creds for service in region on date (YYYYMMDD).
+func awsSigningKey(creds *AWSCredentials, date, region, service string) []byte {
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,41 @@
+package gitpodidp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claims decodes the claims of a token without verifying its signature. Use it to inspect tokens obtained from
+// GetIDToken, not to authenticate tokens received from elsewhere.
+func Claims(token string) (map[string]interface{}, error) {
+	segs := strings.Split(token, ".")
+	if len(segs) != 3 {
+		return nil, fmt.Errorf("malformed JWT: expected 3 segments, got %d", len(segs))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segs[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %w", err)
+	}
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %w", err)
+	}
+	return claims, nil
+}
+
+// Expiry returns the expiry time of a token, or the zero time if it cannot be determined.
+func Expiry(token string) time.Time {
+	claims, err := Claims(token)
+	if err != nil {
+		return time.Time{}
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(exp), 0)
+}
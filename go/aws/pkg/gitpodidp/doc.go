@@ -0,0 +1,16 @@
+// Package gitpodidp obtains identity tokens for the Gitpod workspace it runs in, and exchanges them for
+// cloud credentials.
+//
+// It talks to the workspace's supervisor and the Gitpod API directly, so Go services and tools can embed it
+// instead of shelling out to the gp CLI:
+//
+//	token, err := gitpodidp.GetIDToken(ctx, "sts.amazonaws.com")
+//	if err != nil {
+//		return err
+//	}
+//	creds, err := gitpodidp.AssumeRoleWithWebIdentity(ctx, token, gitpodidp.AssumeRoleInput{
+//		RoleARN: "arn:aws:iam::123456789012:role/gitpod",
+//	})
+//
+// Note: some of the Gitpod APIs used here are not entirely stable yet and may change without prior notice.
+package gitpodidp
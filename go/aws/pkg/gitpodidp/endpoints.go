@@ -0,0 +1,85 @@
+package gitpodidp
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Endpoints are the URLs of the services the package talks to, for networks which reach them through internal
+// gateways or mirrors. Empty fields select the public endpoints.
+type Endpoints struct {
+	// GitpodAPI is the base URL of the Gitpod API, which defaults to IDP_GITPOD_API_URL or https://api.<host>.
+	GitpodAPI string
+	// AWSSTS replaces https://sts.amazonaws.com/ and the regional STS endpoints.
+	AWSSTS string
+	// GoogleSTS replaces https://sts.googleapis.com/v1/token.
+	GoogleSTS string
+	// GoogleIAMCredentials replaces https://iamcredentials.googleapis.com.
+	GoogleIAMCredentials string
+	// EntraID replaces the authority host https://login.microsoftonline.com.
+	EntraID string
+}
+
+var customEndpoints atomic.Pointer[Endpoints]
+
+// SetEndpoints makes the package use e for all requests which don't pass WithEndpoints.
+func SetEndpoints(e Endpoints) {
+	customEndpoints.Store(&e)
+}
+
+func defaultEndpoints() Endpoints {
+	if e := customEndpoints.Load(); e != nil {
+		return *e
+	}
+	return Endpoints{}
+}
+
+// WithEndpoints overrides the endpoints set with SetEndpoints.
+func WithEndpoints(e Endpoints) Option {
+	return func(o *options) { o.endpoints = e }
+}
+
+func (e Endpoints) awsSTS(region string) string {
+	switch {
+	case e.AWSSTS != "":
+		return e.AWSSTS
+	case region != "":
+		return fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	default:
+		return "https://sts.amazonaws.com/"
+	}
+}
+
+func (e Endpoints) googleSTS() string {
+	if e.GoogleSTS != "" {
+		return e.GoogleSTS
+	}
+	return "https://sts.googleapis.com/v1/token"
+}
+
+func (e Endpoints) googleIAMCredentials() string {
+	if e.GoogleIAMCredentials != "" {
+		return strings.TrimSuffix(e.GoogleIAMCredentials, "/")
+	}
+	return "https://iamcredentials.googleapis.com"
+}
+
+func (e Endpoints) entraID() string {
+	if e.EntraID != "" {
+		return strings.TrimSuffix(e.EntraID, "/")
+	}
+	return "https://login.microsoftonline.com"
+}
+
+// GoogleSTSEndpoint returns the Google STS endpoint set with SetEndpoints, for credential configurations of other
+// tools.
+func GoogleSTSEndpoint() string {
+	return defaultEndpoints().googleSTS()
+}
+
+// GoogleImpersonationURL returns the URL which generates access tokens for serviceAccount, honouring the endpoint
+// set with SetEndpoints.
+func GoogleImpersonationURL(serviceAccount string) string {
+	return fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken", defaultEndpoints().googleIAMCredentials(), serviceAccount)
+}
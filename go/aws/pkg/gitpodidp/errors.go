@@ -0,0 +1,32 @@
+package gitpodidp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors callers can test for with errors.Is. The errors returned by this package wrap them together with the
+// details of what went wrong.
+var (
+	// ErrNotInGitpod means the process does not run in a Gitpod workspace.
+	ErrNotInGitpod = errors.New("not running in a Gitpod workspace")
+	// ErrRoleNotConfigured means there is no role to exchange the token for.
+	ErrRoleNotConfigured = errors.New("no role to assume is configured")
+	// ErrTokenMint means Gitpod did not produce an identity token.
+	ErrTokenMint = errors.New("cannot mint an identity token")
+	// ErrExchangeRejected means the cloud provider refused to exchange the identity token for credentials.
+	ErrExchangeRejected = errors.New("the token exchange was rejected")
+)
+
+// rejectedError is a provider's refusal to exchange a token.
+type rejectedError struct {
+	msg string
+}
+
+func (e *rejectedError) Error() string { return e.msg }
+
+func (e *rejectedError) Is(target error) bool { return target == ErrExchangeRejected }
+
+func rejectedf(format string, args ...interface{}) error {
+	return &rejectedError{msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,160 @@
+package gitpodidp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GCPAudience returns the audience Google expects on tokens for a workload identity pool provider, given its
+// resource name projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>.
+func GCPAudience(workloadIdentityProvider string) string {
+	return "https://iam.googleapis.com/" + workloadIdentityProvider
+}
+
+// GCPExchangeToken exchanges a workspace identity token for a federated Google access token using Google's STS.
+func GCPExchangeToken(ctx context.Context, workloadIdentityProvider, token string) (string, error) {
+	res, err := gcpExchangeToken(ctx, newOptions(nil), workloadIdentityProvider, token)
+	if err != nil {
+		return "", err
+	}
+	return res.Token, nil
+}
+
+func gcpExchangeToken(ctx context.Context, o *options, workloadIdentityProvider, token string) (*OAuthToken, error) {
+	form := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {"//iam.googleapis.com/" + workloadIdentityProvider},
+		"scope":                {"https://www.googleapis.com/auth/cloud-platform"},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token":        {token},
+		"subject_token_type":   {"urn:ietf:params:oauth:token-type:jwt"},
+	}
+	o.logger.DebugContext(ctx, "exchanging token with GCP STS", "workloadIdentityProvider", workloadIdentityProvider)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoints.googleSTS(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare GCP STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := doThrottled(o, req, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make GCP STS request: %w", err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, rejectedf("GCP STS rejected the token (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode GCP STS response: %w", err)
+	}
+	return &OAuthToken{Token: res.AccessToken, Expiry: expiresIn(res.ExpiresIn)}, nil
+}
+
+// GCPImpersonate uses a federated access token to obtain an access token for a service account.
+func GCPImpersonate(ctx context.Context, federatedToken, serviceAccount string) (string, error) {
+	res, err := gcpImpersonate(ctx, newOptions(nil), federatedToken, serviceAccount)
+	if err != nil {
+		return "", err
+	}
+	return res.Token, nil
+}
+
+func gcpImpersonate(ctx context.Context, o *options, federatedToken, serviceAccount string) (*OAuthToken, error) {
+	impersonation := struct {
+		Scope    []string `json:"scope"`
+		Lifetime string   `json:"lifetime,omitempty"`
+	}{
+		Scope: []string{"https://www.googleapis.com/auth/cloud-platform"},
+	}
+	if o.duration > 0 {
+		impersonation.Lifetime = fmt.Sprintf("%ds", int(o.duration.Seconds()))
+	}
+	reqBody, err := json.Marshal(impersonation)
+	if err != nil {
+		return nil, err
+	}
+	o.logger.DebugContext(ctx, "impersonating service account", "serviceAccount", serviceAccount)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken", o.endpoints.googleIAMCredentials(), serviceAccount), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare service account impersonation request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+federatedToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := doThrottled(o, req, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make service account impersonation request: %w", err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, rejectedf("cannot impersonate %s (%s): %s", serviceAccount, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var res struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode service account impersonation response: %w", err)
+	}
+	return &OAuthToken{Token: res.AccessToken, Expiry: res.ExpireTime}, nil
+}
+
+// GCP obtains Google access tokens through a workload identity pool provider.
+type GCP struct {
+	WorkloadIdentityProvider string
+	// ServiceAccount to impersonate. Without one, access tokens are federated tokens of the workspace itself.
+	ServiceAccount string
+	opts           *options
+}
+
+// NewGCP returns a client for the workload identity pool provider, given as
+// projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>. WithDuration (the
+// lifetime of impersonated tokens), WithAudience, WithHTTPClient, WithLogger and WithRefreshMargin apply.
+func NewGCP(workloadIdentityProvider, serviceAccount string, opts ...Option) *GCP {
+	return &GCP{WorkloadIdentityProvider: workloadIdentityProvider, ServiceAccount: serviceAccount, opts: newOptions(opts)}
+}
+
+// AccessToken mints a token for the current workspace and exchanges it for a Google access token.
+func (g *GCP) AccessToken(ctx context.Context) (string, error) {
+	res, err := g.accessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	return res.Token, nil
+}
+
+// Refresher keeps a Google access token fresh in the background.
+func (g *GCP) Refresher(ctx context.Context) (*Refresher[OAuthToken], error) {
+	return NewRefresher(ctx, func(ctx context.Context) (OAuthToken, time.Time, error) {
+		res, err := g.accessToken(ctx)
+		if err != nil {
+			return OAuthToken{}, time.Time{}, err
+		}
+		return *res, res.Expiry, nil
+	}, withOptions(g.opts))
+}
+
+func (g *GCP) accessToken(ctx context.Context) (*OAuthToken, error) {
+	token, err := getIDToken(ctx, g.opts, g.opts.audienceOr(GCPAudience(g.WorkloadIdentityProvider)))
+	if err != nil {
+		return nil, err
+	}
+	federated, err := gcpExchangeToken(ctx, g.opts, g.WorkloadIdentityProvider, token)
+	if err != nil || g.ServiceAccount == "" {
+		return federated, err
+	}
+	return gcpImpersonate(ctx, g.opts, federated.Token, g.ServiceAccount)
+}
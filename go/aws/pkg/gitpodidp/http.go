@@ -0,0 +1,70 @@
+package gitpodidp
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPDoer sends HTTP requests. *http.Client implements it, and so can fakes for tests.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// The time budgets of the phases of a request. Each phase has its own, so that a slow DNS lookup or TLS handshake
+// doesn't eat into the time the server has to respond. RequestTimeout bounds the whole request, including reading
+// the response.
+const (
+	DialTimeout           = 5 * time.Second
+	TLSHandshakeTimeout   = 5 * time.Second
+	ResponseHeaderTimeout = 10 * time.Second
+	RequestTimeout        = 30 * time.Second
+)
+
+// maxDrain is how much of an unread response body closeBody reads to keep the connection alive.
+const maxDrain = 64 << 10
+
+var (
+	defaultHTTPClient HTTPDoer = &http.Client{Timeout: RequestTimeout, Transport: NewTransport()}
+	customHTTPClient  atomic.Pointer[HTTPDoer]
+)
+
+// NewTransport returns a transport with the time budgets above, which keeps connections alive so that the
+// requests of a sign-in, e.g. to the supervisor and then the Gitpod API, reuse them. It honours HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY.
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   TLSHandshakeTimeout,
+		ResponseHeaderTimeout: ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   4,
+	}
+}
+
+// closeBody reads what's left of body before closing it, so that the connection can be reused.
+func closeBody(body io.ReadCloser) {
+	_, _ = io.CopyN(io.Discard, body, maxDrain)
+	body.Close()
+}
+
+// SetHTTPClient makes the package send all requests, to the supervisor, Gitpod and the cloud providers, through c.
+func SetHTTPClient(c HTTPDoer) {
+	customHTTPClient.Store(&c)
+}
+
+func httpClient() HTTPDoer {
+	if c := customHTTPClient.Load(); c != nil {
+		return *c
+	}
+	return defaultHTTPClient
+}
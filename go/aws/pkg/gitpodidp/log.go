@@ -0,0 +1,22 @@
+package gitpodidp
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var logger atomic.Pointer[slog.Logger]
+
+// SetLogger makes the package log to l. Until it is called, the package logs to slog.Default(). The package logs
+// at debug level, except for warnings about throttled requests being retried, failed background renewals and
+// credential files other users could read. Nothing it logs contains tokens or credentials.
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+func log() *slog.Logger {
+	if l := logger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,69 @@
+package gitpodidp
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Option tunes the clients created by NewAWS, NewGCP and NewAzure, refreshers, and the STS calls
+// AssumeRoleWithWebIdentity, AssumeRole and GetCallerIdentity.
+type Option func(*options)
+
+type options struct {
+	profile  string
+	duration time.Duration
+	audience []string
+	client   HTTPDoer
+	logger   *slog.Logger
+
+	endpoints     Endpoints
+	refreshMargin time.Duration
+}
+
+// newOptions applies opts on top of the package defaults set with SetHTTPClient, SetLogger and SetEndpoints.
+func newOptions(opts []Option) *options {
+	o := &options{
+		client:    httpClient(),
+		logger:    log(),
+		endpoints: defaultEndpoints(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithProfile makes NewAWS write the credentials to this profile of the shared credentials file
+// (~/.aws/credentials, or AWS_SHARED_CREDENTIALS_FILE).
+func WithProfile(name string) Option {
+	return func(o *options) { o.profile = name }
+}
+
+// WithDuration sets how long AWS sessions are valid. STS defaults to one hour, and caps the duration at the
+// maximum session duration of the role.
+func WithDuration(d time.Duration) Option {
+	return func(o *options) { o.duration = d }
+}
+
+// WithAudience overrides the audiences of the identity token, which default to what the cloud provider expects.
+func WithAudience(audience ...string) Option {
+	return func(o *options) { o.audience = audience }
+}
+
+// WithHTTPClient sends the requests through c rather than the client set with SetHTTPClient.
+func WithHTTPClient(c HTTPDoer) Option {
+	return func(o *options) { o.client = c }
+}
+
+// WithLogger logs to l rather than the logger set with SetLogger.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) { o.logger = l }
+}
+
+// audienceOr returns the audiences set with WithAudience, or def.
+func (o *options) audienceOr(def ...string) []string {
+	if len(o.audience) > 0 {
+		return o.audience
+	}
+	return def
+}
@@ -0,0 +1,198 @@
+package gitpodidp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// AWSCredentialsFile returns the path of the shared credentials file the AWS CLI and SDKs read.
+func AWSCredentialsFile() (string, error) {
+	if fn := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); fn != "" {
+		return fn, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".aws", "credentials"), nil
+}
+
+// WriteAWSProfile stores creds as profile in the shared credentials file, keeping all other profiles and keys.
+// Only the current user can read the file afterwards.
+func WriteAWSProfile(profile string, creds *AWSCredentials) error {
+	fn, err := AWSCredentialsFile()
+	if err != nil {
+		return err
+	}
+	fc, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	vals := map[string]string{
+		"aws_access_key_id":     creds.AccessKeyID,
+		"aws_secret_access_key": creds.SecretAccessKey,
+		"aws_session_token":     creds.SessionToken,
+	}
+	res := setINIKeys(string(fc), profile, vals)
+
+	err = os.MkdirAll(filepath.Dir(fn), 0700)
+	if err != nil {
+		return err
+	}
+	// file modes don't tell who can read files on Windows
+	if fi, err := os.Stat(fn); err == nil && fi.Mode().Perm()&0077 != 0 && runtime.GOOS != "windows" {
+		log().Warn("other users could access the AWS credentials file, restricting it to you", "path", fn, "mode", fmt.Sprintf("%#o", fi.Mode().Perm()))
+		err = os.Chmod(fn, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	err = replaceFile(fn, []byte(res))
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", fn, err)
+	}
+	return nil
+}
+
+// AWSConfigFile returns the path of the shared config file the AWS CLI and SDKs read settings like the region from.
+func AWSConfigFile() (string, error) {
+	if fn := os.Getenv("AWS_CONFIG_FILE"); fn != "" {
+		return fn, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".aws", "config"), nil
+}
+
+// WriteAWSConfig sets vals, e.g. region, for profile in the shared config file, keeping everything else. Profiles
+// other than default are sections named "profile <name>" there.
+func WriteAWSConfig(profile string, vals map[string]string) error {
+	fn, err := AWSConfigFile()
+	if err != nil {
+		return err
+	}
+	fc, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	section := profile
+	if profile != "default" {
+		section = "profile " + profile
+	}
+	res := setINIKeys(string(fc), section, vals)
+
+	err = os.MkdirAll(filepath.Dir(fn), 0700)
+	if err != nil {
+		return err
+	}
+	err = replaceFile(fn, []byte(res))
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", fn, err)
+	}
+	return nil
+}
+
+// replaceFile writes content to a temporary file next to fn, which then takes fn's place, so that the SDKs never
+// read a partly written file, not even if the process is killed while writing it. fn is only readable by the
+// current user afterwards. Symlinks are followed.
+func replaceFile(fn string, content []byte) error {
+	if target, err := filepath.EvalSymlinks(fn); err == nil {
+		fn = target
+	}
+	f, err := os.CreateTemp(filepath.Dir(fn), "."+filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fn)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// setINIKeys sets vals in section of the INI document doc, replacing existing values and adding the section if
+// it doesn't exist.
+func setINIKeys(doc, section string, vals map[string]string) string {
+	var (
+		lines   = strings.Split(strings.TrimSuffix(doc, "\n"), "\n")
+		res     []string
+		current string
+		found   bool
+		pending = make(map[string]string, len(vals))
+	)
+	if doc == "" {
+		lines = nil
+	}
+	for k, v := range vals {
+		pending[k] = v
+	}
+	// flush adds the keys which weren't replaced to the end of the section, before any blank lines
+	flush := func() {
+		var add []string
+		for _, k := range []string{"aws_access_key_id", "aws_secret_access_key", "aws_session_token"} {
+			if v, ok := pending[k]; ok {
+				add = append(add, k+" = "+v)
+				delete(pending, k)
+			}
+		}
+		for k, v := range pending {
+			add = append(add, k+" = "+v)
+			delete(pending, k)
+		}
+		end := len(res)
+		for end > 0 && strings.TrimSpace(res[end-1]) == "" {
+			end--
+		}
+		res = append(res[:end], append(add, res[end:]...)...)
+	}
+	for _, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			if current == section {
+				flush()
+			}
+			current = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			if current == section {
+				found = true
+			}
+			res = append(res, l)
+			continue
+		}
+		if current == section {
+			if k, _, ok := strings.Cut(trimmed, "="); ok {
+				k = strings.TrimSpace(k)
+				if v, ok := pending[k]; ok {
+					res = append(res, k+" = "+v)
+					delete(pending, k)
+					continue
+				}
+			}
+		}
+		res = append(res, l)
+	}
+	if current == section {
+		flush()
+	}
+	if !found {
+		if len(res) > 0 && res[len(res)-1] != "" {
+			res = append(res, "")
+		}
+		res = append(res, "["+section+"]")
+		flush()
+	}
+	return strings.Join(res, "\n") + "\n"
+}
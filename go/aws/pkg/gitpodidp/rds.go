@@ -0,0 +1,57 @@
+package gitpodidp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RDSAuthTokenLifetime is how long RDS and Aurora accept an IAM authentication token for opening connections.
+// Connections opened with it stay open after it has expired.
+const RDSAuthTokenLifetime = 15 * time.Minute
+
+// RDSAuthToken returns an IAM authentication token for the database user of the RDS or Aurora instance at
+// endpoint, host:port, in region. It's used as the password, and is valid for RDSAuthTokenLifetime, or until
+// creds expire if that's sooner. Like the AWS SDKs, it presigns the connect request locally, without talking to AWS.
+func RDSAuthToken(creds *AWSCredentials, endpoint, region, user string, now time.Time) (string, error) {
+	if !strings.Contains(endpoint, ":") {
+		return "", fmt.Errorf("the endpoint %q has no port", endpoint)
+	}
+	if region == "" {
+		return "", fmt.Errorf("the region of %s is required", endpoint)
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := date + "/" + region + "/rds-db/aws4_request"
+	query := url.Values{
+		"Action":              {"connect"},
+		"DBUser":              {user},
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {creds.AccessKeyID + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {fmt.Sprint(int(RDSAuthTokenLifetime / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if creds.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	// Signature Version 4 escapes spaces as %20, which Encode writes as +
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	emptyHash := sha256.Sum256(nil)
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		"/",
+		canonicalQuery,
+		"host:" + endpoint + "\n",
+		"host",
+		hex.EncodeToString(emptyHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(creds, date, region, "rds-db"), stringToSign))
+	return endpoint + "/?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
@@ -0,0 +1,176 @@
+package gitpodidp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultRefreshMargin is how long before they expire a Refresher renews credentials, unless WithRefreshMargin
+// says otherwise.
+const DefaultRefreshMargin = 5 * time.Minute
+
+const (
+	minRefreshRetry = time.Second
+	maxRefreshRetry = time.Minute
+)
+
+// OAuthToken is an access token and when it expires.
+type OAuthToken struct {
+	Token  string
+	Expiry time.Time
+}
+
+// expiresIn turns the expires_in of an OAuth token response into an expiry. Zero means unknown.
+func expiresIn(seconds int64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+// WithRefreshMargin sets how long before they expire a Refresher renews credentials.
+func WithRefreshMargin(d time.Duration) Option {
+	return func(o *options) { o.refreshMargin = d }
+}
+
+// withOptions starts from the options of an existing client.
+func withOptions(src *options) Option {
+	return func(o *options) { *o = *src }
+}
+
+// Refresher keeps credentials fresh in the background, so long-running programs don't have to track their expiry
+// themselves. Credentials without an expiry are never renewed.
+type Refresher[T any] struct {
+	fetch   func(ctx context.Context) (T, time.Time, error)
+	opts    *options
+	rotated chan T
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu      sync.Mutex
+	current T
+	expiry  time.Time
+	err     error
+}
+
+// NewRefresher obtains credentials with fetch, which also returns when they expire, and renews them in the
+// background until ctx is cancelled or Stop is called. It fails if the first fetch does. WithRefreshMargin and
+// WithLogger apply.
+//
+// AWS.Refresher, GCP.Refresher and Azure.Refresher return refreshers for the credentials of those clients.
+func NewRefresher[T any](ctx context.Context, fetch func(ctx context.Context) (T, time.Time, error), opts ...Option) (*Refresher[T], error) {
+	current, expiry, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Refresher[T]{
+		fetch:   fetch,
+		opts:    newOptions(opts),
+		rotated: make(chan T, 1),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		current: current,
+		expiry:  expiry,
+	}
+	if r.opts.refreshMargin <= 0 {
+		r.opts.refreshMargin = DefaultRefreshMargin
+	}
+	go r.run(ctx)
+	return r, nil
+}
+
+// Current returns the latest credentials.
+func (r *Refresher[T]) Current() T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Expiry returns when the latest credentials expire.
+func (r *Refresher[T]) Expiry() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expiry
+}
+
+// Err returns why the last renewal failed, or nil if it succeeded. Failed renewals are retried with backoff.
+func (r *Refresher[T]) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Rotated receives the credentials each time they are renewed. Receivers which fall behind only get the latest
+// ones. The channel is closed once the refresher stops.
+func (r *Refresher[T]) Rotated() <-chan T {
+	return r.rotated
+}
+
+// Stop stops renewing the credentials and waits for an ongoing renewal to finish.
+func (r *Refresher[T]) Stop() {
+	r.cancel()
+	<-r.done
+}
+
+func (r *Refresher[T]) run(ctx context.Context) {
+	defer close(r.done)
+	defer close(r.rotated)
+
+	retry := minRefreshRetry
+	next, ok := r.nextRefresh()
+	for ok {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		current, expiry, err := r.fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.opts.logger.WarnContext(ctx, "cannot renew credentials", "error", err, "retryIn", retry)
+			r.mu.Lock()
+			r.err = err
+			r.mu.Unlock()
+			next = time.Now().Add(retry)
+			retry = min(2*retry, maxRefreshRetry)
+			continue
+		}
+		retry = minRefreshRetry
+
+		r.mu.Lock()
+		r.current, r.expiry, r.err = current, expiry, nil
+		r.mu.Unlock()
+		r.opts.logger.DebugContext(ctx, "renewed credentials", "expiry", expiry)
+		select {
+		case <-r.rotated:
+		default:
+		}
+		r.rotated <- current
+
+		next, ok = r.nextRefresh()
+	}
+	<-ctx.Done()
+}
+
+// nextRefresh returns when to renew the current credentials: the refresh margin before they expire, or halfway
+// there if they are valid for less than the margin. It reports false if they don't expire.
+func (r *Refresher[T]) nextRefresh() (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.expiry.IsZero() {
+		return time.Time{}, false
+	}
+	lifetime := time.Until(r.expiry)
+	if lifetime <= r.opts.refreshMargin {
+		// don't spin if fetch keeps returning credentials which are about to expire
+		return time.Now().Add(max(lifetime/2, minRefreshRetry)), true
+	}
+	return r.expiry.Add(-r.opts.refreshMargin), true
+}
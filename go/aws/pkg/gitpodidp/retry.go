@@ -0,0 +1,88 @@
+package gitpodidp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MaxThrottleRetries is how often a request the provider throttles is retried before giving up.
+const MaxThrottleRetries = 5
+
+// The bounds of the backoff between retries of throttled requests.
+const (
+	minThrottleBackoff = 500 * time.Millisecond
+	maxThrottleBackoff = 20 * time.Second
+)
+
+// maxThrottledBody is how much of a throttled response is read to tell throttling apart from other errors.
+const maxThrottledBody = 64 << 10
+
+// ThrottleBackoff returns how long to wait before retry n, counting from 0, of a throttled request: exponential
+// with full jitter, so that many workspaces throttled at once, e.g. restarting after an outage, spread out rather
+// than being throttled again together.
+func ThrottleBackoff(n int) time.Duration {
+	ceil := maxThrottleBackoff
+	if n < 10 {
+		ceil = min(minThrottleBackoff<<n, maxThrottleBackoff)
+	}
+	return minThrottleBackoff/2 + time.Duration(rand.Int63n(int64(ceil)))
+}
+
+// stsThrottled recognises the throttling errors of AWS STS, which it answers with 400 rather than 429.
+func stsThrottled(body []byte) bool {
+	for _, code := range []string{"Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException"} {
+		if bytes.Contains(body, []byte("<Code>"+code+"</Code>")) {
+			return true
+		}
+	}
+	return false
+}
+
+// doThrottled sends req like o.client.Do, but retries it with backoff while the provider throttles it: answers
+// 429 or 503, or an error body throttled recognises. Retry-After is honoured within the backoff bounds. Once out
+// of retries, the last response is returned for the caller to report. req's body must be one http.NewRequest can
+// rewind, if it has one.
+func doThrottled(o *options, req *http.Request, throttled func(body []byte) bool) (*http.Response, error) {
+	ctx := req.Context()
+	for n := 0; ; n++ {
+		resp, err := o.client.Do(req)
+		if err != nil || resp.StatusCode == http.StatusOK {
+			return resp, err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxThrottledBody))
+		closeBody(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read response: %w", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		isThrottled := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable ||
+			(throttled != nil && throttled(body))
+		if !isThrottled || n == MaxThrottleRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+
+		wait := ThrottleBackoff(n)
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			wait = min(time.Duration(s)*time.Second, maxThrottleBackoff)
+		}
+		o.logger.WarnContext(ctx, "request throttled, retrying", "host", req.URL.Host, "status", resp.Status, "retryIn", wait, "attempt", n+1)
+		select {
+		case <-ctx.Done():
+			return resp, nil
+		case <-time.After(wait):
+		}
+		next := req.Clone(ctx)
+		if req.GetBody != nil {
+			next.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		req = next
+	}
+}
@@ -0,0 +1,111 @@
+package gitpodidp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Workspace describes the Gitpod workspace the process runs in, as advertised by its environment.
+type Workspace struct {
+	ID             string
+	Host           string
+	SupervisorAddr string
+	// APIURL is the base URL of the Gitpod API, https://api.<host> unless SetEndpoints or IDP_GITPOD_API_URL say
+	// otherwise, e.g. to talk to idp fake-server.
+	APIURL string
+}
+
+// CurrentWorkspace returns the workspace the process runs in.
+func CurrentWorkspace() (*Workspace, error) {
+	if os.Getenv("GITPOD_WORKSPACE_ID") == "" {
+		return nil, ErrNotInGitpod
+	}
+	host, err := url.Parse(os.Getenv("GITPOD_HOST"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Gitpod host url: %w", err)
+	}
+	apiURL := strings.TrimSuffix(defaultEndpoints().GitpodAPI, "/")
+	if apiURL == "" {
+		apiURL = strings.TrimSuffix(os.Getenv("IDP_GITPOD_API_URL"), "/")
+	}
+	if apiURL == "" {
+		apiURL = "https://api." + host.Host
+	}
+	return &Workspace{
+		ID:             os.Getenv("GITPOD_WORKSPACE_ID"),
+		Host:           host.Host,
+		SupervisorAddr: os.Getenv("SUPERVISOR_ADDR"),
+		APIURL:         apiURL,
+	}, nil
+}
+
+// Issuer returns the OIDC issuer of the workspace's identity tokens.
+func (ws *Workspace) Issuer() string {
+	return ws.APIURL + "/idp"
+}
+
+// GetIDToken produces an identity token for the current workspace which is valid for the given audiences.
+func GetIDToken(ctx context.Context, audience ...string) (string, error) {
+	return getIDToken(ctx, newOptions(nil), audience)
+}
+
+func getIDToken(ctx context.Context, o *options, audience []string) (string, error) {
+	ws, err := CurrentWorkspace()
+	if err != nil {
+		return "", err
+	}
+	return ws.getIDToken(ctx, o, audience)
+}
+
+// GetIDToken produces an identity token for ws which is valid for the given audiences. Failures wrap ErrTokenMint.
+func (ws *Workspace) GetIDToken(ctx context.Context, audience ...string) (string, error) {
+	return ws.getIDToken(ctx, newOptions(nil), audience)
+}
+
+func (ws *Workspace) getIDToken(ctx context.Context, o *options, audience []string) (string, error) {
+	if len(audience) == 0 {
+		return "", fmt.Errorf("at least one audience is required")
+	}
+	o.logger.DebugContext(ctx, "minting identity token", "workspace", ws.ID, "audience", audience)
+	token, err := ws.mintIDToken(ctx, o, audience)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTokenMint, err)
+	}
+	return token, nil
+}
+
+func (ws *Workspace) mintIDToken(ctx context.Context, o *options, audience []string) (string, error) {
+	idpReq, err := json.Marshal(struct {
+		WorkspaceID string   `json:"workspace_id"`
+		Audience    []string `json:"audience"`
+	}{
+		WorkspaceID: ws.ID,
+		Audience:    audience,
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal ID token request: %w", err)
+	}
+	resp, err := ws.postAuthorized(ctx, o, "ID token", ws.APIURL+"/gitpod.experimental.v1.IdentityProviderService/GetIDToken", idpReq)
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("ID token request failed (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var idtkn struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&idtkn)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode ID token response: %w", err)
+	}
+	return idtkn.Token, nil
+}
@@ -0,0 +1,104 @@
+package gitpodidp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// AdmissionEveryone is the admission level of a workspace its owner shared, which everyone with its URL can open.
+const AdmissionEveryone = "ADMISSION_LEVEL_EVERYONE"
+
+// Admission returns the admission level of ws's running instance, ADMISSION_LEVEL_OWNER_ONLY unless the owner
+// shared it.
+func (ws *Workspace) Admission(ctx context.Context) (string, error) {
+	info, err := ws.getWorkspace(ctx, newOptions(nil))
+	if err != nil {
+		return "", err
+	}
+	return info.Status.Instance.Status.Admission, nil
+}
+
+// ProjectEnvironmentVariables returns the environment variables of the Gitpod project ws was started for, as they
+// are now rather than when the workspace started. It returns nil for workspaces of no project.
+func (ws *Workspace) ProjectEnvironmentVariables(ctx context.Context) (map[string]string, error) {
+	o := newOptions(nil)
+	info, err := ws.getWorkspace(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	if info.ProjectID == "" {
+		return nil, nil
+	}
+	var res struct {
+		EnvironmentVariables []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"environmentVariables"`
+	}
+	err = ws.callAPI(ctx, o, "gitpod.v1.EnvironmentVariableService/ListConfigurationEnvironmentVariables", struct {
+		ConfigurationID string `json:"configurationId"`
+	}{
+		ConfigurationID: info.ProjectID,
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string, len(res.EnvironmentVariables))
+	for _, v := range res.EnvironmentVariables {
+		vars[v.Name] = v.Value
+	}
+	return vars, nil
+}
+
+// workspaceInfo is the part of a workspace the Gitpod API describes which this package uses.
+type workspaceInfo struct {
+	ProjectID string `json:"projectId"`
+	Status    struct {
+		Instance struct {
+			Status struct {
+				Admission string `json:"admission"`
+			} `json:"status"`
+		} `json:"instance"`
+	} `json:"status"`
+}
+
+func (ws *Workspace) getWorkspace(ctx context.Context, o *options) (*workspaceInfo, error) {
+	var res struct {
+		Result workspaceInfo `json:"result"`
+	}
+	err := ws.callAPI(ctx, o, "gitpod.experimental.v1.WorkspacesService/GetWorkspace", struct {
+		WorkspaceID string `json:"workspaceId"`
+	}{
+		WorkspaceID: ws.ID,
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res.Result, nil
+}
+
+// callAPI calls method of the Gitpod API with the workspace's API token, decoding the response into res.
+func (ws *Workspace) callAPI(ctx context.Context, o *options, method string, in, res interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("cannot marshal %s request: %w", method, err)
+	}
+	resp, err := ws.postAuthorized(ctx, o, method, ws.APIURL+"/"+method, body)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s request failed (%s): %s", method, resp.Status, strings.TrimSpace(string(body)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		return fmt.Errorf("cannot decode %s response: %w", method, err)
+	}
+	return nil
+}
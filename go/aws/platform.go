@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// filePermissionsApply reports whether Unix permissions decide who can read files. On Windows, the ACLs of the
+// user's profile do, and file modes only reflect the read-only attribute.
+func filePermissionsApply() bool {
+	return runtime.GOOS != "windows"
+}
+
+// executableName returns the file name of the executable name, which has an .exe extension on Windows.
+func executableName(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// commandName returns the name the executable fn is run by, which on Windows is without its extension.
+func commandName(fn string) string {
+	name := filepath.Base(fn)
+	if runtime.GOOS == "windows" {
+		ext := filepath.Ext(name)
+		if windowsExecutableExt(ext) {
+			name = strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// isExecutable reports whether the file fi describes can be run: if it has an execute bit set, or on Windows if
+// its extension is one of PATHEXT.
+func isExecutable(fi os.FileInfo) bool {
+	if !fi.Mode().IsRegular() {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return windowsExecutableExt(filepath.Ext(fi.Name()))
+	}
+	return fi.Mode().Perm()&0o111 != 0
+}
+
+func windowsExecutableExt(ext string) bool {
+	if ext == "" {
+		return false
+	}
+	pathext := os.Getenv("PATHEXT")
+	if pathext == "" {
+		pathext = ".com;.exe;.bat;.cmd"
+	}
+	for _, e := range filepath.SplitList(pathext) {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// shellCommand returns the command which runs script in sh. On Windows without sh, e.g. that of Git for Windows,
+// cmd.exe runs it instead.
+func shellCommand(script string) (string, []string) {
+	if runtime.GOOS == "windows" {
+		if _, err := runner.LookPath("sh"); err != nil {
+			return "cmd.exe", []string{"/d", "/c", script}
+		}
+	}
+	return "sh", []string{"-c", script}
+}
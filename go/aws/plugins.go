@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pluginPrefix is the prefix of executables on PATH which provide additional providers. idp-provider-pki provides
+// the provider pki.
+const pluginPrefix = "idp-provider-"
+
+// pluginProtocolVersion is sent with every request so plugins can reject requests they don't understand.
+const pluginProtocolVersion = 1
+
+// describeTimeout bounds the describe call, which runs when a command asks whether the plugin is configured and
+// there is no cached description.
+const describeTimeout = 5 * time.Second
+
+// pluginRequest is written to the plugin's stdin. The action is also passed as its only argument.
+type pluginRequest struct {
+	Version int    `json:"version"`
+	Action  string `json:"action"`
+	// Token is an identity token for the audience the plugin asked for, on login.
+	Token string `json:"token,omitempty"`
+	// Revoke asks the plugin to revoke its credentials, on logout.
+	Revoke bool `json:"revoke,omitempty"`
+	// Settings are all IDP_<NAME>_* settings and the settings the plugin requires.
+	Settings map[string]string `json:"settings"`
+}
+
+// pluginResponse is read from the plugin's stdout. Which fields are used depends on the action.
+type pluginResponse struct {
+	// describe
+	Audience         string   `json:"audience,omitempty"`
+	RequiredSettings []string `json:"requiredSettings,omitempty"`
+	// describe, login and whoami
+	Identity string `json:"identity,omitempty"`
+	// login
+	Expiry time.Time         `json:"expiry,omitempty"`
+	Env    map[string]string `json:"env,omitempty"`
+}
+
+// pluginProvider drives an idp-provider-* executable.
+type pluginProvider struct {
+	name string
+	path string
+
+	describeOnce sync.Once
+	description  pluginResponse
+	describeErr  error
+}
+
+// discoverPlugins adds a provider for every idp-provider-* executable on PATH. Where several have the same name,
+// the first one on PATH wins, and none replaces a built-in provider.
+func discoverPlugins() {
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name, ok := strings.CutPrefix(commandName(e.Name()), pluginPrefix)
+			if !ok || name == "" || name == "all" {
+				continue
+			}
+			if _, exists := findProvider(name); exists {
+				continue
+			}
+			fn := filepath.Join(dir, e.Name())
+			if fi, err := os.Stat(fn); err != nil || !isExecutable(fi) {
+				continue
+			}
+			slog.Debug("found provider plugin", "provider", name, "path", fn)
+			providers = append(providers, (&pluginProvider{name: name, path: fn}).provider())
+		}
+	}
+}
+
+func (pp *pluginProvider) provider() provider {
+	return provider{
+		Name:     pp.name,
+		Missing:  pp.missing,
+		Login:    pp.login,
+		Whoami:   pp.whoami,
+		Logout:   pp.logout,
+		Env:      pp.env,
+		Identity: pp.identity,
+	}
+}
+
+// call runs the plugin for action and decodes its response. A plugin fails by exiting non-zero, with the reason on
+// stderr.
+func (pp *pluginProvider) call(ctx context.Context, req pluginRequest) (*pluginResponse, error) {
+	req.Version = pluginProtocolVersion
+	req.Settings = pp.settings()
+	in, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	out, err := runner.Pipe(ctx, in, pp.path, req.Action)
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("%s %s: %w: %s", filepath.Base(pp.path), req.Action, err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, fmt.Errorf("%s %s: %w", filepath.Base(pp.path), req.Action, err)
+	}
+	var res pluginResponse
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return &res, nil
+	}
+	err = json.Unmarshal(out, &res)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: cannot decode response: %w", filepath.Base(pp.path), req.Action, err)
+	}
+	return &res, nil
+}
+
+// settingsPrefix is the prefix of the settings passed to the plugin, e.g. IDP_INTERNAL_PKI_ for internal-pki.
+func (pp *pluginProvider) settingsPrefix() string {
+	return "IDP_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(pp.name)) + "_"
+}
+
+// settings returns the settings passed to the plugin: those with its prefix, from wherever setting reads them, and
+// those it requires.
+func (pp *pluginProvider) settings() map[string]string {
+	return pp.settingsRequiring(pp.description.RequiredSettings)
+}
+
+// settingsRequiring returns the settings with the plugin's prefix and the required ones.
+func (pp *pluginProvider) settingsRequiring(required []string) map[string]string {
+	res := make(map[string]string)
+	prefix := pp.settingsPrefix()
+	var names []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		names = append(names, k)
+	}
+	names = append(names, sortedKeys(cfg.settings())...)
+	names = append(names, sortedKeys(environmentSettings())...)
+	for _, n := range names {
+		if !strings.HasPrefix(n, prefix) {
+			continue
+		}
+		if v := setting(n); v != "" {
+			res[n] = v
+		}
+	}
+	for _, n := range required {
+		if v := setting(n); v != "" {
+			res[n] = v
+		}
+	}
+	return res
+}
+
+// describe asks the plugin once which audience and settings it needs. The answer is cached on disk until the
+// plugin or its settings change, so that commands on the hot path, like env --login in a shell profile, don't
+// have to run it.
+func (pp *pluginProvider) describe() (*pluginResponse, error) {
+	pp.describeOnce.Do(func() {
+		if desc, ok := pp.cachedDescription(); ok {
+			pp.description = *desc
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), describeTimeout)
+		defer cancel()
+		res, err := pp.call(ctx, pluginRequest{Action: "describe"})
+		if err != nil {
+			pp.describeErr = err
+			return
+		}
+		pp.description = *res
+		if err := pp.cacheDescription(); err != nil {
+			slog.Debug("cannot cache the plugin description", "provider", pp.name, "error", err)
+		}
+	})
+	return &pp.description, pp.describeErr
+}
+
+// cachedDescription is the description of a plugin as cached on disk, with what it depends on.
+type cachedDescription struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Settings is a hash of the settings the plugin was described with, which may be secret.
+	Settings    string         `json:"settings"`
+	Description pluginResponse `json:"description"`
+}
+
+func (pp *pluginProvider) describeCachePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "plugins", pp.name+"-describe.json"), nil
+}
+
+// describeDependencies returns what the cached description of the plugin must match to be used, with the settings
+// it requires according to that description.
+func (pp *pluginProvider) describeDependencies(required []string) (cachedDescription, error) {
+	fi, err := os.Stat(pp.path)
+	if err != nil {
+		return cachedDescription{}, err
+	}
+	settings, err := json.Marshal(pp.settingsRequiring(required))
+	if err != nil {
+		return cachedDescription{}, err
+	}
+	sum := sha256.Sum256(settings)
+	return cachedDescription{Size: fi.Size(), ModTime: fi.ModTime().UTC(), Settings: hex.EncodeToString(sum[:])}, nil
+}
+
+func (pp *pluginProvider) cachedDescription() (*pluginResponse, bool) {
+	fn, err := pp.describeCachePath()
+	if err != nil {
+		return nil, false
+	}
+	fc, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, false
+	}
+	var cached cachedDescription
+	if json.Unmarshal(fc, &cached) != nil {
+		return nil, false
+	}
+	deps, err := pp.describeDependencies(cached.Description.RequiredSettings)
+	if err != nil || deps.Size != cached.Size || !deps.ModTime.Equal(cached.ModTime) || deps.Settings != cached.Settings {
+		return nil, false
+	}
+	return &cached.Description, true
+}
+
+func (pp *pluginProvider) cacheDescription() error {
+	cached, err := pp.describeDependencies(pp.description.RequiredSettings)
+	if err != nil {
+		return err
+	}
+	cached.Description = pp.description
+	fc, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	fn, err := pp.describeCachePath()
+	if err != nil {
+		return err
+	}
+	return writeSecretFile(fn, fc)
+}
+
+func (pp *pluginProvider) missing() []string {
+	desc, err := pp.describe()
+	if err != nil {
+		slog.Warn("cannot describe provider plugin", "provider", pp.name, "error", err)
+		return []string{filepath.Base(pp.path) + " describe"}
+	}
+	return missingSettings(desc.RequiredSettings...)
+}
+
+func (pp *pluginProvider) identity() string {
+	desc, err := pp.describe()
+	if err != nil {
+		return ""
+	}
+	return desc.Identity
+}
+
+// envPath is where the environment a plugin returned on login is kept, sealed with the cache key.
+func (pp *pluginProvider) envPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "plugins", pp.name+"-env.json"), nil
+}
+
+func (pp *pluginProvider) login(ctx context.Context) error {
+	desc, err := pp.describe()
+	if err != nil {
+		return withExitCode(exitMissingConfig, err)
+	}
+	req := pluginRequest{Action: "login"}
+	audience := desc.Audience
+	if v := setting(pp.settingsPrefix() + "AUDIENCE"); v != "" {
+		audience = v
+	}
+	if audience != "" {
+		req.Token, err = gitpodIDToken(ctx, audience)
+		if err != nil {
+			return err
+		}
+	}
+	var res *pluginResponse
+	err = traceStep(ctx, "exchange token", func(ctx context.Context) error {
+		return withProgress("signing into "+pp.name, func() (err error) {
+			res, err = pp.call(ctx, req)
+			return err
+		})
+	}, "idp.method", "plugin")
+	if err != nil {
+		return withExitCode(exitExchangeFailed, err)
+	}
+	emitEvent(eventExchangeSucceeded, pp.name, "identity", res.Identity)
+
+	fn, err := pp.envPath()
+	if err != nil {
+		return err
+	}
+	env, err := json.Marshal(res.Env)
+	if err != nil {
+		return err
+	}
+	err = writeSealedFile(fn, env)
+	wipe(env)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write the environment of %s: %w", pp.name, err)
+	}
+
+	// record the identity the configuration asks for, so that env --login can tell whether it changed
+	identity := desc.Identity
+	if identity == "" {
+		identity = res.Identity
+	}
+	recordLogin(credentialRecord{Provider: pp.name, Identity: identity, IssuedAt: time.Now(), Expiry: res.Expiry})
+	return nil
+}
+
+func (pp *pluginProvider) whoami(ctx context.Context) (string, error) {
+	res, err := pp.call(ctx, pluginRequest{Action: "whoami"})
+	if err != nil {
+		return "", err
+	}
+	return res.Identity, nil
+}
+
+func (pp *pluginProvider) env() (map[string]string, error) {
+	fn, err := pp.envPath()
+	if err != nil {
+		return nil, err
+	}
+	content, err := readSealedFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the environment of %s, sign in again: %w", pp.name, err)
+	}
+	defer wipe(content)
+	var res map[string]string
+	err = json.Unmarshal(content, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", fn, err)
+	}
+	return res, nil
+}
+
+func (pp *pluginProvider) logout(ctx context.Context, revoke bool) error {
+	_, err := pp.call(ctx, pluginRequest{Action: "logout", Revoke: revoke})
+	if err != nil {
+		return err
+	}
+	fn, err := pp.envPath()
+	if err != nil {
+		return err
+	}
+	return removeFiles(fn)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakePlugin answers the plugin idp-provider-pki with the response to each action, and mints tokens like gp.
+func fakePlugin(responses map[string]string) func(name string, args ...string) ([]byte, error) {
+	return func(name string, args ...string) ([]byte, error) {
+		if name == "/fake/plugins/idp-provider-pki" && len(args) == 1 {
+			return []byte(responses[args[0]]), nil
+		}
+		return fakeGitpodToken(name, args...)
+	}
+}
+
+func TestPluginSettings(t *testing.T) {
+	testWorkspace(t, &fakeRunner{})
+	cfg = &config{Environments: environmentsConfig{"staging": {"IDP_PKI_URL": "https://pki.staging.example", "IDP_PKI_ROLE": "dev"}}}
+	t.Setenv("IDP_ENVIRONMENT", "staging")
+	t.Setenv("IDP_PKI_ROLE", "admin")
+	t.Setenv("IDP_PKI_EMPTY", "")
+	t.Setenv("IDP_PKIX_OTHER", "other")
+	t.Setenv("IDP_CA", "https://ca.example")
+	pp := &pluginProvider{name: "pki", path: "/fake/plugins/idp-provider-pki"}
+	pp.description.RequiredSettings = []string{"IDP_CA"}
+
+	got := pp.settings()
+	want := map[string]string{
+		"IDP_PKI_URL":  "https://pki.staging.example",
+		"IDP_PKI_ROLE": "dev",
+		"IDP_CA":       "https://ca.example",
+	}
+	if len(got) != len(want) {
+		t.Errorf("settings() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("settings()[%s] = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestPluginDescriptionCached(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "idp-provider-pki")
+	var described int
+	testWorkspace(t, &fakeRunner{run: func(name string, args ...string) ([]byte, error) {
+		if name == fn && len(args) == 1 && args[0] == "describe" {
+			described++
+			return []byte(`{"requiredSettings": ["IDP_CA"]}`), nil
+		}
+		return fakeGitpodToken(name, args...)
+	}})
+	if err := os.WriteFile(fn, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("IDP_PKI_URL", "https://pki.example")
+	t.Setenv("IDP_CA", "https://ca.example")
+
+	describe := func() {
+		t.Helper()
+		pp := &pluginProvider{name: "pki", path: fn}
+		if _, err := pp.describe(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	describe()
+	describe()
+	if described != 1 {
+		t.Errorf("described the plugin %d times, want once and then from the cache", described)
+	}
+	t.Setenv("IDP_CA", "https://other-ca.example")
+	describe()
+	if described != 2 {
+		t.Errorf("described the plugin %d times, want again after a setting it requires changed", described)
+	}
+}
+
+func TestPluginLoginAudience(t *testing.T) {
+	tests := []struct {
+		name     string
+		describe string
+		audience string
+		want     string
+	}{
+		{name: "asked for", describe: `{"audience": "pki"}`, want: "pki"},
+		{name: "overridden", describe: `{"audience": "pki"}`, audience: "pki.example", want: "pki.example"},
+		{name: "set although the plugin asks for none", describe: `{}`, audience: "pki.example", want: "pki.example"},
+		{name: "none", describe: `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeRunner{run: fakePlugin(map[string]string{"describe": tt.describe, "login": `{"identity": "jane"}`})}
+			testWorkspace(t, r)
+			t.Setenv("IDP_PKI_AUDIENCE", tt.audience)
+			pp := &pluginProvider{name: "pki", path: "/fake/plugins/idp-provider-pki"}
+
+			err := pp.login(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if r.ran("gp idp token") {
+					t.Error("minted a token although no audience is configured")
+				}
+			} else if !r.ran("gp idp token --audience " + tt.want) {
+				t.Errorf("ran %q, want a token for %s", r.calls, tt.want)
+			}
+			var req pluginRequest
+			err = json.Unmarshal(r.stdin, &req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (req.Token != "") != (tt.want != "") {
+				t.Errorf("the login request has token %q, want one %v", req.Token, tt.want != "")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var confirmPrivilegedFlag = flag.Bool("confirm-privileged", false, "assume roles the policy marks as privileged without asking")
+
+// rolePatterns returns the comma-separated role patterns of the setting name.
+func rolePatterns(name string) []string {
+	var res []string
+	for _, p := range strings.Split(setting(name), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// matchesRolePattern reports whether roleARN matches any of patterns, in which * matches any sequence of
+// characters, including slashes of role paths.
+func matchesRolePattern(roleARN string, patterns []string) bool {
+	for _, p := range patterns {
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*") + "$"
+		if ok, _ := regexp.MatchString(expr, roleARN); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRoleAllowed fails if the policy doesn't allow assuming roleARN.
+func checkRoleAllowed(roleARN string) error {
+	allowed := rolePatterns("IDP_AWS_ALLOWED_ROLES")
+	if len(allowed) == 0 || matchesRolePattern(roleARN, allowed) {
+		return nil
+	}
+	return exitErrorf(exitMissingConfig, "the policy does not allow assuming %s (allowed: %s)", roleARN, strings.Join(allowed, ", "))
+}
+
+// checkRefreshAllowed fails if the policy doesn't allow renewing credentials for roleARN. Approvals are given for
+// the credentials of one login, so roles which require approval aren't refreshed; signing in again asks anew.
+func checkRefreshAllowed(ctx context.Context, roleARN string) error {
+	if requiresApproval(roleARN) {
+		return exitErrorf(exitMissingConfig, "%s requires approval, which covers one login only - run idp login aws to ask again", roleARN)
+	}
+	return checkRoleAllowed(roleARN)
+}
+
+// confirmRole checks roleARN against the policy, asks the user to confirm assuming it if it is privileged, and
+// waits for the approvers if it requires approval.
+func confirmRole(ctx context.Context, roleARN string) error {
+	err := checkRoleAllowed(roleARN)
+	if err != nil {
+		return err
+	}
+	if requiresApproval(roleARN) {
+		return awaitApproval(ctx, roleARN)
+	}
+	if *confirmPrivilegedFlag || !matchesRolePattern(roleARN, rolePatterns("IDP_AWS_PRIVILEGED_ROLES")) {
+		return nil
+	}
+	p, err := newPrompter()
+	if err != nil {
+		return exitErrorf(exitUsage, "%s is a privileged role, pass -confirm-privileged to assume it without a terminal", roleARN)
+	}
+	ok, err := p.confirm(fmt.Sprintf("%s is a privileged role. Do you really want to assume it?", roleARN), false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("not assuming the privileged role %s", roleARN)
+	}
+	return nil
+}
+
+// readOnlySignin returns a login into IDP_AWS_READONLY_ROLE_ARN instead of the configured roles, for the policies
+// which downgrade AWS sign-ins, explaining why with reason.
+func readOnlySignin(p provider, reason string) func(ctx context.Context) error {
+	role := setting("IDP_AWS_READONLY_ROLE_ARN")
+	if *roleFlag != role {
+		printWarning("%s, so signing into the read-only role %s", reason, role)
+		// as if -role had been given, which takes precedence over profiles and IDP_AWS_ROLE_ARN
+		*roleFlag = role
+		awsRoleResolved = false
+	}
+	// a fresh login, as refreshing would renew the role the credentials were issued for
+	return p.Login
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// projectSettingNames are the settings admins can manage centrally as environment variables of the Gitpod project,
+// which apply where neither the environment nor the config file sets them.
+var projectSettingNames = []string{"IDP_AWS_ROLE_ARN", "IDP_AWS_PROFILES"}
+
+// projectSettingsMaxAge is how long the project's settings are cached, so that only the first command in a while
+// asks the Gitpod API for them.
+const projectSettingsMaxAge = 5 * time.Minute
+
+// projectSettingsTimeout bounds how long a command waits for the Gitpod API to list the project's variables.
+const projectSettingsTimeout = 5 * time.Second
+
+var projectSettings struct {
+	once sync.Once
+	vals map[string]string
+}
+
+// projectSetting returns the value the Gitpod project's variables give name, if it's one of projectSettingNames.
+// Unlike the variables Gitpod sets when the workspace starts, these follow changes admins make later on.
+// IDP_PROJECT_SETTINGS=false turns the lookup off.
+func projectSetting(name string) string {
+	known := false
+	for _, n := range projectSettingNames {
+		known = known || n == name
+	}
+	if !known || os.Getenv("IDP_PROJECT_SETTINGS") == "false" {
+		return ""
+	}
+	projectSettings.once.Do(func() {
+		projectSettings.vals = loadProjectSettings()
+	})
+	return projectSettings.vals[name]
+}
+
+func projectSettingsPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "project-settings.json"), nil
+}
+
+// loadProjectSettings returns the project's settings, from the cache if it's recent and from the Gitpod API
+// otherwise. Failing to get them isn't an error: the settings are missing as they would be without a project.
+func loadProjectSettings() map[string]string {
+	ws, err := gitpodidp.CurrentWorkspace()
+	if err != nil {
+		return nil
+	}
+	fn, err := projectSettingsPath()
+	if err != nil {
+		return nil
+	}
+	if fi, err := os.Stat(fn); err == nil && time.Since(fi.ModTime()) < projectSettingsMaxAge {
+		var res map[string]string
+		if fc, err := os.ReadFile(fn); err == nil && json.Unmarshal(fc, &res) == nil {
+			return res
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), projectSettingsTimeout)
+	defer cancel()
+	vars, err := ws.ProjectEnvironmentVariables(ctx)
+	if err != nil {
+		slog.Debug("cannot get the settings of the Gitpod project", "error", err)
+		return nil
+	}
+	res := make(map[string]string)
+	for _, name := range projectSettingNames {
+		if v := vars[name]; v != "" {
+			res[name] = v
+		}
+	}
+	fc, err := json.Marshal(res)
+	if err == nil {
+		err = writeSecretFile(fn, fc)
+	}
+	if err != nil {
+		slog.Debug("cannot cache the settings of the Gitpod project", "error", err)
+	}
+	return res
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "prompt",
+		Usage:   "prompt [--tmux] [--snippet starship|p10k|tmux]",
+		Summary: "print the active AWS profile and minutes to expiry for shell prompts, or all identities for tmux",
+		Run:     runPrompt,
+	})
+}
+
+const starshipSnippet = `# ~/.config/starship.toml
+[custom.gitpod_idp]
+command = "idp prompt"
+when = true
+format = "[$output]($style) "
+style = "yellow"
+`
+
+const p10kSnippet = `# ~/.p10k.zsh - and add gitpod_idp to POWERLEVEL9K_RIGHT_PROMPT_ELEMENTS
+function prompt_gitpod_idp() {
+  local out
+  out=$(idp prompt 2>/dev/null)
+  [[ -n $out ]] && p10k segment -f 208 -t "$out"
+}
+`
+
+const tmuxSnippet = `# ~/.tmux.conf
+set -g status-interval 15
+set -g status-right '#(idp prompt --tmux) %H:%M'
+`
+
+// runPrompt is called on every prompt render, so it only reads the credential record: no subprocesses, no network.
+func runPrompt(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("prompt", flag.ExitOnError)
+	snippet := flags.String("snippet", "", "print a prompt configuration snippet for starship, p10k or tmux instead")
+	tmux := flags.Bool("tmux", false, "print the identities and minutes to expiry of all providers signed into, with tmux colours")
+	_ = flags.Parse(args)
+
+	switch *snippet {
+	case "":
+	case "starship":
+		fmt.Print(starshipSnippet)
+		return nil
+	case "p10k":
+		fmt.Print(p10kSnippet)
+		return nil
+	case "tmux":
+		fmt.Print(tmuxSnippet)
+		return nil
+	default:
+		return exitErrorf(exitUsage, "unknown snippet %q: use starship, p10k or tmux", *snippet)
+	}
+	if *tmux {
+		printTmuxStatus()
+		return nil
+	}
+
+	rec, err := loadCredentialRecord("aws")
+	if err != nil || rec == nil {
+		// print nothing so that the prompt segment disappears
+		return nil
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	if rec.Expiry.IsZero() {
+		fmt.Printf("aws:%s\n", profile)
+		return nil
+	}
+	left := time.Until(rec.Expiry)
+	if left <= 0 {
+		fmt.Printf("aws:%s (expired)\n", profile)
+		return nil
+	}
+	fmt.Printf("aws:%s (%dm)\n", profile, int(left.Minutes()))
+	return nil
+}
+
+// tmuxStatusEntry is a provider signed into, as kept in the tmux status cache.
+type tmuxStatusEntry struct {
+	Provider string    `json:"provider"`
+	Identity string    `json:"identity"`
+	Expiry   time.Time `json:"expiry,omitempty"`
+}
+
+// printTmuxStatus prints e.g. "aws:deploy 42m gcp:ci 12m", with those about to expire in yellow and the expired
+// in red. tmux runs it every few seconds in every session, so it reads the plain cache of the credential records
+// rather than unsealing them, and the minutes are worked out anew each time.
+func printTmuxStatus() {
+	entries, err := tmuxStatusEntries()
+	if err != nil {
+		// print nothing so that the status line only loses the segment
+		return
+	}
+	var parts []string
+	for _, e := range entries {
+		part := e.Provider + ":" + shortIdentity(e.Identity)
+		if !e.Expiry.IsZero() {
+			left := time.Until(e.Expiry)
+			switch {
+			case left <= 0:
+				part = "#[fg=red]" + part + " expired#[default]"
+			case left < 15*time.Minute:
+				part = fmt.Sprintf("#[fg=yellow]%s %dm#[default]", part, int(left.Minutes()))
+			default:
+				part = fmt.Sprintf("%s %dm", part, int(left.Minutes()))
+			}
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) > 0 {
+		fmt.Println(strings.Join(parts, " "))
+	}
+}
+
+// tmuxStatusEntries returns the providers signed into from the cache, or from the credential records if any of
+// them is newer than the cache, which it then updates.
+func tmuxStatusEntries() ([]tmuxStatusEntry, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	cacheFile := filepath.Join(dir, "tmux-status.json")
+	if cached, err := os.Stat(cacheFile); err == nil {
+		var entries []tmuxStatusEntry
+		fc, err := os.ReadFile(cacheFile)
+		if err == nil && json.Unmarshal(fc, &entries) == nil && tmuxCacheFresh(entries, cached.ModTime()) {
+			return entries, nil
+		}
+	}
+
+	entries := []tmuxStatusEntry{}
+	for _, p := range providers {
+		rec, err := loadCredentialRecord(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			entries = append(entries, tmuxStatusEntry{Provider: p.Name, Identity: rec.Identity, Expiry: rec.Expiry})
+		}
+	}
+	fc, err := json.Marshal(entries)
+	if err == nil {
+		// without the cache the status is only slower
+		_ = writeSecretFile(cacheFile, fc)
+	}
+	return entries, nil
+}
+
+// tmuxCacheFresh reports whether the cached entries are those of the credential records: no record was written
+// since the cache, and none was added or removed.
+func tmuxCacheFresh(entries []tmuxStatusEntry, cached time.Time) bool {
+	n := 0
+	for _, p := range providers {
+		fn, err := credentialRecordPath(p.Name)
+		if err != nil {
+			return false
+		}
+		st, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		if !st.ModTime().Before(cached) || n >= len(entries) || entries[n].Provider != p.Name {
+			return false
+		}
+		n++
+	}
+	return n == len(entries)
+}
+
+// shortIdentity shortens identities for the tmux status line: role and service account names without their
+// account, and other long ones cut off.
+func shortIdentity(identity string) string {
+	if i := strings.Index(identity, ":role/"); i >= 0 && !strings.Contains(identity, ",") {
+		identity = identity[strings.LastIndex(identity, "/")+1:]
+	} else if i := strings.Index(identity, "@"); i > 0 {
+		identity = identity[:i]
+	}
+	if len(identity) > 24 {
+		identity = identity[:23] + "…"
+	}
+	return identity
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "providers",
+		Usage:   "providers list",
+		Summary: "list supported providers and the configuration they are missing",
+		Run:     runProviders,
+	})
+}
+
+type providerInfo struct {
+	Name       string   `json:"name"`
+	Configured bool     `json:"configured"`
+	Missing    []string `json:"missing,omitempty"`
+	// Audience is the audience of the provider's identity tokens, its preset unless the configuration overrides it.
+	Audience string `json:"audience,omitempty"`
+}
+
+func runProviders(ctx context.Context, args []string) error {
+	if len(args) > 0 && args[0] != "list" {
+		return exitErrorf(exitUsage, "unknown providers subcommand %q", args[0])
+	}
+
+	var res []providerInfo
+	for _, p := range providers {
+		missing := p.Missing()
+		res = append(res, providerInfo{Name: p.Name, Configured: len(missing) == 0, Missing: missing, Audience: providerAudience(p.Name)})
+	}
+	return writeOutput(res, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, p := range res {
+			status := "configured"
+			if !p.Configured {
+				status = "missing " + strings.Join(p.Missing, ", ")
+			}
+			if p.Audience != "" {
+				status += "\taudience " + p.Audience
+			}
+			fmt.Fprintf(w, "%s\t%s\n", p.Name, status)
+		}
+		return w.Flush()
+	})
+}
+
+// missingSettings returns the names of all given settings which are neither set in the environment nor in the config file.
+func missingSettings(names ...string) []string {
+	var res []string
+	for _, n := range names {
+		if setting(n) == "" {
+			res = append(res, n)
+		}
+	}
+	return res
+}
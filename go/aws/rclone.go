@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "rclone",
+		Usage:   "rclone configure [--prefix gitpod-] [--azure-storage-account name] [aws|gcp|azure...]",
+		Summary: "write rclone remotes for S3, Google Cloud Storage and Azure Blob Storage which use the signed-in credentials",
+		Run:     runRclone,
+	})
+}
+
+// defaultRclonePrefix starts the names of the remotes, e.g. gitpod-s3, so that they don't clash with the user's.
+const defaultRclonePrefix = "gitpod-"
+
+// rcloneConfig makes login write rclone remotes for the providers signed into.
+type rcloneConfig struct {
+	// Prefix of the remote names. IDP_RCLONE_PREFIX overrides it.
+	Prefix string `json:"prefix,omitempty"`
+	// Providers to write remotes for. Defaults to all providers with storage.
+	Providers []string `json:"providers,omitempty"`
+	// AzureStorageAccount is the account of the Azure Blob Storage remote. IDP_AZURE_STORAGE_ACCOUNT overrides it.
+	AzureStorageAccount string `json:"azureStorageAccount,omitempty"`
+}
+
+// rcloneRemote is a remote of the rclone config file.
+type rcloneRemote struct {
+	Name   string
+	Values map[string]string
+}
+
+func runRclone(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "configure" {
+		return exitErrorf(exitUsage, "usage: rclone configure [--prefix gitpod-] [--azure-storage-account name] [aws|gcp|azure...]")
+	}
+	flags := flag.NewFlagSet("rclone configure", flag.ExitOnError)
+	prefix := flags.String("prefix", rclonePrefix(), "prefix of the remote names")
+	account := flags.String("azure-storage-account", setting("IDP_AZURE_STORAGE_ACCOUNT"), "storage account of the Azure Blob Storage remote")
+	_ = flags.Parse(args[1:])
+
+	selected, err := selectProviders(flags.Args())
+	if err != nil {
+		return err
+	}
+	remotes, err := rcloneRemotes(selected, *prefix, *account, flags.NArg() > 0)
+	if err != nil {
+		return err
+	}
+	if len(remotes) == 0 {
+		return exitErrorf(exitMissingConfig, "not signed into any provider with storage - run idp login first")
+	}
+	fn, err := writeRcloneRemotes(remotes)
+	if err != nil {
+		return err
+	}
+	for _, r := range remotes {
+		printSuccess("rclone remote %s: is in %s", r.Name, fn)
+	}
+	if rec, _ := loadCredentialRecord("gcp"); rec != nil && hasRemote(remotes, *prefix+"gcs") {
+		fmt.Println("  The Google Cloud Storage remote reads GOOGLE_APPLICATION_CREDENTIALS, which eval \"$(idp env gcp)\" sets.")
+	}
+	return nil
+}
+
+// writeRcloneSink updates the remotes in the rclone config file after login, if rclone is configured. The remotes
+// read the credential files which login and the daemon keep fresh, so they only change with the configuration.
+func writeRcloneSink(ctx context.Context) error {
+	if (cfg == nil || cfg.Rclone == nil) && setting("IDP_RCLONE_PREFIX") == "" {
+		return nil
+	}
+	var rc rcloneConfig
+	if cfg != nil && cfg.Rclone != nil {
+		rc = *cfg.Rclone
+	}
+	selected, err := selectProviders(rc.Providers)
+	if err != nil {
+		return err
+	}
+	remotes, err := rcloneRemotes(selected, rclonePrefix(), setting("IDP_AZURE_STORAGE_ACCOUNT"), false)
+	if err != nil || len(remotes) == 0 {
+		return err
+	}
+	_, err = writeRcloneRemotes(remotes)
+	return err
+}
+
+func rclonePrefix() string {
+	if p := setting("IDP_RCLONE_PREFIX"); p != "" {
+		return p
+	}
+	return defaultRclonePrefix
+}
+
+// rcloneRemotes returns the remotes of the selected providers which are signed into. explicit says the providers
+// were asked for by name, so that those without remotes are an error rather than skipped.
+func rcloneRemotes(selected []provider, prefix, azureAccount string, explicit bool) ([]rcloneRemote, error) {
+	var res []rcloneRemote
+	for _, p := range selected {
+		rec, err := loadCredentialRecord(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if rec == nil {
+			if explicit {
+				return nil, exitErrorf(exitMissingConfig, "not signed into %s - run idp login %s first", p.Name, p.Name)
+			}
+			continue
+		}
+		switch p.Name {
+		case "aws":
+			remotes, err := rcloneS3Remotes(prefix, rec.Method == awsProfilesMethod)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, remotes...)
+		case "gcp":
+			res = append(res, rcloneGCSRemote(prefix))
+		case "azure":
+			if azureAccount == "" {
+				if explicit {
+					return nil, exitErrorf(exitMissingConfig, "the storage account of the Azure Blob Storage remote is not configured - set IDP_AZURE_STORAGE_ACCOUNT or use --azure-storage-account")
+				}
+				continue
+			}
+			res = append(res, rcloneRemote{Name: prefix + "azblob", Values: map[string]string{
+				"type":    "azureblob",
+				"account": azureAccount,
+				// the Azure SDK's default credential chain, which gets to the az CLI login refreshed by the daemon
+				"env_auth": "true",
+			}})
+		default:
+			if explicit {
+				return nil, exitErrorf(exitUsage, "%s has no storage rclone can use", p.Name)
+			}
+		}
+	}
+	return res, nil
+}
+
+// rcloneS3Remotes returns the S3 remote of the default profile, or with IDP_AWS_PROFILES one per profile.
+func rcloneS3Remotes(prefix string, withProfiles bool) ([]rcloneRemote, error) {
+	fn, err := gitpodidp.AWSCredentialsFile()
+	if err != nil {
+		return nil, err
+	}
+	remote := func(name, profile, region string) rcloneRemote {
+		vals := map[string]string{
+			"type":                    "s3",
+			"provider":                "AWS",
+			"env_auth":                "true",
+			"profile":                 profile,
+			"shared_credentials_file": fn,
+		}
+		if region != "" {
+			vals["region"] = region
+		}
+		return rcloneRemote{Name: name, Values: vals}
+	}
+	if !withProfiles {
+		return []rcloneRemote{remote(prefix+"s3", "default", setting("IDP_AWS_REGION"))}, nil
+	}
+	profiles, err := awsProfiles()
+	if err != nil {
+		return nil, err
+	}
+	var res []rcloneRemote
+	for _, name := range sortedKeys(profiles) {
+		region := profiles[name].Region
+		if region == "" {
+			region = setting("IDP_AWS_REGION")
+		}
+		res = append(res, remote(prefix+"s3-"+name, name, region))
+	}
+	return res, nil
+}
+
+func rcloneGCSRemote(prefix string) rcloneRemote {
+	vals := map[string]string{
+		"type": "google cloud storage",
+		// application default credentials, i.e. the external account configuration of GOOGLE_APPLICATION_CREDENTIALS
+		"env_auth":           "true",
+		"bucket_policy_only": "true",
+	}
+	if project := setting("IDP_GCP_PROJECT"); project != "" {
+		vals["project_number"] = project
+	}
+	return rcloneRemote{Name: prefix + "gcs", Values: vals}
+}
+
+func hasRemote(remotes []rcloneRemote, name string) bool {
+	for _, r := range remotes {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rcloneConfigFile returns the location of rclone's config file, which RCLONE_CONFIG overrides.
+func rcloneConfigFile() (string, error) {
+	if fn := os.Getenv("RCLONE_CONFIG"); fn != "" {
+		return fn, nil
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "rclone", "rclone.conf"), nil
+}
+
+// writeRcloneRemotes replaces the sections of remotes in the rclone config file, keeping all other remotes as they
+// are, and returns the file's location.
+func writeRcloneRemotes(remotes []rcloneRemote) (string, error) {
+	fn, err := rcloneConfigFile()
+	if err != nil {
+		return "", err
+	}
+	fc, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if bytes.HasPrefix(fc, []byte("# Encrypted rclone configuration File")) {
+		return "", exitErrorf(exitPersistFailed, "cannot add remotes to %s: it is encrypted", fn)
+	}
+	doc := string(fc)
+	for _, r := range remotes {
+		doc = replaceINISection(doc, r.Name, r.Values)
+	}
+	err = os.MkdirAll(filepath.Dir(fn), 0700)
+	if err == nil {
+		err = writeSecretFile(fn, []byte(doc))
+	}
+	if err != nil {
+		return "", exitErrorf(exitPersistFailed, "cannot write %s: %w", fn, err)
+	}
+	for _, r := range remotes {
+		emitEvent(eventProfileWritten, "", "tool", "rclone", "remote", r.Name, "path", fn)
+	}
+	return fn, nil
+}
+
+// replaceINISection replaces section of the INI document doc with vals, in the order of their keys, or adds it at
+// the end.
+func replaceINISection(doc, section string, vals map[string]string) string {
+	var body []string
+	for _, k := range sortedKeys(vals) {
+		body = append(body, k+" = "+vals[k])
+	}
+	var (
+		res      []string
+		skipping bool
+		found    bool
+	)
+	if doc != "" {
+		for _, line := range strings.Split(strings.TrimSuffix(doc, "\n"), "\n") {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+				skipping = strings.TrimSpace(trimmed[1:len(trimmed)-1]) == section
+				if skipping {
+					found = true
+					res = append(res, line)
+					res = append(res, body...)
+					res = append(res, "")
+					continue
+				}
+			}
+			if !skipping {
+				res = append(res, line)
+			}
+		}
+	}
+	if !found {
+		if len(res) > 0 && res[len(res)-1] != "" {
+			res = append(res, "")
+		}
+		res = append(res, "["+section+"]")
+		res = append(res, body...)
+	}
+	for len(res) > 0 && res[len(res)-1] == "" {
+		res = res[:len(res)-1]
+	}
+	return strings.Join(res, "\n") + "\n"
+}
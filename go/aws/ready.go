@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "wait",
+		Usage:   "wait [--ready-file file] [--max-wait 5m] [provider...]",
+		Summary: "block until credentials are in place, e.g. in a Gitpod task which needs them",
+		Run:     runWait,
+	})
+}
+
+// readyState is what login and daemon write to the ready file.
+type readyState struct {
+	Ready bool      `json:"ready"`
+	Time  time.Time `json:"time"`
+	// Error is why signing in failed, in which case waiting for the credentials is pointless.
+	Error string `json:"error,omitempty"`
+}
+
+// readyFile returns the ready file given by flag, or IDP_READY_FILE.
+func readyFile(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	return setting("IDP_READY_FILE")
+}
+
+// writeReadyFile replaces fn with the outcome of signing in. It's renamed into place, so waiters never read half
+// of it.
+func writeReadyFile(fn string, err error) error {
+	st := readyState{Ready: err == nil, Time: time.Now().UTC()}
+	if err != nil {
+		st.Error = redactText(err.Error())
+	}
+	fc, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fn), "."+filepath.Base(fn)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(fc, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fn)
+}
+
+// clearReadyFile removes a ready file left by an earlier run, e.g. before the workspace was restarted, so that
+// nobody goes ahead before this run signed in.
+func clearReadyFile(fn string) error {
+	err := os.Remove(fn)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return exitErrorf(exitPersistFailed, "cannot remove the ready file: %w", err)
+	}
+	return nil
+}
+
+func runWait(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("wait", flag.ExitOnError)
+	fileFlag := flags.String("ready-file", "", "wait for login or daemon to write this ready file (default IDP_READY_FILE)")
+	maxWait := flags.Duration("max-wait", 5*time.Minute, "give up after this long (0 waits forever)")
+	_ = flags.Parse(args)
+
+	selected, err := selectProviders(flags.Args())
+	if err != nil {
+		return err
+	}
+	if *maxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxWait)
+		defer cancel()
+	}
+	fn := readyFile(*fileFlag)
+	for {
+		var done bool
+		if fn != "" {
+			done, err = readyFileDone(fn)
+		} else {
+			done, err = credentialsReady(selected)
+		}
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return exitErrorf(exitFailure, "credentials not ready after %s", *maxWait)
+			}
+			return ctx.Err()
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+// readyFileDone reports whether the ready file fn says the credentials are in place, and fails if it says signing
+// in failed.
+func readyFileDone(fn string) (bool, error) {
+	fc, err := os.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var st readyState
+	err = json.Unmarshal(fc, &st)
+	if err != nil {
+		return false, fmt.Errorf("cannot read the ready file %s: %w", fn, err)
+	}
+	if st.Error != "" {
+		return false, fmt.Errorf("signing in failed: %s", st.Error)
+	}
+	if st.Ready {
+		printSuccess("credentials are ready")
+	}
+	return st.Ready, nil
+}
+
+// credentialsReady reports whether all configured providers among selected have valid credentials for the
+// identity they are configured with.
+func credentialsReady(selected []provider) (bool, error) {
+	var configured []string
+	for _, p := range selected {
+		if !p.configured() {
+			continue
+		}
+		configured = append(configured, p.Name)
+		st, err := getProviderStatus(p)
+		if err != nil {
+			return false, err
+		}
+		if st.State != stateValid || st.Identity != p.Identity() {
+			return false, nil
+		}
+	}
+	if len(configured) == 0 {
+		return false, exitErrorf(exitMissingConfig, "no provider is configured")
+	}
+	printSuccess("credentials for %s are ready", strings.Join(configured, ", "))
+	return true, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+var (
+	recordFlag = flag.String("record", "", "record all HTTP exchanges, with secrets redacted, to this file for bug reports")
+	replayFlag = flag.String("replay", "", "answer HTTP requests from a file written by -record instead of the network")
+)
+
+// recordedExchange is one HTTP request and its response in a record bundle.
+type recordedExchange struct {
+	Time            time.Time           `json:"time"`
+	Method          string              `json:"method"`
+	URL             string              `json:"url"`
+	RequestHeaders  map[string][]string `json:"requestHeaders,omitempty"`
+	RequestBody     string              `json:"requestBody,omitempty"`
+	Status          int                 `json:"status,omitempty"`
+	ResponseHeaders map[string][]string `json:"responseHeaders,omitempty"`
+	ResponseBody    string              `json:"responseBody,omitempty"`
+	Error           string              `json:"error,omitempty"`
+}
+
+// setupRecording wraps httpClient according to -record and -replay.
+func setupRecording() error {
+	switch {
+	case *recordFlag != "" && *replayFlag != "":
+		return exitErrorf(exitUsage, "-record and -replay are mutually exclusive")
+	case *recordFlag != "":
+		httpClient = &recordingClient{next: httpClient, fn: *recordFlag}
+	case *replayFlag != "":
+		fc, err := os.ReadFile(*replayFlag)
+		if err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		var bundle []recordedExchange
+		err = json.Unmarshal(fc, &bundle)
+		if err != nil {
+			return exitErrorf(exitUsage, "cannot parse %s: %w", *replayFlag, err)
+		}
+		httpClient = &replayingClient{exchanges: bundle, used: make([]bool, len(bundle))}
+	}
+	return nil
+}
+
+// recordingClient passes requests on and appends each exchange to the bundle at fn as it completes, so the
+// bundle is complete even if the command fails half way.
+type recordingClient struct {
+	next gitpodidp.HTTPDoer
+	fn   string
+
+	mu        sync.Mutex
+	exchanges []recordedExchange
+}
+
+func (c *recordingClient) Do(req *http.Request) (*http.Response, error) {
+	ex := recordedExchange{
+		Time:           time.Now(),
+		Method:         req.Method,
+		URL:            req.URL.String(),
+		RequestHeaders: redactHeaders(req.Header),
+	}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		ex.RequestBody = redactBody(req.Header.Get("Content-Type"), body)
+	}
+
+	resp, err := c.next.Do(req)
+	if err != nil {
+		ex.Error = err.Error()
+		c.save(ex)
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	ex.Status = resp.StatusCode
+	ex.ResponseHeaders = redactHeaders(resp.Header)
+	ex.ResponseBody = redactBody(resp.Header.Get("Content-Type"), body)
+	c.save(ex)
+	return resp, nil
+}
+
+func (c *recordingClient) save(ex recordedExchange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.exchanges = append(c.exchanges, ex)
+	fc, err := json.MarshalIndent(c.exchanges, "", "  ")
+	if err == nil {
+		err = writeSecretFile(c.fn, fc)
+	}
+	if err != nil {
+		printWarning("cannot write %s: %v", c.fn, err)
+	}
+}
+
+// replayingClient answers each request with the first unused recorded exchange for the same method and URL.
+type replayingClient struct {
+	mu        sync.Mutex
+	exchanges []recordedExchange
+	used      []bool
+}
+
+func (c *replayingClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, ex := range c.exchanges {
+		if c.used[i] || ex.Method != req.Method || ex.URL != req.URL.String() {
+			continue
+		}
+		c.used[i] = true
+		if ex.Error != "" {
+			return nil, fmt.Errorf("%s (replayed)", ex.Error)
+		}
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+			StatusCode: ex.Status,
+			Header:     http.Header(ex.ResponseHeaders),
+			Body:       io.NopCloser(strings.NewReader(ex.ResponseBody)),
+			Request:    req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL)
+}
+
+const redacted = "REDACTED"
+
+// secretHeaders and secretFields name the headers and body fields which carry credentials.
+var (
+	secretHeaders = []string{"Authorization", "Proxy-Authorization", "X-Vault-Token", "X-Amz-Security-Token", "Cookie", "Set-Cookie"}
+	secretFields  = map[string]bool{
+		"token": true, "jwt": true, "access_token": true, "accessToken": true, "client_token": true,
+		"subject_token": true, "client_assertion": true, "WebIdentityToken": true, "id_token": true,
+		"refresh_token": true,
+	}
+	// jwtPattern keeps the header and claims of JWTs, which help debugging, but drops the signature so that the
+	// token cannot be used.
+	jwtPattern = regexp.MustCompile(`(eyJ[\w-]*\.[\w-]*)\.[\w-]+`)
+	xmlSecrets = regexp.MustCompile(`<(SecretAccessKey|SessionToken)>[^<]*</`)
+)
+
+func redactHeaders(h http.Header) map[string][]string {
+	if len(h) == 0 {
+		return nil
+	}
+	res := h.Clone()
+	for _, k := range secretHeaders {
+		if _, ok := res[k]; ok {
+			res[k] = []string{redacted}
+		}
+	}
+	return res
+}
+
+// redactBody removes credentials from JSON, form and XML bodies. Fields named like secrets are replaced
+// completely; JWTs anywhere else lose their signature.
+func redactBody(contentType string, body []byte) string {
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		form, err := url.ParseQuery(string(body))
+		if err == nil {
+			for k := range form {
+				if secretFields[k] {
+					form.Set(k, redactSecret(form.Get(k)))
+				}
+			}
+			return form.Encode()
+		}
+	case strings.Contains(contentType, "json"):
+		var v interface{}
+		if json.Unmarshal(body, &v) == nil {
+			fc, err := json.Marshal(redactJSON(v))
+			if err == nil {
+				return jwtPattern.ReplaceAllString(string(fc), "$1."+redacted)
+			}
+		}
+	}
+	res := xmlSecrets.ReplaceAllString(string(body), "<$1>"+redacted+"</")
+	return jwtPattern.ReplaceAllString(res, "$1."+redacted)
+}
+
+// redactSecret replaces a secret, keeping the header and claims if it's a JWT.
+func redactSecret(s string) string {
+	if jwtPattern.MatchString(s) {
+		return jwtPattern.ReplaceAllString(s, "$1."+redacted)
+	}
+	return redacted
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if str, isString := e.(string); isString && secretFields[k] {
+				v[k] = redactSecret(str)
+				continue
+			}
+			v[k] = redactJSON(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactJSON(e)
+		}
+	}
+	return v
+}
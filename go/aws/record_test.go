@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordingRedactsSignedSTSRequests(t *testing.T) {
+	const (
+		sessionToken = "FwoGZXIvYXdzEBYaDsessiontoken"
+		signature    = "AWS4-HMAC-SHA256 Credential=ASIAEXAMPLE/20261014/us-east-1/sts/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token, Signature=abcdef"
+		secretKey    = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+	)
+	d := &fakeDoer{respond: func(req *http.Request) (*http.Response, error) {
+		return fakeResponse(req, http.StatusOK, "text/xml", "<AssumeRoleResponse><Credentials><AccessKeyId>ASIAEXAMPLE</AccessKeyId>"+
+			"<SecretAccessKey>"+secretKey+"</SecretAccessKey><SessionToken>"+sessionToken+"</SessionToken></Credentials></AssumeRoleResponse>"), nil
+	}}
+	fn := filepath.Join(t.TempDir(), "bundle.json")
+	c := &recordingClient{next: d, fn: fn}
+
+	req, err := http.NewRequest(http.MethodPost, "https://sts.amazonaws.com/", strings.NewReader("Action=AssumeRole&Version=2011-06-15"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Amz-Date", "20261014T120000Z")
+	req.Header.Set("X-Amz-Security-Token", sessionToken)
+	req.Header.Set("Authorization", signature)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	fc, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{sessionToken, "Signature=abcdef", secretKey} {
+		if strings.Contains(string(fc), secret) {
+			t.Errorf("the bundle contains %q:\n%s", secret, fc)
+		}
+	}
+	var bundle []recordedExchange
+	err = json.Unmarshal(fc, &bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle) != 1 {
+		t.Fatalf("recorded %d exchanges, want 1", len(bundle))
+	}
+	h := http.Header(bundle[0].RequestHeaders)
+	if got := h.Get("X-Amz-Security-Token"); got != redacted {
+		t.Errorf("X-Amz-Security-Token = %q, want %q", got, redacted)
+	}
+	if got := h.Get("X-Amz-Date"); got != "20261014T120000Z" {
+		t.Errorf("X-Amz-Date = %q, want it kept", got)
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	h := http.Header{
+		"Authorization":        {"Bearer secret"},
+		"Proxy-Authorization":  {"Basic secret"},
+		"X-Vault-Token":        {"hvs.secret"},
+		"X-Amz-Security-Token": {"secret"},
+		"Cookie":               {"session=secret"},
+		"Set-Cookie":           {"session=secret"},
+		"Content-Type":         {"application/json"},
+	}
+	got := http.Header(redactHeaders(h))
+	for k := range h {
+		want := redacted
+		if k == "Content-Type" {
+			want = "application/json"
+		}
+		if got.Get(k) != want {
+			t.Errorf("%s = %q, want %q", k, got.Get(k), want)
+		}
+	}
+	if h.Get("Authorization") != "Bearer secret" {
+		t.Error("redactHeaders changed the headers it was given")
+	}
+}
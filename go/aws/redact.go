@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// knownSecrets are the tokens and keys this process has obtained. They are redacted wherever they show up, e.g.
+// in the output of a CLI which echoes its arguments, and wiped by forgetSecrets.
+var knownSecrets struct {
+	mu     sync.Mutex
+	values []*secret
+}
+
+// registerSecret makes redactText remove s, however it is embedded. Values too short to be secrets are ignored.
+func registerSecret(s string) {
+	if len(s) < 8 {
+		return
+	}
+	knownSecrets.mu.Lock()
+	defer knownSecrets.mu.Unlock()
+	knownSecrets.values = append(knownSecrets.values, newSecretString(s))
+	// replace longer secrets first, in case one contains another
+	sort.Slice(knownSecrets.values, func(i, j int) bool { return len(knownSecrets.values[i].b) > len(knownSecrets.values[j].b) })
+}
+
+// forgetSecrets wipes the key the cache is encrypted with and the secrets the process knows of, so that they don't
+// linger in its memory, e.g. for a core dump. Go strings cannot be overwritten, so the strings they were obtained
+// as stay in memory until it's reused. redactText no longer knows them afterwards, so nothing should be logged after.
+func forgetSecrets() {
+	forgetCacheKey()
+	knownSecrets.mu.Lock()
+	for _, s := range knownSecrets.values {
+		s.Wipe()
+	}
+	knownSecrets.values = nil
+	knownSecrets.mu.Unlock()
+	debug.FreeOSMemory()
+}
+
+var (
+	secretAssignment = regexp.MustCompile(`(?i)\b(` + secretNames() + `)=[^\s&"',;]+`)
+	secretJSONField  = regexp.MustCompile(`(?i)"(` + secretNames() + `)"\s*:\s*"[^"]*"`)
+	bearerToken      = regexp.MustCompile(`(?i)\bbearer\s+[\w.~+/=-]+`)
+	vaultToken       = regexp.MustCompile(`\bhv[sbr]\.[\w-]{20,}`)
+	googleToken      = regexp.MustCompile(`\bya29\.[\w.-]+`)
+	// longOpaqueValue catches AWS session tokens and other base64 blobs nobody needs to read in a log.
+	longOpaqueValue = regexp.MustCompile(`[A-Za-z0-9+/]{100,}={0,2}`)
+	// secretFlag matches the command line flags whose value is a credential, e.g. -p, --password or
+	// --client-secret, with the value after = if there is one.
+	secretFlag = regexp.MustCompile(`(?i)^(-p|--?(?:[\w-]*[-_])?(?:password|passwd|token|secret))(=.*)?$`)
+)
+
+// secretNames returns the field names which carry credentials as an alternation for regular expressions.
+func secretNames() string {
+	names := []string{"aws_secret_access_key", "aws_session_token", "SecretAccessKey", "SessionToken", "X-Vault-Token"}
+	for n := range secretFields {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for i, n := range names {
+		names[i] = regexp.QuoteMeta(n)
+	}
+	return strings.Join(names, "|")
+}
+
+// redactText removes credentials from s, so that log lines and error messages are safe to share. Like the
+// recorder, it keeps the header and claims of JWTs.
+func redactText(s string) string {
+	knownSecrets.mu.Lock()
+	if len(knownSecrets.values) > 0 {
+		text := []byte(s)
+		for _, secret := range knownSecrets.values {
+			text = secret.redactIn(text)
+		}
+		s = string(text)
+	}
+	knownSecrets.mu.Unlock()
+
+	s = secretAssignment.ReplaceAllString(s, "$1="+redacted)
+	s = secretJSONField.ReplaceAllString(s, `"$1":"`+redacted+`"`)
+	s = bearerToken.ReplaceAllString(s, "Bearer "+redacted)
+	s = jwtPattern.ReplaceAllString(s, "$1."+redacted)
+	s = vaultToken.ReplaceAllString(s, redacted)
+	s = googleToken.ReplaceAllString(s, redacted)
+	s = longOpaqueValue.ReplaceAllString(s, redacted)
+	return s
+}
+
+// redactCommand removes credentials from a command line. Unlike redactText, which only sees one argument at a
+// time, it redacts the arguments following flags like -p and --password too.
+func redactCommand(args []string) []string {
+	res := make([]string, len(args))
+	for i := 0; i < len(args); i++ {
+		m := secretFlag.FindStringSubmatch(args[i])
+		switch {
+		case m == nil:
+			res[i] = redactText(args[i])
+		case m[2] != "":
+			res[i] = m[1] + "=" + redacted
+		default:
+			res[i] = args[i]
+			if i+1 < len(args) {
+				i++
+				res[i] = redacted
+			}
+		}
+	}
+	return res
+}
+
+// redactingHandler passes log records on with credentials removed from the message and all attributes.
+type redactingHandler struct {
+	slog.Handler
+}
+
+func (h redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	res := slog.NewRecord(r.Time, r.Level, redactText(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		res.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, res)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	res := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		res[i] = redactAttr(a)
+	}
+	return redactingHandler{h.Handler.WithAttrs(res)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{h.Handler.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindGroup:
+		group := v.Group()
+		res := make([]interface{}, len(group))
+		for i, ga := range group {
+			res[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, res...)
+	case slog.KindString, slog.KindAny:
+		// errors and anything else formatted with fmt may carry credentials
+		return slog.String(a.Key, redactText(v.String()))
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// The JSON-RPC error codes the servers answer with.
+const (
+	rpcParseError     = -32700
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+// rpcConn speaks newline-delimited JSON-RPC 2.0, as the MCP and editor servers do on stdio. Messages may be sent
+// from several goroutines.
+type rpcConn struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newRPCConn(out io.Writer) *rpcConn {
+	return &rpcConn{enc: json.NewEncoder(out)}
+}
+
+func (c *rpcConn) send(v any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(v)
+}
+
+// reply answers req with res, or with err, which is sent as is if it's an *rpcError and as invalid parameters
+// otherwise. Notifications aren't answered.
+func (c *rpcConn) reply(req rpcRequest, res any, err error) error {
+	if len(req.ID) == 0 {
+		return nil
+	}
+	resp := rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: res}
+	if err != nil {
+		var rerr *rpcError
+		if !errors.As(err, &rerr) {
+			rerr = &rpcError{Code: rpcInvalidParams, Message: redactText(err.Error())}
+		}
+		resp.Result, resp.Error = nil, rerr
+	}
+	return c.send(resp)
+}
+
+// notify sends a notification, which the client doesn't answer.
+func (c *rpcConn) notify(method string, params any) error {
+	return c.send(rpcNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// serve reads the messages of in until it ends, passing each request and notification to handle and answering
+// those it cannot parse itself.
+func (c *rpcConn) serve(in io.Reader, handle func(req rpcRequest) error) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var req rpcRequest
+		err := json.Unmarshal([]byte(line), &req)
+		if err != nil {
+			err = c.send(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+		} else {
+			err = handle(req)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// commandRunner runs the CLIs this tool drives (gp, aws, gcloud, az, git). Replacing runner with a fake lets the
+// sign-in flows run without those binaries, a workspace or a cloud account.
+type commandRunner interface {
+	// LookPath reports where name is installed, like exec.LookPath.
+	LookPath(name string) (string, error)
+	// Output runs name and returns its stdout. If the process fails, the error is an *exec.ExitError carrying
+	// its stderr.
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+	// CombinedOutput runs name and returns its stdout and stderr.
+	CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error)
+	// Pipe runs name with stdin as its input and returns its stdout, like Output.
+	Pipe(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error)
+}
+
+var runner commandRunner = execRunner{}
+
+// httpClient makes all HTTP requests of the CLI and, through gitpodidp.SetHTTPClient, of the library. setupNetwork
+// replaces it with one configured for proxies and custom CAs.
+var httpClient gitpodidp.HTTPDoer = &http.Client{Timeout: gitpodidp.RequestTimeout, Transport: gitpodidp.NewTransport()}
+
+// commandWaitDelay is how long a cancelled subprocess gets to close its output before we stop waiting for it.
+const commandWaitDelay = 2 * time.Second
+
+// execRunner runs real subprocesses, which are killed once their context is cancelled.
+type execRunner struct{}
+
+func (execRunner) LookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
+
+func (execRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := newCommand(ctx, name, args...)
+	if *verboseFlag {
+		return streamOutput(cmd)
+	}
+	return cmd.Output()
+}
+
+func (execRunner) CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := newCommand(ctx, name, args...)
+	if *verboseFlag {
+		var out bytes.Buffer
+		streamer := newLineStreamer(name)
+		defer streamer.flush()
+		cmd.Stdout = io.MultiWriter(&out, streamer)
+		cmd.Stderr = cmd.Stdout
+		err := cmd.Run()
+		return out.Bytes(), err
+	}
+	return cmd.CombinedOutput()
+}
+
+func (execRunner) Pipe(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := newCommand(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	if *verboseFlag {
+		return streamOutput(cmd)
+	}
+	return cmd.Output()
+}
+
+// streamOutput is cmd.Output, but streams stderr with -verbose as it's written. Stdout is the result, often a
+// token, and isn't shown.
+func streamOutput(cmd *exec.Cmd) ([]byte, error) {
+	var out, stderr bytes.Buffer
+	streamer := newLineStreamer(cmd.Path)
+	defer streamer.flush()
+	cmd.Stdout = &out
+	cmd.Stderr = io.MultiWriter(&stderr, streamer)
+	err := cmd.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		ee.Stderr = stderr.Bytes()
+	}
+	return out.Bytes(), err
+}
+
+// newCommand prepares a subprocess which is killed once ctx is cancelled. Unlike exec.CommandContext on its own,
+// this doesn't hang if the process left children behind which still hold its output open. The process trusts
+// the CA bundle this tool does.
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	slog.DebugContext(ctx, "running command", "name", name)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = commandWaitDelay
+	cmd.Env = subprocessEnv()
+	if env, ok := ctx.Value(commandEnvKey{}).([]string); ok {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	return cmd
+}
+
+type commandEnvKey struct{}
+
+// withCommandEnv returns a context whose subprocesses additionally get the variables of env, e.g. "NAME=value".
+func withCommandEnv(ctx context.Context, env ...string) context.Context {
+	if prev, ok := ctx.Value(commandEnvKey{}).([]string); ok {
+		env = append(append([]string{}, prev...), env...)
+	}
+	return context.WithValue(ctx, commandEnvKey{}, env)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "s3a",
+		Usage:   "s3a configure [--profile name] [--region region] [--dir dir] [--print]",
+		Summary: "write the Hadoop and Spark configuration which makes S3A read S3 with the signed-in AWS profile",
+		Run:     runS3A,
+	})
+}
+
+// s3aCredentialsProvider is the credentials provider S3A reads the AWS profile with. Hadoop 3.4 and later, which use
+// the AWS SDK v2, map it to the SDK v2 provider of the same name. Both re-read the credentials file, so jobs keep
+// working while the daemon refreshes the credentials.
+const s3aCredentialsProvider = "com.amazonaws.auth.profile.ProfileCredentialsProvider"
+
+func runS3A(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "configure" {
+		return exitErrorf(exitUsage, "usage: s3a configure [--profile name] [--region region] [--dir dir] [--print]")
+	}
+	flags := flag.NewFlagSet("s3a configure", flag.ExitOnError)
+	profile := flags.String("profile", "default", "AWS profile the jobs read S3 with")
+	region := flags.String("region", setting("IDP_AWS_REGION"), "region of the buckets")
+	dir := flags.String("dir", "", "directory to write core-site.xml and spark-defaults.conf to (default the s3a directory in the state directory)")
+	printOnly := flags.Bool("print", false, "print the configuration instead of writing it")
+	_ = flags.Parse(args[1:])
+
+	props := s3aProperties(*region)
+	env, err := s3aEnv(*profile)
+	if err != nil {
+		return err
+	}
+	coreSite := s3aCoreSite(props)
+	sparkDefaults := s3aSparkDefaults(props, env)
+	if *printOnly {
+		fmt.Printf("<!-- core-site.xml -->\n%s\n# spark-defaults.conf\n%s", coreSite, sparkDefaults)
+		return nil
+	}
+
+	if *dir == "" {
+		sd, err := stateDir()
+		if err != nil {
+			return err
+		}
+		*dir = filepath.Join(sd, "s3a")
+	}
+	err = os.MkdirAll(*dir, 0755)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot create %s: %w", *dir, err)
+	}
+	files := map[string]string{"core-site.xml": coreSite, "spark-defaults.conf": sparkDefaults}
+	for _, name := range sortedKeys(files) {
+		fn := filepath.Join(*dir, name)
+		err := os.WriteFile(fn, []byte(files[name]), 0644)
+		if err != nil {
+			return exitErrorf(exitPersistFailed, "cannot write %s: %w", fn, err)
+		}
+		recordArtifact(fn)
+		emitEvent(eventProfileWritten, "aws", "tool", "s3a", "profile", *profile, "path", fn)
+	}
+
+	printSuccess("S3A reads S3 with the AWS profile %s (%s)", *profile, *dir)
+	fmt.Printf("  Hadoop: export HADOOP_CONF_DIR=%s, or merge core-site.xml into yours\n", *dir)
+	fmt.Printf("  Spark:  spark-submit --properties-file %s ...\n", filepath.Join(*dir, "spark-defaults.conf"))
+	for _, name := range sortedKeys(env) {
+		fmt.Printf("  export %s=%s\n", name, shellQuote(env[name]))
+	}
+	return nil
+}
+
+// s3aProperties returns the Hadoop properties which make S3A use the AWS profile.
+func s3aProperties(region string) [][2]string {
+	res := [][2]string{{"fs.s3a.aws.credentials.provider", s3aCredentialsProvider}}
+	if region != "" {
+		res = append(res, [2]string{"fs.s3a.endpoint.region", region})
+	}
+	return res
+}
+
+// s3aEnv returns the environment the drivers and executors need to find the profile. Only the SDK's defaults are
+// left out.
+func s3aEnv(profile string) (map[string]string, error) {
+	res := make(map[string]string)
+	if profile != "default" {
+		res["AWS_PROFILE"] = profile
+	}
+	fn, err := gitpodidp.AWSCredentialsFile()
+	if err != nil {
+		return nil, err
+	}
+	if home, err := os.UserHomeDir(); err != nil || fn != filepath.Join(home, ".aws", "credentials") {
+		// the SDK v1 has a variable of its own for the file
+		res["AWS_SHARED_CREDENTIALS_FILE"] = fn
+		res["AWS_CREDENTIAL_PROFILES_FILE"] = fn
+	}
+	return res, nil
+}
+
+func s3aCoreSite(props [][2]string) string {
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\"?>\n<configuration>\n")
+	for _, p := range props {
+		buf.WriteString("  <property>\n    <name>")
+		_ = xml.EscapeText(&buf, []byte(p[0]))
+		buf.WriteString("</name>\n    <value>")
+		_ = xml.EscapeText(&buf, []byte(p[1]))
+		buf.WriteString("</value>\n  </property>\n")
+	}
+	buf.WriteString("</configuration>\n")
+	return buf.String()
+}
+
+// s3aSparkDefaults returns the Spark configuration, which passes the Hadoop properties on with the spark.hadoop.
+// prefix and the environment to the executors.
+func s3aSparkDefaults(props [][2]string, env map[string]string) string {
+	var lines []string
+	for _, p := range props {
+		lines = append(lines, "spark.hadoop."+p[0]+" "+p[1])
+	}
+	for _, name := range sortedKeys(env) {
+		lines = append(lines, "spark.executorEnv."+name+" "+env[name])
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "scrub",
+		Usage:   "scrub [--dry-run] [--revoke] [--audit-log]",
+		Summary: "remove every credential, token, cache and config entry this tool wrote, e.g. before a snapshot or handing the workspace over",
+		Run:     runScrub,
+	})
+}
+
+// scrubItem is something scrub removes, described for the report.
+type scrubItem struct {
+	What   string
+	Remove func(ctx context.Context) error
+}
+
+// scrubStep finds the items of one kind of artifact. All steps look before any removes, so that they still find
+// what the state directory points to.
+type scrubStep struct {
+	Name string
+	Find func(ctx context.Context, opts scrubOptions) ([]scrubItem, error)
+}
+
+type scrubOptions struct {
+	revoke   bool
+	auditLog bool
+}
+
+var scrubSteps = []scrubStep{
+	{Name: "env files", Find: findScrubEnvFiles},
+	{Name: "pgpass", Find: findScrubPgpass},
+	{Name: "local logins", Find: findScrubLocalLogins},
+	{Name: "providers", Find: findScrubProviders},
+	{Name: "registries", Find: findScrubCredHelpers},
+	{Name: "git", Find: findScrubGitHelpers},
+	{Name: "kubeconfig", Find: findScrubKubeconfigUsers},
+	{Name: "rclone", Find: findScrubRcloneRemotes},
+	{Name: "artifacts", Find: findScrubArtifacts},
+	{Name: "state", Find: findScrubState},
+}
+
+func runScrub(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only list what would be removed")
+	revoke := flags.Bool("revoke", false, "also revoke credentials with the provider where supported (Vault, gcloud, az)")
+	auditLog := flags.Bool("audit-log", false, "remove the audit log too")
+	_ = flags.Parse(args)
+	opts := scrubOptions{revoke: *revoke, auditLog: *auditLog}
+
+	var items []scrubItem
+	for _, step := range scrubSteps {
+		found, err := step.Find(ctx, opts)
+		if err != nil {
+			// a step which cannot look mustn't keep the others from removing what they found
+			printWarning("%s: %v", step.Name, err)
+			continue
+		}
+		items = append(items, found...)
+	}
+	if *dryRun {
+		for _, item := range items {
+			fmt.Println(item.What)
+		}
+		return nil
+	}
+
+	var failed int
+	for _, item := range items {
+		err := item.Remove(ctx)
+		if err != nil {
+			printFailure("%s: %v", item.What, err)
+			failed++
+			continue
+		}
+		printSuccess("removed %s", item.What)
+	}
+	forgetSecrets()
+	if failed > 0 {
+		return exitErrorf(exitPersistFailed, "cannot remove %d of %d items", failed, len(items))
+	}
+	if len(items) == 0 {
+		printSuccess("nothing to remove")
+	}
+	return nil
+}
+
+// findScrubEnvFiles finds the variables login wrote to the dotenv file and db sidecar to the env files of the
+// databases: all those the providers and the exported claims may set, whether or not they are signed in.
+func findScrubEnvFiles(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	files := make(map[string][]string)
+	if fn, err := dotenvPath(); err == nil && fn != "" {
+		var dc dotenvConfig
+		if cfg != nil && cfg.Dotenv != nil {
+			dc = *cfg.Dotenv
+		}
+		selected, err := selectProviders(dc.Providers)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, p := range selected {
+			if p.EnvNames != nil {
+				names = append(names, p.EnvNames...)
+			} else if env, err := p.Env(); err == nil {
+				names = append(names, sortedKeys(env)...)
+			}
+		}
+		for _, c := range exportedClaims() {
+			names = append(names, claimEnvName(c))
+		}
+		for _, k := range names {
+			if renamed, ok := dc.Keys[k]; ok {
+				k = renamed
+			}
+			files[fn] = append(files[fn], k)
+		}
+	}
+	dbs, err := databases()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range sortedKeys(dbs) {
+		if dbs[name].EnvFile == "" {
+			continue
+		}
+		fn, err := databaseEnvFile(dbs[name])
+		if err != nil {
+			return nil, err
+		}
+		files[fn] = append(files[fn], sortedKeys(databaseEnv(dbs[name], ""))...)
+	}
+
+	var res []scrubItem
+	for _, fn := range sortedKeys(files) {
+		present, err := dotenvKeys(fn)
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		for _, k := range files[fn] {
+			if present[k] && !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		fn := fn
+		res = append(res, scrubItem{
+			What:   fmt.Sprintf("%s from %s", strings.Join(keys, ", "), fn),
+			Remove: func(ctx context.Context) error { return removeDotenvKeys(fn, keys) },
+		})
+	}
+	return res, nil
+}
+
+// findScrubPgpass finds the lines of the databases in the PostgreSQL password file.
+func findScrubPgpass(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	dbs, err := databases()
+	if err != nil {
+		return nil, err
+	}
+	fn, err := pgpassFile()
+	if err != nil {
+		return nil, err
+	}
+	fc, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res []scrubItem
+	for _, name := range sortedKeys(dbs) {
+		key := pgpassKey(dbs[name])
+		if !dbs[name].PgPass || !strings.Contains("\n"+string(fc), "\n"+key) {
+			continue
+		}
+		res = append(res, scrubItem{
+			What: fmt.Sprintf("the password of database %s from %s", name, fn),
+			Remove: func(ctx context.Context) error {
+				lines, err := pgpassLines(fn, key)
+				if err != nil {
+					return err
+				}
+				return writeSecretFile(fn, []byte(strings.Join(lines, "\n")+"\n"))
+			},
+		})
+	}
+	return res, nil
+}
+
+// findScrubLocalLogins finds the gcloud and az logins of login gcp and login azure, which logout only removes with
+// --revoke. Removing them revokes nothing: the federated credentials have nothing to revoke.
+func findScrubLocalLogins(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	if opts.revoke {
+		// logout does it
+		return nil, nil
+	}
+	var res []scrubItem
+	if rec, _ := loadCredentialRecord("gcp"); rec != nil {
+		if pth, _ := runner.LookPath("gcloud"); pth != "" {
+			account := rec.Identity
+			res = append(res, scrubItem{
+				What: "the gcloud login of " + account,
+				Remove: func(ctx context.Context) error {
+					out, err := runner.CombinedOutput(ctx, "gcloud", "auth", "revoke", account)
+					if err != nil {
+						return fmt.Errorf("gcloud auth revoke failure: %s: %w", strings.TrimSpace(string(out)), err)
+					}
+					return nil
+				},
+			})
+		}
+	}
+	if rec, _ := loadCredentialRecord("azure"); rec != nil && setting("IDP_AZURE_CLIENT_ID") != "" {
+		if pth, _ := runner.LookPath("az"); pth != "" {
+			clientID := setting("IDP_AZURE_CLIENT_ID")
+			res = append(res, scrubItem{
+				What: "the az login of " + clientID,
+				Remove: func(ctx context.Context) error {
+					out, err := runner.CombinedOutput(ctx, "az", "logout", "--username", clientID)
+					if err != nil {
+						return fmt.Errorf("az logout failure: %s: %w", strings.TrimSpace(string(out)), err)
+					}
+					return nil
+				},
+			})
+		}
+	}
+	return res, nil
+}
+
+// findScrubProviders logs out of every provider, which removes the AWS profiles, token files, the Vault token, the
+// helm registry logins and the environments of plugins.
+func findScrubProviders(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	var names []string
+	for _, p := range providers {
+		names = append(names, p.Name)
+	}
+	return []scrubItem{{
+		What: "the credentials of " + strings.Join(names, ", "),
+		Remove: func(ctx context.Context) error {
+			failed := logoutProviders(ctx, providers, opts.revoke)
+			if len(failed) > 0 {
+				return fmt.Errorf("cannot log out of %s", strings.Join(failed, ", "))
+			}
+			return nil
+		},
+	}}, nil
+}
+
+// findScrubCredHelpers finds the registries docker configure pointed at the credential helper.
+func findScrubCredHelpers(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	var res []scrubItem
+	for _, f := range registryAuthFiles() {
+		if _, err := os.Stat(f.path); err != nil {
+			continue
+		}
+		dc, err := readDockerConfig(f.path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.path, err)
+		}
+		var hosts []string
+		for _, host := range sortedKeys(dc.CredHelpers) {
+			if dc.CredHelpers[host] == dockerHelperSuffix() {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+		fn := f.path
+		res = append(res, scrubItem{
+			What: fmt.Sprintf("the credential helper of %s from %s", strings.Join(hosts, ", "), fn),
+			Remove: func(ctx context.Context) error {
+				dc, err := readDockerConfig(fn)
+				if err != nil {
+					return err
+				}
+				for _, host := range hosts {
+					delete(dc.CredHelpers, host)
+				}
+				return writeDockerConfig(fn, dc)
+			},
+		})
+	}
+	return res, nil
+}
+
+// findScrubGitHelpers finds the URLs git credential configure set the credential helper for.
+func findScrubGitHelpers(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	if pth, _ := runner.LookPath("git"); pth == "" {
+		return nil, nil
+	}
+	// exits with 1 when nothing matches
+	out, _ := runner.Output(ctx, "git", "config", "--global", "--get-regexp", `^credential\..*\.helper$`)
+	name := strings.TrimPrefix(gitHelperName, "git-credential-")
+	var res []scrubItem
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok || strings.TrimSpace(value) != name {
+			continue
+		}
+		res = append(res, scrubItem{
+			What: "the git credential helper of " + strings.TrimSuffix(strings.TrimPrefix(key, "credential."), ".helper"),
+			Remove: func(ctx context.Context) error {
+				out, err := runner.CombinedOutput(ctx, "git", "config", "--global", "--unset-all", key, "^"+name+"$")
+				if err != nil {
+					return fmt.Errorf("git config failure: %s: %w", strings.TrimSpace(string(out)), err)
+				}
+				return nil
+			},
+		})
+	}
+	return res, nil
+}
+
+// findScrubKubeconfigUsers finds the users of the kubeconfig which get their tokens from the kubectl plugin.
+func findScrubKubeconfigUsers(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	if pth, _ := runner.LookPath("kubectl"); pth == "" {
+		return nil, nil
+	}
+	out, err := runner.Output(ctx, "kubectl", "config", "view", "-o", "json")
+	if err != nil {
+		return nil, fmt.Errorf("kubectl config view failure: %w", err)
+	}
+	var kubeconfig struct {
+		Users []struct {
+			Name string `json:"name"`
+			User struct {
+				Exec *struct {
+					Command string   `json:"command"`
+					Args    []string `json:"args"`
+				} `json:"exec"`
+			} `json:"user"`
+		} `json:"users"`
+	}
+	err = json.Unmarshal(out, &kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the kubeconfig: %w", err)
+	}
+	var res []scrubItem
+	for _, u := range kubeconfig.Users {
+		exec := u.User.Exec
+		if exec == nil {
+			continue
+		}
+		command := filepath.Base(exec.Command)
+		if command != kubectlPluginName && !(command == "kubectl" && len(exec.Args) > 0 && exec.Args[0] == "idp") {
+			continue
+		}
+		name := u.Name
+		res = append(res, scrubItem{
+			What: "the kubeconfig user " + name,
+			Remove: func(ctx context.Context) error {
+				out, err := runner.CombinedOutput(ctx, "kubectl", "config", "unset", "users."+name)
+				if err != nil {
+					return fmt.Errorf("kubectl config unset failure: %s: %w", strings.TrimSpace(string(out)), err)
+				}
+				return nil
+			},
+		})
+	}
+	return res, nil
+}
+
+// findScrubRcloneRemotes finds the remotes rclone configure wrote.
+func findScrubRcloneRemotes(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	fn, err := rcloneConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	sections, err := iniSections(fn)
+	if err != nil {
+		return nil, err
+	}
+	prefix := rclonePrefix()
+	var res []scrubItem
+	for _, section := range sections {
+		if !strings.HasPrefix(section, prefix) {
+			continue
+		}
+		vals, err := readINISection(fn, section)
+		if err != nil {
+			return nil, err
+		}
+		if vals["env_auth"] != "true" {
+			// not one of ours after all
+			continue
+		}
+		section := section
+		res = append(res, scrubItem{
+			What: fmt.Sprintf("the rclone remote %s from %s", section, fn),
+			Remove: func(ctx context.Context) error {
+				return removeINIKeys(fn, section, sortedKeys(vals)...)
+			},
+		})
+	}
+	return res, nil
+}
+
+// findScrubArtifacts finds the files written outside the state directory which recordArtifact keeps track of,
+// like the env files of idp containers and the build secrets of idp buildkit, and the ready file.
+func findScrubArtifacts(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	paths, err := loadArtifacts()
+	if err != nil {
+		return nil, err
+	}
+	if fn := readyFile(""); fn != "" && !slices.Contains(paths, fn) {
+		paths = append(paths, fn)
+	}
+	var res []scrubItem
+	for _, fn := range paths {
+		if _, err := os.Lstat(fn); err != nil {
+			continue
+		}
+		fn := fn
+		res = append(res, scrubItem{
+			What:   fn,
+			Remove: func(ctx context.Context) error { return os.RemoveAll(fn) },
+		})
+	}
+	return res, nil
+}
+
+// findScrubState finds the state directory with the credential records, token files, caches and session state,
+// which go last as the other steps read them. The audit log stays unless asked for.
+func findScrubState(ctx context.Context, opts scrubOptions) ([]scrubItem, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	audit, _ := auditLogPath()
+	var res []scrubItem
+	for _, e := range entries {
+		fn := filepath.Join(dir, e.Name())
+		if fn == audit && !opts.auditLog {
+			continue
+		}
+		res = append(res, scrubItem{
+			What:   fn,
+			Remove: func(ctx context.Context) error { return os.RemoveAll(fn) },
+		})
+	}
+	if opts.auditLog && audit != "" && filepath.Dir(audit) != dir {
+		if _, err := os.Stat(audit); err == nil {
+			res = append(res, scrubItem{What: audit, Remove: func(ctx context.Context) error { return removeFiles(audit) }})
+		}
+	}
+	return res, nil
+}
+
+// artifactsPath returns the file which lists the artifacts written outside the state directory.
+func artifactsPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "artifacts.json"), nil
+}
+
+func loadArtifacts() ([]string, error) {
+	fn, err := artifactsPath()
+	if err != nil {
+		return nil, err
+	}
+	fc, err := os.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	err = json.Unmarshal(fc, &res)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", fn, err)
+	}
+	return res, nil
+}
+
+// recordArtifact remembers that the file or directory fn holds credentials this tool wrote, for scrub to remove.
+func recordArtifact(fn string) {
+	fn, err := filepath.Abs(fn)
+	if err != nil {
+		return
+	}
+	paths, err := loadArtifacts()
+	if err == nil && !slices.Contains(paths, fn) {
+		var fc []byte
+		fc, err = json.Marshal(append(paths, fn))
+		if err == nil {
+			var afn string
+			afn, err = artifactsPath()
+			if err == nil {
+				err = writeSecretFile(afn, fc)
+			}
+		}
+	}
+	if err != nil {
+		slog.Debug("cannot record the artifact for scrub", "path", fn, "error", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScrubEnvFilesWithoutSignin(t *testing.T) {
+	testWorkspace(t, &fakeRunner{})
+	fn := filepath.Join(t.TempDir(), ".env")
+	t.Setenv("IDP_DOTENV_PATH", fn)
+	t.Setenv("IDP_EXPORT_CLAIMS", "sub")
+	cfg = &config{Dotenv: &dotenvConfig{Keys: map[string]string{"AWS_ACCESS_KEY_ID": "APP_AWS_KEY"}}}
+	err := os.WriteFile(fn, []byte("APP_AWS_KEY=ASIA\nAWS_SESSION_TOKEN=token\nGITPOD_IDP_SUB=repo\nAPP_PORT=8080\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := findScrubEnvFiles(context.Background(), scrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("found %d items, want the variables of the dotenv file", len(items))
+	}
+	err = items[0].Remove(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := dotenvKeys(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys["APP_PORT"] {
+		t.Errorf("%s has %v left, want only APP_PORT", fn, sortedKeys(keys))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+)
+
+// secret holds a token or key in memory the process can overwrite, unlike a string, so that it doesn't linger for
+// a core dump or a debugger once it's wiped. It formats as [REDACTED] with fmt, slog and encoding/json, so that it
+// can't end up in output by accident; Bytes is the only way to get at the value.
+type secret struct {
+	b []byte
+}
+
+// newSecret returns a secret holding b, which it takes over: b must not be used by the caller afterwards.
+func newSecret(b []byte) *secret {
+	return &secret{b: b}
+}
+
+// newSecretString returns a secret holding a copy of s. s itself can't be wiped, so values should be turned into
+// secrets where they are obtained, before copies of them are made.
+func newSecretString(s string) *secret {
+	return newSecret([]byte(s))
+}
+
+// Bytes returns the value of the secret, which is only valid until the secret is wiped. A nil secret has none.
+func (s *secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.b
+}
+
+// Wipe overwrites the value of the secret with zeros and drops it.
+func (s *secret) Wipe() {
+	if s == nil {
+		return
+	}
+	wipe(s.b)
+	s.b = nil
+}
+
+func (s *secret) String() string {
+	return redacted
+}
+
+func (s *secret) GoString() string {
+	return redacted
+}
+
+// Format makes all verbs print [REDACTED], including %x and %q, which would otherwise print the bytes.
+func (s *secret) Format(f fmt.State, verb rune) {
+	_, _ = f.Write([]byte(redacted))
+}
+
+func (s *secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+func (s *secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redacted + `"`), nil
+}
+
+func (s *secret) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}
+
+// redactIn replaces the secret in text, keeping the header and claims of JWTs like redactSecret.
+func (s *secret) redactIn(text []byte) []byte {
+	if len(s.b) == 0 || !bytes.Contains(text, s.b) {
+		return text
+	}
+	repl := []byte(redacted)
+	if jwtPattern.Match(s.b) {
+		repl = jwtPattern.ReplaceAll(s.b, []byte("$1."+redacted))
+	}
+	return bytes.ReplaceAll(text, s.b, repl)
+}
+
+// wipe overwrites b with zeros.
+func wipe(b []byte) {
+	clear(b)
+}
+
+// writeWipedSecretFile writes content like writeSecretFile and wipes it afterwards, for buffers built to hold
+// credentials which aren't needed once they are on disk.
+func writeWipedSecretFile(fn string, content []byte) error {
+	defer wipe(content)
+	return writeSecretFile(fn, content)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "secrets",
+		Usage:   "secrets list [provider...] | get [--min-valid 5m] <id> | configure earthly [--bin-dir dir]",
+		Summary: "hand single credentials to Dagger, Earthly and other tools which run a command for their secrets",
+		Run:     runSecrets,
+	})
+}
+
+// earthlyProviderName is the name the Earthly secret provider is installed as. Earthly runs it with the name of the
+// secret as its argument.
+const earthlyProviderName = "earthly-secret-provider-gitpod-idp"
+
+// secretInfo is a secret secrets list shows, without its value.
+type secretInfo struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	// Dagger is the secret's URI for the secret arguments of Dagger functions.
+	Dagger string `json:"dagger"`
+}
+
+func runSecrets(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return exitErrorf(exitUsage, "usage: secrets list | get <id> | configure earthly")
+	}
+	switch args[0] {
+	case "list":
+		return runSecretsList(ctx, args[1:])
+	case "get":
+		return runSecretsGet(ctx, args[1:])
+	case "configure":
+		return runSecretsConfigure(ctx, args[1:])
+	}
+	return exitErrorf(exitUsage, "unknown secrets subcommand %q", args[0])
+}
+
+// runSecretsList shows the secrets the signed-in providers hand out, which are those buildkit passes to builds.
+func runSecretsList(ctx context.Context, args []string) error {
+	selected, err := selectProviders(args)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	res := []secretInfo{}
+	for _, p := range selected {
+		secrets, err := buildSecrets(ctx, []provider{p})
+		if err != nil {
+			return err
+		}
+		for _, id := range sortedKeys(secrets) {
+			res = append(res, secretInfo{ID: id, Provider: p.Name, Dagger: fmt.Sprintf("cmd://%q", exe+" secrets get "+id)})
+		}
+	}
+	return writeOutput(res, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPROVIDER\tDAGGER")
+		for _, s := range res {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.ID, s.Provider, s.Dagger)
+		}
+		return w.Flush()
+	})
+}
+
+// runSecretsGet prints the value of one secret, without a trailing newline, refreshing its provider's credentials
+// first if they expire soon. Unknown secrets exit with 2, which tells Earthly to try its other secret providers.
+func runSecretsGet(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("secrets get", flag.ExitOnError)
+	minValid := flags.Duration("min-valid", 5*time.Minute, "refresh credentials which expire sooner than this")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return exitErrorf(exitUsage, "usage: secrets get [--min-valid 5m] <id>")
+	}
+	id := flags.Arg(0)
+
+	for _, p := range providers {
+		err := loginWhereNeeded(ctx, []provider{p}, *minValid)
+		if err != nil {
+			return err
+		}
+		secrets, err := buildSecrets(ctx, []provider{p})
+		if err != nil {
+			return err
+		}
+		if v, ok := secrets[id]; ok {
+			meterUsage(ctx, "secrets", p.Name, id)
+			_, err = os.Stdout.WriteString(v)
+			return err
+		}
+	}
+	return exitErrorf(exitUsage, "unknown secret %q - secrets list shows them", id)
+}
+
+// runSecretsConfigure installs the Earthly secret provider and makes it Earthly's, so that earthly --secret id and
+// RUN --secret id=... get the credentials without them being in the environment.
+func runSecretsConfigure(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "earthly" {
+		return exitErrorf(exitUsage, "usage: secrets configure earthly [--bin-dir dir]")
+	}
+	flags := flag.NewFlagSet("secrets configure earthly", flag.ExitOnError)
+	binDir := flags.String("bin-dir", "", "install "+earthlyProviderName+" into this directory (default ~/.local/bin)")
+	_ = flags.Parse(args[1:])
+
+	dir, err := helperDir(*binDir)
+	if err != nil {
+		return err
+	}
+	helper, err := installHelper(dir, earthlyProviderName)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot install %s: %w", earthlyProviderName, err)
+	}
+	if _, err := runner.LookPath("earthly"); err != nil {
+		printWarning("earthly is not installed - once it is, run: earthly config global.secret_provider %s", helper)
+		return nil
+	}
+	out, err := runner.CombinedOutput(ctx, "earthly", "config", "global.secret_provider", helper)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return exitErrorf(exitPersistFailed, "earthly config failure: %s: %w", strings.TrimSpace(string(out)), err)
+		}
+		return exitErrorf(exitPersistFailed, "earthly config failure: %w", err)
+	}
+	emitEvent(eventProfileWritten, "", "tool", "earthly", "path", helper)
+	printSuccess("earthly gets its secrets from %s", helper)
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "self-update",
+		Usage:   "self-update [--check] [--version tag] [--insecure-skip-signature]",
+		Summary: "replace this binary with the latest release after verifying its checksum",
+		Run:     runSelfUpdate,
+	})
+}
+
+var (
+	// version is set at build time using -ldflags "-X main.version=v1.2.3".
+	version = "dev"
+	// releasePublicKey is the base64-encoded ed25519 key release checksums are signed with, set at build time.
+	// Without it, self-update refuses to install unless it's told to rely on checksums alone.
+	releasePublicKey = ""
+)
+
+const releasesURL = "https://api.github.com/repos/gitpod-io/example-idp-integration/releases"
+
+type release struct {
+	TagName string `json:"tag_name"`
+	// Body is the release notes.
+	Body       string `json:"body"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+	Assets     []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *release) assetURL(name string) string {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+func runSelfUpdate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := flags.Bool("check", false, "only report whether an update is available")
+	tag := flags.String("version", "", "release to install instead of the latest one")
+	skipSignature := flags.Bool("insecure-skip-signature", false, "install without a release signing key, trusting checksums from the same place as the binary")
+	_ = flags.Parse(args)
+	if releasePublicKey == "" && !*check && !*skipSignature {
+		// checksums from the same release only catch broken downloads, not whoever could replace the binary
+		return exitErrorf(exitMissingConfig, "this build has no release signing key to verify updates with - update it yourself, or pass --insecure-skip-signature to trust the release's checksums alone")
+	}
+
+	rel, err := fetchRelease(ctx, *tag)
+	if err != nil {
+		return err
+	}
+	if *tag == "" && !versionNewer(rel.TagName, version) {
+		fmt.Fprintf(os.Stderr, "%s is up to date\n", version)
+		return nil
+	}
+	if *check {
+		fmt.Printf("%s is available (running %s)\n", rel.TagName, version)
+		return nil
+	}
+
+	assetName := fmt.Sprintf("idp_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		assetName += ".exe"
+	}
+	binURL, sumsURL := rel.assetURL(assetName), rel.assetURL("checksums.txt")
+	if binURL == "" || sumsURL == "" {
+		return fmt.Errorf("release %s has no %s binary or checksums", rel.TagName, assetName)
+	}
+
+	sums, err := download(ctx, sumsURL)
+	if err != nil {
+		return err
+	}
+	if releasePublicKey != "" {
+		sigURL := rel.assetURL("checksums.txt.sig")
+		if sigURL == "" {
+			return fmt.Errorf("release %s is not signed", rel.TagName)
+		}
+		sig, err := download(ctx, sigURL)
+		if err != nil {
+			return err
+		}
+		err = verifyReleaseSignature(sums, sig)
+		if err != nil {
+			return err
+		}
+	} else {
+		slog.Warn("--insecure-skip-signature: verifying the checksum only")
+	}
+	expected, err := checksumFor(sums, assetName)
+	if err != nil {
+		return err
+	}
+
+	var bin []byte
+	err = withProgress("downloading "+rel.TagName, func() (err error) {
+		bin, err = download(ctx, binURL)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	actual := sha256.Sum256(bin)
+	if hex.EncodeToString(actual[:]) != expected {
+		return fmt.Errorf("checksum mismatch for %s: refusing to install", assetName)
+	}
+
+	err = replaceExecutable(bin)
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot replace binary: %w", err)
+	}
+	printSuccess("updated from %s to %s", version, rel.TagName)
+	return nil
+}
+
+func fetchRelease(ctx context.Context, tag string) (*release, error) {
+	u := releasesURL + "/latest"
+	if tag != "" {
+		u = releasesURL + "/tags/" + tag
+	}
+	fc, err := download(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	var rel release
+	err = json.Unmarshal(fc, &rel)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode release: %w", err)
+	}
+	return &rel, nil
+}
+
+// downloadClient fetches releases. Binaries take longer than the API calls httpClient is meant for.
+var downloadClient gitpodidp.HTTPDoer = &http.Client{Timeout: 60 * time.Second}
+
+func download(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot download %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func verifyReleaseSignature(msg, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(releasePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid release signing key in this build")
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("malformed release signature: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), msg, rawSig) {
+		return fmt.Errorf("release signature does not verify: refusing to install")
+	}
+	return nil
+}
+
+// checksumFor finds the sha256 of name in a checksums file in sha256sum format.
+func checksumFor(sums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// replaceExecutable atomically replaces the running binary with bin.
+func replaceExecutable(bin []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".idp-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(bin)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// versionNewer reports whether version a (e.g. v1.10.0) is newer than b. Development builds are never up to date.
+func versionNewer(a, b string) bool {
+	if b == "dev" {
+		return true
+	}
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if idx := strings.IndexAny(v, "-+"); idx >= 0 {
+		v = v[:idx]
+	}
+	var res []int
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		res = append(res, n)
+	}
+	return res
+}
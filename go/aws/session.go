@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// sessionState holds choices the user made interactively, so that they're asked only once per workspace session.
+type sessionState struct {
+	AWSRoleARN string `json:"awsRoleArn,omitempty"`
+	// Environment is the environment login --env selected.
+	Environment string `json:"environment,omitempty"`
+}
+
+// stateDir returns the directory this tool keeps its files in: IDP_CACHE_DIR, or gitpod-idp in XDG_CACHE_HOME or
+// the user's cache directory. Pointing IDP_CACHE_DIR below /workspace keeps the state across workspace restarts.
+func stateDir() (string, error) {
+	if dir := os.Getenv("IDP_CACHE_DIR"); dir != "" {
+		return filepath.Abs(dir)
+	}
+	return xdgDir("XDG_CACHE_HOME", os.UserCacheDir)
+}
+
+// userConfigDir returns the directory of the user's config file: IDP_CONFIG_DIR, or gitpod-idp in XDG_CONFIG_HOME
+// or the user's config directory.
+func userConfigDir() (string, error) {
+	if dir := os.Getenv("IDP_CONFIG_DIR"); dir != "" {
+		return filepath.Abs(dir)
+	}
+	return xdgDir("XDG_CONFIG_HOME", os.UserConfigDir)
+}
+
+// xdgDir returns gitpod-idp in the directory of the XDG variable env if it's set, which is honoured on every
+// platform, and in the one of the platform's convention otherwise.
+func xdgDir(env string, platformDir func() (string, error)) (string, error) {
+	dir := os.Getenv(env)
+	if !filepath.IsAbs(dir) {
+		// the spec says to ignore relative paths
+		var err error
+		dir, err = platformDir()
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "gitpod-idp"), nil
+}
+
+func sessionStatePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	id := os.Getenv("GITPOD_INSTANCE_ID")
+	if id == "" {
+		id = os.Getenv("GITPOD_WORKSPACE_ID")
+	}
+	if id == "" {
+		id = "local"
+	}
+	return filepath.Join(dir, "session-"+id+".json"), nil
+}
+
+// loadSessionState returns the state of the current session. Missing or unreadable state is treated as empty.
+func loadSessionState() (res sessionState) {
+	fn, err := sessionStatePath()
+	if err != nil {
+		return
+	}
+	fc, err := os.ReadFile(fn)
+	if err != nil {
+		return
+	}
+	_ = json.Unmarshal(fc, &res)
+	return
+}
+
+func saveSessionState(state sessionState) error {
+	fn, err := sessionStatePath()
+	if err != nil {
+		return err
+	}
+	fc, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeSecretFile(fn, fc)
+}
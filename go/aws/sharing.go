@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "snapshot",
+		Usage:   "snapshot",
+		Summary: "take a workspace snapshot with gp snapshot, refusing logins and refreshes until it is taken",
+		Run:     runSnapshot,
+	})
+}
+
+// Policies for signing in while the workspace is shared, which IDP_SHARED_WORKSPACE_POLICY selects.
+const (
+	sharedPolicyRefuse    = "refuse"
+	sharedPolicyDowngrade = "downgrade"
+	sharedPolicyAllow     = "allow"
+)
+
+// sharingCheckInterval is how long the daemon trusts an earlier look at whether the workspace is shared.
+const sharingCheckInterval = time.Minute
+
+// snapshotMaxAge is how long a snapshot marker counts, so that one a crashed snapshot left behind doesn't block
+// logins forever.
+const snapshotMaxAge = 10 * time.Minute
+
+// workspaceSharing caches whether the Gitpod API says the workspace is shared.
+var workspaceSharing struct {
+	mu      sync.Mutex
+	checked time.Time
+	reason  string
+}
+
+// sharedWorkspacePolicy returns the policy for signing in while the workspace is shared. It defaults to
+// downgrade if IDP_AWS_READONLY_ROLE_ARN is set, and to refuse otherwise.
+func sharedWorkspacePolicy() (string, error) {
+	switch policy := setting("IDP_SHARED_WORKSPACE_POLICY"); policy {
+	case "":
+		if setting("IDP_AWS_READONLY_ROLE_ARN") != "" {
+			return sharedPolicyDowngrade, nil
+		}
+		return sharedPolicyRefuse, nil
+	case sharedPolicyRefuse, sharedPolicyAllow:
+		return policy, nil
+	case sharedPolicyDowngrade:
+		if setting("IDP_AWS_READONLY_ROLE_ARN") == "" {
+			return "", exitErrorf(exitMissingConfig, "IDP_SHARED_WORKSPACE_POLICY is downgrade, but IDP_AWS_READONLY_ROLE_ARN is not set")
+		}
+		return policy, nil
+	default:
+		return "", exitErrorf(exitMissingConfig, "IDP_SHARED_WORKSPACE_POLICY must be refuse, downgrade or allow, not %q", policy)
+	}
+}
+
+// workspaceSharedReason returns why others may have access to the workspace - its owner shared it, or a snapshot
+// of it is being taken - or an empty string if they don't. Outside of Gitpod, and with an API that doesn't say,
+// the workspace counts as not shared, as refusing would lock everyone out. When the Gitpod API fails to answer,
+// though, it may well be shared, so it counts as shared until the API answers again.
+func workspaceSharedReason(ctx context.Context) string {
+	if snapshotInProgress() {
+		return "a snapshot of the workspace is being taken"
+	}
+	ws, err := gitpodidp.CurrentWorkspace()
+	if err != nil {
+		return ""
+	}
+
+	workspaceSharing.mu.Lock()
+	defer workspaceSharing.mu.Unlock()
+	if !workspaceSharing.checked.IsZero() && time.Since(workspaceSharing.checked) < sharingCheckInterval {
+		return workspaceSharing.reason
+	}
+	admission, err := ws.Admission(ctx)
+	if err != nil {
+		slog.Warn("cannot tell whether the workspace is shared, so it counts as shared", "error", err)
+		return "the Gitpod API cannot tell whether the workspace is shared"
+	}
+	workspaceSharing.reason = ""
+	if admission == gitpodidp.AdmissionEveryone {
+		workspaceSharing.reason = "the workspace is shared"
+	}
+	workspaceSharing.checked = time.Now()
+	return workspaceSharing.reason
+}
+
+// guardSharedWorkspace applies the shared workspace policy to signing into p. It refuses while others may have
+// access to the workspace, or, for AWS with the downgrade policy, returns a sign-in into the read-only role
+// instead. Outside of shared workspaces it returns signin.
+func guardSharedWorkspace(ctx context.Context, p provider, signin func(ctx context.Context) error) (func(ctx context.Context) error, error) {
+	policy, err := sharedWorkspacePolicy()
+	if err != nil {
+		return nil, err
+	}
+	if policy == sharedPolicyAllow {
+		return signin, nil
+	}
+	reason := workspaceSharedReason(ctx)
+	if reason == "" {
+		return signin, nil
+	}
+	if p.Name != "aws" || policy != sharedPolicyDowngrade {
+		return nil, exitErrorf(exitTokenMintFailed, "not signing into %s while %s, as others could get hold of the credentials - set IDP_SHARED_WORKSPACE_POLICY=allow to sign in anyway", p.Name, reason)
+	}
+
+	return readOnlySignin(p, reason), nil
+}
+
+type signinGuardedKey struct{}
+
+// withSigninGuarded marks ctx as that of a sign-in runSignin applied the policies to, so that minting its tokens
+// doesn't apply them again.
+func withSigninGuarded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, signinGuardedKey{}, true)
+}
+
+// guardCredentials applies the shared workspace and untrusted context policies to handing out what, e.g. a token
+// for an audience or the credentials for a registry, outside of runSignin: gitpodIDToken for every token minted,
+// and the commands which hand out credentials obtained earlier. There is no read-only alternative to downgrade to,
+// so downgrade refuses like refuse does.
+func guardCredentials(ctx context.Context, what string) error {
+	if guarded, _ := ctx.Value(signinGuardedKey{}).(bool); guarded {
+		return nil
+	}
+	policy, err := sharedWorkspacePolicy()
+	if err != nil {
+		return err
+	}
+	if policy != sharedPolicyAllow {
+		if reason := workspaceSharedReason(ctx); reason != "" {
+			return exitErrorf(exitTokenMintFailed, "not handing out %s while %s, as others could get hold of it - set IDP_SHARED_WORKSPACE_POLICY=allow to anyway", what, reason)
+		}
+	}
+	return guardUntrustedCredentials(ctx, what)
+}
+
+func snapshotMarkerPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "snapshot-in-progress"), nil
+}
+
+// snapshotInProgress reports whether idp snapshot is taking a snapshot of the workspace.
+func snapshotInProgress() bool {
+	fn, err := snapshotMarkerPath()
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(fn)
+	return err == nil && time.Since(fi.ModTime()) < snapshotMaxAge
+}
+
+func runSnapshot(ctx context.Context, args []string) error {
+	if !runningInGitpod() {
+		return gitpodidp.ErrNotInGitpod
+	}
+	fn, err := snapshotMarkerPath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(fn), 0o700)
+	if err == nil {
+		err = os.WriteFile(fn, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o600)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot mark the snapshot as in progress: %w", err)
+	}
+	defer func() {
+		if err := removeFiles(fn); err != nil {
+			slog.Warn("cannot clear the snapshot marker", "error", err)
+		}
+	}()
+
+	out, err := runner.CombinedOutput(ctx, "gp", "snapshot")
+	if err != nil {
+		return fmt.Errorf("gp snapshot failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	fmt.Print(string(out))
+	return nil
+}
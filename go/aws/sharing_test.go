@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// sharedWorkspace makes the workspace look shared, as the Gitpod API would say.
+func sharedWorkspace(t *testing.T) {
+	t.Helper()
+	t.Setenv("GITPOD_WORKSPACE_ID", "ws-test")
+	workspaceSharing.mu.Lock()
+	workspaceSharing.checked, workspaceSharing.reason = time.Now(), "the workspace is shared"
+	workspaceSharing.mu.Unlock()
+	t.Cleanup(func() {
+		workspaceSharing.mu.Lock()
+		workspaceSharing.checked, workspaceSharing.reason = time.Time{}, ""
+		workspaceSharing.mu.Unlock()
+	})
+}
+
+func fakeGitpodToken(name string, args ...string) ([]byte, error) {
+	if name == "gp" && len(args) > 1 && args[0] == "idp" && args[1] == "token" {
+		return []byte("eyJhbGciOiJub25lIn0.eyJzdWIiOiJ0ZXN0In0.c2ln\n"), nil
+	}
+	return nil, errors.New("unexpected command")
+}
+
+func TestGitpodIDTokenSharedWorkspace(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		guarded bool
+		wantErr bool
+	}{
+		{name: "refuse", wantErr: true},
+		{name: "downgrade", policy: sharedPolicyDowngrade, wantErr: true},
+		{name: "allow", policy: sharedPolicyAllow},
+		{name: "guarded by runSignin", guarded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeRunner{run: fakeGitpodToken}
+			testWorkspace(t, r)
+			sharedWorkspace(t)
+			t.Setenv("IDP_SHARED_WORKSPACE_POLICY", tt.policy)
+			if tt.policy == sharedPolicyDowngrade {
+				t.Setenv("IDP_AWS_READONLY_ROLE_ARN", "arn:aws:iam::123456789012:role/readonly")
+			}
+			ctx := context.Background()
+			if tt.guarded {
+				ctx = withSigninGuarded(ctx)
+			}
+
+			_, err := gitpodIDToken(ctx, gitpodidp.AWSAudience)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gitpodIDToken() error = %v, want error %v", err, tt.wantErr)
+			}
+			if r.ran("gp idp token") == tt.wantErr {
+				t.Errorf("minted a token: %v, want %v", r.ran("gp idp token"), !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSharingUnknownCountsAsShared(t *testing.T) {
+	r := &fakeRunner{run: fakeGitpodToken}
+	testWorkspace(t, r)
+	t.Setenv("GITPOD_WORKSPACE_ID", "ws-test")
+	t.Setenv("GITPOD_HOST", "https://gitpod.example")
+	t.Setenv("IDP_SHARED_WORKSPACE_POLICY", "")
+	d := &fakeDoer{}
+	oldClient := httpClient
+	httpClient = d
+	gitpodidp.SetHTTPClient(d)
+	t.Cleanup(func() {
+		httpClient = oldClient
+		gitpodidp.SetHTTPClient(oldClient)
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := gitpodIDToken(context.Background(), gitpodidp.AWSAudience); err == nil {
+			t.Fatal("gitpodIDToken() minted a token though the Gitpod API cannot tell whether the workspace is shared")
+		}
+	}
+	if r.ran("gp idp token") {
+		t.Error("minted a token")
+	}
+	workspaceSharing.mu.Lock()
+	checked := workspaceSharing.checked
+	workspaceSharing.mu.Unlock()
+	if !checked.IsZero() {
+		t.Error("cached the failure to tell whether the workspace is shared")
+	}
+}
+
+func TestMCPRefusedInSharedWorkspace(t *testing.T) {
+	r := &fakeRunner{run: fakeGitpodToken}
+	testWorkspace(t, r)
+	sharedWorkspace(t)
+	t.Setenv("IDP_AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/gitpod")
+	aws, _ := findProvider("aws")
+	s := &mcpServer{providers: []provider{aws}, maxDuration: time.Hour}
+	s.tools = s.availableTools()
+
+	params, _ := json.Marshal(map[string]any{"name": "aws_credentials", "arguments": map[string]any{"reason": "test"}})
+	res, err := s.handle(context.Background(), rpcRequest{Method: "tools/call", Params: params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _ := res.(map[string]any)
+	if result["isError"] != true {
+		t.Fatalf("aws_credentials handed out credentials in a shared workspace: %v", res)
+	}
+	text, _ := json.Marshal(result["content"])
+	if !strings.Contains(string(text), "the workspace is shared") {
+		t.Errorf("aws_credentials failed with %s, want the shared workspace refusal", text)
+	}
+	if r.ran("gp idp token") {
+		t.Error("aws_credentials minted a token in a shared workspace")
+	}
+}
+
+func TestDockerGetRefusedInSharedWorkspace(t *testing.T) {
+	r := &fakeRunner{run: fakeGitpodToken}
+	testWorkspace(t, r)
+	sharedWorkspace(t)
+	t.Setenv("IDP_AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/gitpod")
+
+	fakeStdin(t, "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com\n")
+
+	err := dockerGet(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "the workspace is shared") {
+		t.Fatalf("dockerGet() error = %v, want the shared workspace refusal", err)
+	}
+	if r.ran("aws ecr") {
+		t.Error("dockerGet obtained registry credentials in a shared workspace")
+	}
+}
+
+func TestGitCredentialGetRefusedInSharedWorkspace(t *testing.T) {
+	r := &fakeRunner{run: fakeGitpodToken}
+	testWorkspace(t, r)
+	t.Setenv("IDP_AZURE_CLIENT_ID", "client-1")
+	t.Setenv("IDP_AZURE_TENANT_ID", "tenant-1")
+	dir, err := stateDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// credentials obtained before the workspace was shared
+	fc, _ := json.Marshal(registryCredentials{Username: "gitpod-idp", Secret: "cached-secret", Expiry: time.Now().Add(time.Hour)})
+	err = writeSealedFile(filepath.Join(dir, "docker", "dev.azure.com.json"), fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedWorkspace(t)
+	fakeStdin(t, "protocol=https\nhost=dev.azure.com\n\n")
+
+	err = gitCredentialGet(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "the workspace is shared") {
+		t.Fatalf("gitCredentialGet() error = %v, want the shared workspace refusal", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// signinMethod is one way of obtaining AWS credentials and writing them to the default profile.
+type signinMethod interface {
+	Name() string
+	// Available reports whether the method can be used in this environment at all.
+	Available() bool
+	// Requires describes what the method needs to be available, for the chain report.
+	Requires() string
+	// Login assumes roleARN.
+	Login(ctx context.Context, roleARN string) error
+	// Refresh renews credentials obtained by an earlier login without asking the user anything.
+	Refresh(ctx context.Context, rec credentialRecord) error
+}
+
+// signinMethods are tried in order until one of them signs in, unless IDP_SIGNIN_ORDER says otherwise.
+var signinMethods []signinMethod
+
+func registerSigninMethod(m signinMethod) {
+	signinMethods = append(signinMethods, m)
+}
+
+func findSigninMethod(name string) signinMethod {
+	for _, m := range signinMethods {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func init() {
+	registerSigninMethod(gitpodCLISignin{})
+	registerSigninMethod(gitpodAPISignin{})
+	registerSigninMethod(ssoSignin{})
+}
+
+// signinStep is an entry of the sign-in chain: a method, and the condition under which it is tried.
+type signinStep struct {
+	Method    signinMethod
+	Condition string
+}
+
+// signinConditions are the conditions steps of IDP_SIGNIN_ORDER can depend on. Prefixing one with ! negates it.
+var signinConditions = map[string]func() bool{
+	"gitpod":   runningInGitpod,
+	"terminal": func() bool { return isTerminal(os.Stdin) },
+}
+
+func (s signinStep) applies() bool {
+	if s.Condition == "" {
+		return true
+	}
+	name := strings.TrimPrefix(s.Condition, "!")
+	return signinConditions[name]() != strings.HasPrefix(s.Condition, "!")
+}
+
+// signinChain returns the steps of IDP_SIGNIN_ORDER, e.g. "gp,api,sso:!gitpod", or all registered methods in
+// order if it is not set.
+func signinChain() ([]signinStep, error) {
+	order := setting("IDP_SIGNIN_ORDER")
+	if order == "" {
+		res := make([]signinStep, len(signinMethods))
+		for i, m := range signinMethods {
+			res[i] = signinStep{Method: m}
+		}
+		return res, nil
+	}
+
+	var res []signinStep
+	for _, entry := range strings.Split(order, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, cond, _ := strings.Cut(entry, ":")
+		m := findSigninMethod(strings.TrimSpace(name))
+		if m == nil {
+			var known []string
+			for _, m := range signinMethods {
+				known = append(known, m.Name())
+			}
+			return nil, exitErrorf(exitMissingConfig, "IDP_SIGNIN_ORDER: unknown sign-in method %q, use one of %s", name, strings.Join(known, ", "))
+		}
+		cond = strings.TrimSpace(cond)
+		if _, ok := signinConditions[strings.TrimPrefix(cond, "!")]; cond != "" && !ok {
+			return nil, exitErrorf(exitMissingConfig, "IDP_SIGNIN_ORDER: unknown condition %q, use gitpod or terminal, optionally negated with !", cond)
+		}
+		res = append(res, signinStep{Method: m, Condition: cond})
+	}
+	if len(res) == 0 {
+		return nil, exitErrorf(exitMissingConfig, "IDP_SIGNIN_ORDER lists no sign-in method")
+	}
+	return res, nil
+}
+
+// loginAWS tries the available AWS sign-in methods of the chain in order until one succeeds, or all of them at
+// once with IDP_SIGNIN_RACE. If none does, the error lists why each of them failed. With IDP_AWS_PROFILES, it signs
+// into each of its profiles instead, unless -role picks a single role.
+func loginAWS(ctx context.Context) error {
+	return loginAWSRole(ctx, "", confirmRole)
+}
+
+// loginAWSRole is loginAWS into roleARN, or the role -role and the settings select if it's empty, checking it
+// with confirm first.
+func loginAWSRole(ctx context.Context, roleARN string, confirm func(ctx context.Context, roleARN string) error) error {
+	profiles, err := awsProfiles()
+	if err != nil {
+		return err
+	}
+	if len(profiles) > 0 && *roleFlag == "" && roleARN == "" {
+		return loginAWSProfiles(ctx, profiles, confirm)
+	}
+	chain, err := signinChain()
+	if err != nil {
+		return err
+	}
+	report := &chainReport{}
+	defer report.publish()
+	var candidates []signinMethod
+	for _, step := range chain {
+		switch {
+		case !step.applies():
+			report.add(step.Method.Name(), attemptSkipped, fmt.Sprintf("condition %s doesn't hold", step.Condition), 0)
+		case !step.Method.Available():
+			report.add(step.Method.Name(), attemptSkipped, "needs "+step.Method.Requires(), 0)
+		default:
+			candidates = append(candidates, step.Method)
+		}
+	}
+	ctx = context.WithValue(ctx, chainReportKey{}, report)
+
+	var errs []error
+	if len(candidates) > 0 {
+		if roleARN == "" {
+			roleARN, err = awsRoleARN()
+			if err != nil {
+				return err
+			}
+		}
+		if roleARN == "" {
+			slog.Warn("running in a Gitpod workspace, but IDP_AWS_ROLE_ARN is not set - set up OIDC trust (https://www.gitpod.io/docs/integrations/aws) and set IDP_AWS_ROLE_ARN on your project")
+			return signinFailed([]error{gitpodidp.ErrRoleNotConfigured})
+		}
+		err = confirm(ctx, roleARN)
+		if err != nil {
+			return err
+		}
+		if setting("IDP_SIGNIN_RACE") == "true" && len(candidates) > 1 {
+			errs = raceSignin(ctx, candidates, roleARN)
+		} else {
+			errs = chainSignin(ctx, candidates, roleARN)
+		}
+		if errs == nil {
+			return writeAWSRegion("default", setting("IDP_AWS_REGION"))
+		}
+		if ctx.Err() != nil {
+			return errs[0]
+		}
+	}
+	if len(errs) == 0 && !runningInGitpod() {
+		errs = append(errs, fmt.Errorf("no sign-in method is available: %w", gitpodidp.ErrNotInGitpod))
+	}
+	if len(errs) == 0 {
+		errs = append(errs, withExitCode(exitMissingConfig, errors.New("no sign-in method of IDP_SIGNIN_ORDER applies here")))
+	}
+	return signinFailed(errs)
+}
+
+// writeAWSRegion sets the region of profile in the AWS config file, if there is one to set.
+func writeAWSRegion(profile, region string) error {
+	if region == "" {
+		return nil
+	}
+	err := gitpodidp.WriteAWSConfig(profile, map[string]string{"region": region})
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot set the region of the %s profile: %w", profile, err)
+	}
+	return nil
+}
+
+// signinFailed explains that none of the sign-in methods worked, with errs the reasons why.
+func signinFailed(errs []error) error {
+	// the last method tried is the most generic one, so its failure is most telling
+	code := exitCode(errs[len(errs)-1])
+	return exitErrorf(code, "don't know how to sign in - I've tried everything 🤷\n%w", errors.Join(errs...))
+}
+
+// chainSignin tries methods one after the other. It returns nil once one succeeds, and otherwise why each of them
+// failed. If ctx is cancelled, it returns just that error.
+func chainSignin(ctx context.Context, methods []signinMethod, roleARN string) []error {
+	report, _ := ctx.Value(chainReportKey{}).(*chainReport)
+	var errs []error
+	for i, m := range methods {
+		start := time.Now()
+		err := m.Login(ctx, roleARN)
+		report.result(m.Name(), err, time.Since(start))
+		if err == nil {
+			for _, rest := range methods[i+1:] {
+				report.add(rest.Name(), attemptNotTried, m.Name()+" signed in first", 0)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return []error{err}
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", m.Name(), err))
+	}
+	return errs
+}
+
+// errSigninRaceLost is returned by the methods which lose a race of IDP_SIGNIN_RACE.
+var errSigninRaceLost = errors.New("another sign-in method was faster")
+
+// signinRace makes sure only the first method to obtain credentials writes them.
+type signinRace struct {
+	mu  sync.Mutex
+	won bool
+}
+
+type signinRaceKey struct{}
+
+// raceSignin tries methods concurrently and cancels the others once one succeeds, so that a method which is slow
+// to time out doesn't hold up the ones after it. It returns like chainSignin.
+func raceSignin(ctx context.Context, methods []signinMethod, roleARN string) []error {
+	report, _ := ctx.Value(chainReportKey{}).(*chainReport)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx = context.WithValue(ctx, signinRaceKey{}, &signinRace{})
+
+	type result struct {
+		i       int
+		err     error
+		elapsed time.Duration
+	}
+	results := make(chan result, len(methods))
+	for i, m := range methods {
+		go func(i int, m signinMethod) {
+			start := time.Now()
+			err := m.Login(ctx, roleARN)
+			results <- result{i, err, time.Since(start)}
+		}(i, m)
+	}
+
+	errs := make([]error, len(methods))
+	won := false
+	for range methods {
+		r := <-results
+		if won {
+			report.add(methods[r.i].Name(), attemptLost, "another method signed in first", r.elapsed)
+			continue
+		}
+		report.result(methods[r.i].Name(), r.err, r.elapsed)
+		if r.err == nil {
+			slog.Debug("sign-in method won the race", "method", methods[r.i].Name())
+			won = true
+			// wait for the losers, so none of them is still running once the command exits
+			cancel()
+			continue
+		}
+		errs[r.i] = fmt.Errorf("%s: %w", methods[r.i].Name(), r.err)
+	}
+	if won {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return []error{ctx.Err()}
+	}
+	return errs
+}
+
+// racingSignin reports whether the sign-in method running with ctx races others.
+func racingSignin(ctx context.Context) bool {
+	_, ok := ctx.Value(signinRaceKey{}).(*signinRace)
+	return ok
+}
+
+// persistCredentials runs persist, which writes the AWS credentials. While sign-in methods race, only the first
+// one to get here writes them; the others fail with errSigninRaceLost, so that they can't overwrite the winner's
+// credentials half way.
+func persistCredentials(ctx context.Context, persist func() error) error {
+	race, ok := ctx.Value(signinRaceKey{}).(*signinRace)
+	if !ok {
+		return persist()
+	}
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	if race.won {
+		return errSigninRaceLost
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := persist()
+	if err == nil {
+		race.won = true
+	}
+	return err
+}
+
+// refreshAWS renews the AWS credentials using the method that obtained them.
+func refreshAWS(ctx context.Context) error {
+	rec, err := loadCredentialRecord("aws")
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return exitErrorf(exitMissingConfig, "not signed into aws")
+	}
+	if rec.Method == elevateMethod {
+		return refreshElevated(ctx)
+	}
+	if profiles, err := awsProfiles(); err != nil {
+		return err
+	} else if rec.Method == awsProfilesMethod && len(profiles) > 0 {
+		// privileged roles were confirmed on login
+		return loginAWSProfiles(ctx, profiles, checkRefreshAllowed)
+	}
+	m := findSigninMethod(rec.Method)
+	if m == nil || !m.Available() {
+		return loginAWS(ctx)
+	}
+	// privileged roles were confirmed on login
+	err = checkRefreshAllowed(ctx, rec.Identity)
+	if err != nil {
+		return err
+	}
+	return m.Refresh(ctx, *rec)
+}
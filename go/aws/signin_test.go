@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSignin is a sign-in method which signs in with login, persisting nothing but a count of the methods which
+// got to write their credentials.
+type fakeSignin struct {
+	name      string
+	login     func(ctx context.Context) error
+	persisted *atomic.Int32
+}
+
+func (m fakeSignin) Name() string     { return m.name }
+func (m fakeSignin) Available() bool  { return true }
+func (m fakeSignin) Requires() string { return "nothing" }
+func (m fakeSignin) Refresh(ctx context.Context, rec credentialRecord) error {
+	return m.Login(ctx, rec.Identity)
+}
+
+func (m fakeSignin) Login(ctx context.Context, roleARN string) error {
+	err := m.login(ctx)
+	if err != nil {
+		return err
+	}
+	return persistCredentials(ctx, func() error {
+		m.persisted.Add(1)
+		return nil
+	})
+}
+
+// signinAfter signs in after d, or fails once ctx is done.
+func signinAfter(d time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		select {
+		case <-time.After(d):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func failSignin(msg string) func(ctx context.Context) error {
+	return func(ctx context.Context) error { return errors.New(msg) }
+}
+
+func TestSigninChain(t *testing.T) {
+	tests := []struct {
+		order   string
+		want    []string
+		wantErr bool
+	}{
+		{order: "", want: []string{"gp", "api", "sso"}},
+		{order: "sso", want: []string{"sso"}},
+		{order: " gp , sso:!gitpod ,", want: []string{"gp", "sso:!gitpod"}},
+		{order: "api:terminal,gp", want: []string{"api:terminal", "gp"}},
+		{order: "okta", wantErr: true},
+		{order: "gp:laptop", wantErr: true},
+		{order: ",", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			testWorkspace(t, &fakeRunner{})
+			t.Setenv("IDP_SIGNIN_ORDER", tt.order)
+			chain, err := signinChain()
+			if tt.wantErr {
+				if exitCode(err) != exitMissingConfig {
+					t.Fatalf("signinChain() error = %v, want one with exit code %d", err, exitMissingConfig)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, step := range chain {
+				s := step.Method.Name()
+				if step.Condition != "" {
+					s += ":" + step.Condition
+				}
+				got = append(got, s)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("signinChain() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSigninStepApplies(t *testing.T) {
+	testWorkspace(t, &fakeRunner{})
+	gp := findSigninMethod("gp")
+	if !(signinStep{Method: gp, Condition: "gitpod"}).applies() {
+		t.Error("gitpod doesn't hold in a workspace")
+	}
+	if (signinStep{Method: gp, Condition: "!gitpod"}).applies() {
+		t.Error("!gitpod holds in a workspace")
+	}
+	if !(signinStep{Method: gp}).applies() {
+		t.Error("a step without a condition doesn't apply")
+	}
+}
+
+// runSigninMethods runs the methods one after the other, or in a race, and returns the errors and the report.
+func runSigninMethods(race bool, methods ...signinMethod) ([]error, *chainReport) {
+	report := &chainReport{}
+	ctx := context.WithValue(context.Background(), chainReportKey{}, report)
+	if race {
+		return raceSignin(ctx, methods, "arn:aws:iam::123456789012:role/gitpod"), report
+	}
+	return chainSignin(ctx, methods, "arn:aws:iam::123456789012:role/gitpod"), report
+}
+
+// reportResults returns the results of the report by method, e.g. gp=failed.
+func reportResults(report *chainReport) []string {
+	var res []string
+	for _, a := range report.Attempts {
+		res = append(res, a.Method+"="+a.Result)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestChainSignin(t *testing.T) {
+	var persisted atomic.Int32
+	errs, report := runSigninMethods(false,
+		fakeSignin{name: "gp", login: failSignin("gp is not installed"), persisted: &persisted},
+		fakeSignin{name: "api", login: signinAfter(0), persisted: &persisted},
+		fakeSignin{name: "sso", login: func(ctx context.Context) error {
+			t.Error("tried sso after api signed in")
+			return nil
+		}, persisted: &persisted},
+	)
+	if errs != nil {
+		t.Fatalf("chainSignin() = %v, want nil", errs)
+	}
+	if n := persisted.Load(); n != 1 {
+		t.Errorf("%d methods persisted credentials, want 1", n)
+	}
+	want := "api=succeeded,gp=failed,sso=not tried"
+	if got := strings.Join(reportResults(report), ","); got != want {
+		t.Errorf("the report says %s, want %s", got, want)
+	}
+
+	errs, _ = runSigninMethods(false,
+		fakeSignin{name: "gp", login: failSignin("gp is not installed"), persisted: &persisted},
+		fakeSignin{name: "api", login: failSignin("no API token"), persisted: &persisted},
+	)
+	if len(errs) != 2 || errs[0].Error() != "gp: gp is not installed" || errs[1].Error() != "api: no API token" {
+		t.Errorf("chainSignin() = %q, want why each method failed", errs)
+	}
+}
+
+func TestRaceSignin(t *testing.T) {
+	var persisted atomic.Int32
+	start := time.Now()
+	errs, report := runSigninMethods(true,
+		// slow to time out, which the race doesn't wait for
+		fakeSignin{name: "gp", login: signinAfter(time.Minute), persisted: &persisted},
+		fakeSignin{name: "api", login: signinAfter(0), persisted: &persisted},
+		fakeSignin{name: "sso", login: failSignin("no terminal"), persisted: &persisted},
+	)
+	if errs != nil {
+		t.Fatalf("raceSignin() = %v, want nil", errs)
+	}
+	if took := time.Since(start); took > 10*time.Second {
+		t.Errorf("the race took %v, waiting for the slow method", took)
+	}
+	if n := persisted.Load(); n != 1 {
+		t.Errorf("%d methods persisted credentials, want 1", n)
+	}
+	results := strings.Join(reportResults(report), ",")
+	if !strings.Contains(results, "api=succeeded") || !strings.Contains(results, "gp=lost the race") {
+		t.Errorf("the report says %s, want api to win and gp to lose", results)
+	}
+}
+
+func TestRaceSigninPersistsOnce(t *testing.T) {
+	var persisted atomic.Int32
+	// all of them obtain credentials at once, but only one may write them
+	methods := make([]signinMethod, 8)
+	for i := range methods {
+		methods[i] = fakeSignin{name: string(rune('a' + i)), login: signinAfter(0), persisted: &persisted}
+	}
+	errs, _ := runSigninMethods(true, methods...)
+	if errs != nil {
+		t.Fatalf("raceSignin() = %v, want nil", errs)
+	}
+	if n := persisted.Load(); n != 1 {
+		t.Errorf("%d methods persisted credentials, want 1", n)
+	}
+}
+
+func TestRaceSigninAllFail(t *testing.T) {
+	var persisted atomic.Int32
+	errs, _ := runSigninMethods(true,
+		fakeSignin{name: "gp", login: failSignin("gp is not installed"), persisted: &persisted},
+		fakeSignin{name: "api", login: failSignin("no API token"), persisted: &persisted},
+	)
+	if len(errs) != 2 || errs[0].Error() != "gp: gp is not installed" || errs[1].Error() != "api: no API token" {
+		t.Errorf("raceSignin() = %q, want why each method failed, in the order of the chain", errs)
+	}
+}
+
+func TestLoginAWSWithGitpodCLI(t *testing.T) {
+	const role = "arn:aws:iam::123456789012:role/gitpod"
+	tests := []struct {
+		name     string
+		run      func(name string, args ...string) ([]byte, error)
+		wantCode int
+	}{
+		{name: "signed in", run: func(name string, args ...string) ([]byte, error) { return []byte("ok"), nil }},
+		{name: "gp fails", wantCode: exitExchangeFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeRunner{run: tt.run}
+			testWorkspace(t, r)
+			t.Setenv("IDP_SIGNIN_ORDER", "gp")
+			t.Setenv("IDP_AWS_ROLE_ARN", role)
+
+			err := loginAWSRole(context.Background(), "", func(ctx context.Context, roleARN string) error { return nil })
+			if exitCode(err) != tt.wantCode {
+				t.Fatalf("loginAWSRole() error = %v, want exit code %d", err, tt.wantCode)
+			}
+			if !r.ran("gp idp login aws --role-arn " + role) {
+				t.Errorf("ran %q, want gp idp login", r.calls)
+			}
+			rec, err := loadCredentialRecord("aws")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode != 0 {
+				if rec != nil {
+					t.Errorf("recorded %+v after failing", rec)
+				}
+				return
+			}
+			if rec == nil || rec.Identity != role || rec.Method != "gp" {
+				t.Errorf("recorded %+v, want %s signed in with gp", rec, role)
+			}
+		})
+	}
+}
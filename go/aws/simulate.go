@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "simulate",
+		Usage:   "simulate aws --policy file | gcp --provider file | --condition expr | azure --credential file [--claims file] [--claim name=value...]",
+		Summary: "evaluate a trust policy, attribute condition or federated credential against token claims offline",
+		Run:     runSimulate,
+	})
+}
+
+// simulateClaims are the flags which choose the claims to evaluate: those of a file, or of this workspace's token,
+// with some of them replaced.
+type simulateClaims struct {
+	file      *string
+	overrides stringList
+}
+
+func addSimulateClaimFlags(flags *flag.FlagSet) *simulateClaims {
+	c := &simulateClaims{file: flags.String("claims", "", "JSON claims or a token to evaluate, - for stdin (default this workspace's token)")}
+	flags.Var(&c.overrides, "claim", "replace a claim, name=value, where JSON values like [\"a\",\"b\"] are decoded; repeatable")
+	return c
+}
+
+// load returns the claims, minting a token for audience if no file was given, so that they are what the provider
+// would see.
+func (c *simulateClaims) load(ctx context.Context, audience string) (map[string]interface{}, error) {
+	var claims map[string]interface{}
+	if *c.file != "" {
+		fc, err := readSimulateInput(*c.file)
+		if err != nil {
+			return nil, err
+		}
+		text := strings.TrimSpace(string(fc))
+		if strings.HasPrefix(text, "{") {
+			err = json.Unmarshal([]byte(text), &claims)
+		} else {
+			claims, err = gitpodidp.Claims(text)
+		}
+		if err != nil {
+			return nil, exitErrorf(exitUsage, "cannot read the claims in %s: %w", *c.file, err)
+		}
+	} else {
+		token, err := gitpodIDToken(ctx, audience)
+		if err != nil {
+			return nil, exitErrorf(exitMissingConfig, "cannot get this workspace's token: %w - pass --claims to evaluate other claims", err)
+		}
+		claims, err = gitpodidp.Claims(token)
+		if err != nil {
+			return nil, withExitCode(exitTokenMintFailed, err)
+		}
+	}
+	for _, o := range c.overrides {
+		name, value, ok := strings.Cut(o, "=")
+		if !ok || name == "" {
+			return nil, exitErrorf(exitUsage, "invalid --claim %q: use name=value", o)
+		}
+		var v interface{}
+		if json.Unmarshal([]byte(value), &v) != nil {
+			v = value
+		}
+		claims[name] = v
+	}
+	return claims, nil
+}
+
+func readSimulateInput(fn string) ([]byte, error) {
+	if fn == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(fn)
+}
+
+func runSimulate(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return exitErrorf(exitUsage, "simulate needs a provider: aws, gcp or azure")
+	}
+	var (
+		eval *trustEvaluation
+		what string
+		err  error
+	)
+	switch args[0] {
+	case "aws":
+		eval, err = simulateAWS(ctx, args[1:])
+		what = "assume the role"
+	case "gcp":
+		eval, err = simulateGCP(ctx, args[1:])
+		what = "be exchanged by the workload identity provider"
+	case "azure":
+		eval, err = simulateAzure(ctx, args[1:])
+		what = "sign in to the app"
+	default:
+		return exitErrorf(exitUsage, "cannot simulate %q: use aws, gcp or azure", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	err = writeOutput(eval, func(w io.Writer) error {
+		printTrustEvaluation(w, eval, what)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !eval.Allowed {
+		return exitErrorf(exitExchangeFailed, "the token may not %s", what)
+	}
+	return nil
+}
+
+func simulateAWS(ctx context.Context, args []string) (*trustEvaluation, error) {
+	flags := flag.NewFlagSet("simulate aws", flag.ExitOnError)
+	policyFile := flags.String("policy", "", "the trust policy, or the output of aws iam get-role, - for stdin")
+	issuer := flags.String("issuer", "", "issuer of the token (default its iss claim)")
+	claims := addSimulateClaimFlags(flags)
+	_ = flags.Parse(args)
+	if *policyFile == "" {
+		return nil, exitErrorf(exitUsage, "simulate aws needs --policy")
+	}
+	policy, err := readSimulateInput(*policyFile)
+	if err != nil {
+		return nil, err
+	}
+	var role struct {
+		Role struct {
+			AssumeRolePolicyDocument json.RawMessage
+		}
+	}
+	if json.Unmarshal(policy, &role) == nil && len(role.Role.AssumeRolePolicyDocument) > 0 {
+		policy = role.Role.AssumeRolePolicyDocument
+	}
+	c, err := claims.load(ctx, gitpodidp.AWSAudience)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateAWSTrustPolicy(policy, simulateIssuerHost(*issuer, c), c)
+}
+
+// simulateIssuerHost returns the issuer without https://, as IAM condition keys and provider ARNs have it.
+func simulateIssuerHost(issuer string, claims map[string]interface{}) string {
+	if issuer == "" {
+		issuer, _ = claims["iss"].(string)
+	}
+	if issuer == "" {
+		issuer, _ = gitpodIssuer()
+	}
+	return strings.TrimPrefix(issuer, "https://")
+}
+
+// gcpProviderConfig is the part of a workload identity pool provider, as gcloud iam workload-identity-pools
+// providers describe --format=json prints it, which decides about token exchanges.
+type gcpProviderConfig struct {
+	Name               string            `json:"name"`
+	Disabled           bool              `json:"disabled"`
+	AttributeCondition string            `json:"attributeCondition"`
+	AttributeMapping   map[string]string `json:"attributeMapping"`
+	OIDC               struct {
+		IssuerURI        string   `json:"issuerUri"`
+		AllowedAudiences []string `json:"allowedAudiences"`
+	} `json:"oidc"`
+}
+
+func simulateGCP(ctx context.Context, args []string) (*trustEvaluation, error) {
+	flags := flag.NewFlagSet("simulate gcp", flag.ExitOnError)
+	providerFile := flags.String("provider", "", "the provider as gcloud iam workload-identity-pools providers describe --format=json prints it, - for stdin")
+	condition := flags.String("condition", "", "the attribute condition (default the provider's)")
+	mapping := flags.String("mapping", "", "the attribute mapping as gcloud takes it, e.g. google.subject=assertion.sub (default the provider's, or that)")
+	audiences := flags.String("allowed-audiences", "", "comma-separated audiences the provider allows (default the provider's)")
+	claims := addSimulateClaimFlags(flags)
+	_ = flags.Parse(args)
+
+	var cfg gcpProviderConfig
+	if *providerFile != "" {
+		fc, err := readSimulateInput(*providerFile)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(fc, &cfg)
+		if err != nil {
+			return nil, exitErrorf(exitUsage, "cannot read the provider in %s: %w", *providerFile, err)
+		}
+	} else if *condition == "" && *mapping == "" {
+		return nil, exitErrorf(exitUsage, "simulate gcp needs --provider or --condition")
+	}
+	if *condition != "" {
+		cfg.AttributeCondition = *condition
+	}
+	if *mapping != "" {
+		m, err := parseGCPAttributeMapping(*mapping)
+		if err != nil {
+			return nil, exitErrorf(exitUsage, "invalid --mapping: %w", err)
+		}
+		cfg.AttributeMapping = m
+	}
+	if *audiences != "" {
+		cfg.OIDC.AllowedAudiences = strings.Split(*audiences, ",")
+	}
+	if cfg.Name == "" {
+		cfg.Name = gcpWorkloadIdentityProvider()
+	}
+
+	audience := providerAudience("gcp")
+	if audience == "" && cfg.Name != "" {
+		audience = gitpodidp.GCPAudience(cfg.Name)
+	}
+	c, err := claims.load(ctx, audience)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateGCPProvider(cfg, c)
+}
+
+// parseGCPAttributeMapping splits a mapping like google.subject=assertion.sub,attribute.repo=assertion.repo at the
+// commas which aren't part of an expression.
+func parseGCPAttributeMapping(s string) (map[string]string, error) {
+	res := make(map[string]string)
+	var depth int
+	var quote byte
+	start := 0
+	add := func(part string) error {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return fmt.Errorf("%q is not attribute=expression", part)
+		}
+		res[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		return nil
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			if err := add(s[start:i]); err != nil {
+				return nil, err
+			}
+			start = i + 1
+		}
+	}
+	return res, add(s[start:])
+}
+
+// evaluateGCPProvider checks claims the way Google's STS does: the issuer and audience, then the attribute mapping,
+// which has to yield google.subject, then the attribute condition on the claims and the mapped attributes.
+func evaluateGCPProvider(cfg gcpProviderConfig, claims map[string]interface{}) (*trustEvaluation, error) {
+	var problems []string
+	if cfg.Disabled {
+		problems = append(problems, "the provider is disabled")
+	}
+	if iss, _ := claims["iss"].(string); cfg.OIDC.IssuerURI != "" && iss != cfg.OIDC.IssuerURI {
+		problems = append(problems, fmt.Sprintf("the provider trusts the issuer %q, the token is from %q", cfg.OIDC.IssuerURI, iss))
+	}
+	allowed := cfg.OIDC.AllowedAudiences
+	if len(allowed) == 0 && cfg.Name != "" {
+		// without allowed audiences, Google accepts the provider's URL
+		allowed = []string{gitpodidp.GCPAudience(cfg.Name)}
+	}
+	if aud := claimValues(claims["aud"]); len(allowed) > 0 && !anyIn(aud, allowed) {
+		problems = append(problems, fmt.Sprintf("the token's audience %s is not among the allowed audiences %s", quoteAll(aud), quoteAll(allowed)))
+	}
+
+	mapping := cfg.AttributeMapping
+	if len(mapping) == 0 {
+		mapping = map[string]string{"google.subject": "assertion.sub"}
+	}
+	google := make(map[string]interface{})
+	attribute := make(map[string]interface{})
+	vars := map[string]interface{}{"assertion": claims}
+	for _, key := range sortedKeys(mapping) {
+		expr, err := parseCEL(mapping[key])
+		if err != nil {
+			return nil, exitErrorf(exitUsage, "invalid mapping of %s: %w", key, err)
+		}
+		v, err := expr.eval(vars)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("mapping %s=%s fails: %v", key, mapping[key], err))
+			continue
+		}
+		ns, name, _ := strings.Cut(key, ".")
+		switch ns {
+		case "google":
+			google[name] = v
+		case "attribute":
+			attribute[name] = v
+		}
+	}
+	switch sub, _ := google["subject"].(string); {
+	case sub == "":
+		problems = append(problems, "the attribute mapping yields no google.subject, which Google requires")
+	case len(sub) > 127:
+		problems = append(problems, fmt.Sprintf("google.subject is %d bytes long, Google allows at most 127", len(sub)))
+	}
+
+	if cfg.AttributeCondition != "" {
+		vars["google"], vars["attribute"] = google, attribute
+		expr, err := parseCEL(cfg.AttributeCondition)
+		if err != nil {
+			return nil, exitErrorf(exitUsage, "invalid attribute condition: %w", err)
+		}
+		problems = append(problems, explainCELCondition(expr, vars)...)
+	}
+
+	return &trustEvaluation{
+		Allowed:    len(problems) == 0,
+		Statements: []trustStatementResult{{Index: 1, Sid: cfg.Name, Effect: "Allow", Matches: len(problems) == 0, Problems: problems}},
+	}, nil
+}
+
+// explainCELCondition evaluates a condition and describes each of its && terms which fails, with the values of
+// the attributes and claims it refers to.
+func explainCELCondition(expr *celExpr, vars map[string]interface{}) []string {
+	v, err := expr.eval(vars)
+	if v == true {
+		return nil
+	}
+	if err == nil {
+		if _, ok := v.(bool); !ok {
+			return []string{fmt.Sprintf("the attribute condition yields a %s rather than a bool", celTypeName(v))}
+		}
+	}
+	var problems []string
+	for _, term := range expr.conjuncts() {
+		tv, err := term.eval(vars)
+		if tv == true {
+			continue
+		}
+		src := expr.src[term.start:term.end]
+		var values []string
+		for _, ref := range expr.references(term) {
+			if ev, err := mustParseCEL(ref).eval(vars); err == nil {
+				values = append(values, fmt.Sprintf("%s is %s", ref, celQuote(ev)))
+			} else {
+				values = append(values, fmt.Sprintf("%s is missing", ref))
+			}
+		}
+		msg := fmt.Sprintf("condition %s is false", src)
+		if err != nil {
+			msg = fmt.Sprintf("condition %s fails: %v", src, err)
+		}
+		if len(values) > 0 {
+			msg += " (" + strings.Join(values, ", ") + ")"
+		}
+		problems = append(problems, msg)
+	}
+	return problems
+}
+
+func mustParseCEL(src string) *celExpr {
+	expr, err := parseCEL(src)
+	if err != nil {
+		return &celExpr{src: src, root: &celNode{kind: "lit"}}
+	}
+	return expr
+}
+
+func celQuote(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func anyIn(values, allowed []string) bool {
+	for _, v := range values {
+		for _, a := range allowed {
+			if v == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// azureFederatedCredential is a federated credential of an app registration, as az ad app federated-credential
+// list prints them.
+type azureFederatedCredential struct {
+	Name                     string   `json:"name"`
+	Issuer                   string   `json:"issuer"`
+	Subject                  string   `json:"subject"`
+	Audiences                []string `json:"audiences"`
+	ClaimsMatchingExpression *struct {
+		Value string `json:"value"`
+	} `json:"claimsMatchingExpression"`
+}
+
+func simulateAzure(ctx context.Context, args []string) (*trustEvaluation, error) {
+	flags := flag.NewFlagSet("simulate azure", flag.ExitOnError)
+	credentialFile := flags.String("credential", "", "a federated credential, or the list az ad app federated-credential list prints, - for stdin")
+	var inline azureFederatedCredential
+	flags.StringVar(&inline.Issuer, "issuer", "", "issuer of the federated credential, instead of --credential")
+	flags.StringVar(&inline.Subject, "subject", "", "subject of the federated credential, instead of --credential")
+	audience := flags.String("audience", providerAudience("azure"), "audience of the federated credential, with --issuer and --subject")
+	claims := addSimulateClaimFlags(flags)
+	_ = flags.Parse(args)
+
+	var creds []azureFederatedCredential
+	switch {
+	case *credentialFile != "":
+		fc, err := readSimulateInput(*credentialFile)
+		if err != nil {
+			return nil, err
+		}
+		var single azureFederatedCredential
+		if err := json.Unmarshal(fc, &creds); err != nil {
+			err = json.Unmarshal(fc, &single)
+			if err != nil {
+				return nil, exitErrorf(exitUsage, "cannot read the federated credentials in %s: %w", *credentialFile, err)
+			}
+			creds = []azureFederatedCredential{single}
+		}
+	case inline.Issuer != "" && inline.Subject != "":
+		inline.Audiences = []string{*audience}
+		creds = []azureFederatedCredential{inline}
+	default:
+		return nil, exitErrorf(exitUsage, "simulate azure needs --credential, or --issuer and --subject")
+	}
+	c, err := claims.load(ctx, providerAudience("azure"))
+	if err != nil {
+		return nil, err
+	}
+	return evaluateAzureCredentials(creds, c)
+}
+
+// evaluateAzureCredentials checks claims against the federated credentials the way Entra ID does: a credential
+// matches if its issuer and subject equal those of the token exactly, or its claims matching expression holds, and
+// the token is for its audience. One matching credential is enough.
+func evaluateAzureCredentials(creds []azureFederatedCredential, claims map[string]interface{}) (*trustEvaluation, error) {
+	res := &trustEvaluation{}
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	aud := claimValues(claims["aud"])
+	for i, cred := range creds {
+		var problems []string
+		if cred.Issuer != iss {
+			problems = append(problems, fmt.Sprintf("the credential's issuer %q is not the token's %q", cred.Issuer, iss))
+		}
+		if cred.ClaimsMatchingExpression != nil && cred.ClaimsMatchingExpression.Value != "" {
+			p, err := evaluateAzureClaimsExpression(cred.ClaimsMatchingExpression.Value, claims)
+			if err != nil {
+				return nil, exitErrorf(exitUsage, "invalid claims matching expression of %s: %w", cred.Name, err)
+			}
+			problems = append(problems, p...)
+		} else if cred.Subject != sub {
+			problems = append(problems, fmt.Sprintf("the credential's subject %q is not the token's %q (Entra ID compares them exactly)", cred.Subject, sub))
+		}
+		if !anyIn(aud, cred.Audiences) {
+			problems = append(problems, fmt.Sprintf("the token's audience %s is not the credential's %s", quoteAll(aud), quoteAll(cred.Audiences)))
+		}
+		r := trustStatementResult{Index: i + 1, Sid: cred.Name, Effect: "Allow", Matches: len(problems) == 0, Problems: problems}
+		res.Allowed = res.Allowed || r.Matches
+		res.Statements = append(res.Statements, r)
+	}
+	return res, nil
+}
+
+var azureClaimsTerm = regexp.MustCompile(`^claims\['([^']+)'\]\s+(eq|matches)\s+'([^']*)'$`)
+
+// evaluateAzureClaimsExpression evaluates the claims matching expression of a flexible federated credential, terms
+// like claims['sub'] matches 'repo:contoso/*' joined by and, and describes each term which doesn't hold.
+func evaluateAzureClaimsExpression(expr string, claims map[string]interface{}) ([]string, error) {
+	var problems []string
+	for _, term := range regexp.MustCompile(`(?i)\s+and\s+`).Split(strings.TrimSpace(expr), -1) {
+		m := azureClaimsTerm.FindStringSubmatch(strings.TrimSpace(strings.Trim(term, "()")))
+		if m == nil {
+			return nil, fmt.Errorf("unsupported term %q", term)
+		}
+		actual, _ := claims[m[1]].(string)
+		ok := actual == m[3]
+		if m[2] == "matches" {
+			ok = awsStringLike(m[3], actual)
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: the token's %s is %q", term, m[1], actual))
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "status",
+		Usage:   "status [--json]",
+		Summary: "show which credentials exist, whom they belong to and when they expire",
+		Run:     runStatus,
+	})
+}
+
+type providerStatus struct {
+	Provider   string     `json:"provider"`
+	Configured bool       `json:"configured"`
+	State      string     `json:"state"`
+	Identity   string     `json:"identity,omitempty"`
+	IssuedAt   *time.Time `json:"issuedAt,omitempty"`
+	Expiry     *time.Time `json:"expiry,omitempty"`
+	ExpiresIn  int64      `json:"expiresInSeconds,omitempty"`
+}
+
+const (
+	stateValid   = "valid"
+	stateExpired = "expired"
+	stateNone    = "none"
+)
+
+func runStatus(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the status as JSON - shorthand for --output json")
+	_ = flags.Parse(args)
+
+	var res []providerStatus
+	for _, p := range providers {
+		st, err := getProviderStatus(p)
+		if err != nil {
+			return err
+		}
+		res = append(res, st)
+	}
+
+	format := *outputFlag
+	if *asJSON {
+		format = outputJSON
+	}
+	return writeOutputAs(format, res, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PROVIDER\tCONFIGURED\tCREDENTIALS\tIDENTITY\tEXPIRES")
+		for _, st := range res {
+			identity, expires := "-", "-"
+			if st.Identity != "" {
+				identity = st.Identity
+			}
+			if st.Expiry != nil {
+				expires = humanizeExpiry(time.Until(*st.Expiry))
+			}
+			fmt.Fprintf(w, "%s\t%v\t%s\t%s\t%s\n", st.Provider, st.Configured, st.State, identity, expires)
+		}
+		return w.Flush()
+	})
+}
+
+func getProviderStatus(p provider) (providerStatus, error) {
+	res := providerStatus{
+		Provider:   p.Name,
+		Configured: p.configured(),
+		State:      stateNone,
+	}
+	rec, err := loadCredentialRecord(p.Name)
+	if err != nil {
+		return res, fmt.Errorf("cannot read %s credential record: %w", p.Name, err)
+	}
+	if rec == nil {
+		return res, nil
+	}
+
+	res.Identity = rec.Identity
+	res.IssuedAt = &rec.IssuedAt
+	res.State = stateValid
+	if !rec.Expiry.IsZero() {
+		res.Expiry = &rec.Expiry
+		res.ExpiresIn = int64(time.Until(rec.Expiry).Seconds())
+		if res.ExpiresIn <= 0 {
+			res.State = stateExpired
+			res.ExpiresIn = 0
+		}
+	}
+	return res, nil
+}
+
+// humanizeExpiry renders the time left until expiry, e.g. "in 42m" or "expired 3m ago".
+func humanizeExpiry(d time.Duration) string {
+	if d <= 0 {
+		return fmt.Sprintf("expired %s ago", (-d).Round(time.Minute))
+	}
+	return fmt.Sprintf("in %s", d.Round(time.Minute))
+}
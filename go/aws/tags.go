@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "tags",
+		Usage:   "tags [provider...]",
+		Summary: "show how the tags config maps this workspace's token claims onto each provider, and how to configure it",
+		Run:     runTags,
+	})
+}
+
+// tagsConfig maps tag names to the token claims they take their values from, e.g. {"cost_center": "org_id"}, so
+// that cost attribution and attribute-based access control use the same labels on every provider.
+type tagsConfig map[string]string
+
+// tagValue is the value a tag takes for this workspace's token.
+type tagValue struct {
+	Tag   string `json:"tag"`
+	Claim string `json:"claim"`
+	// Value is empty if the token lacks the claim.
+	Value string `json:"value,omitempty"`
+}
+
+// tagTarget is how a provider's configuration has to change for it to carry the tags.
+type tagTarget struct {
+	Provider string     `json:"provider"`
+	Tags     []tagValue `json:"tags"`
+	// Command applies the mapping to the provider, where that is possible.
+	Command string `json:"command,omitempty"`
+	Note    string `json:"note,omitempty"`
+}
+
+// tagProviders renders the mapping for the providers that support it, given the tags and the token's claims.
+var tagProviders = map[string]func(tags []tagValue, claims map[string]interface{}) tagTarget{
+	"aws":   awsTagTarget,
+	"gcp":   gcpTagTarget,
+	"azure": azureTagTarget,
+	"vault": vaultTagTarget,
+}
+
+func runTags(ctx context.Context, args []string) error {
+	if cfg == nil || len(cfg.Tags) == 0 {
+		return exitErrorf(exitMissingConfig, "no tags are configured: add a tags section to %s mapping tag names to token claims", configFileName)
+	}
+	selected, err := selectProviders(args)
+	if err != nil {
+		return err
+	}
+	token, err := gitpodIDToken(ctx, "sts.amazonaws.com")
+	if err != nil {
+		return err
+	}
+	claims, err := gitpodidp.Claims(token)
+	if err != nil {
+		return withExitCode(exitTokenMintFailed, err)
+	}
+
+	var tags []tagValue
+	for _, tag := range sortedKeys(cfg.Tags) {
+		claim := cfg.Tags[tag]
+		tags = append(tags, tagValue{Tag: tag, Claim: claim, Value: strings.Join(claimValues(claims[claim]), ",")})
+	}
+	var res []tagTarget
+	for _, p := range selected {
+		render, ok := tagProviders[p.Name]
+		if !ok || !p.configured() {
+			continue
+		}
+		res = append(res, render(tags, claims))
+	}
+
+	return writeOutput(res, func(w io.Writer) error {
+		for _, t := range res {
+			fmt.Fprintln(w, t.Provider)
+			for _, tv := range t.Tags {
+				val := fmt.Sprintf("%q", tv.Value)
+				if tv.Value == "" {
+					val = "(the token has no such claim)"
+				}
+				fmt.Fprintf(w, "  %s = %s %s\n", tv.Tag, tv.Claim, val)
+			}
+			if t.Note != "" {
+				fmt.Fprintf(w, "  %s\n", t.Note)
+			}
+			if t.Command != "" {
+				fmt.Fprintf(w, "  %s\n", t.Command)
+			}
+		}
+		return nil
+	})
+}
+
+// awsSessionTagsClaim is the claim AssumeRoleWithWebIdentity takes session tags from. Unlike AssumeRole, it has no
+// parameter for them.
+const awsSessionTagsClaim = "https://aws.amazon.com/tags"
+
+func awsTagTarget(tags []tagValue, claims map[string]interface{}) tagTarget {
+	res := tagTarget{Provider: "aws", Tags: tags}
+	session, _ := claims[awsSessionTagsClaim].(map[string]interface{})
+	principalTags, _ := session["principal_tags"].(map[string]interface{})
+	if principalTags == nil {
+		res.Note = "STS takes session tags only from the " + awsSessionTagsClaim + " claim, which this workspace's token doesn't have - until the Gitpod installation issues it, use conditions on these claims in the role's trust policy (see validate-trust)"
+		return res
+	}
+	var mismatches []string
+	for _, tv := range tags {
+		got := strings.Join(claimValues(principalTags[tv.Tag]), ",")
+		if got != tv.Value {
+			mismatches = append(mismatches, fmt.Sprintf("%s is %q rather than %q", tv.Tag, got, tv.Value))
+		}
+	}
+	if len(mismatches) > 0 {
+		res.Note = "the session tags of the token differ: " + strings.Join(mismatches, ", ")
+	} else {
+		res.Note = "the token carries these session tags - the role's trust policy must allow sts:TagSession"
+	}
+	return res
+}
+
+var (
+	nonGCPAttributeChars = regexp.MustCompile(`[^a-z0-9_]+`)
+	celIdentifier        = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+func gcpTagTarget(tags []tagValue, _ map[string]interface{}) tagTarget {
+	res := tagTarget{Provider: "gcp", Tags: tags}
+	// update-oidc replaces the whole mapping, so it restates the subject, which Gitpod always sets
+	mappings := []string{"google.subject=assertion.sub"}
+	for _, tv := range tags {
+		attr := nonGCPAttributeChars.ReplaceAllString(strings.ToLower(tv.Tag), "_")
+		expr := "assertion." + tv.Claim
+		if !celIdentifier.MatchString(tv.Claim) {
+			expr = fmt.Sprintf("assertion[%q]", tv.Claim)
+		}
+		mappings = append(mappings, "attribute."+attr+"="+expr)
+	}
+	ref, ok := parseGCPProvider(gcpWorkloadIdentityProvider())
+	if !ok {
+		res.Note = "IDP_GCP_WORKLOAD_IDENTITY_PROVIDER is not the resource name of a workload identity pool provider"
+		return res
+	}
+	res.Note = "map the claims onto attributes of the pool, which IAM conditions and audit logs can use as principalSet://.../attribute.<tag>/<value>"
+	res.Command = ref.update("--attribute-mapping=" + shellQuote(strings.Join(mappings, ",")))
+	return res
+}
+
+func azureTagTarget(tags []tagValue, _ map[string]interface{}) tagTarget {
+	return tagTarget{
+		Provider: "azure",
+		Tags:     tags,
+		Note:     "Entra ID doesn't pass claims of a federated credential's token on to the access tokens it issues, so the tags can't reach Azure - sign-in logs record the token's subject, so give each federated credential a subject as specific as the tags need",
+	}
+}
+
+func vaultTagTarget(tags []tagValue, _ map[string]interface{}) tagTarget {
+	res := tagTarget{Provider: "vault", Tags: tags}
+	mount := setting("IDP_VAULT_AUTH_PATH")
+	if mount == "" {
+		mount = "jwt"
+	}
+	var mappings []string
+	for _, tv := range tags {
+		mappings = append(mappings, tv.Claim+"="+tv.Tag)
+	}
+	sort.Strings(mappings)
+	res.Note = "claim_mappings copy the claims into the token's metadata, which audit logs record and policy templates can use"
+	res.Command = fmt.Sprintf("vault write auth/%s/role/%s claim_mappings=%s", mount, setting("IDP_VAULT_ROLE"), shellQuote(strings.Join(mappings, ",")))
+	return res
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "telemetry",
+		Usage:   "telemetry",
+		Summary: "show whether usage telemetry is on, and the report it would send next",
+		Run:     runTelemetry,
+	})
+}
+
+// telemetryInterval is how often the aggregated usage is sent, so that a report says nothing about when
+// individual commands ran.
+const telemetryInterval = 24 * time.Hour
+
+// telemetrySendTimeout bounds sending a report, which must never hold up a command noticeably.
+const telemetrySendTimeout = 2 * time.Second
+
+// telemetryReport is all telemetry ever sends: counts of commands and sign-in results, and which features are
+// configured. It never holds identities, tokens, role names or anything else a person or account could be
+// recognized by.
+type telemetryReport struct {
+	// InstallID is random, and only tells reports of the same state directory apart.
+	InstallID string    `json:"installId"`
+	Version   string    `json:"version"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Since     time.Time `json:"since"`
+	// Commands counts runs by command name, Failures the runs which failed.
+	Commands map[string]int `json:"commands,omitempty"`
+	Failures map[string]int `json:"failures,omitempty"`
+	// Signins counts logins and refreshes by provider and result, success or failure. Plugins count as plugin.
+	Signins  map[string]map[string]int `json:"signins,omitempty"`
+	Features []string                  `json:"features,omitempty"`
+}
+
+// telemetryState is the report being aggregated, as kept in the state directory between commands.
+type telemetryState struct {
+	Report   telemetryReport `json:"report"`
+	LastSent time.Time       `json:"lastSent"`
+}
+
+// telemetryFeatures report whether a feature is configured, by a name which says nothing about how.
+var telemetryFeatures = map[string]func() bool{
+	"aws-profiles":   func() bool { return setting("IDP_AWS_PROFILES") != "" },
+	"aws-multi-role": func() bool { return strings.Contains(setting("IDP_AWS_ROLE_ARN"), ",") },
+	"signin-order":   func() bool { return setting("IDP_SIGNIN_ORDER") != "" },
+	"signin-race":    func() bool { return setting("IDP_SIGNIN_RACE") == "true" },
+	"role-policy": func() bool {
+		return setting("IDP_AWS_ALLOWED_ROLES") != "" || setting("IDP_AWS_PRIVILEGED_ROLES") != ""
+	},
+	"readonly-role":    func() bool { return setting("IDP_AWS_READONLY_ROLE_ARN") != "" },
+	"trusted-repos":    func() bool { return setting("IDP_TRUSTED_REPOSITORIES") != "" },
+	"environments":     func() bool { return cfg != nil && len(cfg.Environments) > 0 },
+	"tags":             func() bool { return cfg != nil && len(cfg.Tags) > 0 },
+	"hooks":            func() bool { return cfg != nil && cfg.Hooks != nil },
+	"dotenv":           func() bool { fn, _ := dotenvPath(); return fn != "" },
+	"export-claims":    func() bool { return setting("IDP_EXPORT_CLAIMS") != "" },
+	"custom-endpoints": func() bool { return cfg != nil && cfg.Network != nil && cfg.Network.Endpoints != nil },
+	"tracing":          tracingEnabled,
+}
+
+// telemetryEnabled reports whether the user opted into telemetry with IDP_TELEMETRY=true and said where to send
+// it with IDP_TELEMETRY_ENDPOINT. Only the environment counts, so that a repository's config file can't opt its
+// contributors in, and DO_NOT_TRACK overrides it.
+func telemetryEnabled() bool {
+	if os.Getenv("DO_NOT_TRACK") == "1" || os.Getenv("DO_NOT_TRACK") == "true" {
+		return false
+	}
+	return os.Getenv("IDP_TELEMETRY") == "true" && os.Getenv("IDP_TELEMETRY_ENDPOINT") != ""
+}
+
+func telemetryPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "telemetry.json"), nil
+}
+
+func loadTelemetryState() (*telemetryState, error) {
+	fn, err := telemetryPath()
+	if err != nil {
+		return nil, err
+	}
+	state := &telemetryState{}
+	fc, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		// a damaged file only costs the counts so far
+		_ = json.Unmarshal(fc, state)
+	}
+	if state.Report.InstallID == "" {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		state.Report.InstallID = hex.EncodeToString(b)
+		state.Report.Since = time.Now().UTC().Truncate(24 * time.Hour)
+		// the first report, too, waits for a day of usage
+		state.LastSent = time.Now()
+	}
+	return state, nil
+}
+
+// recordTelemetry adds the command which just ran, and the sign-ins it made, to the aggregated report, and sends
+// the report if it's due. Concurrent commands may lose each other's counts, which aggregate numbers tolerate.
+func recordTelemetry(command string, err error) {
+	if !telemetryEnabled() || command == "telemetry" {
+		return
+	}
+	state, lerr := loadTelemetryState()
+	if lerr != nil {
+		slog.Debug("cannot load telemetry", "error", lerr)
+		return
+	}
+	r := &state.Report
+	r.Commands = incrementCount(r.Commands, command)
+	if err != nil {
+		r.Failures = incrementCount(r.Failures, command)
+	}
+	metrics.mu.Lock()
+	for k, n := range metrics.exchanges {
+		provider := k[0]
+		if _, builtin := builtinProviders[provider]; !builtin {
+			provider = "plugin"
+		}
+		if r.Signins == nil {
+			r.Signins = make(map[string]map[string]int)
+		}
+		if r.Signins[provider] == nil {
+			r.Signins[provider] = make(map[string]int)
+		}
+		r.Signins[provider][k[1]] += n
+	}
+	metrics.mu.Unlock()
+
+	if time.Since(state.LastSent) >= telemetryInterval {
+		serr := sendTelemetry(completeTelemetryReport(r))
+		if serr == nil {
+			state = &telemetryState{Report: telemetryReport{InstallID: r.InstallID, Since: time.Now().UTC().Truncate(24 * time.Hour)}, LastSent: time.Now()}
+		} else {
+			slog.Debug("cannot send telemetry", "error", serr)
+		}
+	}
+	if serr := saveTelemetryState(state); serr != nil {
+		slog.Debug("cannot save telemetry", "error", serr)
+	}
+}
+
+func incrementCount(m map[string]int, k string) map[string]int {
+	if m == nil {
+		m = make(map[string]int)
+	}
+	m[k]++
+	return m
+}
+
+// builtinProviders are the providers whose names telemetry reports. Those of plugins could say who uses them.
+var builtinProviders = map[string]struct{}{"aws": {}, "gcp": {}, "azure": {}, "vault": {}}
+
+// completeTelemetryReport returns r with the details of this build and the configured features.
+func completeTelemetryReport(r *telemetryReport) *telemetryReport {
+	res := *r
+	res.Version, res.OS, res.Arch = version, runtime.GOOS, runtime.GOARCH
+	res.Features = nil
+	for _, name := range sortedKeys(telemetryFeatures) {
+		if telemetryFeatures[name]() {
+			res.Features = append(res.Features, name)
+		}
+	}
+	return &res
+}
+
+func saveTelemetryState(state *telemetryState) error {
+	fn, err := telemetryPath()
+	if err != nil {
+		return err
+	}
+	fc, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeSecretFile(fn, fc)
+}
+
+func sendTelemetry(r *telemetryReport) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), telemetrySendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, os.Getenv("IDP_TELEMETRY_ENDPOINT"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("telemetry endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func runTelemetry(ctx context.Context, args []string) error {
+	if !telemetryEnabled() {
+		fmt.Fprintln(os.Stderr, "telemetry is off - IDP_TELEMETRY=true and IDP_TELEMETRY_ENDPOINT turn it on, DO_NOT_TRACK=1 keeps it off")
+	} else {
+		fmt.Fprintf(os.Stderr, "telemetry is on, sending a report like this to %s once a day\n", os.Getenv("IDP_TELEMETRY_ENDPOINT"))
+	}
+	state, err := loadTelemetryState()
+	if err != nil {
+		return err
+	}
+	report := completeTelemetryReport(&state.Report)
+	return writeOutput(report, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	})
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "templates",
+		Usage:   "templates render [--print] [path...]",
+		Summary: "render the configured template files with the current credentials, which login and refresh do by themselves",
+		Run:     runTemplates,
+	})
+}
+
+// templateSinkConfig configures a file rendered from a Go template after each login and refresh, for tools whose
+// configuration format no other sink writes, e.g. a boto config.
+type templateSinkConfig struct {
+	// Path of the file, relative to the repository root unless absolute. ~/ is the home directory.
+	Path string `json:"path"`
+	// Template is the text/template to render. TemplateFile reads it from a file instead, relative to the
+	// repository root unless absolute.
+	Template     string `json:"template,omitempty"`
+	TemplateFile string `json:"templateFile,omitempty"`
+	// Providers whose credentials the template uses. The file is rendered once all of them which are configured are
+	// signed in. Defaults to all providers.
+	Providers []string `json:"providers,omitempty"`
+}
+
+// templateData is what templates render: .Env has the variables env exports for the providers, .Claims the claims
+// of the last identity token and .Providers the identity and expiry of each signed-in provider.
+type templateData struct {
+	Env       map[string]string
+	Claims    map[string]interface{}
+	Providers map[string]templateProvider
+}
+
+type templateProvider struct {
+	Identity string
+	Expiry   time.Time
+}
+
+// templateFuncs are the functions templates may use besides the built-in ones.
+var templateFuncs = template.FuncMap{
+	"quote":   strconv.Quote,
+	"shell":   shellQuote,
+	"base64":  func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"setting": setting,
+	"json": func(v interface{}) (string, error) {
+		fc, err := json.Marshal(v)
+		return string(fc), err
+	},
+}
+
+func runTemplates(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "render" {
+		return exitErrorf(exitUsage, "usage: templates render [--print] [path...]")
+	}
+	flags := flag.NewFlagSet("templates render", flag.ExitOnError)
+	printOnly := flags.Bool("print", false, "print the rendered files instead of writing them")
+	_ = flags.Parse(args[1:])
+
+	sinks, err := templateSinks()
+	if err != nil {
+		return err
+	}
+	if len(sinks) == 0 {
+		return exitErrorf(exitMissingConfig, "no template is configured: add templates to %s", configFileName)
+	}
+	var errs []error
+	var rendered int
+	for _, s := range sinks {
+		fn, err := templateSinkPath(s.Path)
+		if err != nil {
+			return err
+		}
+		if flags.NArg() > 0 && !slices.Contains(flags.Args(), s.Path) && !slices.Contains(flags.Args(), fn) {
+			continue
+		}
+		rendered++
+		if !*printOnly {
+			err = writeTemplateSink(ctx, s, true)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		content, err := renderTemplateSink(ctx, s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("# %s\n%s", fn, content)
+		if !bytes.HasSuffix(content, []byte("\n")) {
+			fmt.Println()
+		}
+		wipe(content)
+	}
+	if rendered == 0 {
+		return exitErrorf(exitUsage, "no template is configured for %s", strings.Join(flags.Args(), ", "))
+	}
+	if len(errs) > 0 {
+		return withExitCode(exitPersistFailed, errors.Join(errs...))
+	}
+	return nil
+}
+
+func templateSinks() ([]templateSinkConfig, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	for _, s := range cfg.Templates {
+		if s.Path == "" || (s.Template == "") == (s.TemplateFile == "") {
+			return nil, exitErrorf(exitMissingConfig, "every template needs a path and either template or templateFile")
+		}
+	}
+	return cfg.Templates, nil
+}
+
+// templateSinkPath resolves fn like the dotenv path, and ~/ to the home directory.
+func templateSinkPath(fn string) (string, error) {
+	if rest, ok := strings.CutPrefix(fn, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, rest), nil
+	}
+	if filepath.IsAbs(fn) {
+		return fn, nil
+	}
+	root, err := repoRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, fn), nil
+}
+
+// writeTemplateSinks renders the templates which use p after it signed in, warning rather than failing where one
+// cannot be rendered, as the credentials are in place either way.
+func writeTemplateSinks(ctx context.Context, p provider) {
+	sinks, err := templateSinks()
+	if err != nil {
+		printWarning("%v", err)
+		return
+	}
+	if len(sinks) == 0 {
+		return
+	}
+	// logins of several providers finish concurrently, and the last one to render must see all their credentials
+	unlock, _, err := acquireLock(ctx, "templates")
+	if err != nil {
+		printWarning("not rendering the templates: %v", err)
+		return
+	}
+	defer unlock()
+	for _, s := range sinks {
+		if len(s.Providers) > 0 && !slices.Contains(s.Providers, p.Name) {
+			continue
+		}
+		err := writeTemplateSink(ctx, s, false)
+		if err != nil {
+			printWarning("%v", err)
+		}
+	}
+}
+
+// writeTemplateSink renders s to its file. Unless force is set, it waits until all of the template's
+// providers are signed in rather than failing on the variables of those which aren't yet.
+func writeTemplateSink(ctx context.Context, s templateSinkConfig, force bool) error {
+	fn, err := templateSinkPath(s.Path)
+	if err != nil {
+		return err
+	}
+	if !force {
+		selected, err := selectProviders(s.Providers)
+		if err != nil {
+			return err
+		}
+		for _, p := range selected {
+			if !p.configured() {
+				continue
+			}
+			if rec, err := loadCredentialRecord(p.Name); err != nil || rec == nil {
+				slog.Debug("not rendering the template before all its providers are signed in", "path", fn, "provider", p.Name)
+				return err
+			}
+		}
+	}
+	// git only checks the file in a directory which exists
+	err = mkdirPrivate(filepath.Dir(fn))
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", fn, err)
+	}
+	err = ensureGitignored(ctx, fn)
+	if err != nil {
+		return err
+	}
+	content, err := renderTemplateSink(ctx, s)
+	if err != nil {
+		return err
+	}
+	err = writeWipedSecretFile(fn, content)
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", fn, err)
+	}
+	recordArtifact(fn)
+	emitEvent(eventProfileWritten, "", "tool", "template", "path", fn)
+	return nil
+}
+
+// renderTemplateSink renders s with the current credentials. Referring to a variable or claim which isn't there
+// is an error rather than an empty value, which would only fail in the tool reading the file.
+func renderTemplateSink(ctx context.Context, s templateSinkConfig) ([]byte, error) {
+	text, name := s.Template, s.Path
+	if s.TemplateFile != "" {
+		fn, err := templateSinkPath(s.TemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		fc, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, exitErrorf(exitMissingConfig, "cannot read the template of %s: %w", s.Path, err)
+		}
+		text, name = string(fc), s.TemplateFile
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, exitErrorf(exitMissingConfig, "invalid template: %w", err)
+	}
+
+	selected, err := selectProviders(s.Providers)
+	if err != nil {
+		return nil, err
+	}
+	data := templateData{Providers: make(map[string]templateProvider)}
+	data.Env, err = credentialEnv(selected)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range selected {
+		rec, err := loadCredentialRecord(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			data.Providers[p.Name] = templateProvider{Identity: rec.Identity, Expiry: rec.Expiry}
+		}
+	}
+	if referencesClaims(tmpl) {
+		data.Claims, err = templateClaims()
+		if err != nil {
+			return nil, err
+		}
+		if len(data.Claims) == 0 && runningInGitpod() {
+			// sign-ins delegated to gp don't mint a token here. The claims but aud are the same for all audiences.
+			token, err := gitpodIDToken(ctx, gitpodidp.AWSAudience)
+			if err != nil {
+				return nil, fmt.Errorf("cannot mint a token for the claims of %s: %w", s.Path, err)
+			}
+			data.Claims, err = gitpodidp.Claims(token)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		wipe(buf.Bytes())
+		return nil, fmt.Errorf("cannot render %s: %w", s.Path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// referencesClaims reports whether tmpl may use the claims, so that rendering it needs them: it refers to .Claims,
+// or hands all of its data to a function or template.
+func referencesClaims(tmpl *template.Template) bool {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && nodeReferencesClaims(t.Tree.Root, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeReferencesClaims reports whether n may use the claims. dotIsRoot is whether dot is all the data there,
+// rather than e.g. the element range binds it to.
+func nodeReferencesClaims(n parse.Node, dotIsRoot bool) bool {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if nodeReferencesClaims(c, dotIsRoot) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeReferencesClaims(n.Pipe, dotIsRoot)
+	case *parse.TemplateNode:
+		return nodeReferencesClaims(n.Pipe, dotIsRoot)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if nodeReferencesClaims(c, dotIsRoot) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if nodeReferencesClaims(a, dotIsRoot) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return n.Ident[0] == "Claims"
+	case *parse.VariableNode:
+		// $ is all the data, wherever it's used
+		return n.Ident[0] == "$" && (len(n.Ident) == 1 || n.Ident[1] == "Claims")
+	case *parse.ChainNode:
+		return nodeReferencesClaims(n.Node, dotIsRoot) || n.Field[0] == "Claims"
+	case *parse.DotNode:
+		return dotIsRoot
+	case *parse.IfNode:
+		return nodeReferencesClaims(n.Pipe, dotIsRoot) || nodeReferencesClaims(n.List, dotIsRoot) || nodeReferencesClaims(n.ElseList, dotIsRoot)
+	case *parse.RangeNode:
+		return nodeReferencesClaims(n.Pipe, dotIsRoot) || nodeReferencesClaims(n.List, false) || nodeReferencesClaims(n.ElseList, dotIsRoot)
+	case *parse.WithNode:
+		return nodeReferencesClaims(n.Pipe, dotIsRoot) || nodeReferencesClaims(n.List, false) || nodeReferencesClaims(n.ElseList, dotIsRoot)
+	}
+	return false
+}
+
+func templateClaimsPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "template-claims.json"), nil
+}
+
+// recordTemplateClaims stores the claims of a freshly minted token for the templates, but only if there are
+// templates, as the claims are personal data.
+func recordTemplateClaims(claims map[string]interface{}) {
+	if cfg == nil || len(cfg.Templates) == 0 {
+		return
+	}
+	fn, err := templateClaimsPath()
+	if err == nil {
+		var fc []byte
+		fc, err = json.Marshal(claims)
+		if err == nil {
+			err = writeSealedFile(fn, fc)
+		}
+	}
+	if err != nil {
+		slog.Warn("cannot record the token claims for the templates", "error", err)
+	}
+}
+
+// templateClaims returns the claims recordTemplateClaims stored, or none if no token was minted since templates
+// were configured.
+func templateClaims() (map[string]interface{}, error) {
+	res := make(map[string]interface{})
+	fn, err := templateClaimsPath()
+	if err != nil {
+		return nil, err
+	}
+	fc, err := readSealedFile(fn)
+	if os.IsNotExist(err) || errors.Is(err, errForeignCache) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(fc, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
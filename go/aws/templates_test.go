@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"text/template"
+)
+
+func TestReferencesClaims(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{text: `AWS_PROFILE={{.Env.AWS_PROFILE}}`},
+		{text: `{{range $k, $v := .Env}}{{$k}}={{quote $v}}{{end}}`},
+		{text: `{{range .Providers}}{{.Identity}} {{.}}{{end}}`},
+		{text: `{{with .Providers.aws}}{{.Expiry}}{{end}}`},
+		{text: `{{setting "IDP_AWS_ROLE_ARN"}}`},
+		{text: `sub={{.Claims.sub}}`, want: true},
+		{text: `{{index .Claims "sub"}}`, want: true},
+		{text: `{{with .Claims}}{{.sub}}{{end}}`, want: true},
+		{text: `{{range .Env}}{{$.Claims.sub}}{{end}}`, want: true},
+		{text: `{{if .Env}}{{json .}}{{end}}`, want: true},
+		{text: `{{range .Env}}{{.}}{{else}}{{json $}}{{end}}`, want: true},
+		{text: `{{define "sub"}}{{.Claims.sub}}{{end}}{{template "sub" .}}`, want: true},
+	}
+	for _, tt := range tests {
+		tmpl, err := template.New("test").Funcs(templateFuncs).Parse(tt.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := referencesClaims(tmpl); got != tt.want {
+			t.Errorf("referencesClaims(%s) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTemplateSinkMintsOnlyForClaims(t *testing.T) {
+	for _, tt := range []struct {
+		text     string
+		wantMint bool
+	}{
+		{text: "role={{setting \"IDP_AWS_ROLE_ARN\"}}\n"},
+		{text: "sub={{.Claims.sub}}\n", wantMint: true},
+	} {
+		r := &fakeRunner{run: fakeGitpodToken}
+		testWorkspace(t, r)
+		t.Setenv("IDP_AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/gitpod")
+
+		_, err := renderTemplateSink(context.Background(), templateSinkConfig{Path: ".env.idp", Template: tt.text, Providers: []string{"aws"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ran("gp idp token") != tt.wantMint {
+			t.Errorf("rendering %q minted a token: %v, want %v", tt.text, r.ran("gp idp token"), tt.wantMint)
+		}
+	}
+}
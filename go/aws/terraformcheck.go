@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "check",
+		Usage:   "check terraform [--dir dir] [--backend-config file|key=value...]",
+		Summary: "check that the signed-in identity can reach the state of the Terraform backend, before terraform init fails",
+		Run:     runCheck,
+	})
+}
+
+func runCheck(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "terraform" {
+		return exitErrorf(exitUsage, "usage: check terraform [--dir dir] [--backend-config file|key=value...]")
+	}
+	flags := flag.NewFlagSet("check terraform", flag.ExitOnError)
+	dir := flags.String("dir", ".", "directory of the Terraform configuration")
+	var extra []string
+	flags.Func("backend-config", "backend setting, or file of them, as passed to terraform init (repeatable)", func(v string) error {
+		extra = append(extra, v)
+		return nil
+	})
+	_ = flags.Parse(args[1:])
+
+	be, err := parseTerraformBackend(*dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range extra {
+		err := be.addBackendConfig(*dir, v)
+		if err != nil {
+			return err
+		}
+	}
+	return runChecks(ctx, be.checks(), true)
+}
+
+// terraformBackend is the backend block of a Terraform configuration, with the attributes of nested blocks like
+// assume_role prefixed by the block name, e.g. assume_role.role_arn.
+type terraformBackend struct {
+	Type     string
+	File     string
+	Settings map[string]string
+}
+
+var (
+	hclBackendStart = regexp.MustCompile(`\bbackend\s+"([^"]+)"\s*\{`)
+	hclTerraform    = regexp.MustCompile(`\bterraform\s*\{`)
+	hclAttribute    = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+)\s*=\s*(.+?)\s*$`)
+	hclBlockStart   = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+)\s*(=\s*)?\{\s*$`)
+)
+
+// parseTerraformBackend finds the backend block in the .tf files of dir. Backend blocks can't contain expressions,
+// so the attributes are literals. A configuration without a backend block has local state.
+func parseTerraformBackend(dir string) (*terraformBackend, error) {
+	fns, err := filepath.Glob(filepath.Join(dir, "*.tf"))
+	if err != nil {
+		return nil, err
+	}
+	if len(fns) == 0 {
+		return nil, exitErrorf(exitUsage, "%s contains no Terraform configuration (*.tf files)", dir)
+	}
+	for _, fn := range fns {
+		fc, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		doc := stripHCLComments(string(fc))
+		for _, loc := range hclTerraform.FindAllStringIndex(doc, -1) {
+			block := hclBlock(doc[loc[1]:])
+			m := hclBackendStart.FindStringSubmatchIndex(block)
+			if m == nil {
+				continue
+			}
+			be := &terraformBackend{Type: block[m[2]:m[3]], File: fn, Settings: make(map[string]string)}
+			be.parseAttributes(hclBlock(block[m[1]:]))
+			return be, nil
+		}
+	}
+	return &terraformBackend{Type: "local", Settings: map[string]string{}}, nil
+}
+
+// stripHCLComments removes the #, // and /* */ comments from doc, but not what looks like them in strings.
+func stripHCLComments(doc string) string {
+	var b strings.Builder
+	inString := false
+	for i := 0; i < len(doc); i++ {
+		c := doc[i]
+		switch {
+		case inString && c == '\\' && i+1 < len(doc):
+			b.WriteByte(c)
+			i++
+			c = doc[i]
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '#' || strings.HasPrefix(doc[i:], "//"):
+			end := strings.IndexByte(doc[i:], '\n')
+			if end < 0 {
+				return b.String()
+			}
+			i += end
+			c = '\n'
+		case strings.HasPrefix(doc[i:], "/*"):
+			end := strings.Index(doc[i+2:], "*/")
+			if end < 0 {
+				return b.String()
+			}
+			i += end + 3
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// hclBlock returns the body of the block whose opening brace precedes doc.
+func hclBlock(doc string) string {
+	depth := 1
+	inString := false
+	for i := 0; i < len(doc); i++ {
+		switch c := doc[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return doc[:i]
+			}
+		}
+	}
+	return doc
+}
+
+func (be *terraformBackend) parseAttributes(body string) {
+	var prefix []string
+	for _, line := range strings.Split(body, "\n") {
+		if m := hclBlockStart.FindStringSubmatch(line); m != nil {
+			prefix = append(prefix, m[1])
+			continue
+		}
+		if strings.TrimSpace(line) == "}" && len(prefix) > 0 {
+			prefix = prefix[:len(prefix)-1]
+			continue
+		}
+		if m := hclAttribute.FindStringSubmatch(line); m != nil {
+			be.Settings[strings.Join(append(prefix, m[1]), ".")] = hclValue(m[2])
+		}
+	}
+}
+
+func hclValue(v string) string {
+	if s, err := strconv.Unquote(v); err == nil {
+		return s
+	}
+	return v
+}
+
+// addBackendConfig applies a -backend-config argument of terraform init: a key=value pair, or a file of them.
+func (be *terraformBackend) addBackendConfig(dir, v string) error {
+	if k, val, ok := strings.Cut(v, "="); ok && !strings.ContainsAny(k, `/\`) {
+		be.Settings[strings.TrimSpace(k)] = hclValue(strings.TrimSpace(val))
+		return nil
+	}
+	fn := v
+	if !filepath.IsAbs(fn) {
+		fn = filepath.Join(dir, fn)
+	}
+	fc, err := os.ReadFile(fn)
+	if err != nil {
+		return exitErrorf(exitUsage, "cannot read the backend config: %w", err)
+	}
+	be.parseAttributes(stripHCLComments(string(fc)))
+	return nil
+}
+
+func (be *terraformBackend) checks() []doctorCheck {
+	where := func(detail string) string {
+		if be.File == "" {
+			return detail
+		}
+		return detail + " (" + be.File + ")"
+	}
+	found := doctorCheck{Name: "backend", Run: func(ctx context.Context) (checkResult, string, string) {
+		return checkPass, where(be.Type), ""
+	}}
+	switch be.Type {
+	case "s3":
+		return append([]doctorCheck{found}, be.s3Checks()...)
+	case "gcs":
+		return append([]doctorCheck{found}, be.gcsChecks()...)
+	case "azurerm":
+		return append([]doctorCheck{found}, be.azurermChecks()...)
+	case "local":
+		return []doctorCheck{{Name: "backend", Run: func(ctx context.Context) (checkResult, string, string) {
+			return checkPass, "local state, no credentials needed", ""
+		}}}
+	}
+	return []doctorCheck{{Name: "backend", Run: func(ctx context.Context) (checkResult, string, string) {
+		return checkWarn, where(be.Type + ", whose credentials can't be checked"), ""
+	}}}
+}
+
+// stateKey returns the key of the state in the bucket, which is below per-workspace prefix outside the default
+// workspace.
+func (be *terraformBackend) stateKey(keySetting, prefixSetting, defaultPrefix string) string {
+	key := be.Settings[keySetting]
+	if ws := os.Getenv("TF_WORKSPACE"); ws != "" && ws != "default" {
+		prefix := be.Settings[prefixSetting]
+		if prefix == "" {
+			prefix = defaultPrefix
+		}
+		key = prefix + "/" + ws + "/" + key
+	}
+	return key
+}
+
+// checkLogin checks that provider is signed into and its credentials haven't expired.
+func checkLogin(provider string) doctorCheck {
+	return doctorCheck{Name: provider + " is signed into", Run: func(ctx context.Context) (checkResult, string, string) {
+		rec, err := loadCredentialRecord(provider)
+		if err != nil {
+			return checkFail, err.Error(), ""
+		}
+		if rec == nil {
+			return checkFail, "no credentials", "run idp login " + provider
+		}
+		if !rec.Expiry.IsZero() && time.Now().After(rec.Expiry) {
+			return checkFail, "the credentials expired at " + rec.Expiry.Format(time.Kitchen), "run idp login " + provider + ", and idp daemon to keep them fresh"
+		}
+		return checkPass, rec.Identity, ""
+	}}
+}
+
+func (be *terraformBackend) s3Checks() []doctorCheck {
+	var (
+		s      = be.Settings
+		bucket = s["bucket"]
+		key    = be.stateKey("key", "workspace_key_prefix", "env:")
+		role   = s["assume_role.role_arn"]
+		// common are the arguments selecting the credentials and region terraform uses
+		common []string
+	)
+	if role == "" {
+		role = s["role_arn"]
+	}
+	if s["region"] != "" {
+		common = append(common, "--region", s["region"])
+	}
+	// the checks after assuming the role run with its credentials rather than the profile's
+	var roleEnv []string
+	aws := func(ctx context.Context, args ...string) ([]byte, error) {
+		args = append(args, common...)
+		if roleEnv != nil {
+			return runAWSCLI(withCommandEnv(ctx, roleEnv...), args...)
+		}
+		if s["profile"] != "" {
+			args = append(args, "--profile", s["profile"])
+		}
+		return runAWSCLI(ctx, args...)
+	}
+
+	res := []doctorCheck{
+		{Name: "backend settings", Run: func(ctx context.Context) (checkResult, string, string) {
+			if bucket == "" || key == "" {
+				return checkFail, "bucket and key are required", "set them in the backend block, or pass them with --backend-config"
+			}
+			return checkPass, "s3://" + bucket + "/" + key, ""
+		}},
+		checkLogin("aws"),
+		{Name: "aws CLI is installed", Run: func(ctx context.Context) (checkResult, string, string) {
+			if _, err := runner.LookPath("aws"); err != nil {
+				return checkFail, "aws not found on PATH", "install the AWS CLI, which the checks use"
+			}
+			return checkPass, "", ""
+		}},
+	}
+	if p := s["profile"]; p != "" {
+		res = append(res, doctorCheck{Name: "profile " + p + " has credentials", Run: func(ctx context.Context) (checkResult, string, string) {
+			fn, err := awsCredentialsFile()
+			if err != nil {
+				return checkFail, err.Error(), ""
+			}
+			sect, err := readINISection(fn, p)
+			if err != nil {
+				return checkFail, err.Error(), ""
+			}
+			if sect["aws_access_key_id"] == "" {
+				return checkFail, "not in " + fn, "sign into it with IDP_AWS_PROFILES, or remove profile from the backend block to use the default profile"
+			}
+			return checkPass, fn, ""
+		}})
+	}
+	res = append(res, doctorCheck{Name: "identity", Run: func(ctx context.Context) (checkResult, string, string) {
+		out, err := aws(ctx, "sts", "get-caller-identity")
+		if err != nil {
+			return checkFail, err.Error(), "run idp login aws"
+		}
+		var id struct{ Arn string }
+		_ = json.Unmarshal(out, &id)
+		return checkPass, id.Arn, ""
+	}})
+	if role != "" {
+		res = append(res, doctorCheck{Name: "backend role can be assumed", Run: func(ctx context.Context) (checkResult, string, string) {
+			out, err := aws(ctx, "sts", "assume-role", "--role-arn", role, "--role-session-name", "idp-check-terraform")
+			if err != nil {
+				return checkFail, err.Error(), "allow the signed-in role sts:AssumeRole on " + role + ", and " + role + " to be assumed by it in its trust policy"
+			}
+			var assumed struct {
+				Credentials struct{ AccessKeyId, SecretAccessKey, SessionToken string }
+			}
+			err = json.Unmarshal(out, &assumed)
+			if err != nil {
+				return checkFail, err.Error(), ""
+			}
+			c := assumed.Credentials
+			registerSecret(c.SecretAccessKey)
+			registerSecret(c.SessionToken)
+			roleEnv = []string{"AWS_ACCESS_KEY_ID=" + c.AccessKeyId, "AWS_SECRET_ACCESS_KEY=" + c.SecretAccessKey, "AWS_SESSION_TOKEN=" + c.SessionToken}
+			return checkPass, role, ""
+		}})
+	}
+	res = append(res,
+		doctorCheck{Name: "state bucket is reachable", Run: func(ctx context.Context) (checkResult, string, string) {
+			_, err := aws(ctx, "s3api", "head-bucket", "--bucket", bucket)
+			switch {
+			case err == nil:
+				return checkPass, bucket, ""
+			case awsErrorIs(err, "404", "NoSuchBucket"):
+				return checkFail, bucket + " doesn't exist", "create the bucket, or fix bucket in the backend block"
+			case awsErrorIs(err, "301", "PermanentRedirect"):
+				return checkFail, bucket + " is in another region", "set region in the backend block to the bucket's region"
+			case awsErrorIs(err, "403", "AccessDenied"):
+				return checkFail, "access denied to " + bucket, "allow s3:ListBucket on arn:aws:s3:::" + bucket + " to the role terraform uses"
+			}
+			return checkFail, err.Error(), ""
+		}},
+		doctorCheck{Name: "state is readable", Run: func(ctx context.Context) (checkResult, string, string) {
+			_, err := aws(ctx, "s3api", "head-object", "--bucket", bucket, "--key", key)
+			switch {
+			case err == nil:
+				return checkPass, key, ""
+			case awsErrorIs(err, "404", "Not Found"):
+				return checkPass, "no state yet, terraform init will create it", ""
+			case awsErrorIs(err, "403", "Forbidden"):
+				return checkFail, "access denied to " + key, "allow s3:GetObject and s3:PutObject on arn:aws:s3:::" + bucket + "/" + key + " to the role terraform uses"
+			}
+			return checkFail, err.Error(), ""
+		}},
+	)
+	if table := s["dynamodb_table"]; table != "" {
+		res = append(res, doctorCheck{Name: "lock table is reachable", Run: func(ctx context.Context) (checkResult, string, string) {
+			lockKey, _ := json.Marshal(map[string]map[string]string{"LockID": {"S": bucket + "/" + key + "-md5"}})
+			_, err := aws(ctx, "dynamodb", "get-item", "--table-name", table, "--key", string(lockKey))
+			switch {
+			case err == nil:
+				return checkPass, table, ""
+			case awsErrorIs(err, "ResourceNotFoundException"):
+				return checkFail, table + " doesn't exist", "create the table with the string partition key LockID, or fix dynamodb_table in the backend block"
+			case awsErrorIs(err, "AccessDenied"):
+				return checkFail, "access denied to " + table, "allow dynamodb:GetItem, dynamodb:PutItem and dynamodb:DeleteItem on the table to the role terraform uses"
+			}
+			return checkFail, err.Error(), ""
+		}})
+	}
+	return res
+}
+
+// awsErrorIs says whether the aws CLI failed with one of the error codes or messages.
+func awsErrorIs(err error, codes ...string) bool {
+	for _, c := range codes {
+		if strings.Contains(err.Error(), "("+c+")") || strings.Contains(err.Error(), c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (be *terraformBackend) gcsChecks() []doctorCheck {
+	bucket := be.Settings["bucket"]
+	prefix := be.Settings["prefix"]
+	res := []doctorCheck{
+		{Name: "backend settings", Run: func(ctx context.Context) (checkResult, string, string) {
+			if bucket == "" {
+				return checkFail, "bucket is required", "set it in the backend block, or pass it with --backend-config"
+			}
+			if be.Settings["credentials"] != "" || be.Settings["access_token"] != "" {
+				return checkWarn, "the backend has credentials of its own, so terraform doesn't use the signed-in identity", "remove credentials and access_token from the backend block"
+			}
+			return checkPass, "gs://" + bucket + "/" + prefix, ""
+		}},
+		checkLogin("gcp"),
+	}
+	if sa := be.Settings["impersonate_service_account"]; sa != "" {
+		res = append(res, doctorCheck{Name: "service account impersonation", Run: func(ctx context.Context) (checkResult, string, string) {
+			return checkWarn, "terraform impersonates " + sa + ", which isn't checked", "grant the signed-in identity roles/iam.serviceAccountTokenCreator on " + sa
+		}})
+	}
+	res = append(res, doctorCheck{Name: "state bucket is reachable", Run: func(ctx context.Context) (checkResult, string, string) {
+		token, err := gcpAccessToken(ctx, "check")
+		if err != nil {
+			return checkFail, err.Error(), "run idp login gcp"
+		}
+		q := url.Values{"prefix": {prefix}, "maxResults": {"1"}}
+		status, body, err := getWithBearer(ctx, "https://storage.googleapis.com/storage/v1/b/"+url.PathEscape(bucket)+"/o?"+q.Encode(), token, nil)
+		switch {
+		case err != nil:
+			return checkFail, err.Error(), ""
+		case status == http.StatusOK:
+			return checkPass, bucket, ""
+		case status == http.StatusNotFound:
+			return checkFail, bucket + " doesn't exist", "create the bucket, or fix bucket in the backend block"
+		case status == http.StatusForbidden || status == http.StatusUnauthorized:
+			return checkFail, "access denied to " + bucket, "grant " + gcpIdentity() + " roles/storage.objectAdmin on the bucket"
+		}
+		return checkFail, fmt.Sprintf("%d: %s", status, body), ""
+	}})
+	return res
+}
+
+func (be *terraformBackend) azurermChecks() []doctorCheck {
+	account := be.Settings["storage_account_name"]
+	container := be.Settings["container_name"]
+	return []doctorCheck{
+		{Name: "backend settings", Run: func(ctx context.Context) (checkResult, string, string) {
+			switch {
+			case account == "" || container == "":
+				return checkFail, "storage_account_name and container_name are required", "set them in the backend block, or pass them with --backend-config"
+			case be.Settings["access_key"] != "" || be.Settings["sas_token"] != "":
+				return checkWarn, "the backend has credentials of its own, so terraform doesn't use the signed-in identity", "remove access_key and sas_token from the backend block"
+			case be.Settings["use_azuread_auth"] != "true":
+				return checkWarn, "terraform looks up the storage account key, which needs listKeys permission on the account", "set use_azuread_auth = true to access the state with the signed-in identity"
+			}
+			return checkPass, account + "/" + container + "/" + be.Settings["key"], ""
+		}},
+		checkLogin("azure"),
+		{Name: "state container is reachable", Run: func(ctx context.Context) (checkResult, string, string) {
+			token, err := azureAccessToken(ctx, "https://storage.azure.com/.default", "check")
+			if err != nil {
+				return checkFail, err.Error(), "run idp login azure"
+			}
+			u := "https://" + account + ".blob.core.windows.net/" + url.PathEscape(container) + "?restype=container&comp=list&maxresults=1"
+			status, body, err := getWithBearer(ctx, u, token, map[string]string{"x-ms-version": "2021-08-06"})
+			switch {
+			case err != nil:
+				return checkFail, err.Error(), "check storage_account_name in the backend block"
+			case status == http.StatusOK:
+				return checkPass, account + "/" + container, ""
+			case status == http.StatusNotFound:
+				return checkFail, container + " doesn't exist in " + account, "create the container, or fix container_name in the backend block"
+			case status == http.StatusForbidden:
+				return checkFail, "access denied to " + container, "assign " + azureIdentity() + " the Storage Blob Data Contributor role on the container"
+			}
+			return checkFail, fmt.Sprintf("%d: %s", status, body), ""
+		}},
+	}
+}
+
+// getWithBearer sends a GET request with token, returning the status and the start of the response body.
+func getWithBearer(ctx context.Context, u, token string, headers map[string]string) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer drainBody(resp.Body)
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return resp.StatusCode, strings.TrimSpace(string(body)), nil
+}
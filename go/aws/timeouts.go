@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// timeoutsConfig bounds the phases of signing in, keyed by provider name or * for all providers, so that a
+// provider which hangs fails on its own instead of holding up the others during login all.
+type timeoutsConfig map[string]providerTimeouts
+
+type providerTimeouts struct {
+	// Login bounds the whole sign-in, hooks included.
+	Login jsonDuration `json:"login,omitempty"`
+	// Mint bounds minting an identity token.
+	Mint jsonDuration `json:"mint,omitempty"`
+	// Exchange bounds exchanging it with the provider.
+	Exchange jsonDuration `json:"exchange,omitempty"`
+	// Persist bounds writing the credentials, e.g. with aws configure.
+	Persist jsonDuration `json:"persist,omitempty"`
+}
+
+// jsonDuration is a duration written like "30s" in the config file.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+// phaseTimeouts maps login, which runSignin bounds, and the names of the steps traceStep runs to their timeout.
+var phaseTimeouts = map[string]func(providerTimeouts) jsonDuration{
+	"login":               func(t providerTimeouts) jsonDuration { return t.Login },
+	"mint identity token": func(t providerTimeouts) jsonDuration { return t.Mint },
+	"exchange token":      func(t providerTimeouts) jsonDuration { return t.Exchange },
+	"persist credentials": func(t providerTimeouts) jsonDuration { return t.Persist },
+}
+
+type signinProviderKey struct{}
+
+// withSigninProvider returns a context whose steps are bounded by the timeouts of provider.
+func withSigninProvider(ctx context.Context, provider string) context.Context {
+	return context.WithValue(ctx, signinProviderKey{}, provider)
+}
+
+// phaseTimeout returns the timeout of phase for the provider signing in with ctx, or for all providers, or 0 if
+// there is none.
+func phaseTimeout(ctx context.Context, phase string) time.Duration {
+	get := phaseTimeouts[phase]
+	if cfg == nil || get == nil {
+		return 0
+	}
+	if provider, ok := ctx.Value(signinProviderKey{}).(string); ok {
+		if d := get(cfg.Timeouts[provider]); d > 0 {
+			return time.Duration(d)
+		}
+	}
+	return time.Duration(get(cfg.Timeouts["*"]))
+}
+
+// withPhaseTimeout runs f with the timeout of phase, if one is configured, and says so if it ran out.
+func withPhaseTimeout(ctx context.Context, phase string, f func(ctx context.Context) error) error {
+	d := phaseTimeout(ctx, phase)
+	if d <= 0 {
+		return f(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	err := f(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %s: %w", phase, d, err)
+	}
+	return err
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+// traceExportTimeout bounds exporting the spans, so an unreachable collector doesn't hold up the command.
+const traceExportTimeout = 5 * time.Second
+
+// tracer collects the spans of this process and exports them to the OTLP endpoint of the standard
+// OTEL_EXPORTER_OTLP_* variables. Without an endpoint, tracing is off and spans cost nothing.
+var tracer struct {
+	endpoint string
+	headers  map[string]string
+	client   gitpodidp.HTTPDoer
+	// remoteParent is the span of TRACEPARENT, e.g. of the workspace start script which ran this command.
+	remoteParent spanContext
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+// traceSpan is a running span. Its methods do nothing on nil, which startSpan returns while tracing is off.
+type traceSpan struct {
+	spanContext
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	attrs    []otlpAttribute
+}
+
+type spanKey struct{}
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// setupTracing enables tracing if an OTLP endpoint is configured, and wraps httpClient to trace every request.
+// Spans are sent as OTLP/HTTP JSON, which every collector accepts.
+func setupTracing() {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if p := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); p != "" && p != "http/json" && p != "http/protobuf" {
+		printWarning("tracing is off: the OTLP protocol %s is not supported, use http/json", p)
+		return
+	}
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return
+	}
+
+	tracer.endpoint = endpoint
+	tracer.headers = parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	tracer.client = httpClient
+	if m := traceparentPattern.FindStringSubmatch(os.Getenv("TRACEPARENT")); m != nil {
+		tracer.remoteParent = spanContext{traceID: m[1], spanID: m[2]}
+	}
+	httpClient = &tracingClient{next: httpClient}
+}
+
+// parseOTLPHeaders parses the key1=value1,key2=value2 list of OTEL_EXPORTER_OTLP_HEADERS, whose values are URL
+// encoded.
+func parseOTLPHeaders(s string) map[string]string {
+	res := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		if uv, err := url.QueryUnescape(strings.TrimSpace(v)); err == nil {
+			v = uv
+		}
+		res[strings.TrimSpace(k)] = v
+		registerSecret(v)
+	}
+	return res
+}
+
+func tracingEnabled() bool {
+	return tracer.endpoint != ""
+}
+
+// startSpan starts a span named name as a child of the span in ctx, and returns a context carrying it. Key-value
+// pairs in kv become its attributes.
+func startSpan(ctx context.Context, name string, kv ...string) (context.Context, *traceSpan) {
+	return startSpanKind(ctx, name, spanKindInternal, kv...)
+}
+
+func startSpanKind(ctx context.Context, name string, kind int, kv ...string) (context.Context, *traceSpan) {
+	if !tracingEnabled() {
+		return ctx, nil
+	}
+	parent, ok := ctx.Value(spanKey{}).(*traceSpan)
+	s := &traceSpan{name: name, kind: kind, start: time.Now(), spanContext: spanContext{spanID: randomHex(8)}}
+	switch {
+	case ok:
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	case tracer.remoteParent.traceID != "":
+		s.traceID, s.parentID = tracer.remoteParent.traceID, tracer.remoteParent.spanID
+	default:
+		s.traceID = randomHex(16)
+	}
+	s.setAttributes(kv...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *traceSpan) setAttributes(kv ...string) {
+	if s == nil {
+		return
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.attrs = append(s.attrs, otlpAttribute{Key: kv[i], Value: otlpValue{StringValue: kv[i+1]}})
+	}
+}
+
+// end finishes the span, marking it failed if err isn't nil.
+func (s *traceSpan) end(err error) {
+	if s == nil {
+		return
+	}
+	res := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+		Status:            otlpStatus{Code: spanStatusOK},
+	}
+	if err != nil {
+		res.Status = otlpStatus{Code: spanStatusError, Message: redactText(err.Error())}
+	}
+	tracer.mu.Lock()
+	tracer.spans = append(tracer.spans, res)
+	tracer.mu.Unlock()
+}
+
+// traceStep runs f in a span named name, bounded by the configured timeout of the phase of that name.
+func traceStep(ctx context.Context, name string, f func(ctx context.Context) error, kv ...string) error {
+	ctx, span := startSpan(ctx, name, kv...)
+	err := withPhaseTimeout(ctx, name, f)
+	span.end(err)
+	return err
+}
+
+// flushTraces exports the spans which ended since the last flush. Failures are only logged: tracing must never
+// break signing in.
+func flushTraces() {
+	tracer.mu.Lock()
+	spans := tracer.spans
+	tracer.spans = nil
+	tracer.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	err := exportSpans(spans)
+	if err != nil {
+		slog.Warn("cannot export traces", "endpoint", tracer.endpoint, "error", err)
+	}
+}
+
+func exportSpans(spans []otlpSpan) error {
+	resource := []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: serviceName()}}}
+	for _, a := range []struct{ key, env string }{
+		{"gitpod.workspace.id", "GITPOD_WORKSPACE_ID"},
+		{"gitpod.instance.id", "GITPOD_INSTANCE_ID"},
+		{"gitpod.host", "GITPOD_HOST"},
+	} {
+		if v := os.Getenv(a.env); v != "" {
+			resource = append(resource, otlpAttribute{Key: a.key, Value: otlpValue{StringValue: v}})
+		}
+	}
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "gitpod-idp", Version: version}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tracer.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range tracer.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := tracer.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func serviceName() string {
+	if n := os.Getenv("OTEL_SERVICE_NAME"); n != "" {
+		return n
+	}
+	return filepath.Base(os.Args[0])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tracingClient traces every HTTP request made within a span, and propagates the trace to the server.
+type tracingClient struct {
+	next gitpodidp.HTTPDoer
+}
+
+func (c *tracingClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(spanKey{}) == nil {
+		return c.next.Do(req)
+	}
+	_, span := startSpanKind(req.Context(), "HTTP "+req.Method, spanKindClient,
+		"http.request.method", req.Method,
+		"server.address", req.URL.Hostname(),
+		"url.path", req.URL.Path,
+	)
+	req.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", span.traceID, span.spanID))
+	resp, err := c.next.Do(req)
+	spanErr := err
+	if err == nil {
+		span.setAttributes("http.response.status_code", strconv.Itoa(resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			spanErr = fmt.Errorf("%s", resp.Status)
+		}
+	}
+	span.end(spanErr)
+	return resp, err
+}
+
+// The OTLP/JSON encoding of ExportTraceServiceRequest, as far as it's used here.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
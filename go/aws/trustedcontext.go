@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Policies for signing in from workspaces opened on forks or on pull requests from them, which
+// IDP_UNTRUSTED_CONTEXT_POLICY selects.
+const (
+	untrustedPolicySkip      = "skip"
+	untrustedPolicyDowngrade = "downgrade"
+	untrustedPolicyAllow     = "allow"
+)
+
+// errSigninSkipped means the untrusted context policy skipped signing into a provider, which doesn't count as a
+// failure, like CI systems withholding credentials from pull requests of forks.
+var errSigninSkipped = errors.New("skipped")
+
+// contextRepository is a repository as GITPOD_WORKSPACE_CONTEXT describes it.
+type contextRepository struct {
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	// Fork is set if the repository is a fork of another one.
+	Fork *struct {
+		Parent *contextRepository `json:"parent"`
+	} `json:"fork"`
+}
+
+func (r contextRepository) fullName() string {
+	return r.Owner + "/" + r.Name
+}
+
+// workspaceContext is the part of GITPOD_WORKSPACE_CONTEXT which tells where the workspace's code comes from.
+type workspaceContext struct {
+	// Repository is the repository the workspace was opened on, the head repository for pull requests.
+	Repository contextRepository `json:"repository"`
+	// Nr is the number of the pull request the workspace was opened on, if it was.
+	Nr int `json:"nr"`
+	// Base is the repository a pull request is to be merged into.
+	Base *struct {
+		Repository contextRepository `json:"repository"`
+	} `json:"base"`
+}
+
+// untrustedContextPolicy returns the policy for signing in from untrusted contexts. It defaults to allow, unless
+// IDP_TRUSTED_REPOSITORIES is set, in which case everything else is skipped, or downgraded if
+// IDP_AWS_READONLY_ROLE_ARN is set, too.
+func untrustedContextPolicy() (string, error) {
+	switch policy := setting("IDP_UNTRUSTED_CONTEXT_POLICY"); policy {
+	case "":
+		switch {
+		case setting("IDP_TRUSTED_REPOSITORIES") == "":
+			return untrustedPolicyAllow, nil
+		case setting("IDP_AWS_READONLY_ROLE_ARN") != "":
+			return untrustedPolicyDowngrade, nil
+		default:
+			return untrustedPolicySkip, nil
+		}
+	case untrustedPolicySkip, untrustedPolicyAllow:
+		return policy, nil
+	case untrustedPolicyDowngrade:
+		if setting("IDP_AWS_READONLY_ROLE_ARN") == "" {
+			return "", exitErrorf(exitMissingConfig, "IDP_UNTRUSTED_CONTEXT_POLICY is downgrade, but IDP_AWS_READONLY_ROLE_ARN is not set")
+		}
+		return policy, nil
+	default:
+		return "", exitErrorf(exitMissingConfig, "IDP_UNTRUSTED_CONTEXT_POLICY must be skip, downgrade or allow, not %q", policy)
+	}
+}
+
+// currentWorkspaceContext returns the context of the workspace from GITPOD_WORKSPACE_CONTEXT, and otherwise the
+// repository of the origin remote, which says nothing about forks or pull requests.
+func currentWorkspaceContext(ctx context.Context) (*workspaceContext, error) {
+	if raw := os.Getenv("GITPOD_WORKSPACE_CONTEXT"); raw != "" {
+		var res workspaceContext
+		err := json.Unmarshal([]byte(raw), &res)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse GITPOD_WORKSPACE_CONTEXT: %w", err)
+		}
+		if res.Repository.Owner != "" {
+			return &res, nil
+		}
+	}
+	remote := gitRepositoryURL(ctx)
+	if remote == "" {
+		return nil, fmt.Errorf("cannot tell which repository the workspace is on")
+	}
+	u, err := url.Parse(remote)
+	if err != nil {
+		return nil, err
+	}
+	owner, name, ok := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if !ok {
+		return nil, fmt.Errorf("cannot tell the owner of %s", remote)
+	}
+	return &workspaceContext{Repository: contextRepository{Owner: owner, Name: name}}, nil
+}
+
+// untrustedContextReason returns why the workspace's code can't be trusted with credentials, or an empty string
+// if it can. With IDP_TRUSTED_REPOSITORIES, repository patterns like my-org/*, only code from matching
+// repositories is trusted; otherwise forks and pull requests from other repositories are not.
+func untrustedContextReason(wc *workspaceContext) string {
+	repo := wc.Repository.fullName()
+	if trusted := rolePatterns("IDP_TRUSTED_REPOSITORIES"); len(trusted) > 0 {
+		if !matchesRolePattern(repo, trusted) {
+			return fmt.Sprintf("%s is not a trusted repository", repo)
+		}
+		return ""
+	}
+	if wc.Base != nil && wc.Base.Repository.Owner != "" && !strings.EqualFold(wc.Base.Repository.fullName(), repo) {
+		return fmt.Sprintf("the workspace is opened on pull request #%d of %s from %s", wc.Nr, wc.Base.Repository.fullName(), repo)
+	}
+	if fork := wc.Repository.Fork; fork != nil {
+		if fork.Parent != nil {
+			return fmt.Sprintf("the workspace is opened on %s, a fork of %s", repo, fork.Parent.fullName())
+		}
+		return fmt.Sprintf("the workspace is opened on %s, a fork", repo)
+	}
+	return ""
+}
+
+// guardUntrustedContext applies the untrusted context policy to signing into p. It skips signing in from
+// untrusted contexts, or, for AWS with the downgrade policy, returns a sign-in into the read-only role instead.
+// For trusted contexts it returns signin.
+func guardUntrustedContext(ctx context.Context, p provider, signin func(ctx context.Context) error) (func(ctx context.Context) error, error) {
+	policy, err := untrustedContextPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if policy == untrustedPolicyAllow {
+		return signin, nil
+	}
+	reason := workspaceUntrustedReason(ctx)
+	if reason == "" {
+		return signin, nil
+	}
+	if p.Name != "aws" || policy != untrustedPolicyDowngrade {
+		return nil, fmt.Errorf("%w signing into %s, as %s", errSigninSkipped, p.Name, reason)
+	}
+	return readOnlySignin(p, reason), nil
+}
+
+// workspaceUntrustedReason returns why the code of the workspace can't be trusted with credentials, or an empty
+// string if it can.
+func workspaceUntrustedReason(ctx context.Context) string {
+	wc, err := currentWorkspaceContext(ctx)
+	switch {
+	case err == nil:
+		return untrustedContextReason(wc)
+	case setting("IDP_TRUSTED_REPOSITORIES") == "":
+		slog.Debug("cannot tell whether the workspace context is trusted", "error", err)
+		return ""
+	default:
+		// with a list of trusted repositories, code of unknown provenance isn't trusted either
+		return fmt.Sprintf("the workspace's repository is unknown (%v)", err)
+	}
+}
+
+// guardUntrustedCredentials applies the untrusted context policy to handing out what outside of runSignin, like
+// guardCredentials does the shared workspace policy. It refuses rather than skips, as the caller asked for what
+// explicitly, and downgrade refuses too.
+func guardUntrustedCredentials(ctx context.Context, what string) error {
+	policy, err := untrustedContextPolicy()
+	if err != nil {
+		return err
+	}
+	if policy == untrustedPolicyAllow {
+		return nil
+	}
+	if reason := workspaceUntrustedReason(ctx); reason != "" {
+		return exitErrorf(exitTokenMintFailed, "not handing out %s, as %s - set IDP_UNTRUSTED_CONTEXT_POLICY=allow to anyway", what, reason)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+const (
+	forkContext        = `{"repository": {"owner": "mallory", "name": "app", "fork": {"parent": {"owner": "acme", "name": "app"}}}}`
+	pullRequestContext = `{"repository": {"owner": "mallory", "name": "app"}, "nr": 7, "base": {"repository": {"owner": "acme", "name": "app"}}}`
+	ownContext         = `{"repository": {"owner": "acme", "name": "app"}}`
+)
+
+func TestGitpodIDTokenUntrustedContext(t *testing.T) {
+	tests := []struct {
+		name      string
+		context   string
+		policy    string
+		trusted   string
+		guarded   bool
+		wantToken bool
+	}{
+		{name: "own repository", context: ownContext, policy: untrustedPolicySkip, wantToken: true},
+		{name: "fork", context: forkContext, policy: untrustedPolicySkip},
+		{name: "pull request from a fork", context: pullRequestContext, policy: untrustedPolicySkip},
+		{name: "fork, downgrade", context: forkContext, policy: untrustedPolicyDowngrade},
+		{name: "fork, allow", context: forkContext, policy: untrustedPolicyAllow, wantToken: true},
+		{name: "fork, default policy", context: forkContext, wantToken: true},
+		{name: "untrusted repository", context: ownContext, trusted: "other/*"},
+		{name: "trusted repository", context: ownContext, trusted: "acme/*", wantToken: true},
+		{name: "fork, guarded by runSignin", context: forkContext, policy: untrustedPolicySkip, guarded: true, wantToken: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeRunner{run: fakeGitpodToken}
+			testWorkspace(t, r)
+			t.Setenv("GITPOD_WORKSPACE_CONTEXT", tt.context)
+			t.Setenv("IDP_UNTRUSTED_CONTEXT_POLICY", tt.policy)
+			t.Setenv("IDP_TRUSTED_REPOSITORIES", tt.trusted)
+			if tt.policy == untrustedPolicyDowngrade {
+				t.Setenv("IDP_AWS_READONLY_ROLE_ARN", "arn:aws:iam::123456789012:role/readonly")
+			}
+			ctx := context.Background()
+			if tt.guarded {
+				ctx = withSigninGuarded(ctx)
+			}
+
+			_, err := gitpodIDToken(ctx, gitpodidp.AWSAudience)
+			if (err == nil) != tt.wantToken {
+				t.Fatalf("gitpodIDToken() error = %v, want a token %v", err, tt.wantToken)
+			}
+			if r.ran("gp idp token") != tt.wantToken {
+				t.Errorf("minted a token: %v, want %v", r.ran("gp idp token"), tt.wantToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// stringOrSlice decodes IAM policy elements which may be either a single string or a list of strings.
+type stringOrSlice []string
+
+func (s *stringOrSlice) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = []string{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*s = multi
+	return nil
+}
+
+type trustPolicy struct {
+	Statement []trustStatement
+}
+
+func (p *trustPolicy) UnmarshalJSON(data []byte) error {
+	var doc struct {
+		Statement json.RawMessage
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	// Statement may be a single object rather than a list
+	var single trustStatement
+	if err := json.Unmarshal(doc.Statement, &single); err == nil {
+		p.Statement = []trustStatement{single}
+		return nil
+	}
+	return json.Unmarshal(doc.Statement, &p.Statement)
+}
+
+type trustStatement struct {
+	Sid       string
+	Effect    string
+	Principal trustPrincipal
+	Action    stringOrSlice
+	Condition map[string]map[string]stringOrSlice
+}
+
+type trustPrincipal struct {
+	Any       bool
+	Federated stringOrSlice
+}
+
+func (p *trustPrincipal) UnmarshalJSON(data []byte) error {
+	var any string
+	if err := json.Unmarshal(data, &any); err == nil {
+		p.Any = any == "*"
+		return nil
+	}
+	var principals struct {
+		Federated stringOrSlice
+	}
+	if err := json.Unmarshal(data, &principals); err != nil {
+		return err
+	}
+	p.Federated = principals.Federated
+	return nil
+}
+
+// trustStatementResult is the outcome of evaluating a single statement against a token.
+type trustStatementResult struct {
+	Index    int      `json:"index"`
+	Sid      string   `json:"sid,omitempty"`
+	Effect   string   `json:"effect"`
+	Matches  bool     `json:"matches"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// trustEvaluation is the outcome of evaluating a trust policy against a token.
+type trustEvaluation struct {
+	Allowed    bool                   `json:"allowed"`
+	Statements []trustStatementResult `json:"statements"`
+}
+
+// evaluateAWSTrustPolicy determines whether a token with claims issued by issuerHost (e.g. api.gitpod.io/idp)
+// could assume a role with the given trust policy via AssumeRoleWithWebIdentity, explaining every mismatch.
+func evaluateAWSTrustPolicy(policy []byte, issuerHost string, claims map[string]interface{}) (*trustEvaluation, error) {
+	var doc trustPolicy
+	err := json.Unmarshal(policy, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust policy: %w", err)
+	}
+
+	res := &trustEvaluation{}
+	var allowed, denied bool
+	for i, stmt := range doc.Statement {
+		r := trustStatementResult{Index: i + 1, Sid: stmt.Sid, Effect: stmt.Effect}
+		r.Problems = evaluateTrustStatement(stmt, issuerHost, claims)
+		r.Matches = len(r.Problems) == 0
+		if r.Matches {
+			switch stmt.Effect {
+			case "Allow":
+				allowed = true
+			case "Deny":
+				denied = true
+				r.Problems = []string{"this Deny statement applies to the token"}
+			}
+		}
+		res.Statements = append(res.Statements, r)
+	}
+	res.Allowed = allowed && !denied
+	return res, nil
+}
+
+func evaluateTrustStatement(stmt trustStatement, issuerHost string, claims map[string]interface{}) []string {
+	var problems []string
+
+	var actionOK bool
+	for _, a := range stmt.Action {
+		if awsStringLike(strings.ToLower(a), "sts:assumerolewithwebidentity") {
+			actionOK = true
+		}
+	}
+	if !actionOK {
+		problems = append(problems, fmt.Sprintf("action %s does not include sts:AssumeRoleWithWebIdentity", strings.Join(stmt.Action, ", ")))
+	}
+
+	if !stmt.Principal.Any {
+		var principalOK bool
+		for _, f := range stmt.Principal.Federated {
+			if strings.HasSuffix(f, ":oidc-provider/"+issuerHost) {
+				principalOK = true
+			}
+		}
+		if !principalOK {
+			if len(stmt.Principal.Federated) == 0 {
+				problems = append(problems, "the statement has no federated principal")
+			} else {
+				problems = append(problems, fmt.Sprintf("the federated principal %s is not the OIDC provider for %s", strings.Join(stmt.Principal.Federated, ", "), issuerHost))
+			}
+		}
+	}
+
+	ops := make([]string, 0, len(stmt.Condition))
+	for op := range stmt.Condition {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		keys := make([]string, 0, len(stmt.Condition[op]))
+		for k := range stmt.Condition[op] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if problem := evaluateTrustCondition(op, key, stmt.Condition[op][key], issuerHost, claims); problem != "" {
+				problems = append(problems, problem)
+			}
+		}
+	}
+	return problems
+}
+
+// evaluateTrustCondition checks a single condition, returning a description of the mismatch or an empty string.
+func evaluateTrustCondition(op, key string, expected []string, issuerHost string, claims map[string]interface{}) string {
+	lkey := strings.ToLower(key)
+	if strings.HasPrefix(lkey, "aws:") || strings.HasPrefix(lkey, "sts:") {
+		// global and STS condition keys depend on the request rather than the token
+		return ""
+	}
+	if !strings.HasPrefix(lkey, strings.ToLower(issuerHost)+":") {
+		return fmt.Sprintf("%s %s: the condition key does not refer to the issuer %s", op, key, issuerHost)
+	}
+	claim := key[len(issuerHost)+1:]
+	actual := claimValues(claims[claim])
+
+	baseOp := op
+	ifExists := strings.HasSuffix(baseOp, "IfExists")
+	baseOp = strings.TrimSuffix(baseOp, "IfExists")
+	forAll := strings.HasPrefix(baseOp, "ForAllValues:")
+	forAny := strings.HasPrefix(baseOp, "ForAnyValue:")
+	baseOp = strings.TrimPrefix(strings.TrimPrefix(baseOp, "ForAnyValue:"), "ForAllValues:")
+	negated := strings.HasPrefix(baseOp, "StringNot")
+	if len(actual) == 0 {
+		// ForAllValues holds for no values at all, and so do negated single-valued operators. ForAnyValue doesn't.
+		if ifExists || forAll || (negated && !forAny) {
+			return ""
+		}
+		return fmt.Sprintf("%s %s: the token has no %s claim, the policy expects %s", op, key, claim, quoteAll(expected))
+	}
+
+	var match func(pattern, value string) bool
+	switch baseOp {
+	case "StringEquals", "StringNotEquals":
+		match = func(p, v string) bool { return p == v }
+	case "StringEqualsIgnoreCase", "StringNotEqualsIgnoreCase":
+		match = strings.EqualFold
+	case "StringLike", "StringNotLike":
+		match = awsStringLike
+	default:
+		return fmt.Sprintf("%s %s: unsupported condition operator", op, key)
+	}
+
+	// a value satisfies the operator if it matches one of the expected values, or, negated, none of them
+	var satisfied, unsatisfied []string
+	for _, a := range actual {
+		matched := slices.ContainsFunc(expected, func(e string) bool { return match(e, a) })
+		if matched != negated {
+			satisfied = append(satisfied, a)
+		} else {
+			unsatisfied = append(unsatisfied, a)
+		}
+	}
+	switch {
+	case forAll || (negated && !forAny):
+		// every value must satisfy it
+		if len(unsatisfied) == 0 {
+			return ""
+		}
+		if negated {
+			return fmt.Sprintf("%s %s: the token has %s, which the policy excludes", op, key, quoteAll(unsatisfied))
+		}
+		return fmt.Sprintf("%s %s: the token has %s, the policy expects only %s", op, key, quoteAll(unsatisfied), quoteAll(expected))
+	case len(satisfied) > 0:
+		return ""
+	case negated:
+		return fmt.Sprintf("%s %s: the token has only %s, which the policy excludes", op, key, quoteAll(actual))
+	}
+	return fmt.Sprintf("%s %s: the token has %s, the policy expects %s", op, key, quoteAll(actual), quoteAll(expected))
+}
+
+// claimValues returns a claim as list of strings. Claims like aud can be a string or a list.
+func claimValues(claim interface{}) []string {
+	switch c := claim.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{c}
+	case []interface{}:
+		res := make([]string, 0, len(c))
+		for _, v := range c {
+			res = append(res, fmt.Sprint(v))
+		}
+		return res
+	default:
+		return []string{fmt.Sprint(c)}
+	}
+}
+
+func quoteAll(vals []string) string {
+	quoted := make([]string, len(vals))
+	for i, v := range vals {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	return strings.Join(quoted, " or ")
+}
+
+// awsStringLike matches s against an IAM StringLike pattern, where * matches any sequence of characters and ? any single character.
+func awsStringLike(pattern, s string) bool {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String()).MatchString(s)
+}
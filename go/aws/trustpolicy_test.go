@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testIssuer = "api.gitpod.io/idp"
+
+func TestEvaluateTrustCondition(t *testing.T) {
+	claims := map[string]interface{}{
+		"sub":    "gitpod:org:acme:project:app:user:jane",
+		"aud":    []interface{}{"sts.amazonaws.com", "other"},
+		"groups": []interface{}{"dev", "ops"},
+	}
+	tests := []struct {
+		op       string
+		key      string
+		expected []string
+		wantOK   bool
+	}{
+		{op: "StringEquals", key: "aud", expected: []string{"sts.amazonaws.com"}, wantOK: true},
+		{op: "StringEquals", key: "aud", expected: []string{"nope"}},
+		{op: "StringLike", key: "sub", expected: []string{"gitpod:org:acme:*"}, wantOK: true},
+		{op: "StringLike", key: "sub", expected: []string{"gitpod:org:other:*"}},
+		{op: "StringEqualsIgnoreCase", key: "sub", expected: []string{"GITPOD:ORG:ACME:PROJECT:APP:USER:JANE"}, wantOK: true},
+		{op: "StringNotEquals", key: "sub", expected: []string{"gitpod:org:acme:project:app:user:jane"}},
+		{op: "StringNotEquals", key: "email", expected: []string{"x"}, wantOK: true},
+		{op: "StringEquals", key: "email", expected: []string{"x"}},
+		{op: "StringEqualsIfExists", key: "email", expected: []string{"x"}, wantOK: true},
+		{op: "ForAnyValue:StringEquals", key: "groups", expected: []string{"ops"}, wantOK: true},
+		{op: "ForAnyValue:StringEquals", key: "groups", expected: []string{"admin"}},
+		{op: "ForAnyValue:StringEquals", key: "email", expected: []string{"x"}},
+		{op: "ForAnyValue:StringNotEquals", key: "groups", expected: []string{"dev"}, wantOK: true},
+		{op: "ForAnyValue:StringNotEquals", key: "groups", expected: []string{"dev", "ops"}},
+		{op: "ForAllValues:StringEquals", key: "groups", expected: []string{"dev", "ops", "qa"}, wantOK: true},
+		{op: "ForAllValues:StringEquals", key: "groups", expected: []string{"dev"}},
+		{op: "ForAllValues:StringLike", key: "groups", expected: []string{"*"}, wantOK: true},
+		{op: "ForAllValues:StringEquals", key: "email", expected: []string{"x"}, wantOK: true},
+		{op: "ForAllValues:StringNotEquals", key: "groups", expected: []string{"admin"}, wantOK: true},
+		{op: "ForAllValues:StringNotEquals", key: "groups", expected: []string{"ops"}},
+		{op: "NumericEquals", key: "sub", expected: []string{"1"}},
+	}
+	for _, tt := range tests {
+		problem := evaluateTrustCondition(tt.op, testIssuer+":"+tt.key, tt.expected, testIssuer, claims)
+		if (problem == "") != tt.wantOK {
+			t.Errorf("%s %s %q: problem %q, want ok %v", tt.op, tt.key, tt.expected, problem, tt.wantOK)
+		}
+	}
+
+	if problem := evaluateTrustCondition("StringEquals", "token.actions.githubusercontent.com:sub", []string{"x"}, testIssuer, claims); !strings.Contains(problem, "does not refer to the issuer") {
+		t.Errorf("a key of another issuer: problem %q", problem)
+	}
+	if problem := evaluateTrustCondition("StringEquals", "aws:SourceIp", []string{"x"}, testIssuer, claims); problem != "" {
+		t.Errorf("a global condition key: problem %q, want it ignored", problem)
+	}
+}
+
+func TestEvaluateAWSTrustPolicy(t *testing.T) {
+	claims := map[string]interface{}{"sub": "gitpod:org:acme:project:app:user:jane", "aud": "sts.amazonaws.com"}
+	allow := `{"Effect": "Allow", "Principal": {"Federated": "arn:aws:iam::123456789012:oidc-provider/api.gitpod.io/idp"},
+		"Action": "sts:AssumeRoleWithWebIdentity", "Condition": {"StringLike": {"api.gitpod.io/idp:sub": "gitpod:org:acme:*"}}}`
+	tests := []struct {
+		name        string
+		policy      string
+		wantAllowed bool
+	}{
+		{name: "allowed", policy: `{"Statement": ` + allow + `}`, wantAllowed: true},
+		{name: "allowed by one of several", policy: `{"Statement": [{"Effect": "Allow", "Principal": "*", "Action": "sts:AssumeRole"}, ` + allow + `]}`, wantAllowed: true},
+		{name: "denied", policy: `{"Statement": [` + allow + `, {"Effect": "Deny", "Principal": "*", "Action": "sts:*",
+			"Condition": {"StringEquals": {"api.gitpod.io/idp:aud": "sts.amazonaws.com"}}}]}`},
+		{name: "other provider", policy: `{"Statement": {"Effect": "Allow", "Principal": {"Federated": "arn:aws:iam::123456789012:oidc-provider/example.com"},
+			"Action": "sts:AssumeRoleWithWebIdentity"}}`},
+		{name: "other action", policy: `{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "sts:AssumeRole"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := evaluateAWSTrustPolicy([]byte(tt.policy), testIssuer, claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Allowed != tt.wantAllowed {
+				t.Errorf("allowed = %v, want %v: %+v", res.Allowed, tt.wantAllowed, res.Statements)
+			}
+		})
+	}
+
+	_, err := evaluateAWSTrustPolicy([]byte(`{"Statement": 1}`), testIssuer, claims)
+	if err == nil {
+		t.Error("an invalid policy evaluated without error")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var noColorFlag = flag.Bool("no-color", false, "disable colored output (also honors NO_COLOR)")
+
+const (
+	ansiRed    = "31"
+	ansiGreen  = "32"
+	ansiYellow = "33"
+	ansiCyan   = "36"
+)
+
+// interactiveOutput reports whether stderr is a terminal we can draw progress indicators on.
+func interactiveOutput() bool {
+	return isTerminal(os.Stderr) && !*porcelainFlag && os.Getenv("TERM") != "dumb"
+}
+
+func colorEnabled() bool {
+	return interactiveOutput() && !*noColorFlag && os.Getenv("NO_COLOR") == ""
+}
+
+func colorize(code, s string) string {
+	if !colorEnabled() {
+		return s
+	}
+	return "\033[" + code + "m" + s + "\033[0m"
+}
+
+// printSuccess and printFailure print a summary line to stderr.
+func printSuccess(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", colorize(ansiGreen, "✔"), fmt.Sprintf(format, args...))
+}
+
+// printFailure and printWarning redact credentials, as their messages often include errors and command output.
+func printFailure(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", colorize(ansiRed, "✘"), redactText(fmt.Sprintf(format, args...)))
+}
+
+func printWarning(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", colorize(ansiYellow, "!"), redactText(fmt.Sprintf(format, args...)))
+}
+
+// spinnerActive is set while a spinner is drawn. Only one spinner runs at a time: steps started while another
+// one is active, e.g. within the concurrent providers of login all, don't draw anything.
+var spinnerActive int32
+
+// withProgress runs f while showing a spinner with msg, replaced by a success or failure mark once f returns.
+func withProgress(msg string, f func() error) error {
+	if *verboseFlag {
+		// a spinner would garble the streamed output, so announce the step instead
+		printVerbose("step", msg)
+		return markResult(msg, f())
+	}
+	if !interactiveOutput() || !atomic.CompareAndSwapInt32(&spinnerActive, 0, 1) {
+		return f()
+	}
+	defer atomic.StoreInt32(&spinnerActive, 0)
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		frames := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			fmt.Fprintf(os.Stderr, "\r%s %s", colorize(ansiCyan, frames[i%len(frames)]), msg)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	err := f()
+	close(stop)
+	<-done
+	fmt.Fprint(os.Stderr, "\r\033[K")
+	return markResult(msg, err)
+}
+
+// markResult prints msg with a success or failure mark depending on err, and returns err.
+func markResult(msg string, err error) error {
+	if err != nil {
+		printFailure("%s", msg)
+	} else {
+		printSuccess("%s", msg)
+	}
+	return err
+}
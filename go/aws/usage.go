@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "usage",
+		Usage:   "usage [--since 168h] [provider...]",
+		Summary: "show which programs in the workspace got credentials from the credential helpers and token server, and how often",
+		Run:     runUsage,
+	})
+}
+
+// usageLogLimit is the size beyond which the usage log is rotated, keeping one older file.
+const usageLogLimit = 1 << 20
+
+// usageEntry is a line of the usage log: credentials this tool handed to a local program.
+type usageEntry struct {
+	Time time.Time `json:"time"`
+	// Channel is how the credentials were handed out: docker, git, bazel, kubectl, secrets or kafka-token-server.
+	Channel  string `json:"channel"`
+	Provider string `json:"provider,omitempty"`
+	// Target is what the credentials are for, like a registry, host, cluster or secret.
+	Target string `json:"target,omitempty"`
+	// PID, Exe and Command are those of the program which asked, where they can be told.
+	PID     int      `json:"pid,omitempty"`
+	Exe     string   `json:"exe,omitempty"`
+	Command []string `json:"command,omitempty"`
+}
+
+// usageSummary is a row of the usage report.
+type usageSummary struct {
+	Program  string    `json:"program"`
+	Channel  string    `json:"channel"`
+	Provider string    `json:"provider,omitempty"`
+	Requests int       `json:"requests"`
+	Targets  []string  `json:"targets,omitempty"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+func usageLogPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "usage.log"), nil
+}
+
+// meterUsage records that the program which ran this one as a credential helper got credentials for target. Shells
+// and wrappers in between, like the sh git runs helpers with, are skipped. Metering never fails the helper;
+// IDP_USAGE_METERING=false turns it off.
+func meterUsage(ctx context.Context, channel, provider, target string) {
+	appendUsage(helperUsage(ctx, channel, provider, target))
+}
+
+// helperUsage returns the entry for the program which ran this one getting credentials for target.
+func helperUsage(ctx context.Context, channel, provider, target string) usageEntry {
+	pid := os.Getppid()
+	info := processInfoOf(ctx, pid)
+	self, _ := os.Executable()
+	for i := 0; i < 4 && info.ppid > 1 && (isShell(info.exe) || info.exe == self); i++ {
+		pid = info.ppid
+		info = processInfoOf(ctx, pid)
+	}
+	return usageEntry{Channel: channel, Provider: provider, Target: target, PID: pid, Exe: info.exe, Command: info.command}
+}
+
+// meterRequest records that the local program which sent r got credentials for target. The program is only known
+// on Linux, from the owner of the connection's socket.
+func meterRequest(r *http.Request, channel, provider, target string) {
+	entry := usageEntry{Channel: channel, Provider: provider, Target: target}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if pid := socketOwner(r.RemoteAddr, local.String()); pid > 0 {
+			info := processInfoOf(r.Context(), pid)
+			entry.PID, entry.Exe, entry.Command = pid, info.exe, info.command
+		}
+	}
+	appendUsage(entry)
+}
+
+func appendUsage(entry usageEntry) {
+	if setting("IDP_USAGE_METERING") == "false" {
+		return
+	}
+	recordUsage(entry)
+}
+
+// recordUsage writes entry to the usage log, whatever the settings say.
+func recordUsage(entry usageEntry) {
+	entry.Time = time.Now()
+	// command lines may carry credentials, e.g. docker login -p
+	entry.Command = redactCommand(entry.Command)
+	err := writeUsageEntry(entry)
+	if err != nil {
+		slog.Debug("cannot meter credential usage", "channel", entry.Channel, "error", err)
+	}
+}
+
+func writeUsageEntry(entry usageEntry) error {
+	fn, err := usageLogPath()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	err = mkdirPrivate(filepath.Dir(fn))
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(fn); err == nil && fi.Size() > usageLogLimit {
+		_ = os.Rename(fn, fn+".1")
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// processInfo is what can be told about a local process.
+type processInfo struct {
+	exe     string
+	command []string
+	ppid    int
+}
+
+// processInfoOf describes the process pid from /proc, or with ps where there is none. Windows processes are
+// only known by their ID.
+func processInfoOf(ctx context.Context, pid int) processInfo {
+	var res processInfo
+	proc := filepath.Join("/proc", strconv.Itoa(pid))
+	if exe, err := os.Readlink(filepath.Join(proc, "exe")); err == nil {
+		res.exe = exe
+		if fc, err := os.ReadFile(filepath.Join(proc, "cmdline")); err == nil {
+			res.command = strings.Split(strings.TrimSuffix(string(fc), "\x00"), "\x00")
+		}
+		if fc, err := os.ReadFile(filepath.Join(proc, "stat")); err == nil {
+			// pid (comm) state ppid ..., where comm may contain spaces and parentheses
+			if i := strings.LastIndexByte(string(fc), ')'); i >= 0 {
+				if fields := strings.Fields(string(fc[i+1:])); len(fields) > 1 {
+					res.ppid, _ = strconv.Atoi(fields[1])
+				}
+			}
+		}
+		return res
+	}
+	if pth, _ := runner.LookPath("ps"); pth == "" {
+		return res
+	}
+	out, err := runner.Output(ctx, "ps", "-o", "ppid=,comm=", "-p", strconv.Itoa(pid))
+	if err != nil {
+		return res
+	}
+	if ppid, comm, ok := strings.Cut(strings.TrimSpace(string(out)), " "); ok {
+		res.ppid, _ = strconv.Atoi(ppid)
+		res.exe = strings.TrimSpace(comm)
+	}
+	return res
+}
+
+func isShell(exe string) bool {
+	switch filepath.Base(exe) {
+	case "sh", "bash", "dash", "zsh", "fish", "ash":
+		return true
+	}
+	return false
+}
+
+// socketOwner returns the process of the TCP connection from remote to local, both host:port, by finding the
+// socket in /proc/net/tcp and the process which has it open. It returns 0 where that's not possible.
+func socketOwner(remote, local string) int {
+	_, remotePort, err := net.SplitHostPort(remote)
+	if err != nil {
+		return 0
+	}
+	_, localPort, err := net.SplitHostPort(local)
+	if err != nil {
+		return 0
+	}
+	// the client's end of the connection: its local port is our remote one
+	want := fmt.Sprintf("%04X", mustAtoi(remotePort))
+	peer := fmt.Sprintf("%04X", mustAtoi(localPort))
+	var inode string
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if inode = socketInode(table, want, peer); inode != "" {
+			break
+		}
+	}
+	if inode == "" {
+		return 0
+	}
+	target := "socket:[" + inode + "]"
+	procs, _ := os.ReadDir("/proc")
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		fds, _ := os.ReadDir(filepath.Join("/proc", p.Name(), "fd"))
+		for _, fd := range fds {
+			if link, _ := os.Readlink(filepath.Join("/proc", p.Name(), "fd", fd.Name())); link == target {
+				return pid
+			}
+		}
+	}
+	return 0
+}
+
+// socketInode returns the inode of the socket in table whose local and remote ports are the hex ports
+// localPort and remotePort.
+func socketInode(table, localPort, remotePort string) string {
+	f, err := os.Open(table)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if strings.HasSuffix(fields[1], ":"+localPort) && strings.HasSuffix(fields[2], ":"+remotePort) && isLoopbackHex(fields[1]) {
+			return fields[9]
+		}
+	}
+	return ""
+}
+
+// isLoopbackHex reports whether the hex address:port of /proc/net/tcp is on a loopback address: 127.x.x.x, which
+// is little-endian, ::1 or ::ffff:127.x.x.x.
+func isLoopbackHex(addr string) bool {
+	host, _, _ := strings.Cut(addr, ":")
+	b, err := hex.DecodeString(host)
+	if err != nil {
+		return false
+	}
+	switch len(b) {
+	case 4:
+		return b[3] == 127
+	case 16:
+		// four little-endian words
+		var ip net.IP
+		for i := 0; i < 16; i += 4 {
+			ip = append(ip, b[i+3], b[i+2], b[i+1], b[i])
+		}
+		return ip.IsLoopback()
+	}
+	return false
+}
+
+func mustAtoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func loadUsage(since time.Time) ([]usageEntry, error) {
+	fn, err := usageLogPath()
+	if err != nil {
+		return nil, err
+	}
+	var res []usageEntry
+	for _, name := range []string{fn + ".1", fn} {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e usageEntry
+			if json.Unmarshal(scanner.Bytes(), &e) == nil && !e.Time.Before(since) {
+				res = append(res, e)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// summarizeUsage groups entries by program, channel and provider, most requests first.
+func summarizeUsage(entries []usageEntry) []usageSummary {
+	type key struct{ program, channel, provider string }
+	rows := make(map[key]*usageSummary)
+	for _, e := range entries {
+		program := filepath.Base(e.Exe)
+		if e.Exe == "" {
+			program = "unknown"
+		}
+		k := key{program, e.Channel, e.Provider}
+		row := rows[k]
+		if row == nil {
+			row = &usageSummary{Program: program, Channel: e.Channel, Provider: e.Provider}
+			rows[k] = row
+		}
+		row.Requests++
+		if e.Target != "" && !slices.Contains(row.Targets, e.Target) {
+			row.Targets = append(row.Targets, e.Target)
+		}
+		if e.Time.After(row.LastUsed) {
+			row.LastUsed = e.Time
+		}
+	}
+	res := make([]usageSummary, 0, len(rows))
+	for _, row := range rows {
+		sort.Strings(row.Targets)
+		res = append(res, *row)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Requests != res[j].Requests {
+			return res[i].Requests > res[j].Requests
+		}
+		return res[i].Program < res[j].Program
+	})
+	return res
+}
+
+func runUsage(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ExitOnError)
+	since := flags.Duration("since", 7*24*time.Hour, "only count credentials handed out this recently")
+	_ = flags.Parse(args)
+	var selected map[string]bool
+	if flags.NArg() > 0 {
+		chosen, err := selectProviders(flags.Args())
+		if err != nil {
+			return err
+		}
+		selected = make(map[string]bool)
+		for _, p := range chosen {
+			selected[p.Name] = true
+		}
+	}
+
+	entries, err := loadUsage(time.Now().Add(-*since))
+	if err != nil {
+		return err
+	}
+	if selected != nil {
+		var filtered []usageEntry
+		for _, e := range entries {
+			if selected[e.Provider] {
+				filtered = append(filtered, e)
+			}
+		}
+		entries = filtered
+	}
+	res := summarizeUsage(entries)
+	return writeOutput(res, func(out io.Writer) error {
+		if len(res) == 0 {
+			fmt.Fprintf(out, "no credentials were handed to programs since %s\n", time.Now().Add(-*since).Local().Format("2006-01-02 15:04"))
+			return nil
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PROGRAM\tCHANNEL\tPROVIDER\tREQUESTS\tLAST USED\tTARGETS")
+		for _, r := range res {
+			provider := r.Provider
+			if provider == "" {
+				provider = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", r.Program, r.Channel, provider, r.Requests, r.LastUsed.Local().Format("2006-01-02 15:04"), strings.Join(r.Targets, ", "))
+		}
+		return w.Flush()
+	})
+}
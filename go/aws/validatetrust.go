@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "validate-trust",
+		Usage:   "validate-trust [--role-arn arn]",
+		Summary: "compare the AWS role's trust policy with this workspace's token claims",
+		Run:     runValidateTrust,
+	})
+}
+
+func runValidateTrust(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("validate-trust", flag.ExitOnError)
+	roleARNFlag := flags.String("role-arn", "", "role to check (defaults to the configured role)")
+	_ = flags.Parse(args)
+
+	roleARN := *roleARNFlag
+	if roleARN == "" {
+		var err error
+		roleARN, err = awsRoleARN()
+		if err != nil {
+			return err
+		}
+		if roleARN == "" {
+			return exitErrorf(exitMissingConfig, "no role to check: set IDP_AWS_ROLE_ARN or pass --role-arn")
+		}
+	}
+
+	issuer, err := gitpodIssuer()
+	if err != nil {
+		return withExitCode(exitNotInGitpod, err)
+	}
+	token, err := gitpodIDToken(ctx, "sts.amazonaws.com")
+	if err != nil {
+		return err
+	}
+	claims, err := gitpodidp.Claims(token)
+	if err != nil {
+		return withExitCode(exitTokenMintFailed, err)
+	}
+	if iss, _ := claims["iss"].(string); iss != "" && iss != issuer {
+		issuer = iss
+	}
+
+	out, err := runAWSCLI(ctx, "iam", "get-role", "--role-name", awsRoleName(roleARN))
+	if err != nil {
+		return fmt.Errorf("cannot fetch the trust policy of %s (this needs iam:GetRole): %w", roleARN, err)
+	}
+	var role struct {
+		Role struct {
+			AssumeRolePolicyDocument json.RawMessage
+		}
+	}
+	err = json.Unmarshal(out, &role)
+	if err != nil {
+		return err
+	}
+
+	eval, err := evaluateAWSTrustPolicy(role.Role.AssumeRolePolicyDocument, strings.TrimPrefix(issuer, "https://"), claims)
+	if err != nil {
+		return err
+	}
+	err = writeOutput(eval, func(w io.Writer) error {
+		printTrustEvaluation(w, eval, "assume the role")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !eval.Allowed {
+		return exitErrorf(exitExchangeFailed, "the trust policy of %s does not admit this workspace's token", roleARN)
+	}
+	return nil
+}
+
+// printTrustEvaluation explains eval, e.g. whether the token may "assume the role".
+func printTrustEvaluation(w io.Writer, eval *trustEvaluation, what string) {
+	for _, st := range eval.Statements {
+		name := fmt.Sprintf("statement %d", st.Index)
+		if st.Sid != "" {
+			name += " (" + st.Sid + ")"
+		}
+		if len(st.Problems) == 0 {
+			fmt.Fprintf(w, "%s [%s]: matches the token\n", name, st.Effect)
+			continue
+		}
+		fmt.Fprintf(w, "%s [%s]:\n", name, st.Effect)
+		for _, p := range st.Problems {
+			fmt.Fprintf(w, "  - %s\n", p)
+		}
+	}
+	if eval.Allowed {
+		fmt.Fprintln(w, "the token may "+what)
+	} else {
+		fmt.Fprintln(w, "the token may NOT "+what)
+	}
+}
+
+// awsRoleName returns the name of a role given its ARN, e.g. arn:aws:iam::123456789012:role/path/name yields name.
+func awsRoleName(roleARN string) string {
+	if idx := strings.LastIndex(roleARN, "/"); idx >= 0 {
+		return roleARN[idx+1:]
+	}
+	return roleARN
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func vaultMissingConfig() []string {
+	return missingSettings("VAULT_ADDR", "IDP_VAULT_ROLE")
+}
+
+func vaultIdentity() string {
+	return setting("IDP_VAULT_ROLE")
+}
+
+// loginVault authenticates against Vault's JWT auth method and stores the resulting token where the vault CLI
+// looks for it (~/.vault-token).
+func loginVault(ctx context.Context) error {
+	role := setting("IDP_VAULT_ROLE")
+	token, err := gitpodIDToken(ctx, providerAudience("vault"))
+	if err != nil {
+		return err
+	}
+	auth, err := vaultLogin(ctx, token)
+	if err != nil {
+		return err
+	}
+	emitEvent(eventExchangeSucceeded, "vault", "role", role)
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	err = writeWipedSecretFile(filepath.Join(home, ".vault-token"), []byte(auth.ClientToken))
+	if err != nil {
+		return exitErrorf(exitPersistFailed, "cannot write Vault token: %w", err)
+	}
+	emitEvent(eventProfileWritten, "vault", "path", filepath.Join(home, ".vault-token"))
+	now := time.Now()
+	rec := credentialRecord{Provider: "vault", Identity: role, IssuedAt: now}
+	if auth.LeaseDuration > 0 {
+		rec.Expiry = now.Add(time.Duration(auth.LeaseDuration) * time.Second)
+	}
+	recordLogin(rec)
+
+	return nil
+}
+
+// vaultAuth is the token a Vault login issued.
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int64  `json:"lease_duration"`
+}
+
+// vaultLogin exchanges an identity token for a Vault token with the JWT auth method of IDP_VAULT_AUTH_PATH.
+func vaultLogin(ctx context.Context, token string) (*vaultAuth, error) {
+	var (
+		addr      = strings.TrimSuffix(setting("VAULT_ADDR"), "/")
+		role      = setting("IDP_VAULT_ROLE")
+		mount     = setting("IDP_VAULT_AUTH_PATH")
+		namespace = setting("VAULT_NAMESPACE")
+	)
+	if mount == "" {
+		mount = "jwt"
+	}
+
+	loginReq, err := json.Marshal(struct {
+		Role string `json:"role"`
+		JWT  string `json:"jwt"`
+	}{
+		Role: role,
+		JWT:  token,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal Vault login request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/v1/auth/%s/login", addr, mount), bytes.NewReader(loginReq))
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare Vault login request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	var resp *http.Response
+	err = traceStep(ctx, "exchange token", func(ctx context.Context) error {
+		return withProgress("signing into Vault", func() (err error) {
+			resp, err = httpClient.Do(req.WithContext(ctx))
+			return err
+		})
+	}, "idp.method", "vault")
+	if err != nil {
+		return nil, exitErrorf(exitExchangeFailed, "cannot make Vault login request: %w", err)
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, exitErrorf(exitExchangeFailed, "vault login rejected (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var loginResp struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&loginResp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode Vault login response: %w", err)
+	}
+	registerSecret(loginResp.Auth.ClientToken)
+	return &loginResp.Auth, nil
+}
+
+// whoamiVault looks up the stored Vault token and returns the identity it belongs to.
+func whoamiVault(ctx context.Context) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	token, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return "", fmt.Errorf("cannot read Vault token: %w", err)
+	}
+	return vaultLookupSelf(ctx, strings.TrimSpace(string(token)))
+}
+
+// vaultLookupSelf returns the identity the Vault token belongs to.
+func vaultLookupSelf(ctx context.Context, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(setting("VAULT_ADDR"), "/")+"/v1/auth/token/lookup-self", nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot prepare Vault token lookup: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := setting("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot make Vault token lookup: %w", err)
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("vault token lookup rejected (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var lookup struct {
+		Data struct {
+			DisplayName string   `json:"display_name"`
+			Policies    []string `json:"policies"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&lookup)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode Vault token lookup: %w", err)
+	}
+	return fmt.Sprintf("%s (policies: %s)", lookup.Data.DisplayName, strings.Join(lookup.Data.Policies, ", ")), nil
+}
+
+// logoutVault removes ~/.vault-token, revoking the token first if requested.
+func logoutVault(ctx context.Context, revoke bool) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(home, ".vault-token")
+	if revoke && setting("VAULT_ADDR") != "" {
+		if token, err := os.ReadFile(fn); err == nil {
+			err = revokeVaultToken(ctx, strings.TrimSpace(string(token)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return removeFiles(fn)
+}
+
+func revokeVaultToken(ctx context.Context, token string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(setting("VAULT_ADDR"), "/")+"/v1/auth/token/revoke-self", nil)
+	if err != nil {
+		return fmt.Errorf("cannot prepare Vault token revocation: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := setting("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot make Vault token revocation: %w", err)
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("vault token revocation rejected (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
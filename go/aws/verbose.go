@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+var verboseFlag = flag.Bool("verbose", false, "stream the output of gp, aws and the other CLIs run, and summarise HTTP requests, as they happen")
+
+// verboseMu keeps the lines of concurrent subprocesses and requests from interleaving.
+var verboseMu sync.Mutex
+
+// printVerbose prints a line of verbose output, marked with what it comes from, e.g. the name of a subprocess.
+// Like printFailure, it redacts credentials.
+func printVerbose(source, line string) {
+	verboseMu.Lock()
+	defer verboseMu.Unlock()
+	fmt.Fprintf(os.Stderr, "%s %s\n", colorize(ansiCyan, source+" │"), redactText(line))
+}
+
+// setupVerbose wraps httpClient to summarise every request and response with -verbose.
+func setupVerbose() {
+	if *verboseFlag {
+		httpClient = &verboseClient{next: httpClient}
+	}
+}
+
+// verboseClient prints a line when a request is sent and when its response arrives, so a slow or hanging
+// request shows up while it's in flight.
+type verboseClient struct {
+	next gitpodidp.HTTPDoer
+}
+
+func (c *verboseClient) Do(req *http.Request) (*http.Response, error) {
+	// the query may hold tokens, and the path is enough to tell requests apart
+	target := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+	printVerbose("http", fmt.Sprintf("→ %s %s", req.Method, target))
+	start := time.Now()
+	resp, err := c.next.Do(req)
+	took := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		printVerbose("http", fmt.Sprintf("← %s %s failed after %s: %v", req.Method, target, took, err))
+		return nil, err
+	}
+	printVerbose("http", fmt.Sprintf("← %s %s: %s in %s", req.Method, target, resp.Status, took))
+	return resp, nil
+}
+
+// lineStreamer writes what a subprocess outputs with printVerbose, line by line.
+type lineStreamer struct {
+	source string
+	buf    []byte
+}
+
+func newLineStreamer(name string) *lineStreamer {
+	return &lineStreamer{source: filepath.Base(name)}
+}
+
+func (s *lineStreamer) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		printVerbose(s.source, string(bytes.TrimRight(s.buf[:i], "\r")))
+		s.buf = s.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush prints output which didn't end with a newline.
+func (s *lineStreamer) flush() {
+	if len(s.buf) > 0 {
+		printVerbose(s.source, string(s.buf))
+		s.buf = nil
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "verify",
+		Usage:   "verify [provider...]",
+		Summary: "mint a token, exchange it and ask each configured provider whom it belongs to, timing every step",
+		Run:     runVerify,
+	})
+}
+
+// Steps of a verification, named like the spans of a login.
+const (
+	verifyStepMint     = "mint identity token"
+	verifyStepExchange = "exchange token"
+	verifyStepIdentity = "check identity"
+)
+
+type verifyStep struct {
+	Step string `json:"step"`
+	OK   bool   `json:"ok"`
+	// Skipped steps weren't run, for the reason in Detail, which doesn't fail the verification.
+	Skipped  bool         `json:"skipped,omitempty"`
+	Duration jsonDuration `json:"duration"`
+	// Detail is what the step found out, e.g. the role session the exchange produced.
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type verifyResult struct {
+	Provider string       `json:"provider"`
+	OK       bool         `json:"ok"`
+	Duration jsonDuration `json:"duration"`
+	Steps    []verifyStep `json:"steps"`
+
+	err error
+}
+
+// step runs f as the step name unless an earlier step failed, recording how long it took and what it returned.
+func (r *verifyResult) step(ctx context.Context, name string, f func(ctx context.Context) (string, error)) {
+	if r.err != nil {
+		return
+	}
+	start := time.Now()
+	var detail string
+	err := traceStep(ctx, name, func(ctx context.Context) (err error) {
+		detail, err = f(ctx)
+		return err
+	}, "idp.provider", r.Provider, "idp.verify", "true")
+	s := verifyStep{Step: name, OK: err == nil, Duration: jsonDuration(time.Since(start).Round(time.Millisecond)), Detail: detail}
+	if err != nil {
+		s.Error = err.Error()
+		r.err = err
+	}
+	r.Steps = append(r.Steps, s)
+}
+
+// verifiers run the steps of verifying a provider: each mints a token for it, exchanges the token, and asks the
+// provider whom the result belongs to. They keep what they obtain in memory, so verifying leaves the credentials
+// of a login untouched.
+var verifiers = map[string]func(ctx context.Context, r *verifyResult){
+	"aws":   verifyAWS,
+	"gcp":   verifyGCP,
+	"azure": verifyAzure,
+	"vault": verifyVault,
+}
+
+func runVerify(ctx context.Context, args []string) error {
+	selected, err := selectProviders(args)
+	if err != nil {
+		return err
+	}
+	var res []*verifyResult
+	for _, p := range selected {
+		verify, ok := verifiers[p.Name]
+		if !ok || !p.configured() {
+			if len(args) > 0 {
+				return exitErrorf(exitMissingConfig, "cannot verify %s: it is not configured or can't be verified", p.Name)
+			}
+			continue
+		}
+		r := &verifyResult{Provider: p.Name}
+		start := time.Now()
+		verify(ctx, r)
+		r.OK = r.err == nil
+		r.Duration = jsonDuration(time.Since(start).Round(time.Millisecond))
+		res = append(res, r)
+	}
+	if len(res) == 0 {
+		return exitErrorf(exitMissingConfig, "no provider is configured")
+	}
+
+	err = writeOutput(res, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PROVIDER\tSTEP\tRESULT\tTIME\tDETAIL")
+		for _, r := range res {
+			for i, s := range r.Steps {
+				name := r.Provider
+				if i > 0 {
+					name = ""
+				}
+				result, detail := "ok", s.Detail
+				switch {
+				case s.Skipped:
+					result = "skipped"
+				case !s.OK:
+					result, detail = "failed", s.Error
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, s.Step, result, time.Duration(s.Duration), redactText(detail))
+			}
+			fmt.Fprintf(w, "\ttotal\t\t%s\t\n", time.Duration(r.Duration))
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		failed []string
+		code   int
+	)
+	for _, r := range res {
+		if r.err != nil {
+			if len(failed) == 0 {
+				code = exitCode(r.err)
+			}
+			failed = append(failed, r.Provider)
+		}
+	}
+	if len(failed) > 0 {
+		// the report shows what went wrong
+		return exitErrorf(code, "cannot verify %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func verifyAWS(ctx context.Context, r *verifyResult) {
+	roleARN, err := awsRoleARN()
+	region := setting("IDP_AWS_REGION")
+	if err == nil && roleARN == "" {
+		// with IDP_AWS_PROFILES, the first profile stands for all of them
+		profiles, _ := awsProfiles()
+		for _, name := range sortedKeys(profiles) {
+			roleARN = profiles[name].RoleARN
+			if profiles[name].Region != "" {
+				region = profiles[name].Region
+			}
+			break
+		}
+	}
+	if err == nil && roleARN == "" {
+		err = gitpodidp.ErrRoleNotConfigured
+	}
+	switch {
+	case err != nil:
+	case requiresApproval(roleARN):
+		// the approvers are only asked on login, so the exchange is skipped below
+		err = checkRoleAllowed(roleARN)
+	default:
+		// privileged roles are confirmed like on login
+		err = confirmRole(ctx, roleARN)
+	}
+	if err != nil {
+		r.err = err
+		r.Steps = append(r.Steps, verifyStep{Step: "select role", Error: err.Error()})
+		return
+	}
+
+	var (
+		token string
+		creds *gitpodidp.AWSCredentials
+	)
+	r.step(ctx, verifyStepMint, func(ctx context.Context) (string, error) {
+		token, err = gitpodIDToken(ctx, providerAudience("aws"))
+		return tokenSubject(token), err
+	})
+	if r.err == nil && requiresApproval(roleARN) {
+		r.Steps = append(r.Steps, verifyStep{Step: verifyStepExchange, OK: true, Skipped: true,
+			Detail: roleARN + " requires approval, which only idp login aws asks for"})
+		return
+	}
+	r.step(ctx, verifyStepExchange, func(ctx context.Context) (string, error) {
+		creds, err = gitpodidp.AssumeRoleWithWebIdentity(ctx, token, gitpodidp.AssumeRoleInput{RoleARN: roleARN, Region: region})
+		if err != nil {
+			return "", withExitCode(exitExchangeFailed, err)
+		}
+		registerSecret(creds.SecretAccessKey)
+		registerSecret(creds.SessionToken)
+		return creds.AssumedRoleARN, nil
+	})
+	r.step(ctx, verifyStepIdentity, func(ctx context.Context) (string, error) {
+		identity, err := gitpodidp.GetCallerIdentity(ctx, creds, region)
+		if err != nil {
+			return "", err
+		}
+		return identity.ARN, nil
+	})
+}
+
+func verifyGCP(ctx context.Context, r *verifyResult) {
+	var (
+		provider    = gcpWorkloadIdentityProvider()
+		sa          = setting("IDP_GCP_SERVICE_ACCOUNT")
+		token       string
+		accessToken string
+		err         error
+	)
+	r.step(ctx, verifyStepMint, func(ctx context.Context) (string, error) {
+		token, err = gitpodIDToken(ctx, providerAudience("gcp"))
+		return tokenSubject(token), err
+	})
+	r.step(ctx, verifyStepExchange, func(ctx context.Context) (string, error) {
+		accessToken, err = gitpodidp.GCPExchangeToken(ctx, provider, token)
+		if err == nil && sa != "" {
+			registerSecret(accessToken)
+			accessToken, err = gitpodidp.GCPImpersonate(ctx, accessToken, sa)
+		}
+		if err != nil {
+			explainGCPRejection(err, token)
+			return "", withExitCode(exitExchangeFailed, err)
+		}
+		registerSecret(accessToken)
+		if sa != "" {
+			return "impersonated " + sa, nil
+		}
+		return "federated token", nil
+	})
+	r.step(ctx, verifyStepIdentity, func(ctx context.Context) (string, error) {
+		if sa != "" {
+			return gcpTokenInfo(ctx, accessToken)
+		}
+		return gcpIntrospect(ctx, accessToken)
+	})
+}
+
+// gcpTokenInfo asks Google whom the access token of an impersonated service account belongs to.
+func gcpTokenInfo(ctx context.Context, accessToken string) (string, error) {
+	var info struct {
+		Email string `json:"email"`
+		AZP   string `json:"azp"`
+		Scope string `json:"scope"`
+	}
+	err := getJSON(ctx, "https://oauth2.googleapis.com/tokeninfo?access_token="+url.QueryEscape(accessToken), "", &info)
+	if err != nil {
+		return "", err
+	}
+	if info.Email != "" {
+		return info.Email, nil
+	}
+	return fmt.Sprintf("client %s (scopes %s)", info.AZP, info.Scope), nil
+}
+
+// gcpIntrospect asks Google STS for the principal a federated access token stands for.
+func gcpIntrospect(ctx context.Context, accessToken string) (string, error) {
+	endpoint := strings.TrimSuffix(gitpodidp.GoogleSTSEndpoint(), "/token") + "/introspect"
+	body := url.Values{"token": {accessToken}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	var info struct {
+		Active   bool   `json:"active"`
+		Username string `json:"username"`
+	}
+	err = doJSON(req, &info)
+	if err != nil {
+		return "", err
+	}
+	if !info.Active {
+		return "", fmt.Errorf("google STS says the federated token is not active")
+	}
+	return info.Username, nil
+}
+
+func verifyAzure(ctx context.Context, r *verifyResult) {
+	var (
+		token       string
+		accessToken string
+		err         error
+	)
+	r.step(ctx, verifyStepMint, func(ctx context.Context) (string, error) {
+		token, err = gitpodIDToken(ctx, providerAudience("azure"))
+		return tokenSubject(token), err
+	})
+	r.step(ctx, verifyStepExchange, func(ctx context.Context) (string, error) {
+		accessToken, err = gitpodidp.AzureAccessToken(ctx, setting("IDP_AZURE_TENANT_ID"), setting("IDP_AZURE_CLIENT_ID"), token, "https://management.azure.com/.default")
+		if err != nil {
+			explainAzureRejection(err.Error(), token)
+			return "", withExitCode(exitExchangeFailed, err)
+		}
+		registerSecret(accessToken)
+		claims, err := gitpodidp.Claims(accessToken)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("app %v (object %v)", claims["appid"], claims["oid"]), nil
+	})
+	r.step(ctx, verifyStepIdentity, func(ctx context.Context) (string, error) {
+		var subs struct {
+			Value []struct {
+				SubscriptionID string `json:"subscriptionId"`
+			} `json:"value"`
+		}
+		err := getJSON(ctx, "https://management.azure.com/subscriptions?api-version=2022-12-01", accessToken, &subs)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d subscription(s) accessible", len(subs.Value)), nil
+	})
+}
+
+func verifyVault(ctx context.Context, r *verifyResult) {
+	var (
+		token string
+		auth  *vaultAuth
+		err   error
+	)
+	r.step(ctx, verifyStepMint, func(ctx context.Context) (string, error) {
+		token, err = gitpodIDToken(ctx, providerAudience("vault"))
+		return tokenSubject(token), err
+	})
+	r.step(ctx, verifyStepExchange, func(ctx context.Context) (string, error) {
+		auth, err = vaultLogin(ctx, token)
+		if err != nil {
+			return "", err
+		}
+		return "role " + setting("IDP_VAULT_ROLE"), nil
+	})
+	r.step(ctx, verifyStepIdentity, func(ctx context.Context) (string, error) {
+		return vaultLookupSelf(ctx, auth.ClientToken)
+	})
+	if auth != nil {
+		// the token only served the verification
+		_ = revokeVaultToken(ctx, auth.ClientToken)
+	}
+}
+
+// tokenSubject describes an identity token by its subject, which is what trust policies usually match.
+func tokenSubject(token string) string {
+	claims, err := gitpodidp.Claims(token)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("sub %v", claims["sub"])
+}
+
+// getJSON decodes the response to a GET of u, authorized with the bearer token if there is one.
+func getJSON(ctx context.Context, u, bearer string, res interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return doJSON(req, res)
+}
+
+func doJSON(req *http.Request, res interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s (%s): %s", req.Method, req.URL.Host+req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestVerifyAWSAppliesPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   string
+		approval  string
+		wantCode  int
+		wantSteps []string
+	}{
+		{name: "not allowed", allowed: "arn:aws:iam::*:role/dev-*", wantCode: exitMissingConfig, wantSteps: []string{"select role"}},
+		{name: "requires approval", approval: approvalRole, wantSteps: []string{verifyStepMint, verifyStepExchange}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeRunner{run: fakeGitpodToken}
+			testWorkspace(t, r)
+			t.Setenv("GITPOD_WORKSPACE_CONTEXT", ownContext)
+			t.Setenv("IDP_SHARED_WORKSPACE_POLICY", sharedPolicyAllow)
+			t.Setenv("IDP_AWS_ROLE_ARN", approvalRole)
+			t.Setenv("IDP_AWS_ALLOWED_ROLES", tt.allowed)
+			t.Setenv("IDP_AWS_APPROVAL_ROLES", tt.approval)
+			t.Setenv("IDP_AWS_PRIVILEGED_ROLES", "")
+
+			res := &verifyResult{Provider: "aws"}
+			verifyAWS(context.Background(), res)
+			if exitCode(res.err) != tt.wantCode {
+				t.Fatalf("verifyAWS() error = %v, want exit code %d", res.err, tt.wantCode)
+			}
+			var steps []string
+			for _, s := range res.Steps {
+				steps = append(steps, s.Step)
+			}
+			if strings.Join(steps, ",") != strings.Join(tt.wantSteps, ",") {
+				t.Fatalf("ran the steps %q, want %q", steps, tt.wantSteps)
+			}
+			if last := res.Steps[len(res.Steps)-1]; tt.approval != "" && !last.Skipped {
+				t.Errorf("the exchange for a role which requires approval ran: %+v", last)
+			}
+			if tt.wantCode != 0 && r.ran("gp idp token") {
+				t.Error("minted a token for a role the policy doesn't allow")
+			}
+		})
+	}
+}
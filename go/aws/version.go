@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "version",
+		Usage:   "version [--check]",
+		Summary: "print the version and build of this binary, and with --check whether a newer release is out",
+		Run:     runVersion,
+	})
+	readBuildInfo()
+}
+
+var (
+	// commit and buildDate are set at build time like version, using -ldflags "-X main.commit=... -X main.buildDate=...".
+	commit    = ""
+	buildDate = ""
+	// commitDate is when commit was made, and modified is set if the binary was built from a tree with
+	// uncommitted changes.
+	commitDate = ""
+	modified   = false
+)
+
+// readBuildInfo fills in what the linker flags didn't set from the build information Go embeds, so that binaries
+// of go install and go build know their version and commit too.
+func readBuildInfo() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if commit == "" {
+				commit = s.Value
+			}
+		case "vcs.time":
+			commitDate = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+}
+
+// versionInfo is the build of this binary, and with --check what's new since.
+type versionInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	Modified   bool   `json:"modified,omitempty"`
+	CommitDate string `json:"commitDate,omitempty"`
+	BuildDate  string `json:"buildDate,omitempty"`
+	Go         string `json:"go"`
+	Platform   string `json:"platform"`
+	// Latest is the latest release, if it's newer than Version.
+	Latest string `json:"latest,omitempty"`
+	// Breaking lists the breaking changes of the releases since Version.
+	Breaking []breakingChange `json:"breaking,omitempty"`
+}
+
+// breakingChange is a change of a release which needs users to act, e.g. to change their configuration.
+type breakingChange struct {
+	Release string `json:"release"`
+	// Provider is the provider the change breaks, empty if it concerns all of them.
+	Provider string `json:"provider,omitempty"`
+	Note     string `json:"note"`
+}
+
+func runVersion(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	check := flags.Bool("check", false, "check for a newer release, and list its breaking changes")
+	_ = flags.Parse(args)
+
+	info := &versionInfo{
+		Version:    version,
+		Commit:     commit,
+		Modified:   modified,
+		CommitDate: commitDate,
+		BuildDate:  buildDate,
+		Go:         runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if *check {
+		releases, err := newerReleases(ctx)
+		if err != nil {
+			return err
+		}
+		if len(releases) > 0 {
+			info.Latest = releases[0].TagName
+		}
+		for _, rel := range releases {
+			info.Breaking = append(info.Breaking, breakingChanges(rel)...)
+		}
+	}
+	return writeOutput(info, func(w io.Writer) error {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "version\t%s\n", info.Version)
+		if info.Commit != "" {
+			c := info.Commit
+			if info.Modified {
+				c += " (modified)"
+			}
+			fmt.Fprintf(tw, "commit\t%s\n", c)
+		}
+		if info.CommitDate != "" {
+			fmt.Fprintf(tw, "committed\t%s\n", info.CommitDate)
+		}
+		if info.BuildDate != "" {
+			fmt.Fprintf(tw, "built\t%s\n", info.BuildDate)
+		}
+		fmt.Fprintf(tw, "go\t%s\n", info.Go)
+		fmt.Fprintf(tw, "platform\t%s\n", info.Platform)
+		err := tw.Flush()
+		if err != nil || !*check {
+			return err
+		}
+		if info.Latest == "" {
+			fmt.Fprintf(os.Stderr, "%s is up to date\n", info.Version)
+			return nil
+		}
+		fmt.Fprintf(w, "\n%s is available, `idp self-update` installs it\n", info.Latest)
+		if len(info.Breaking) > 0 {
+			fmt.Fprintln(w, "Breaking changes since this version:")
+			for _, c := range info.Breaking {
+				provider := ""
+				if c.Provider != "" {
+					provider = c.Provider + ": "
+				}
+				fmt.Fprintf(w, "  %s  %s%s\n", c.Release, provider, c.Note)
+			}
+		}
+		return nil
+	})
+}
+
+// newerReleases returns the releases newer than the running version, latest first. Drafts and pre-releases
+// don't count.
+func newerReleases(ctx context.Context) ([]release, error) {
+	fc, err := download(ctx, releasesURL+"?per_page=100")
+	if err != nil {
+		return nil, err
+	}
+	var releases []release
+	err = json.Unmarshal(fc, &releases)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode releases: %w", err)
+	}
+	var res []release
+	for _, rel := range releases {
+		if !rel.Draft && !rel.Prerelease && versionNewer(rel.TagName, version) {
+			res = append(res, rel)
+		}
+	}
+	// development builds would be behind every release ever made
+	if version == "dev" && len(res) > 1 {
+		res = res[:1]
+	}
+	return res, nil
+}
+
+// breakingNote matches the lines of release notes which announce breaking changes, e.g.
+// "- BREAKING(aws): IDP_AWS_ROLE_ARN no longer accepts role names".
+var breakingNote = regexp.MustCompile(`^\s*[-*]?\s*\**BREAKING(?:\(([\w-]+)\))?\**:\s*(.+)$`)
+
+func breakingChanges(rel release) []breakingChange {
+	var res []breakingChange
+	for _, line := range strings.Split(rel.Body, "\n") {
+		m := breakingNote.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m != nil {
+			res = append(res, breakingChange{Release: rel.TagName, Provider: m[1], Note: strings.TrimSpace(m[2])})
+		}
+	}
+	return res
+}
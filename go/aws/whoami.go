@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/gitpod-io/example-idp-integration/go/aws/pkg/gitpodidp"
+)
+
+func init() {
+	registerCommand(&command{
+		Name:    "whoami",
+		Usage:   "whoami",
+		Summary: "verify with each provider which identity the stored credentials map to",
+		Run:     runWhoami,
+	})
+}
+
+type whoamiResult struct {
+	Provider string `json:"provider"`
+	SignedIn bool   `json:"signedIn"`
+	Identity string `json:"identity,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func runWhoami(ctx context.Context, args []string) error {
+	var res []whoamiResult
+	for _, p := range providers {
+		rec, err := loadCredentialRecord(p.Name)
+		if err != nil {
+			return err
+		}
+		r := whoamiResult{Provider: p.Name, SignedIn: rec != nil}
+		if rec != nil {
+			r.Identity, err = p.Whoami(ctx)
+			if err != nil {
+				r.Error = err.Error()
+			}
+		}
+		res = append(res, r)
+	}
+
+	return writeOutput(res, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, r := range res {
+			switch {
+			case !r.SignedIn:
+				fmt.Fprintf(w, "%s\tnot signed in\n", r.Provider)
+			case r.Error != "":
+				fmt.Fprintf(w, "%s\terror: %s\n", r.Provider, r.Error)
+			default:
+				fmt.Fprintf(w, "%s\t%s\n", r.Provider, r.Identity)
+			}
+		}
+		return w.Flush()
+	})
+}
+
+// whoamiAWS asks STS whom the credentials in the default profile, or those of IDP_AWS_PROFILES, belong to.
+func whoamiAWS(ctx context.Context) (string, error) {
+	if rec, _ := loadCredentialRecord("aws"); rec != nil && rec.Method == awsProfilesMethod {
+		profiles, err := awsProfiles()
+		if err != nil {
+			return "", err
+		}
+		return whoamiAWSProfiles(ctx, profiles)
+	}
+	creds, err := profileCredentials("default")
+	if err != nil {
+		return "", err
+	}
+	identity, err := gitpodidp.GetCallerIdentity(ctx, creds, setting("IDP_AWS_REGION"))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s (account %s)", identity.ARN, identity.Account), nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWhoamiAWS(t *testing.T) {
+	r := &fakeRunner{}
+	testWorkspace(t, r)
+	d := signedIntoAWS(t, time.Hour)
+	d.respond = func(req *http.Request) (*http.Response, error) {
+		return fakeResponse(req, http.StatusOK, "text/xml", `<GetCallerIdentityResponse><GetCallerIdentityResult>
+			<Arn>arn:aws:sts::123456789012:assumed-role/gitpod/ws-test</Arn><Account>123456789012</Account>
+		</GetCallerIdentityResult></GetCallerIdentityResponse>`), nil
+	}
+
+	got, err := whoamiAWS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "arn:aws:sts::123456789012:assumed-role/gitpod/ws-test (account 123456789012)"; got != want {
+		t.Errorf("whoamiAWS() = %q, want %q", got, want)
+	}
+	if len(r.calls) > 0 {
+		t.Errorf("ran %q, want STS asked directly", r.calls)
+	}
+}